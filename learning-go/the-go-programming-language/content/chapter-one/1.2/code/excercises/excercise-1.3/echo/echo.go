@@ -0,0 +1,85 @@
+// Package echo is exercise 1.3's answer, which grew into a small echo of its own:
+//
+//	-n      don't print the newline at the end
+//	-s SEP  put SEP between the arguments instead of a space
+//	-i      print each argument with its index in os.Args in front, like 1:hello
+//
+// the timing the exercise asks for is in echo_test.go, the section 11.4 way:
+//
+//	go test -bench . -benchmem ./1.2/code/excercises/excercise-1.3/echo
+package echo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopl/chapter-one/internal/cli"
+)
+
+// Flags are echo's flags, parsed by Main
+var Flags = cli.NewFlagSet("echo")
+
+var noNewline = Flags.Bool("n", false, "don't print the trailing newline")
+var sep = Flags.String("s", " ", "separator to put between the arguments")
+var indices = Flags.Bool("i", false, "print each argument's index in os.Args before it, like 1:hello")
+
+// Main runs echo with argv, the command line without the program name, and exits the
+// process when it fails like the program always has.
+func Main(argv []string) {
+	cli.Parse(Flags, argv, 2)
+
+	// the index os.Args would give the first argument after the flags, argv being os.Args[1:]
+	// when echo runs on its own. these are the same numbers exercise 1.2 printed
+	first := 1 + len(argv) - Flags.NArg()
+	opts := echoOptions{sep: *sep, newline: !*noNewline, indices: *indices, first: first}
+	if err := echo(os.Stdout, Flags.Args(), opts); err != nil {
+		fmt.Fprintf(os.Stderr, "echo: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// echoOptions are the flags, passed in so echo can be called with any writer and any settings,
+// not only the ones this run was started with
+type echoOptions struct {
+	sep     string
+	newline bool
+	indices bool
+	first   int // the index -i gives args[0]
+}
+
+// echo writes args to w the way the flags in opts say.
+func echo(w io.Writer, args []string, opts echoOptions) error {
+	if opts.indices {
+		numbered := make([]string, len(args))
+		for i, arg := range args {
+			numbered[i] = strconv.Itoa(opts.first+i) + ":" + arg
+		}
+		args = numbered
+	}
+	s := joinStrings(args, opts.sep)
+	if opts.newline {
+		s += "\n"
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// joinConcat is the loop from echo and echo-v2. every += makes a new string and copies
+// everything so far into it, so n arguments cost about n*n/2 bytes of copying
+func joinConcat(args []string, sep string) string {
+	s, between := "", ""
+	for _, arg := range args {
+		s += between + arg
+		between = sep
+	}
+	return s
+}
+
+// joinStrings is what echo-v3 had commented out. strings.Join adds up the lengths first and
+// copies each argument once into a buffer that is already big enough
+func joinStrings(args []string, sep string) string {
+	return strings.Join(args, sep)
+}
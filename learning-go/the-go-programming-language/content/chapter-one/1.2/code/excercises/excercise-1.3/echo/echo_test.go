@@ -0,0 +1,63 @@
+package echo
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	tests := []struct {
+		args []string
+		opts echoOptions
+		want string
+	}{
+		{nil, echoOptions{sep: " ", newline: true}, "\n"},
+		{[]string{"a", "b", "c"}, echoOptions{sep: " ", newline: true}, "a b c\n"},
+		{[]string{"a", "b"}, echoOptions{sep: ",", newline: false}, "a,b"},
+		{[]string{"a", "b"}, echoOptions{sep: " ", newline: true, indices: true, first: 1}, "1:a 2:b\n"},
+		{[]string{"a", "b"}, echoOptions{sep: " ", newline: true, indices: true, first: 3}, "3:a 4:b\n"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := echo(&out, tt.args, tt.opts); err != nil || out.String() != tt.want {
+			t.Errorf("echo(%q, %+v) = %q, %v, want %q", tt.args, tt.opts, out.String(), err, tt.want)
+		}
+	}
+}
+
+func TestJoins(t *testing.T) {
+	for _, args := range [][]string{nil, {"a"}, {"a", "b", "c"}, {"", "x", ""}} {
+		if got, want := joinConcat(args, "-"), joinStrings(args, "-"); got != want {
+			t.Errorf("joinConcat(%q) = %q, joinStrings gives %q", args, got, want)
+		}
+	}
+}
+
+// the difference only shows once there are enough arguments for the copying to add up, so each
+// join is timed for a few argument counts
+var benchSizes = []int{10, 100, 1000, 10000}
+
+func benchArgs(n int) []string {
+	args := make([]string, n)
+	for i := range args {
+		args[i] = "arg" + strconv.Itoa(i)
+	}
+	return args
+}
+
+func benchmarkJoin(b *testing.B, join func([]string, string) string) {
+	for _, n := range benchSizes {
+		args := benchArgs(n)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				join(args, " ")
+			}
+		})
+	}
+}
+
+func BenchmarkJoinConcat(b *testing.B) { benchmarkJoin(b, joinConcat) }
+
+func BenchmarkJoinStrings(b *testing.B) { benchmarkJoin(b, joinStrings) }
@@ -1,13 +1,17 @@
 // Exercise 1.3: Experiment to measure the difference in running time between our potentially inefficient versions and the one that uses strings.Join.
 // Section 1.6 illustrates part of the time package
 // Section 11.4 shows how to write benchmark tests for systematic performance evaluation
-
+//
+// the echo itself is package echo, so gopltool can run it as gopltool echo. its flags are
+// described there
 package main
 
 import (
-	"fmt"
+	"os"
+
+	"gopl/chapter-one/1.2/code/excercises/excercise-1.3/echo"
 )
 
 func main() {
-	fmt.Println("come back to this later")
-}
\ No newline at end of file
+	echo.Main(os.Args[1:])
+}
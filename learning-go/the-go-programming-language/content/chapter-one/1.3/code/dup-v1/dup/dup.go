@@ -0,0 +1,1934 @@
+// Package dup is dup v1, which prints the text of each line that appears more than once in the standard input (or the files named), preceeded by its count
+//
+// with -spill the counts map is written out to bucket files on disk whenever it grows past
+// -spill-threshold distinct lines. every copy of a line hashes to the same bucket, so each
+// bucket can be counted on its own afterwards and memory stays bounded by the biggest bucket
+// instead of the whole input. it is slower and the output order is different, but the counts are the same.
+//
+// -hash goes further and keys the map on a 64-bit FNV-1a hash of each line instead of the line
+// itself, so a long line costs 8 bytes of key no matter how long it is. the catch is that the text
+// is gone, so duplicates are printed as their hash, and two different lines with the same hash
+// would be counted as one. with 64 bits that takes billions of distinct lines to become likely.
+//
+// -summary prints totals instead of the duplicates themselves, for inputs where the list would just be noise.
+//
+// -wc skips the duplicate counting altogether and prints totals like wc: -l, -w and -c pick
+// lines, words and bytes, and with none of them it prints all three, in that order.
+//
+// -normalize makes lines that only differ in case, or in how an accent was typed, count as
+// the same line, and prints the first spelling that was seen. a proper job needs the NFC tables
+// from golang.org/x/text/unicode/norm, which we don't have, so the accents that get put back
+// together are the common ones from Latin-1 (é typed as e plus a combining acute, and so on).
+// anything past that, like ő, Vietnamese letters with two marks or Hangul typed as jamo, still
+// counts as different lines when it is typed two ways. the case folding is the simple kind too,
+// so ß and SS stay apart.
+//
+// -i and -space are the lighter versions for near-duplicates: -i only ignores case, and -space
+// trims the ends and squeezes every run of spaces and tabs down to one space. they can go
+// together, and with -field (or its short names -f and -d) the column is what gets folded. each
+// group is printed as its first spelling, or with -original as the whole first line that was
+// in it, so "-f 3 -original" shows a real line for each value of the third column.
+//
+// -window N is for endless input like a log being tailed. a line only counts as a duplicate
+// when it shows up again within N lines of an earlier copy, and it is printed as soon as it does,
+// with how many times it is now in the window. memory stays at N lines however long the input runs.
+//
+// -field N counts one column instead of whole lines, like awk '{print $N}' | sort | uniq -c.
+// columns are split on runs of spaces and tabs like awk does, or on every -fieldsep when one is
+// given, so "a,,b" has an empty second field. lines that are too short are skipped, unless
+// -short-lines empty says to count them as an empty field.
+//
+// -jsonpath a.b.c is for NDJSON, like structured logs: each line is decoded as JSON and the
+// value at that dotted path is counted instead of the line. a number in the path indexes an
+// array, so items.0.id works too. strings are counted as they are and anything else as its JSON.
+// lines that aren't JSON get a warning and are skipped, or stop everything with -strict, and
+// lines that just don't have the path are skipped without a word, like short lines with -field.
+//
+// without file arguments the input is stdin, with them it is the files one after the other.
+// -r lets the arguments be directories, which are walked for every file under them, so
+// find | xargs isn't needed and -files and -per-file still know which file each line came from.
+// -include and -exclude are globs like '*.log' that pick the files the walk keeps, and an
+// -exclude that matches a directory skips all of it, like -exclude .git. a glob with a / in it is
+// matched against the path from the directory given instead of the file name. files the walk finds
+// that look binary (a NUL byte in the first 8000 bytes, the way grep and git tell) are skipped,
+// files named on the command line are always read.
+// -watch keeps an eye on those files and runs everything again each time one of them changes,
+// clearing the screen first, until Ctrl-C. it looks at their size and modification time every
+// half second (no fsnotify in the standard library, and polling a few files costs nothing).
+//
+// -per-file adds a line for each file with how many lines it has, how many different ones and
+// how many of those are repeated within that file alone, to see which one brings in the duplicates.
+//
+// -files is exercise 1.4: each duplicate gets a third column with the files it turned up in,
+// as count<TAB>line<TAB>a.txt,b.txt, and -file-counts says how often in each, a.txt:2,b.txt:1.
+// stdin is called - there. a file that can't be opened is reported and skipped, the rest are
+// still counted, and dup1 exits with status 2 at the end so scripts can tell.
+//
+// -p N counts the files with N goroutines, each one into its own map, and adds the maps up at
+// the end. that is for thousands of log files, where one core reading them one after the other is
+// the slow part. goroutines finish in whatever order they like, so with -p the duplicates are
+// printed sorted, most repeated first, to give the same output every time.
+//
+// the duplicates come out in map order, which is different every run. -sort count puts the most
+// repeated first and -sort line sorts them by their text, and -top N is the N most repeated
+// (with -sort line, the top N sorted by line). ties in the count are broken by the line, so the
+// same input gives the same output. -min K only prints lines seen at least K times instead of 2.
+//
+// -fuzzy is for lines that are the same apart from a timestamp or an ID, which no amount of
+// -i or -space makes equal. each line gets a 64-bit simhash of its words and pairs of words, with
+// every number turned into 0 first since numbers are what usually differs. similar lines end up
+// with hashes that only differ in a few bits, and a line joins the first group whose first line's
+// hash is at least -fuzzy-threshold the same (0.9 means no more than 6 of the 64 bits differ).
+// each group is printed as count<TAB>variants<TAB>line: how many lines are in it, how many of
+// them were different, and the first of them. -min, -top and -sort work on the groups.
+//
+// -dedup-in-place file cleans a file up: it keeps the first copy of every line, in the order they
+// came, and drops the rest. the new file is written next to the old one and renamed over it, so
+// a crash halfway leaves the old file as it was. the original is kept as file.bak unless -no-backup.
+// the bytes are kept as they are, \r\n included, so -encoding doesn't come into it.
+//
+// -save writes the final counts to a file as count<TAB>line, and -merge reads such a file back in
+// before counting and writes the new totals over it, so counts can build up across many runs.
+//
+// dup1 exits 0 when it ran and 2 when something went wrong, like a bad flag or a file that
+// couldn't be read. -fail is for CI jobs that should fail when a generated file has repeated lines
+// in it, the way diff and grep do it: then 0 means no duplicates and 1 means there were some (a line
+// reaching -min, a -fuzzy group, a repeat -emit-unique dropped). that status is opt-in on purpose:
+// finding duplicates is what dup is for, and a plain run that exited 1 whenever it found some would
+// break every script that has always taken 0 as success. -q prints nothing and turns on -fail, so
+// only the status is left. -format json is -json with the file and line number of every copy of
+// each duplicate, to point right at them.
+// those positions are kept for every line until the end, so it can't be used with -spill or -p.
+//
+// lines are compared byte for byte, so the same text in two encodings counts as two lines.
+// -encoding latin1 or utf16 turns the input into UTF-8 first. (golang.org/x/text/encoding
+// has every encoding there is, but these two are small enough to do with the standard library.)
+package dup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math/bits"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"gopl/chapter-one/internal/cli"
+)
+
+// Flags are dup's flags, parsed by Main
+var Flags = cli.NewFlagSet("dup")
+
+var emitUnique = Flags.Bool("emit-unique", false, "print every line the first time it is seen and drop the repeats, keeping input order")
+var hashKeys = Flags.Bool("hash", false, "count lines by a 64-bit hash to save memory, printing the hash instead of the line")
+var summary = Flags.Bool("summary", false, "print total, distinct and duplicated line counts instead of the duplicates")
+var wc = Flags.Bool("wc", false, "count lines, words and bytes like wc instead of looking for duplicates")
+var wcLines = Flags.Bool("l", false, "with -wc, print the line count")
+var wcWords = Flags.Bool("w", false, "with -wc, print the word count")
+var wcBytes = Flags.Bool("c", false, "with -wc, print the byte count")
+var save = Flags.String("save", "", "write the counts to this file when done")
+var merge = Flags.String("merge", "", "start from the counts saved in this file and write the totals back to it")
+var print0 = Flags.Bool("print0", false, "end each line of output with a NUL byte instead of a newline, for xargs -0")
+var encoding = Flags.String("encoding", "utf8", "what the input is in: utf8 (or raw bytes), latin1 or utf16 (BOM picks the byte order, little-endian without one)")
+var window = Flags.Int("window", 0, "only look for duplicates among the last this many lines, printing each one as it happens")
+var jsonOut = Flags.Bool("json", false, "print the duplicates (and the -summary figures) as one JSON object")
+var format = cli.Format(Flags, "text, or json for the -json object with the file and line of every copy of each duplicate", "text", "json")
+var failOnDups = Flags.Bool("fail", false, "exit 1 when there are duplicates and 0 when there aren't (off by default, so a plain run still exits 0 when it finds some)")
+var quiet = Flags.Bool("q", false, "print nothing, only exit 1 when there are duplicates and 0 when there aren't (-fail)")
+var normalize = Flags.Bool("normalize", false, "ignore case and differently typed accents when comparing lines (Latin-1 accents only, see the package doc)")
+var ignoreCase = Flags.Bool("i", false, "ignore case when comparing lines")
+var squeeze = Flags.Bool("space", false, "ignore leading and trailing whitespace and treat runs of it as one space when comparing lines")
+var original = Flags.Bool("original", false, "print each group of lines as the whole first line in it, not just the part that was compared")
+var field = Flags.Int("field", 0, "count duplicates of this column (1 is the first) instead of whole lines")
+var fieldSep = Flags.String("fieldsep", "", "what separates the -field columns (by default runs of spaces and tabs)")
+var shortLines = Flags.String("short-lines", "skip", "with -field, what to do with lines that have too few columns: skip or empty")
+var jsonPath = Flags.String("jsonpath", "", "decode each line as JSON and count duplicates of the value at this dotted path, like user.id")
+var strict = Flags.Bool("strict", false, "with -jsonpath, stop at the first line that isn't JSON instead of warning and skipping it")
+var perFile = Flags.Bool("per-file", false, "with file arguments, also print the lines, distinct lines and duplicates within each file on its own")
+var fileNames = Flags.Bool("files", false, "print the files each duplicate was found in after it, like count<TAB>line<TAB>a.txt,b.txt")
+var fileCounts = Flags.Bool("file-counts", false, "like -files, with how many times it was in each file, like a.txt:2,b.txt:1")
+
+// -f and -d are the short names cut uses for -field and -fieldsep
+func init() {
+	Flags.IntVar(field, "f", 0, "same as -field")
+	Flags.StringVar(fieldSep, "d", "", "same as -fieldsep")
+}
+
+var fuzzy = Flags.Bool("fuzzy", false, "group lines that are only nearly the same, like ones that differ in a timestamp, and print count, variants and the first line of each group")
+var fuzzyThreshold = Flags.Float64("fuzzy-threshold", 0.9, "with -fuzzy, how alike two lines' hashes have to be to group them, from 0 to 1")
+
+var topN = Flags.Int("top", 0, "only print the this many most repeated lines, most repeated first")
+var minCount = Flags.Int("min", 2, "print lines seen at least this many times")
+var sortBy = Flags.String("sort", "", "print the duplicates sorted by count (most first) or by line")
+var parallel = Flags.Int("p", 1, "count the files with this many goroutines at once")
+var dedupInPlace = Flags.String("dedup-in-place", "", "rewrite this file with only the first copy of each line, and say how many were removed")
+var noBackup = Flags.Bool("no-backup", false, "with -dedup-in-place, don't keep the original as file.bak")
+var watch = Flags.Bool("watch", false, "with file arguments, count again every time one of the files changes")
+var spill = Flags.String("spill", "", "directory for temporary bucket files when the input has too many distinct lines")
+var spillThreshold = Flags.Int("spill-threshold", 1000000, "distinct lines to keep in memory before spilling to -spill")
+
+// spillBuckets is how many files the spilled counts are spread over. each bucket is counted
+// in memory on its own, so an input with more distinct lines wants more of them
+var spillBuckets = Flags.Int("spill-buckets", 64, "with -spill, how many bucket files to spread the lines over")
+
+var recursive = Flags.Bool("r", false, "read every file under the directories given, instead of taking them as files")
+
+// includes and excludes are the -include and -exclude globs for the files -r finds
+var includes, excludes globList
+
+func init() {
+	Flags.Var(&includes, "include", "with -r, only read files matching this glob, like '*.log' (can be repeated)")
+	Flags.Var(&excludes, "exclude", "with -r, skip files and directories matching this glob (can be repeated)")
+}
+
+// args are the input files: the arguments, or with -r what walking them found
+var args []string
+
+// eol ends every output record. -print0 makes it a NUL so lines with odd characters in them survive xargs -0
+var eol = "\n"
+
+// Main runs dup with argv, the command line without the program name, and exits the
+// process when it fails like the program always has.
+func Main(argv []string) {
+	cli.Parse(Flags, argv, 2)
+	if *print0 {
+		eol = "\x00"
+	}
+	if (len(includes) > 0 || len(excludes) > 0) && !*recursive {
+		fmt.Fprintln(os.Stderr, "dup1: -include and -exclude only make sense with -r")
+		os.Exit(2)
+	}
+	args = Flags.Args()
+	if *recursive {
+		if Flags.NArg() == 0 {
+			// grep -r reads . then, but a dup1 with no arguments has always meant stdin
+			fmt.Fprintln(os.Stderr, "dup1: -r needs a directory (or files) to read")
+			os.Exit(2)
+		}
+		if args = walkArgs(Flags.Args()); len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "dup1: -r found no files to read")
+			os.Exit(2)
+		}
+	}
+
+	if *dedupInPlace != "" {
+		if *dedupInPlace == "-" || Flags.NArg() > 0 {
+			// there is nowhere to put stdin back, and other files would only be ignored
+			fmt.Fprintln(os.Stderr, "dup1: -dedup-in-place takes one real file and no other arguments")
+			os.Exit(2)
+		}
+		removed, kept, err := dedupFile(*dedupInPlace, !*noBackup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("removed %d duplicate lines from %s, %d left\n", removed, *dedupInPlace, kept)
+		return
+	}
+
+	switch *format {
+	case "text":
+	case "json":
+		if *spill != "" || *parallel > 1 || *merge != "" {
+			// -merge counts have no positions, so the numbers wouldn't add up
+			fmt.Fprintln(os.Stderr, "dup1: -format json can't be used with -spill, -p or -merge")
+			os.Exit(2)
+		}
+		*jsonOut = true
+		positions = make(map[string][]location)
+	}
+	if (*quiet || *failOnDups) && *watch {
+		fmt.Fprintln(os.Stderr, "dup1: -q and -fail can't be used with -watch, which has no exit status to look at")
+		os.Exit(2)
+	}
+	if *quiet {
+		*failOnDups = true
+		// every mode prints to os.Stdout its own way, this quiets all of them at once
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			os.Exit(2)
+		}
+		os.Stdout = devNull
+	}
+	if *jsonOut && (*hashKeys || *emitUnique || *wc || *window > 0) {
+		fmt.Fprintln(os.Stderr, "dup1: -json can't be used with -hash, -emit-unique, -wc or -window")
+		os.Exit(2)
+	}
+	if keepsFirst() && (*spill != "" || *hashKeys || *emitUnique || *wc || *window > 0 || *save != "" || *merge != "") {
+		fmt.Fprintln(os.Stderr, "dup1: -normalize, -i, -space and -original only work in the plain counting mode, with -summary or -json")
+		os.Exit(2)
+	}
+	if *field < 0 || *field > 0 && (*hashKeys || *emitUnique || *wc || *window > 0) {
+		fmt.Fprintln(os.Stderr, "dup1: -field has to be 1 or more, and can't be used with -hash, -emit-unique, -wc or -window")
+		os.Exit(2)
+	}
+	if *jsonPath != "" && (*field > 0 || *hashKeys || *emitUnique || *wc || *window > 0) {
+		fmt.Fprintln(os.Stderr, "dup1: -jsonpath can't be used with -field, -hash, -emit-unique, -wc or -window")
+		os.Exit(2)
+	}
+	if *shortLines != "skip" && *shortLines != "empty" {
+		fmt.Fprintf(os.Stderr, "dup1: -short-lines must be skip or empty, not %q\n", *shortLines)
+		os.Exit(2)
+	}
+	if *perFile && (len(args) == 0 || *spill != "" || *hashKeys || *emitUnique || *wc || *window > 0) {
+		// the counts for each file are kept whole in memory, which is what -spill is there to avoid
+		fmt.Fprintln(os.Stderr, "dup1: -per-file needs file arguments, and can't be used with -spill, -hash, -emit-unique, -wc or -window")
+		os.Exit(2)
+	}
+	if *fileCounts {
+		*fileNames = true
+	}
+	if *fileNames && (*spill != "" || *hashKeys || *emitUnique || *wc || *window > 0 || *summary && !*jsonOut) {
+		// where each line was seen is a second map as big as the counts, so no -spill either
+		fmt.Fprintln(os.Stderr, "dup1: -files can't be used with -spill, -hash, -emit-unique, -wc, -window or a plain -summary")
+		os.Exit(2)
+	}
+	if (*save != "" || *merge != "") && (*spill != "" || *hashKeys) {
+		// spilled counts never sit in one map and hashed ones have no text to save
+		fmt.Fprintln(os.Stderr, "dup1: -save and -merge can't be used with -spill or -hash")
+		os.Exit(2)
+	}
+
+	if *minCount < 1 || *topN < 0 || *sortBy != "" && *sortBy != "count" && *sortBy != "line" {
+		fmt.Fprintln(os.Stderr, "dup1: -min has to be 1 or more, -top can't be negative, and -sort is count or line")
+		os.Exit(2)
+	}
+	if (*topN > 0 || *sortBy != "") && (*spill != "" || *hashKeys || *emitUnique || *wc || *window > 0) {
+		// spilled counts are printed a bucket at a time, so nothing ever sees all of them to sort
+		fmt.Fprintln(os.Stderr, "dup1: -top and -sort can't be used with -spill, -hash, -emit-unique, -wc or -window")
+		os.Exit(2)
+	}
+	if *fuzzy && (*fuzzyThreshold <= 0 || *fuzzyThreshold > 1 || *hashKeys || *emitUnique || *wc || *window > 0 || *spill != "" ||
+		*save != "" || *merge != "" || *fileNames || *perFile || *jsonOut || *summary || *parallel > 1) {
+		// the groups are a different kind of thing from the counts all of those work with
+		fmt.Fprintln(os.Stderr, "dup1: -fuzzy-threshold has to be above 0 and at most 1, and -fuzzy can't be used with -hash, -emit-unique, -wc, -window, -spill, -save, -merge, -files, -per-file, -json, -summary or -p")
+		os.Exit(2)
+	}
+	if *parallel < 1 || *parallel > 1 && (len(args) == 0 || *spill != "" || *hashKeys || *emitUnique || *wc || *window > 0 || *watch) {
+		// those modes read one stream from start to end, there is nothing to split up
+		fmt.Fprintln(os.Stderr, "dup1: -p has to be 1 or more, and more than 1 needs file arguments and can't be used with -spill, -hash, -emit-unique, -wc, -window or -watch")
+		os.Exit(2)
+	}
+	if *parallel > 1 {
+		runParallel(args, *parallel)
+		exit()
+	}
+
+	if *spillBuckets < 1 || *spillThreshold < 1 {
+		fmt.Fprintln(os.Stderr, "dup1: -spill-buckets and -spill-threshold have to be 1 or more")
+		os.Exit(2)
+	}
+
+	if *watch && (len(args) == 0 || *window > 0 || *save != "" || *merge != "") {
+		// -window never finishes, and -merge would add the same counts in again on every run
+		fmt.Fprintln(os.Stderr, "dup1: -watch needs file arguments, and can't be used with -window, -save or -merge")
+		os.Exit(2)
+	}
+	if *watch {
+		watchFiles(Flags.Args())
+		return
+	}
+
+	in, closeInput, err := openInput(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		os.Exit(2)
+	}
+	run(in)
+	closeInput()
+	exit()
+}
+
+// exit ends a run with its status: 2 when some input couldn't be read, or else with -fail 1 when
+// duplicates were found, and 0 otherwise.
+func exit() {
+	switch {
+	case inputFailed:
+		os.Exit(2)
+	case dupsFound && *failOnDups:
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// openInput is stdin, or the named files read one after the other, each through the
+// -encoding decoder on its own so every file gets its own utf16 BOM check.
+func openInput(names []string) (io.Reader, func(), error) {
+	if len(names) == 0 {
+		in, err := decoder(*encoding, os.Stdin)
+		return in, func() {}, err
+	}
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	var readers []io.Reader
+	inputs = nil
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			// like cat, one bad name shouldn't cost the counts of all the others
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			inputFailed = true
+			continue
+		}
+		files = append(files, f)
+		in, err := decoder(*encoding, f)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		readers = append(readers, in)
+		inputs = append(inputs, namedReader{name, in})
+	}
+	return io.MultiReader(readers...), closeAll, nil
+}
+
+// walkArgs is -r: the files under each directory in names, in the order WalkDir finds them
+// (sorted by name within a directory), and any plain files as they are. a directory that
+// can't be read is reported and skipped like a file that can't be opened
+func walkArgs(names []string) []string {
+	var files []string
+	for _, root := range names {
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			// openInput reports the ones that aren't there
+			files = append(files, root)
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+				inputFailed = true
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			if path != root && excludes.match(d.Name(), rel) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// symlinks and devices are left alone, a walk should only read what is really in there
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if len(includes) > 0 && !includes.match(d.Name(), rel) {
+				return nil
+			}
+			if binary, err := looksBinary(path); err != nil || binary {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+					inputFailed = true
+				}
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			inputFailed = true
+		}
+	}
+	return files
+}
+
+// looksBinary reads the start of the file and says whether there is a NUL byte in it. text in
+// UTF-16 has them too, so with -encoding utf16 nothing counts as binary
+func looksBinary(name string) (bool, error) {
+	if *encoding == "utf16" {
+		return false, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, 8000)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
+
+// globList is -include or -exclude, each given as many times as needed.
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+// Set checks the glob here, filepath.Match only says it is malformed once it is used.
+func (g *globList) Set(v string) error {
+	if _, err := filepath.Match(v, ""); err != nil {
+		return fmt.Errorf("bad glob %q", v)
+	}
+	*g = append(*g, v)
+	return nil
+}
+
+// match is whether any of the globs matches: the file name, or rel (the path from the directory
+// given to -r, with / between the parts) for a glob with a / in it.
+func (g globList) match(name, rel string) bool {
+	for _, glob := range g {
+		target := name
+		if strings.Contains(glob, "/") {
+			target = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(glob, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// namedReader is one of the files openInput reads from.
+type namedReader struct {
+	name string
+	r    io.Reader
+}
+
+// inputs are the files behind openInput's reader, one by one, for -per-file and -files.
+// reading them uses up the reader openInput returned, it's one or the other
+var inputs []namedReader
+
+// inputFailed is set when a file couldn't be opened or read to the end, so the exit status can say so
+var inputFailed bool
+
+// dupsFound is set once a duplicate has been seen, for the exit status
+var dupsFound bool
+
+// watchFiles is the -watch loop. it runs once straight away and then whenever the size or
+// modification time of one of the files is different from the last run. with -r the
+// directories are walked again every time, so a new file in them counts as a change too
+func watchFiles(roots []string) {
+	names := args
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	redraw := false
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		redraw = true // escape codes would only be noise in a file or a pipe
+	}
+	last := ""
+	for {
+		if *recursive {
+			names = walkArgs(roots)
+			args = names
+		}
+		if now := fileStamps(names); now != last {
+			last = now
+			if redraw {
+				fmt.Print("\x1b[H\x1b[2J")
+			}
+			in, closeInput, err := openInput(names)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			} else {
+				run(in)
+				closeInput()
+			}
+			fmt.Fprintf(os.Stderr, "dup1: %s, watching %d file(s), Ctrl-C to stop\n", time.Now().Format("15:04:05"), len(names))
+		}
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			return
+		}
+	}
+}
+
+// fileStamps sums up the size and modification time of every file in one string to compare.
+// a file that can't be read shows up as missing, and coming back counts as a change too.
+func fileStamps(names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			b.WriteString("missing\n")
+		}
+	}
+	return b.String()
+}
+
+// run is one count over in, in whatever mode the flags ask for.
+func run(in io.Reader) {
+	// -watch calls run again and again, each time has to start from nothing
+	st = stats{}
+	dups = nil
+	perFileStats = nil
+	where = nil
+	if positions != nil {
+		positions = make(map[string][]location)
+	}
+	dupsFound = false
+
+	if *emitUnique {
+		uniq(in)
+		return
+	}
+	if *wc {
+		wordCount(in)
+		return
+	}
+	if *window > 0 {
+		windowDups(in, *window)
+		return
+	}
+	if *hashKeys {
+		countHashes(in)
+		return
+	}
+	if *fuzzy {
+		fuzzyDups(in, *fuzzyThreshold)
+		return
+	}
+
+	counts := make(map[string]int)
+	if *merge != "" {
+		if err := loadCounts(*merge, counts); err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	var sp *spiller
+	// with -normalize (or -i or -space) the counts are kept by normalized line, and firstSeen
+	// remembers how each one was first spelled so that can be printed instead
+	firstSeen := make(map[string]string)
+
+	// -per-file and -files scan the files one at a time, so they can tell whose lines are whose
+	sources := []namedReader{{"-", in}}
+	if (*perFile || *fileNames || positions != nil) && len(args) > 0 {
+		sources = inputs
+	}
+	if *fileNames {
+		where = make(map[string]map[string]int)
+	}
+	lineNo := 0
+
+	for _, src := range sources {
+		var own map[string]int
+		if *perFile {
+			own = make(map[string]int)
+		}
+		input := bufio.NewScanner(src.r)
+		// lineNo runs on across the files for the -jsonpath warnings, srcLine starts again in each
+		srcLine := 0
+		for input.Scan() {
+			lineNo++
+			srcLine++
+			raw := input.Text()
+			line, ok := lineKey(raw, fmt.Sprintf("line %d", lineNo))
+			if !ok {
+				continue
+			}
+			if keepsFirst() {
+				key := canonical(line)
+				if _, ok := firstSeen[key]; !ok {
+					firstSeen[key] = representative(raw, line)
+				}
+				line = key
+			}
+			counts[line]++
+			if own != nil {
+				own[line]++
+			}
+			if where != nil {
+				if where[line] == nil {
+					where[line] = make(map[string]int)
+				}
+				where[line][src.name]++
+			}
+			if positions != nil {
+				positions[line] = append(positions[line], location{src.name, srcLine})
+			}
+
+			if *spill != "" && len(counts) > *spillThreshold {
+				if sp == nil {
+					var err error
+					if sp, err = newSpiller(*spill); err != nil {
+						fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+						os.Exit(2)
+					}
+				}
+				if err := sp.write(counts); err != nil {
+					fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+					sp.cleanup()
+					os.Exit(2)
+				}
+				counts = make(map[string]int)
+			}
+		}
+		if err := input.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			inputFailed = true
+		}
+		if own != nil {
+			fs := fileStats{name: src.name}
+			for _, n := range own {
+				fs.add(n)
+			}
+			perFileStats = append(perFileStats, fs)
+		}
+	}
+
+	if sp != nil {
+		// whatever is still in memory goes to disk too so every line is in exactly one bucket
+		err := sp.write(counts)
+		if err == nil {
+			err = sp.report(show)
+		}
+		// os.Exit skips deferred calls, so the temp files are removed by hand
+		sp.cleanup()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			os.Exit(2)
+		}
+		if err == nil {
+			finish()
+		}
+		return
+	}
+
+	report(counts, firstSeen)
+}
+
+// report is the end of every plain count, however the counts were made: they are saved for
+// -save or -merge, put back in their first spelling for -normalize and the like, and shown.
+func report(counts map[string]int, firstSeen map[string]string) {
+	if name := *save; name != "" || *merge != "" {
+		if name == "" {
+			name = *merge
+		}
+		if err := saveCounts(name, counts); err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if keepsFirst() {
+		shown := make(map[string]int, len(counts))
+		for key, n := range counts {
+			shown[firstSeen[key]] = n
+		}
+		counts = shown
+		if where != nil {
+			byLine := make(map[string]map[string]int, len(where))
+			for key, w := range where {
+				byLine[firstSeen[key]] = w
+			}
+			where = byLine
+		}
+		if positions != nil {
+			byLine := make(map[string][]location, len(positions))
+			for key, p := range positions {
+				byLine[firstSeen[key]] = p
+			}
+			positions = byLine
+		}
+	}
+	show(counts)
+	finish()
+}
+
+// lineKey is what gets counted for line: the -jsonpath value or the -field column when one
+// is asked for, or the line itself. ok is false for a line that isn't counted at all. where
+// says which line it is in the -jsonpath warning
+func lineKey(line, where string) (key string, ok bool) {
+	if *jsonPath != "" {
+		v, found, err := lookupJSON(line, *jsonPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %s: %v\n", where, err)
+			if *strict {
+				os.Exit(2)
+			}
+			return "", false
+		}
+		if !found {
+			return "", false
+		}
+		line = v
+	}
+	if *field > 0 {
+		f, ok := pickField(line, *field)
+		if !ok {
+			return "", false
+		}
+		line = f
+	}
+	return line, true
+}
+
+// tally is one -p goroutine's share of the counting. first is the -normalize firstSeen, with the
+// index of the file each spelling came from so the merge can keep the one from the earliest file.
+// cut is set when one of its files couldn't be read to the end.
+type tally struct {
+	counts map[string]int
+	first  map[string]spelling
+	where  map[string]map[string]int
+	cut    bool
+}
+
+type spelling struct {
+	file int
+	line string
+}
+
+// runParallel is run for -p: workers goroutines take the files one at a time, each opening
+// its own so thousands of names don't mean thousands of open files, and the tallies are added
+// up once they are all done
+func runParallel(names []string, workers int) {
+	st = stats{}
+	dups = nil
+	perFileStats = nil
+	where = nil
+
+	files := make([]fileStats, len(names))
+	failed := make([]bool, len(names)) // each goroutine only writes the slots of its own files
+	tallies := make([]tally, workers)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := range tallies {
+		t := &tallies[w]
+		*t = tally{counts: make(map[string]int), first: make(map[string]spelling)}
+		if *fileNames {
+			t.where = make(map[string]map[string]int)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := t.scan(i, names[i], &files[i]); err != nil {
+					fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+					failed[i] = true
+				}
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	counts := make(map[string]int)
+	if *merge != "" {
+		if err := loadCounts(*merge, counts); err != nil {
+			fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	first := make(map[string]spelling)
+	if *fileNames {
+		where = make(map[string]map[string]int)
+	}
+	for _, t := range tallies {
+		if t.cut {
+			inputFailed = true
+		}
+		for line, n := range t.counts {
+			counts[line] += n
+		}
+		for key, sp := range t.first {
+			if old, ok := first[key]; !ok || sp.file < old.file {
+				first[key] = sp
+			}
+		}
+		for line, w := range t.where {
+			if where[line] == nil {
+				where[line] = make(map[string]int)
+			}
+			for name, n := range w {
+				where[line][name] += n
+			}
+		}
+	}
+	for i := range names {
+		if failed[i] {
+			inputFailed = true
+		} else if *perFile {
+			perFileStats = append(perFileStats, files[i])
+		}
+	}
+	firstSeen := make(map[string]string, len(first))
+	for key, sp := range first {
+		firstSeen[key] = sp.line
+	}
+	report(counts, firstSeen)
+}
+
+// scan counts the lines of file i into t, and its -per-file figures into fs.
+func (t *tally) scan(i int, name string, fs *fileStats) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	in, err := decoder(*encoding, f)
+	if err != nil {
+		return err
+	}
+	own := make(map[string]int)
+	input := bufio.NewScanner(in)
+	lineNo := 0
+	for input.Scan() {
+		lineNo++
+		raw := input.Text()
+		line, ok := lineKey(raw, fmt.Sprintf("%s:%d", name, lineNo))
+		if !ok {
+			continue
+		}
+		if keepsFirst() {
+			key := canonical(line)
+			if sp, ok := t.first[key]; !ok || i < sp.file {
+				t.first[key] = spelling{i, representative(raw, line)}
+			}
+			line = key
+		}
+		t.counts[line]++
+		own[line]++
+		if t.where != nil {
+			if t.where[line] == nil {
+				t.where[line] = make(map[string]int)
+			}
+			t.where[line][name]++
+		}
+	}
+	*fs = fileStats{name: name}
+	for _, n := range own {
+		fs.add(n)
+	}
+	// a file that stops halfway still counts for what was read, like it does without -p
+	if err := input.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %s: %v\n", name, err)
+		t.cut = true
+	}
+	return nil
+}
+
+// pickField returns column n of line for -field. ok is false when the line is too short
+// and -short-lines says to skip it.
+func pickField(line string, n int) (f string, ok bool) {
+	var fields []string
+	if *fieldSep == "" {
+		fields = strings.Fields(line)
+	} else {
+		fields = strings.Split(line, *fieldSep)
+	}
+	if n > len(fields) {
+		return "", *shortLines == "empty"
+	}
+	return fields[n-1], true
+}
+
+// lookupJSON decodes line and walks path one dot at a time for -jsonpath. err is only for
+// lines that aren't JSON, found is false when the path isn't there.
+func lookupJSON(line, path string) (v string, found bool, err error) {
+	// numbers are kept as they were written: as a float64 an ID past 2^53 would turn into its neighbour
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return "", false, fmt.Errorf("not JSON: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return "", false, fmt.Errorf("not JSON: more after the end of the value")
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			if doc, found = node[key]; !found {
+				return "", false, nil
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false, nil
+			}
+			doc = node[i]
+		default:
+			// a string or number can't have anything inside it
+			return "", false, nil
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s, true, nil
+	}
+	// numbers, bools, null and whole objects are counted by their JSON, which
+	// Marshal writes with sorted keys so equal objects come out the same
+	b, _ := json.Marshal(doc)
+	return string(b), true, nil
+}
+
+// composed lists, for each combining accent, pairs of a letter and that letter with the accent
+// built in. it covers every letter in Latin-1 that has one
+var composed = map[rune]string{
+	'\u0300': "AÀEÈIÌOÒUÙaàeèiìoòuù",     // grave
+	'\u0301': "AÁEÉIÍOÓUÚYÝaáeéiíoóuúyý", // acute
+	'\u0302': "AÂEÊIÎOÔUÛaâeêiîoôuû",     // circumflex
+	'\u0303': "AÃNÑOÕaãnñoõ",             // tilde
+	'\u0308': "AÄEËIÏOÖUÜaäeëiïoöuüyÿ",   // diaeresis
+	'\u030a': "AÅaå",                     // ring above
+	'\u0327': "CÇcç",                     // cedilla
+}
+
+// keepsFirst says whether lines are grouped under a key that isn't what gets printed,
+// so the first line of each group has to be remembered.
+func keepsFirst() bool {
+	return *normalize || *ignoreCase || *squeeze || *original
+}
+
+// canonical is the key a line is counted under: -space first, so the case folding
+// doesn't have to care about the whitespace, then -normalize or -i.
+func canonical(line string) string {
+	if *squeeze {
+		line = strings.Join(strings.Fields(line), " ")
+	}
+	if *normalize {
+		// it already folds case
+		return normalizeLine(line)
+	}
+	if *ignoreCase {
+		line = strings.Map(fold, line)
+	}
+	return line
+}
+
+// representative is what a group is printed as: the first line as it came in for
+// -original, otherwise the part of it that was compared.
+func representative(raw, line string) string {
+	if *original {
+		return raw
+	}
+	return line
+}
+
+// normalizeLine is what -normalize compares: accents put back onto their letters where
+// composed knows how, then every letter case folded.
+func normalizeLine(s string) string {
+	var b strings.Builder
+	var prev rune = -1 // the letter waiting to see if an accent follows it
+	flush := func() {
+		if prev >= 0 {
+			b.WriteRune(fold(prev))
+		}
+	}
+	for _, r := range s {
+		if pairs, ok := composed[r]; ok && prev >= 0 {
+			p := []rune(pairs)
+			found := false
+			for i := 0; i < len(p); i += 2 {
+				if p[i] == prev {
+					prev, found = p[i+1], true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+		}
+		flush()
+		prev = r
+	}
+	flush()
+	return b.String()
+}
+
+// fold maps r to one fixed member of its case folding orbit (the smallest), so A, a and
+// the like all come out the same. it is simple folding only: ß doesn't turn into ss.
+func fold(r rune) rune {
+	smallest := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		smallest = min(smallest, f)
+	}
+	return smallest
+}
+
+// loadCounts adds the counts saved in a -save file to counts. a file that isn't there yet
+// is an empty one, so the first -merge run doesn't need any setup.
+func loadCounts(name string, counts map[string]int) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readCounts(f, counts)
+}
+
+// saveCounts writes counts to a temp file and renames it over name, so a run that fails
+// halfway leaves the old totals alone instead of a cut-off file.
+func saveCounts(name string, counts map[string]int) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once the rename has happened
+	w := bufio.NewWriter(f)
+	for line, n := range counts {
+		fmt.Fprintf(w, "%d\t%s\n", n, line)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// dedupFile is -dedup-in-place. a file without duplicates is left alone, backup and all.
+func dedupFile(name string, backup bool) (removed, kept int, err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, 0, fmt.Errorf("%s is not a regular file", name)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once the rename has happened
+	w := bufio.NewWriter(f)
+	seen := make(map[string]bool)
+	r := bufio.NewReader(in)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			// a last line without its newline is still the same line
+			key := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if seen[key] {
+				removed++
+			} else {
+				seen[key] = true
+				kept++
+				w.WriteString(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return 0, 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return 0, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+	if removed == 0 {
+		return 0, kept, nil
+	}
+	// CreateTemp makes the file 0600, the cleaned up one should have the old one's permissions
+	if err := os.Chmod(f.Name(), fi.Mode().Perm()); err != nil {
+		return 0, 0, err
+	}
+	if backup {
+		if err := backupFile(name); err != nil {
+			return 0, 0, err
+		}
+	}
+	return removed, kept, os.Rename(f.Name(), name)
+}
+
+// backupFile makes name.bak a copy of name. a hard link costs nothing, and since the rename
+// after it puts a new file at name, the link keeps the old contents. a copy is the fallback.
+func backupFile(name string) error {
+	bak := name + ".bak"
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(name, bak) == nil {
+		return nil
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(bak)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readCounts adds up "count<TAB>line" lines, the format of both -save files and spill buckets.
+func readCounts(f *os.File, counts map[string]int) error {
+	input := bufio.NewScanner(f)
+	// a saved line is the original plus its count, so it can be a little longer than the scanner's usual limit
+	input.Buffer(nil, bufio.MaxScanTokenSize+32)
+	for input.Scan() {
+		n, line, ok := strings.Cut(input.Text(), "\t")
+		if !ok {
+			return fmt.Errorf("corrupt counts in %s", f.Name())
+		}
+		c, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Errorf("corrupt counts in %s: %v", f.Name(), err)
+		}
+		counts[line] += c
+	}
+	return input.Err()
+}
+
+// st adds up the -summary figures as each map of counts is shown
+var st stats
+
+// perFileStats are the -per-file figures, in the order the files were given
+var perFileStats []fileStats
+
+type fileStats struct {
+	name string
+	stats
+}
+
+// dups collects the duplicates for -json, which can only print them once they are all in
+var dups []dupLine
+
+type dupLine struct {
+	Line      string         `json:"line"`
+	Count     int            `json:"count"`
+	Files     map[string]int `json:"files,omitempty"`
+	Locations []location     `json:"locations,omitempty"`
+}
+
+// location is one copy of a line, for -format json. stdin is file -
+type location struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// positions are the locations of every line so far with -format json, nil without it
+var positions map[string][]location
+
+// where is the -files record of how many times each line was in each file, nil without it
+var where map[string]map[string]int
+
+// filesColumn is the -files column for line: the files in the order they were given,
+// with their counts for -file-counts
+func filesColumn(line string) string {
+	var parts []string
+	seen := make(map[string]bool)
+	for _, src := range sourceNames() {
+		n := where[line][src]
+		if n == 0 || seen[src] {
+			continue
+		}
+		seen[src] = true
+		if *fileCounts {
+			parts = append(parts, fmt.Sprintf("%s:%d", src, n))
+		} else {
+			parts = append(parts, src)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// sourceNames are the names -files uses, - on its own for stdin.
+func sourceNames() []string {
+	if len(args) == 0 {
+		return []string{"-"}
+	}
+	return args
+}
+
+// show prints the duplicates in counts, or only adds them to st for -summary,
+// or keeps them in dups for -json.
+func show(counts map[string]int) {
+	for _, n := range counts {
+		if n >= *minCount {
+			dupsFound = true
+			break
+		}
+	}
+	if *summary {
+		for _, n := range counts {
+			st.add(n)
+		}
+		if !*jsonOut {
+			return
+		}
+	}
+	if *jsonOut {
+		for line, n := range counts {
+			if n >= *minCount {
+				dups = append(dups, dupLine{line, n, where[line], positions[line]})
+			}
+		}
+		return
+	}
+	printDups(counts)
+}
+
+// finish prints whatever show held back: the -summary figures, or the whole -json object.
+func finish() {
+	if !*jsonOut {
+		st.print()
+		if len(perFileStats) > 0 {
+			fmt.Print("file\tlines\tdistinct\tduplicated" + eol)
+			for _, fs := range perFileStats {
+				fmt.Printf("%s\t%d\t%d\t%d%s", fs.name, fs.lines, fs.distinct, fs.duplicated, eol)
+			}
+		}
+		return
+	}
+	// the text output comes in map order, but JSON is for programs, and they
+	// are easier on everyone when the same input always gives the same output
+	sort.Slice(dups, func(i, j int) bool {
+		return moreRepeated(dups[i].Line, dups[j].Line, dups[i].Count, dups[j].Count)
+	})
+	if *topN > 0 && len(dups) > *topN {
+		dups = dups[:*topN]
+	}
+	if *sortBy == "line" {
+		sort.Slice(dups, func(i, j int) bool { return dups[i].Line < dups[j].Line })
+	}
+	out := struct {
+		Duplicates []dupLine  `json:"duplicates"`
+		Stats      *jsonStats `json:"stats,omitempty"`
+		Files      []jsonFile `json:"files,omitempty"`
+	}{Duplicates: dups}
+	if out.Duplicates == nil {
+		out.Duplicates = []dupLine{} // [] rather than null when there are none
+	}
+	if *summary {
+		out.Stats = &jsonStats{st.lines, st.distinct, st.duplicated, st.ratio()}
+	}
+	for _, fs := range perFileStats {
+		out.Files = append(out.Files, jsonFile{fs.name, jsonStats{fs.lines, fs.distinct, fs.duplicated, fs.ratio()}})
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		os.Exit(2)
+	}
+	fmt.Printf("%s\n", b)
+}
+
+type jsonStats struct {
+	Lines      int     `json:"lines"`
+	Distinct   int     `json:"distinct"`
+	Duplicated int     `json:"duplicated"`
+	Ratio      float64 `json:"ratio"`
+}
+
+type jsonFile struct {
+	Name string `json:"name"`
+	jsonStats
+}
+
+// uniq is like sort -u without the sort: a line is printed the first time it is seen
+// and skipped after that, so the output keeps the input's order.
+func uniq(f io.Reader) {
+	seen := make(map[string]bool)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	input := bufio.NewScanner(f)
+	for input.Scan() {
+		line := input.Text()
+		if seen[line] {
+			dupsFound = true
+			continue
+		}
+		seen[line] = true
+		fmt.Fprint(out, line, eol)
+	}
+	if err := input.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		inputFailed = true
+	}
+}
+
+// countHashes is the -hash mode.
+func countHashes(f io.Reader) {
+	counts := make(map[uint64]int)
+	input := bufio.NewScanner(f)
+	for input.Scan() {
+		h := fnv.New64a()
+		h.Write(input.Bytes())
+		counts[h.Sum64()]++
+	}
+	if err := input.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		inputFailed = true
+	}
+
+	for _, n := range counts {
+		if n >= *minCount {
+			dupsFound = true
+			break
+		}
+	}
+	if *summary {
+		for _, n := range counts {
+			st.add(n)
+		}
+		st.print()
+		return
+	}
+	for sum, n := range counts {
+		if n >= *minCount {
+			fmt.Printf("%d\t%016x%s", n, sum, eol)
+		}
+	}
+}
+
+// windowDups is the -window mode. the last n lines sit in a ring buffer, and counts says how
+// many copies of each are in it, so a line leaving the window is one decrement away from forgotten.
+func windowDups(f io.Reader, n int) {
+	ring := make([]string, 0, n)
+	next := 0 // the oldest line once the ring is full, and so the one to replace
+	counts := make(map[string]int)
+
+	input := bufio.NewScanner(f)
+	for input.Scan() {
+		line := input.Text()
+		if c := counts[line]; c > 0 {
+			dupsFound = true
+			fmt.Printf("%d\t%s%s", c+1, line, eol)
+		}
+
+		if len(ring) < n {
+			ring = append(ring, line)
+		} else {
+			old := ring[next]
+			if counts[old]--; counts[old] == 0 {
+				delete(counts, old)
+			}
+			ring[next] = line
+			next = (next + 1) % n
+		}
+		counts[line]++
+	}
+	if err := input.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		inputFailed = true
+	}
+}
+
+// cluster is one -fuzzy group. hash is its first line's, and the one every other line is
+// compared with, so a group can't creep away from where it started one small change at a time
+type cluster struct {
+	hash     uint64
+	line     string
+	count    int
+	variants int
+}
+
+// fuzzyDups is the -fuzzy mode. comparing every line with every group would be slow once there
+// are many groups, so the hashes are indexed by bands: with at most d bits allowed to differ,
+// the 64 bits are cut into d+1 bands, and two hashes that close must have at least one band
+// exactly the same (d differing bits can only spoil d bands). only the groups sharing a band
+// with the line are looked at
+func fuzzyDups(f io.Reader, threshold float64) {
+	maxDist := int((1 - threshold) * 64)
+	bands := min(maxDist+1, 64)
+	index := make(map[[2]uint64][]int) // {band, its bits} to the groups with those bits there
+	var clusters []*cluster
+	// identical lines skip the hashing, and this is also how the variants get counted
+	exact := make(map[string]int)
+
+	input := bufio.NewScanner(f)
+	lineNo := 0
+	for input.Scan() {
+		lineNo++
+		raw := input.Text()
+		line, ok := lineKey(raw, fmt.Sprintf("line %d", lineNo))
+		if !ok {
+			continue
+		}
+		key := canonical(line)
+		if i, ok := exact[key]; ok {
+			clusters[i].count++
+			continue
+		}
+		h := simhash(key)
+		best := -1
+		seen := make(map[int]bool)
+		for b := 0; b < bands; b++ {
+			for _, i := range index[band(h, b, bands)] {
+				if seen[i] {
+					continue
+				}
+				seen[i] = true
+				if bits.OnesCount64(h^clusters[i].hash) <= maxDist && (best < 0 || i < best) {
+					// the earliest group that is close enough, so the result doesn't depend on map order
+					best = i
+				}
+			}
+		}
+		if best < 0 {
+			best = len(clusters)
+			clusters = append(clusters, &cluster{hash: h, line: representative(raw, line)})
+			for b := 0; b < bands; b++ {
+				k := band(h, b, bands)
+				index[k] = append(index[k], best)
+			}
+		}
+		exact[key] = best
+		clusters[best].count++
+		clusters[best].variants++
+	}
+	if err := input.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		inputFailed = true
+	}
+
+	var shown []*cluster
+	for _, c := range clusters {
+		if c.count >= *minCount {
+			shown = append(shown, c)
+		}
+	}
+	dupsFound = len(shown) > 0
+	sort.Slice(shown, func(i, j int) bool {
+		return moreRepeated(shown[i].line, shown[j].line, shown[i].count, shown[j].count)
+	})
+	if *topN > 0 && len(shown) > *topN {
+		shown = shown[:*topN]
+	}
+	if *sortBy == "line" {
+		sort.Slice(shown, func(i, j int) bool { return shown[i].line < shown[j].line })
+	}
+	for _, c := range shown {
+		fmt.Printf("%d\t%d\t%s%s", c.count, c.variants, c.line, eol)
+	}
+}
+
+// band is bits b*64/n up to (b+1)*64/n of h, with b in front so equal bits in two different
+// bands don't look like a match.
+func band(h uint64, b, n int) [2]uint64 {
+	lo, hi := b*64/n, (b+1)*64/n
+	return [2]uint64{uint64(b), h >> lo & (1<<(hi-lo) - 1)}
+}
+
+// simhash hashes every word of line and every pair of words next to each other, and sets each
+// of the 64 bits to what most of those hashes have there. changing one word changes a few of
+// the votes, so only a few bits tend to flip, where a normal hash would change completely.
+// words are runs of letters and digits, and every run of digits is made a single 0, so 7 and 1234 are the same
+func simhash(line string) uint64 {
+	words := strings.FieldsFunc(line, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		var b strings.Builder
+		digits := false
+		for _, r := range w {
+			if unicode.IsDigit(r) {
+				if !digits {
+					b.WriteByte('0')
+				}
+				digits = true
+				continue
+			}
+			digits = false
+			b.WriteRune(r)
+		}
+		words[i] = b.String()
+	}
+	var votes [64]int
+	// each feature votes once, or the 0s a timestamp leaves behind would outvote the words
+	voted := make(map[string]bool)
+	vote := func(feature string) {
+		if voted[feature] {
+			return
+		}
+		voted[feature] = true
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		for i := range votes {
+			if sum>>i&1 == 1 {
+				votes[i]++
+			} else {
+				votes[i]--
+			}
+		}
+	}
+	for i, w := range words {
+		vote(w)
+		if i > 0 {
+			vote(words[i-1] + " " + w)
+		}
+	}
+	var h uint64
+	for i, v := range votes {
+		if v > 0 {
+			h |= 1 << i
+		}
+	}
+	return h
+}
+
+// wordCount is the -wc mode
+func wordCount(f io.Reader) {
+	lines, words, size, err := countWords(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup1: %v\n", err)
+		inputFailed = true
+	}
+
+	all := !*wcLines && !*wcWords && !*wcBytes
+	var out []string
+	if all || *wcLines {
+		out = append(out, fmt.Sprintf("%7d", lines))
+	}
+	if all || *wcWords {
+		out = append(out, fmt.Sprintf("%7d", words))
+	}
+	if all || *wcBytes {
+		out = append(out, fmt.Sprintf("%7d", size))
+	}
+	fmt.Println(strings.Join(out, " "))
+}
+
+// countWords counts the lines, words and bytes in r. it reads with a bufio.Reader and not a
+// Scanner, which gives up on a line longer than 64 KiB, and minified or generated files have
+// those. a last line without its newline still counts as a line, like the Scanner did. the bytes
+// are counted as they are read, so a \r\n counts as two.
+func countWords(r io.Reader) (lines, words int, size int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		size += int64(len(line))
+		if line != "" {
+			lines++
+			words += len(strings.Fields(line))
+		}
+		if err == io.EOF {
+			return lines, words, size, nil
+		}
+		if err != nil {
+			return lines, words, size, err
+		}
+	}
+}
+
+// decoder returns r turned into UTF-8 from the named -encoding.
+func decoder(name string, r io.Reader) (io.Reader, error) {
+	switch strings.ToLower(name) {
+	case "utf8", "utf-8", "raw":
+		return r, nil
+	case "latin1", "latin-1", "iso-8859-1":
+		return &latin1Reader{r: bufio.NewReader(r)}, nil
+	case "utf16", "utf-16":
+		return &utf16Reader{r: bufio.NewReader(r), order: binary.LittleEndian, start: true}, nil
+	}
+	return nil, fmt.Errorf("-encoding must be utf8, latin1 or utf16, not %q", name)
+}
+
+// latin1Reader decodes ISO-8859-1. every byte is the code point with the same number,
+// so it is just a matter of writing bytes from 0x80 up as two-byte UTF-8.
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf []byte // what is left of a character that didn't fit in the last Read's p
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(l.buf) == 0 {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		l.buf = utf8.AppendRune(l.buf[:0], rune(b))
+	}
+	n := 0
+	for {
+		c := copy(p[n:], l.buf)
+		n += c
+		l.buf = l.buf[c:]
+		// don't block for more input when we already have some to hand back
+		if len(l.buf) > 0 || n == len(p) || l.r.Buffered() == 0 {
+			return n, nil
+		}
+		b, _ := l.r.ReadByte() // it's buffered, so there's no error to get
+		l.buf = utf8.AppendRune(l.buf[:0], rune(b))
+	}
+}
+
+// utf16Reader decodes UTF-16, with the byte order taken from a BOM when the input starts with one.
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	start bool  // the BOM hasn't been looked for yet
+	off   int64 // bytes read so far, for error messages
+	buf   []byte
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.buf) == 0 {
+		r, err := u.next()
+		if err != nil {
+			return 0, err
+		}
+		u.buf = utf8.AppendRune(u.buf, r)
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+// next decodes one character, putting surrogate pairs back together.
+func (u *utf16Reader) next() (rune, error) {
+	c, err := u.unit()
+	if err != nil {
+		return 0, err
+	}
+	if u.start {
+		u.start = false
+		switch c {
+		case 0xfeff:
+			return u.next()
+		case 0xfffe:
+			// it was written big-endian
+			u.order = binary.BigEndian
+			return u.next()
+		}
+	}
+	if !utf16.IsSurrogate(rune(c)) {
+		return rune(c), nil
+	}
+	c2, err := u.unit()
+	if err == io.EOF {
+		err = fmt.Errorf("utf16: input ends in the middle of a surrogate pair")
+	}
+	if err != nil {
+		return 0, err
+	}
+	r := utf16.DecodeRune(rune(c), rune(c2))
+	if r == utf8.RuneError {
+		return 0, fmt.Errorf("utf16: broken surrogate pair at byte %d, is the input really UTF-16?", u.off-4)
+	}
+	return r, nil
+}
+
+// unit reads one 16-bit code unit.
+func (u *utf16Reader) unit() (uint16, error) {
+	var b [2]byte
+	n, err := io.ReadFull(u.r, b[:])
+	u.off += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("utf16: odd number of bytes in the input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return u.order.Uint16(b[:]), nil
+}
+
+func printDups(counts map[string]int) {
+	if *parallel > 1 || *sortBy != "" || *topN > 0 {
+		printSortedDups(counts)
+		return
+	}
+	for line, n := range counts {
+		if n >= *minCount {
+			printDup(line, n)
+		}
+	}
+}
+
+// printSortedDups is printDups for -sort and -top, and for -p, which always sorts so its
+// output doesn't depend on which goroutine finished first.
+func printSortedDups(counts map[string]int) {
+	var lines []string
+	for line, n := range counts {
+		if n >= *minCount {
+			lines = append(lines, line)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return moreRepeated(lines[i], lines[j], counts[lines[i]], counts[lines[j]])
+	})
+	// -top picks by count even with -sort line, and only then are the ones it kept sorted by line
+	if *topN > 0 && len(lines) > *topN {
+		lines = lines[:*topN]
+	}
+	if *sortBy == "line" {
+		sort.Strings(lines)
+	}
+	for _, line := range lines {
+		printDup(line, counts[line])
+	}
+}
+
+// moreRepeated is the count order: a before b when it was seen more often, and by line when
+// they were seen as often, so ties always come out the same way.
+func moreRepeated(a, b string, na, nb int) bool {
+	if na != nb {
+		return na > nb
+	}
+	return a < b
+}
+
+func printDup(line string, n int) {
+	if where != nil {
+		fmt.Printf("%d\t%s\t%s%s", n, line, filesColumn(line), eol)
+		return
+	}
+	fmt.Printf("%d\t%s%s", n, line, eol)
+}
+
+// stats are the -summary figures. the counts maps already hold everything, so no second pass is needed.
+type stats struct {
+	lines      int // every line read
+	distinct   int // different lines
+	duplicated int // different lines seen more than once
+}
+
+// add counts one distinct line that was seen n times.
+func (s *stats) add(n int) {
+	s.lines += n
+	s.distinct++
+	if n > 1 {
+		s.duplicated++
+	}
+}
+
+// print does nothing without -summary.
+func (s *stats) print() {
+	if !*summary {
+		return
+	}
+	fmt.Printf("lines\t%d\n", s.lines)
+	fmt.Printf("distinct\t%d\n", s.distinct)
+	fmt.Printf("duplicated\t%d\n", s.duplicated)
+	fmt.Printf("ratio\t%.4f\n", s.ratio())
+}
+
+// ratio is the share of lines that were a repeat of an earlier one.
+func (s *stats) ratio() float64 {
+	if s.lines == 0 {
+		return 0
+	}
+	return float64(s.lines-s.distinct) / float64(s.lines)
+}
+
+// spiller owns the bucket files in a temporary directory.
+type spiller struct {
+	dir     string
+	buckets []*os.File
+	stop    chan os.Signal
+	once    sync.Once // the signal and the normal end can both get to cleanup
+}
+
+func newSpiller(parent string) (*spiller, error) {
+	dir, err := os.MkdirTemp(parent, "dup-")
+	if err != nil {
+		return nil, err
+	}
+	sp := &spiller{dir: dir, stop: make(chan os.Signal, 1)}
+	// os.Exit and dying from a signal both skip deferred calls, so Ctrl-C in the middle of a
+	// big input would leave gigabytes of buckets behind without this
+	signal.Notify(sp.stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-sp.stop; ok {
+			sp.cleanup()
+			os.Exit(130)
+		}
+	}()
+	for i := 0; i < *spillBuckets; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("bucket-%02d", i)))
+		if err != nil {
+			sp.cleanup()
+			return nil, err
+		}
+		sp.buckets = append(sp.buckets, f)
+	}
+	return sp, nil
+}
+
+// write appends every count in the map to its line's bucket as "count<TAB>line".
+func (sp *spiller) write(counts map[string]int) error {
+	ws := make([]*bufio.Writer, len(sp.buckets))
+	for i, f := range sp.buckets {
+		ws[i] = bufio.NewWriter(f)
+	}
+	for line, n := range counts {
+		fmt.Fprintf(ws[bucket(line)], "%d\t%s\n", n, line)
+	}
+	for _, w := range ws {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report adds up each bucket on its own and hands its counts to show.
+func (sp *spiller) report(show func(map[string]int)) error {
+	for _, f := range sp.buckets {
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		counts := make(map[string]int)
+		if err := readCounts(f, counts); err != nil {
+			return err
+		}
+		show(counts)
+	}
+	return nil
+}
+
+func (sp *spiller) cleanup() {
+	sp.once.Do(func() {
+		signal.Stop(sp.stop)
+		close(sp.stop) // lets the signal goroutine go
+		for _, f := range sp.buckets {
+			f.Close()
+		}
+		os.RemoveAll(sp.dir)
+	})
+}
+
+func bucket(line string) int {
+	h := fnv.New32a()
+	h.Write([]byte(line))
+	return int(h.Sum32() % uint32(*spillBuckets))
+}
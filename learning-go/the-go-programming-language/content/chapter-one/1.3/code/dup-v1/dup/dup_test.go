@@ -0,0 +1,1005 @@
+package dup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/bits"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// TestMain runs dup itself instead of the tests when DUP_TEST_ARGS is set, so a test can see what
+// the whole program does, flags, output and exit status, by running its own binary that way
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("DUP_TEST_ARGS"); ok {
+		var argv []string
+		if err := json.Unmarshal([]byte(args), &argv); err != nil {
+			panic(err)
+		}
+		Main(argv)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// dupCmd is dup with args, run through TestMain in a process of its own with stdin as its input
+func dupCmd(stdin string, args ...string) *exec.Cmd {
+	// JSON and not spaces, an argument can have spaces in it
+	argv, _ := json.Marshal(args)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DUP_TEST_ARGS="+string(argv))
+	cmd.Stdin = strings.NewReader(stdin)
+	return cmd
+}
+
+// runDup runs dup with args over stdin and returns what it printed and its exit status
+func runDup(t *testing.T, stdin string, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	var out, errOut strings.Builder
+	cmd := dupCmd(stdin, args...)
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+// sorted is the lines of out in order, for the modes that print in map order
+func sorted(out string) []string {
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if out == "" {
+		lines = nil
+	}
+	slices.Sort(lines)
+	return lines
+}
+
+// readAll reads all of r through a buffer of size bytes
+func readAll(r io.Reader, size int) (string, error) {
+	var out strings.Builder
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), err
+		}
+		if n == 0 {
+			return out.String(), io.ErrNoProgress
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		encoding, in, want string
+		wantErr            bool
+	}{
+		{"utf8", "café\n", "café\n", false},
+		{"raw", "\xff\n", "\xff\n", false},
+		{"latin1", "caf\xe9\n", "café\n", false},
+		{"ISO-8859-1", "\xff\xa9", "ÿ©", false},
+		{"latin1", "", "", false},
+		{"utf16", "h\x00i\x00", "hi", false},
+		{"utf16", "\xff\xfeh\x00i\x00", "hi", false},
+		{"utf16", "\xfe\xff\x00h\x00i", "hi", false},
+		{"utf16", "=\xd8\x00\xde", "😀", false},
+		{"utf16", "h\x00i", "h", true},
+		{"utf16", "=\xd8", "", true},
+		{"ebcdic", "", "", true},
+	}
+	for _, tt := range tests {
+		// small buffers too: a 2-byte character has to come out whole even through a 1-byte p
+		for _, size := range []int{1, 2, 3, 4096} {
+			r, err := decoder(tt.encoding, iotest.OneByteReader(strings.NewReader(tt.in)))
+			if err == nil {
+				var got string
+				got, err = readAll(r, size)
+				if err == nil && got != tt.want {
+					t.Errorf("%s %q through %d bytes = %q, want %q", tt.encoding, tt.in, size, got, tt.want)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s %q through %d bytes: error %v, want error %v", tt.encoding, tt.in, size, err, tt.wantErr)
+			}
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct{ a, b rune }{
+		{'A', 'a'},
+		{'K', 'k'},
+		{'K', 'K'}, // the Kelvin sign folds with K and k
+		{'Σ', 'ς'},
+		{'σ', 'ς'},
+		{'1', '1'},
+	}
+	for _, tt := range tests {
+		if fold(tt.a) != fold(tt.b) {
+			t.Errorf("fold(%q) = %q but fold(%q) = %q, want them the same", tt.a, fold(tt.a), tt.b, fold(tt.b))
+		}
+	}
+	if fold('a') != 'A' {
+		t.Errorf("fold('a') = %q, want the smallest of its orbit, 'A'", fold('a'))
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	tests := []struct {
+		in                 string
+		lines, words, size int
+	}{
+		{"", 0, 0, 0},
+		{"a b\nc\n", 2, 3, 6},
+		{"a b\r\nc", 2, 3, 6},
+		{"\n\n", 2, 0, 2},
+		{long + " y\nz\n", 2, 3, len(long) + 5},
+	}
+	for _, tt := range tests {
+		lines, words, size, err := countWords(strings.NewReader(tt.in))
+		if err != nil || lines != tt.lines || words != tt.words || size != int64(tt.size) {
+			t.Errorf("countWords(%.20q) = %d, %d, %d, %v, want %d, %d, %d", tt.in, lines, words, size, err, tt.lines, tt.words, tt.size)
+		}
+	}
+}
+
+// TestSpill counts an input with far more distinct lines than -spill-threshold: it comes out the
+// same as counting it all in memory, and the bucket files are gone afterwards
+func TestSpill(t *testing.T) {
+	var in strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&in, "line %d\n", i%170)
+		if i%7 == 0 {
+			fmt.Fprintf(&in, "only once %d\n", i)
+		}
+	}
+	want, _, _ := runDup(t, in.String())
+	if len(sorted(want)) != 170 {
+		t.Fatalf("the plain run found %d duplicates, want 170", len(sorted(want)))
+	}
+	wantSummary, _, _ := runDup(t, in.String(), "-summary")
+
+	dir := t.TempDir()
+	for _, buckets := range []string{"1", "4", "64"} {
+		got, errOut, code := runDup(t, in.String(), "-spill", dir, "-spill-threshold", "3", "-spill-buckets", buckets)
+		if code != 0 {
+			t.Fatalf("exit %d: %s", code, errOut)
+		}
+		if !slices.Equal(sorted(got), sorted(want)) {
+			t.Errorf("%s buckets: the spilled counts differ from the ones in memory", buckets)
+		}
+		if got, _, _ := runDup(t, in.String(), "-summary", "-spill", dir, "-spill-threshold", "3", "-spill-buckets", buckets); got != wantSummary {
+			t.Errorf("%s buckets: -summary\n%s\nwant\n%s", buckets, got, wantSummary)
+		}
+	}
+	if left, _ := os.ReadDir(dir); len(left) > 0 {
+		t.Errorf("left behind in the -spill directory: %v", left)
+	}
+}
+
+func TestEmitUnique(t *testing.T) {
+	tests := []struct {
+		in, want string
+		code     int // with -fail
+	}{
+		{"", "", 0},
+		{"a\nb\nc\n", "a\nb\nc\n", 0},
+		{"b\na\nb\nc\na\nb\n", "b\na\nc\n", 1},
+		{"x\n\nx\n\n", "x\n\n", 1},
+		// case and spaces count, it is the plain line
+		{"A\na\n a\n", "A\na\n a\n", 0},
+		{"last\nlast", "last\n", 1},
+	}
+	for _, tt := range tests {
+		got, errOut, code := runDup(t, tt.in, "-emit-unique", "-fail")
+		if got != tt.want || code != tt.code {
+			t.Errorf("-emit-unique %q = %q, exit %d, want %q, exit %d (%s)", tt.in, got, code, tt.want, tt.code, errOut)
+		}
+	}
+}
+
+// TestHash checks -hash finds the same duplicates as counting the lines themselves, each printed
+// as its FNV-1a hash, and that -summary agrees too
+func TestHash(t *testing.T) {
+	in := "alpha\nbeta\nalpha\ngamma\nbeta\nalpha\n" + strings.Repeat("long line ", 1000) + "\n\n\n" + strings.Repeat("long line ", 1000) + "\n"
+	plain, _, _ := runDup(t, in)
+	var want []string
+	for _, line := range sorted(plain) {
+		n, text, _ := strings.Cut(line, "\t")
+		h := fnv.New64a()
+		h.Write([]byte(text))
+		want = append(want, fmt.Sprintf("%s\t%016x", n, h.Sum64()))
+	}
+	slices.Sort(want)
+	got, errOut, code := runDup(t, in, "-hash")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if !slices.Equal(sorted(got), want) {
+		t.Errorf("-hash = %q, want %q", sorted(got), want)
+	}
+	if len(want) != 4 {
+		t.Errorf("%d duplicates, want alpha, beta, the long line and the empty one", len(want))
+	}
+
+	plainSummary, _, _ := runDup(t, in, "-summary")
+	if got, _, _ := runDup(t, in, "-hash", "-summary"); got != plainSummary {
+		t.Errorf("-hash -summary\n%s\nwant\n%s", got, plainSummary)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		in                         string
+		lines, distinct, duplicate int
+		ratio                      string
+	}{
+		{"", 0, 0, 0, "0.0000"},
+		{"a\n", 1, 1, 0, "0.0000"},
+		{"a\nb\na\nc\na\nb\n", 6, 3, 2, "0.5000"},
+		{"x\nx\nx\n", 3, 1, 1, "0.6667"},
+		{"\n\n1\n2\n3\n", 5, 4, 1, "0.2000"},
+	}
+	for _, tt := range tests {
+		want := fmt.Sprintf("lines\t%d\ndistinct\t%d\nduplicated\t%d\nratio\t%s\n", tt.lines, tt.distinct, tt.duplicate, tt.ratio)
+		if got, _, _ := runDup(t, tt.in, "-summary"); got != want {
+			t.Errorf("-summary of %q:\n%s\nwant\n%s", tt.in, got, want)
+		}
+	}
+}
+
+// counts reads a -save file into a map
+func counts(t *testing.T, name string) map[string]int {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c := make(map[string]int)
+	if err := readCounts(f, c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestMerge runs two batches into the same -merge file: the file ends up with the totals of both,
+// and the second run reports a line seen once in each as a duplicate
+func TestMerge(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "counts")
+	if out, errOut, code := runDup(t, "a\nb\na\nonly first\nwith\ttab\n", "-merge", name); code != 0 || out != "2\ta\n" {
+		t.Fatalf("first batch: %q, exit %d: %s", out, code, errOut)
+	}
+	if want := map[string]int{"a": 2, "b": 1, "only first": 1, "with\ttab": 1}; !reflect.DeepEqual(counts(t, name), want) {
+		t.Errorf("after the first batch %v, want %v", counts(t, name), want)
+	}
+
+	out, _, _ := runDup(t, "b\na\nc\nc\nwith\ttab\n", "-merge", name)
+	if want := []string{"2\tb", "2\tc", "2\twith\ttab", "3\ta"}; !slices.Equal(sorted(out), want) {
+		t.Errorf("second batch printed %q, want %q", sorted(out), want)
+	}
+	if want := map[string]int{"a": 3, "b": 2, "c": 2, "only first": 1, "with\ttab": 2}; !reflect.DeepEqual(counts(t, name), want) {
+		t.Errorf("after the second batch %v, want %v", counts(t, name), want)
+	}
+
+	// -save writes the counts of this run only, and starts from nothing
+	saved := filepath.Join(t.TempDir(), "saved")
+	runDup(t, "x\nx\n", "-save", saved)
+	if want := map[string]int{"x": 2}; !reflect.DeepEqual(counts(t, saved), want) {
+		t.Errorf("-save wrote %v, want %v", counts(t, saved), want)
+	}
+
+	if err := os.WriteFile(saved, []byte("not a count\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, errOut, code := runDup(t, "x\n", "-merge", saved); code != 2 || !strings.Contains(errOut, "corrupt counts") {
+		t.Errorf("a corrupt -merge file: exit %d, %q", code, errOut)
+	}
+}
+
+// TestPrint0 checks every mode that prints lines ends each with a NUL and no newline, so a line
+// with spaces or quotes in it comes through xargs -0 whole. the -summary totals aren't
+// lines of the input and keep their newlines
+func TestPrint0(t *testing.T) {
+	in := "it's a \"line\"\nb\nit's a \"line\"\nb\nb\n"
+	tests := []struct {
+		args []string
+		want []string // the records, without their NULs, sorted
+	}{
+		{nil, []string{"2\tit's a \"line\"", "3\tb"}},
+		{[]string{"-emit-unique"}, []string{"b", "it's a \"line\""}},
+		{[]string{"-window", "2"}, []string{"2\tb", "2\tb", "2\tit's a \"line\""}},
+		{[]string{"-sort", "count"}, []string{"2\tit's a \"line\"", "3\tb"}},
+	}
+	for _, tt := range tests {
+		out, errOut, code := runDup(t, in, append([]string{"-print0"}, tt.args...)...)
+		if code != 0 {
+			t.Fatalf("%v: exit %d: %s", tt.args, code, errOut)
+		}
+		if strings.Contains(out, "\n") || !strings.HasSuffix(out, "\x00") {
+			t.Errorf("%v: %q has a newline, or doesn't end in a NUL", tt.args, out)
+			continue
+		}
+		records := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+		slices.Sort(records)
+		if !slices.Equal(records, tt.want) {
+			t.Errorf("%v: records %q, want %q", tt.args, records, tt.want)
+		}
+	}
+
+	if out, _, _ := runDup(t, in, "-print0", "-sort", "count"); out != "3\tb\x002\tit's a \"line\"\x00" {
+		t.Errorf("-print0 -sort count = %q", out)
+	}
+	if out, _, _ := runDup(t, in, "-print0", "-summary"); strings.Contains(out, "\x00") || strings.Count(out, "\n") != 4 {
+		t.Errorf("-print0 -summary = %q, want the four lines as they are", out)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		window int
+		in     string
+		want   string
+	}{
+		// a and its copy are 3 lines apart: inside a window of 3, just outside one of 2
+		{3, "a\nb\nc\na\n", "2\ta\n"},
+		{2, "a\nb\nc\na\n", ""},
+		{1, "a\na\nb\na\n", "2\ta\n"},
+		// the count is this copy and the ones in the n lines before it, older ones have fallen out
+		{3, "x\nx\nx\nx\n", "2\tx\n3\tx\n4\tx\n"},
+		{2, "x\nx\nx\nx\n", "2\tx\n3\tx\n3\tx\n"},
+		{2, "x\ny\nx\ny\nz\nz\n", "2\tx\n2\ty\n2\tz\n"},
+	}
+	for _, tt := range tests {
+		if got, _, _ := runDup(t, tt.in, "-window", strconv.Itoa(tt.window)); got != tt.want {
+			t.Errorf("-window %d over %q = %q, want %q", tt.window, tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestWindowStreams feeds -window through a pipe: a duplicate is printed as soon as its line
+// comes in, while the input is still open
+func TestWindowStreams(t *testing.T) {
+	cmd := dupCmd("", "-window", "10")
+	cmd.Stdin = nil
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	io.WriteString(stdin, "a\nb\na\n")
+	got := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if line != "2\ta\n" {
+			t.Errorf("got %q, want 2\\ta", line)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing printed while the input was still open")
+	}
+}
+
+// dupJSON is the -json object
+type dupJSON struct {
+	Duplicates []dupLine  `json:"duplicates"`
+	Stats      *jsonStats `json:"stats"`
+	Files      []jsonFile `json:"files"`
+}
+
+func decodeJSON(t *testing.T, out string) dupJSON {
+	t.Helper()
+	var got dupJSON
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("%v in %q", err, out)
+	}
+	return got
+}
+
+func TestJSON(t *testing.T) {
+	in := "b\na\nb\nc\na\nb\n"
+	out, errOut, code := runDup(t, in, "-json", "-summary")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	got := decodeJSON(t, out)
+	if want := []dupLine{{Line: "b", Count: 3}, {Line: "a", Count: 2}}; !reflect.DeepEqual(got.Duplicates, want) {
+		t.Errorf("duplicates %+v, want %+v", got.Duplicates, want)
+	}
+	if want := (jsonStats{6, 3, 2, 0.5}); got.Stats == nil || *got.Stats != want {
+		t.Errorf("stats %+v, want %+v", got.Stats, want)
+	}
+
+	// no duplicates is an empty list, not null, and no stats without -summary
+	out, _, _ = runDup(t, "a\nb\n", "-json")
+	if strings.TrimSpace(out) != `{"duplicates":[]}` {
+		t.Errorf("-json with no duplicates = %s", out)
+	}
+
+	// -format json says where every copy was
+	dir := t.TempDir()
+	one, two := filepath.Join(dir, "one"), filepath.Join(dir, "two")
+	os.WriteFile(one, []byte("x\ny\nx\n"), 0o644)
+	os.WriteFile(two, []byte("z\nx\n"), 0o644)
+	out, _, _ = runDup(t, "", "-format", "json", "-file-counts", one, two)
+	got = decodeJSON(t, out)
+	want := []dupLine{{Line: "x", Count: 3, Files: map[string]int{one: 2, two: 1}, Locations: []location{{one, 1}, {one, 3}, {two, 2}}}}
+	if !reflect.DeepEqual(got.Duplicates, want) {
+		t.Errorf("-format json duplicates %+v, want %+v", got.Duplicates, want)
+	}
+}
+
+func TestNormalizeLine(t *testing.T) {
+	// each composed (NFC) and decomposed (NFD), and some in other cases
+	tests := []struct{ a, b string }{
+		{"caf\u00e9", "cafe\u0301"},
+		{"CAF\u00c9", "cafe\u0301"},
+		{"\u00d1and\u00fa", "n\u0303andu\u0301"},
+		{"fa\u00e7ade", "fac\u0327ade"},
+		{"\u00c5ngstr\u00f6m", "A\u030angstro\u0308m"},
+		{"na\u00efve", "NAI\u0308VE"},
+		{"\u00ff", "y\u0308"},
+	}
+	for _, tt := range tests {
+		if normalizeLine(tt.a) != normalizeLine(tt.b) {
+			t.Errorf("normalizeLine(%q) = %q but normalizeLine(%q) = %q, want them the same", tt.a, normalizeLine(tt.a), tt.b, normalizeLine(tt.b))
+		}
+	}
+	// an accent composed doesn't know how to put on a letter is left where it is
+	for in, want := range map[string]string{
+		"q\u0301":       "Q\u0301",
+		"\u0301a":       "\u0301A",
+		"e\u0301\u0301": "\u00c9\u0301",
+	} {
+		if got := normalizeLine(in); got != want {
+			t.Errorf("normalizeLine(%+q) = %+q, want %+q", in, got, want)
+		}
+	}
+	// past Latin-1 the two spellings stay apart, that would take the real NFC tables
+	for _, tt := range []struct{ a, b string }{
+		{"\u0151", "o\u030b"},             // ő, o with a double acute
+		{"Vi\u1ec7t", "Vie\u0323\u0302t"}, // ệ, e with a dot below and a circumflex
+		{"\ud55c", "\u1112\u1161\u11ab"},  // 한 and its jamo
+		{"stra\u00dfe", "STRASSE"},        // only simple case folding, ß isn't ss
+	} {
+		if normalizeLine(tt.a) == normalizeLine(tt.b) {
+			t.Errorf("normalizeLine(%+q) and normalizeLine(%+q) are both %+q, the doc says they aren't", tt.a, tt.b, normalizeLine(tt.a))
+		}
+	}
+}
+
+// TestNormalize counts the same words typed composed (NFC) and decomposed (NFD), in either case,
+// as one line under its first spelling
+func TestNormalize(t *testing.T) {
+	nfc, nfd := "Crème brûlée à la française", "Cre\u0300me bru\u0302le\u0301e a\u0300 la franc\u0327aise"
+	in := nfc + "\n" + nfd + "\n" + strings.ToUpper(nfd) + "\nother\n"
+	if got, _, _ := runDup(t, in); got != "" {
+		t.Errorf("without -normalize the spellings are different lines, got %q", got)
+	}
+	if got, _, _ := runDup(t, in, "-normalize"); got != "3\t"+nfc+"\n" {
+		t.Errorf("-normalize = %q, want all three under the first spelling", got)
+	}
+	if got, _, _ := runDup(t, nfd+"\n"+nfc+"\n", "-normalize"); got != "2\t"+nfd+"\n" {
+		t.Errorf("-normalize with NFD first = %q, want it printed as NFD", got)
+	}
+}
+
+// TestField counts the columns of CSV-like input, each on its own
+func TestField(t *testing.T) {
+	in := "id,user,status\n1,ann,ok\n2,bob,fail\n3,ann,ok\n4,cy,ok\n5,bob,\n6\n"
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-field", "2", "-fieldsep", ","}, []string{"2\tann", "2\tbob"}},
+		{[]string{"-f", "3", "-d", ","}, []string{"3\tok"}},
+		// 5,bob, has an empty third field, and 6 has none at all unless -short-lines empty
+		{[]string{"-f", "3", "-d", ",", "-min", "1", "-short-lines", "empty"}, []string{"1\tfail", "1\tstatus", "2\t", "3\tok"}},
+		{[]string{"-f", "1", "-d", ","}, nil},
+	}
+	for _, tt := range tests {
+		out, errOut, code := runDup(t, in, tt.args...)
+		if code != 0 {
+			t.Fatalf("%v: exit %d: %s", tt.args, code, errOut)
+		}
+		if got := sorted(out); !slices.Equal(got, tt.want) {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// without -fieldsep the columns are split like awk does, on runs of spaces and tabs
+	out, _, _ := runDup(t, "GET  /a 200\nPOST\t/a  404\nGET /b 200\n  GET /c 500\n", "-f", "1")
+	if got, want := sorted(out), []string{"3\tGET"}; !slices.Equal(got, want) {
+		t.Errorf("-f 1 on spaces = %q, want %q", got, want)
+	}
+	out, _, _ = runDup(t, "GET  /a 200\nPOST\t/a  404\nGET /b 200\n", "-f", "2", "-original")
+	if got, want := sorted(out), []string{"2\tGET  /a 200"}; !slices.Equal(got, want) {
+		t.Errorf("-f 2 -original = %q, want %q", got, want)
+	}
+}
+
+// TestWatch changes a file under -watch: the counts are printed again, with the new lines in them
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "in")
+	if err := os.WriteFile(name, []byte("a\na\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	cmd := dupCmd("", "-watch", "-sort", "count", name)
+	cmd.Stdout = out
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	// every run ends with a line on stderr
+	runs := make(chan string)
+	go func() {
+		scan := bufio.NewScanner(stderr)
+		for scan.Scan() {
+			runs <- scan.Text()
+		}
+		close(runs)
+	}()
+	waitRun := func() {
+		t.Helper()
+		select {
+		case line := <-runs:
+			if !strings.Contains(line, "watching 1 file(s)") {
+				t.Fatalf("stderr %q", line)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("no run")
+		}
+	}
+	printed := func() string {
+		b, _ := os.ReadFile(out.Name())
+		return string(b)
+	}
+
+	waitRun()
+	if got := printed(); got != "2\ta\n" {
+		t.Fatalf("first run printed %q", got)
+	}
+	if err := os.WriteFile(name, []byte("a\na\nb\nb\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitRun()
+	if got, want := printed(), "2\ta\n3\tb\n2\ta\n"; got != want {
+		t.Errorf("after the change the output is %q, want %q", got, want)
+	}
+
+	cmd.Process.Signal(os.Interrupt)
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("after Ctrl-C: %v", err)
+	}
+}
+
+func TestLookupJSON(t *testing.T) {
+	tests := []struct {
+		line, path string
+		want       string
+		found      bool
+		err        bool
+	}{
+		{`{"user":{"id":"u1"}}`, "user.id", "u1", true, false},
+		{`{"user":{"id":7}}`, "user.id", "7", true, false},
+		{`{"items":[{"id":1},{"id":2}]}`, "items.1.id", "2", true, false},
+		{`{"items":[{"id":1}]}`, "items.5.id", "", false, false},
+		{`{"items":[{"id":1}]}`, "items.x", "", false, false},
+		{`{"user":"u1"}`, "user.id", "", false, false},
+		{`{"a":{"y":2,"x":1}}`, "a", `{"x":1,"y":2}`, true, false},
+		{`{"a":null}`, "a", "null", true, false},
+		{`{"a":true}`, "a", "true", true, false},
+		// past 2^53 a float64 would make these two the same number
+		{`{"id":9007199254740993}`, "id", "9007199254740993", true, false},
+		{`{"id":1.50}`, "id", "1.50", true, false},
+		{`not json`, "a", "", false, true},
+		{`{"a":1} {"a":2}`, "a", "", false, true},
+		{`{"a":1}]`, "a", "", false, true},
+		{"{\"a\":1}  \t", "a", "1", true, false},
+	}
+	for _, tt := range tests {
+		got, found, err := lookupJSON(tt.line, tt.path)
+		if got != tt.want || found != tt.found || (err != nil) != tt.err {
+			t.Errorf("lookupJSON(%q, %q) = %q, %t, %v, want %q, %t, error %t", tt.line, tt.path, got, found, err, tt.want, tt.found, tt.err)
+		}
+	}
+}
+
+// TestJSONPath counts a nested field of NDJSON: lines without it are skipped quietly, lines that
+// aren't JSON with a warning, or with -strict they stop the run
+func TestJSONPath(t *testing.T) {
+	in := `{"req":{"user":{"id":"ann"}},"n":1}
+{"req":{"user":{"id":"bob"}},"n":2}
+{"req":{"user":{"id":"ann"}},"n":3}
+{"req":{}}
+not json
+{"req":{"user":{"id":"ann"}}}
+`
+	out, errOut, code := runDup(t, in, "-jsonpath", "req.user.id")
+	if code != 0 || out != "3\tann\n" {
+		t.Errorf("-jsonpath = %q, exit %d, want 3 ann", out, code)
+	}
+	if !strings.Contains(errOut, "dup1: line 5: not JSON") || strings.Count(errOut, "\n") != 1 {
+		t.Errorf("stderr %q, want one warning for line 5", errOut)
+	}
+	if out, errOut, code := runDup(t, in, "-jsonpath", "req.user.id", "-strict"); code != 2 || out != "" || !strings.Contains(errOut, "line 5") {
+		t.Errorf("-strict: %q, exit %d, %q, want nothing and exit 2", out, code, errOut)
+	}
+}
+
+// TestPerFile checks each file's own figures: a line repeated only across the two files is a
+// duplicate overall, but not within either of them
+func TestPerFile(t *testing.T) {
+	dir := t.TempDir()
+	one, two := filepath.Join(dir, "one"), filepath.Join(dir, "two")
+	os.WriteFile(one, []byte("a\na\nb\nshared\n"), 0o644)
+	os.WriteFile(two, []byte("shared\nc\nd\nd\nd\n"), 0o644)
+
+	out, errOut, code := runDup(t, "", "-per-file", "-sort", "count", one, two)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	want := "3\td\n2\ta\n2\tshared\n" +
+		"file\tlines\tdistinct\tduplicated\n" +
+		one + "\t4\t3\t1\n" +
+		two + "\t5\t3\t1\n"
+	if out != want {
+		t.Errorf("-per-file:\n%s\nwant\n%s", out, want)
+	}
+
+	out, _, _ = runDup(t, "", "-per-file", "-json", one, two)
+	got := decodeJSON(t, out)
+	wantFiles := []jsonFile{{one, jsonStats{4, 3, 1, 0.25}}, {two, jsonStats{5, 3, 1, 0.4}}}
+	if !reflect.DeepEqual(got.Files, wantFiles) {
+		t.Errorf("-per-file -json files %+v, want %+v", got.Files, wantFiles)
+	}
+
+	if _, errOut, code := runDup(t, "a\n", "-per-file"); code != 2 || !strings.Contains(errOut, "-per-file needs file arguments") {
+		t.Errorf("-per-file over stdin: exit %d, %q", code, errOut)
+	}
+}
+
+func TestDedupInPlace(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+		args           []string
+		report         string
+		backup         bool
+	}{
+		{"keeps first copies in order", "b\na\nb\nc\na\n", "b\na\nc\n", nil, "removed 2 duplicate lines from %s, 3 left\n", true},
+		{"no backup", "a\na\n", "a\n", []string{"-no-backup"}, "removed 1 duplicate lines from %s, 1 left\n", false},
+		{"crlf kept", "a\r\nb\r\na\r\n", "a\r\nb\r\n", nil, "removed 1 duplicate lines from %s, 2 left\n", true},
+		{"last line without newline", "a\nb\na", "a\nb\n", nil, "removed 1 duplicate lines from %s, 2 left\n", true},
+		{"nothing to remove", "a\nb\n", "a\nb\n", nil, "removed 0 duplicate lines from %s, 2 left\n", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "lines")
+			if err := os.WriteFile(name, []byte(tc.in), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			out, errOut, code := runDup(t, "", append(append([]string{}, tc.args...), "-dedup-in-place", name)...)
+			if code != 0 {
+				t.Fatalf("exit %d: %s", code, errOut)
+			}
+			if want := fmt.Sprintf(tc.report, name); out != want {
+				t.Errorf("printed %q, want %q", out, want)
+			}
+			got, _ := os.ReadFile(name)
+			if string(got) != tc.want {
+				t.Errorf("file is %q, want %q", got, tc.want)
+			}
+			if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0o640 {
+				t.Errorf("file mode %v, %v, want 0640", fi.Mode().Perm(), err)
+			}
+			bak, err := os.ReadFile(name + ".bak")
+			if tc.backup {
+				if string(bak) != tc.in {
+					t.Errorf("backup is %q, %v, want %q", bak, err, tc.in)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("backup made: %q, %v", bak, err)
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(name)); len(entries) > 2 {
+				t.Errorf("left behind %v", entries)
+			}
+		})
+	}
+
+	if _, errOut, code := runDup(t, "a\n", "-dedup-in-place", "-"); code != 2 || !strings.Contains(errOut, "one real file") {
+		t.Errorf("-dedup-in-place -: exit %d, %q", code, errOut)
+	}
+}
+
+func TestTopMinSort(t *testing.T) {
+	in := "b\nc\na\nb\nc\na\nd\nd\nd\nb\nc\ne\ne\ne\ne\nf\n"
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		// b and c tie on 3, and ties go by line
+		{[]string{"-sort", "count"}, "4\te\n3\tb\n3\tc\n3\td\n2\ta\n"},
+		{[]string{"-sort", "line"}, "2\ta\n3\tb\n3\tc\n3\td\n4\te\n"},
+		{[]string{"-sort", "count", "-min", "3"}, "4\te\n3\tb\n3\tc\n3\td\n"},
+		{[]string{"-sort", "count", "-min", "1"}, "4\te\n3\tb\n3\tc\n3\td\n2\ta\n1\tf\n"},
+		// -top keeps the most repeated, and the tie at the cut goes to the first line
+		{[]string{"-top", "2"}, "4\te\n3\tb\n"},
+		{[]string{"-top", "3", "-sort", "line"}, "3\tb\n3\tc\n4\te\n"},
+		{[]string{"-top", "10", "-min", "4"}, "4\te\n"},
+	} {
+		out, errOut, code := runDup(t, in, tc.args...)
+		if code != 0 {
+			t.Errorf("%v: exit %d: %s", tc.args, code, errOut)
+			continue
+		}
+		if out != tc.want {
+			t.Errorf("%v printed\n%s\nwant\n%s", tc.args, out, tc.want)
+		}
+	}
+
+	for _, args := range [][]string{{"-min", "0"}, {"-top", "-1"}, {"-sort", "size"}} {
+		if _, errOut, code := runDup(t, in, args...); code != 2 || !strings.Contains(errOut, "-sort is count or line") {
+			t.Errorf("%v: exit %d, %q", args, code, errOut)
+		}
+	}
+}
+
+func TestSimhash(t *testing.T) {
+	same := [][2]string{
+		{"2024-01-02 10:00:01 user 17 logged in", "2024-03-09 23:59:59 user 4021 logged in"},
+		{"request id=8812 took 35ms", "request id=9 took 1200ms"},
+		{"GET /items/12", "GET /items/340"},
+	}
+	for _, p := range same {
+		if a, b := simhash(p[0]), simhash(p[1]); a != b {
+			t.Errorf("simhash(%q) and simhash(%q) differ in %d bits, want none", p[0], p[1], bits.OnesCount64(a^b))
+		}
+	}
+	a, b := simhash("connection reset by peer while reading the response"), simhash("disk quota exceeded for the backup volume")
+	if d := bits.OnesCount64(a ^ b); d <= 6 {
+		t.Errorf("unrelated lines differ in only %d bits", d)
+	}
+}
+
+func TestFuzzy(t *testing.T) {
+	in := "2024-01-02 10:00:01 user 17 logged in\n" +
+		"disk quota exceeded for the backup volume\n" +
+		"2024-01-02 10:00:07 user 4021 logged in\n" +
+		"2024-01-02 10:00:01 user 17 logged in\n" +
+		"connection reset by peer while reading the response\n" +
+		"disk quota exceeded for the backup volume\n" +
+		"2024-01-02 11:30:00 user 5 logged in\n"
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		// four lines, three of them different, and the first is the one printed
+		{nil, "4\t3\t2024-01-02 10:00:01 user 17 logged in\n2\t1\tdisk quota exceeded for the backup volume\n"},
+		{[]string{"-min", "1", "-sort", "line"}, "4\t3\t2024-01-02 10:00:01 user 17 logged in\n" +
+			"1\t1\tconnection reset by peer while reading the response\n" +
+			"2\t1\tdisk quota exceeded for the backup volume\n"},
+		{[]string{"-top", "1"}, "4\t3\t2024-01-02 10:00:01 user 17 logged in\n"},
+		// the numbers are gone before hashing, so even a threshold of 1 groups the logins
+		{[]string{"-fuzzy-threshold", "1"}, "4\t3\t2024-01-02 10:00:01 user 17 logged in\n2\t1\tdisk quota exceeded for the backup volume\n"},
+		// and one so low that nearly any two hashes are close enough puts everything in one group
+		{[]string{"-fuzzy-threshold", "0.01"}, "7\t5\t2024-01-02 10:00:01 user 17 logged in\n"},
+	} {
+		out, errOut, code := runDup(t, in, append([]string{"-fuzzy"}, tc.args...)...)
+		if code != 0 {
+			t.Errorf("%v: exit %d: %s", tc.args, code, errOut)
+			continue
+		}
+		if out != tc.want {
+			t.Errorf("-fuzzy %v printed\n%s\nwant\n%s", tc.args, out, tc.want)
+		}
+	}
+
+	for _, args := range [][]string{{"-fuzzy-threshold", "0"}, {"-fuzzy-threshold", "1.5"}, {"-json"}, {"-window", "3"}} {
+		if _, errOut, code := runDup(t, in, append([]string{"-fuzzy"}, args...)...); code != 2 || !strings.Contains(errOut, "-fuzzy-threshold has to be above 0") {
+			t.Errorf("-fuzzy %v: exit %d, %q", args, code, errOut)
+		}
+	}
+}
+
+// nearDups is n log lines made from groups different lines, each written out again and again
+// with its numbers changed, the input -fuzzy is for
+func nearDups(n, groups int) string {
+	words := strings.Fields(`request user cache disk timeout retry session upload queue worker token
+		expired failed started finished connection backup volume quota reset peer reading response
+		client server proxy gateway header cookie login logout invoice payment order refund customer
+		account profile search index shard replica leader follower snapshot`)
+	// a fixed seed, so every run of the benchmark gets the same input
+	rnd := rand.New(rand.NewPCG(1, 2))
+	templates := make([]string, groups)
+	for i := range templates {
+		pick := make([]string, 8)
+		for j := range pick {
+			pick[j] = words[rnd.IntN(len(words))]
+		}
+		templates[i] = strings.Join(pick, " ")
+	}
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "2024-01-02 10:%02d:%02d %s id=%d took %dms\n", i/60%60, i%60, templates[i%groups], i*31, i%997)
+	}
+	return b.String()
+}
+
+func BenchmarkSimhash(b *testing.B) {
+	line := canonical("2024-01-02 10:00:01 GET /items/340 user 4021 took 35ms from 10.0.0.7")
+	b.ReportAllocs()
+	for b.Loop() {
+		simhash(line)
+	}
+}
+
+// BenchmarkFuzzyDups runs -fuzzy over a few thousand near duplicate lines, against
+// BenchmarkFuzzyPairwise, which groups them by comparing each line with every group
+func BenchmarkFuzzyDups(b *testing.B) {
+	benchmarkFuzzy(b, func(in string) { fuzzyDups(strings.NewReader(in), 0.9) })
+}
+
+func BenchmarkFuzzyPairwise(b *testing.B) {
+	benchmarkFuzzy(b, func(in string) { pairwiseGroups(in, 0.9) })
+}
+
+func benchmarkFuzzy(b *testing.B, group func(string)) {
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	var err error
+	if os.Stdout, err = os.Open(os.DevNull); err != nil {
+		b.Fatal(err)
+	}
+	for _, groups := range []int{10, 1000} {
+		in := nearDups(5000, groups)
+		b.Run(strconv.Itoa(groups)+"groups", func(b *testing.B) {
+			for b.Loop() {
+				group(in)
+			}
+		})
+	}
+}
+
+// pairwiseGroups is what fuzzyDups would be without its band index: each new line is compared
+// with the first line of every group so far. it returns how many groups there were
+func pairwiseGroups(in string, threshold float64) int {
+	maxDist := int((1 - threshold) * 64)
+	var hashes []uint64
+	exact := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(in, "\n"), "\n") {
+		key := canonical(line)
+		if exact[key] {
+			continue
+		}
+		exact[key] = true
+		h := simhash(key)
+		found := false
+		for _, g := range hashes {
+			if bits.OnesCount64(h^g) <= maxDist {
+				found = true
+				break
+			}
+		}
+		if !found {
+			hashes = append(hashes, h)
+		}
+	}
+	return len(hashes)
+}
+
+// TestLongLine checks a line too long for the scanner stops the count with exit 2, in every mode
+// that scans, instead of quietly counting half the input
+func TestLongLine(t *testing.T) {
+	in := "a\na\n" + strings.Repeat("x", bufio.MaxScanTokenSize+1) + "\na\n"
+	name := filepath.Join(t.TempDir(), "long")
+	if err := os.WriteFile(name, []byte(in), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		nil,
+		{"-emit-unique"},
+		{"-hash"},
+		{"-window", "3"},
+		{"-fuzzy"},
+		{"-per-file", name},
+		{"-p", "2", name, name},
+	} {
+		_, errOut, code := runDup(t, in, args...)
+		if code != 2 || !strings.Contains(errOut, bufio.ErrTooLong.Error()) {
+			t.Errorf("%v: exit %d, %q, want exit 2 with %q", args, code, errOut, bufio.ErrTooLong)
+		}
+	}
+}
+
+// TestExitStatus checks the CI statuses are only there when asked for: a plain run exits 0
+// whatever it finds, -fail and -q exit 1 on duplicates, and -q prints nothing
+func TestExitStatus(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		args []string
+		code int
+		out  string
+	}{
+		{"a\nb\na\n", nil, 0, "2\ta\n"},
+		{"a\nb\n", nil, 0, ""},
+		{"a\nb\na\n", []string{"-fail"}, 1, "2\ta\n"},
+		{"a\nb\n", []string{"-fail"}, 0, ""},
+		{"a\nb\na\n", []string{"-q"}, 1, ""},
+		{"a\nb\n", []string{"-q"}, 0, ""},
+	} {
+		out, errOut, code := runDup(t, tt.in, tt.args...)
+		if code != tt.code || out != tt.out {
+			t.Errorf("%v on %q: exit %d, %q, want exit %d, %q\n%s", tt.args, tt.in, code, out, tt.code, tt.out, errOut)
+		}
+	}
+}
+
+// TestLatin1Counts counts a Latin-1 file, testdata/latin1.txt, which has café three times, CAFÉ
+// once and naïve twice. the lines are decoded before anything is compared, so -i can fold É
+// and what is printed is UTF-8
+func TestLatin1Counts(t *testing.T) {
+	name := filepath.Join("testdata", "latin1.txt")
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "3\tcafé\n2\tnaïve\n"},
+		{[]string{"-i"}, "4\tcafé\n2\tnaïve\n"},
+		{[]string{"-p", "2", name}, "6\tcafé\n4\tnaïve\n2\tCAFÉ\n2\tplain\n2\trésumé\n"},
+	} {
+		args := append([]string{"-encoding", "latin1", "-sort", "count"}, tt.args...)
+		out, errOut, code := runDup(t, "", append(args, name)...)
+		if code != 0 {
+			t.Fatalf("%v: exit %d: %s", tt.args, code, errOut)
+		}
+		if out != tt.want {
+			t.Errorf("%v printed %q, want %q", tt.args, out, tt.want)
+		}
+	}
+	// as raw bytes the lines still match, but what is printed isn't UTF-8
+	out, _, _ := runDup(t, "", "-sort", "count", name)
+	if out != "3\tcaf\xe9\n2\tna\xefve\n" {
+		t.Errorf("without -encoding printed %q", out)
+	}
+}
@@ -1,24 +1,15 @@
-// Dup v1 prints the text of each line that appears more than once in the standard input, preceeded by its count
+// Dup v1 prints the text of each line that appears more than once in the standard input (or the files named), preceeded by its count
+//
+// the program itself is package dup, so gopltool can run it as gopltool dup. its flags are
+// described there
 package main
 
 import (
-	"fmt"
-	"bufio"
 	"os"
+
+	"gopl/chapter-one/1.3/code/dup-v1/dup"
 )
 
 func main() {
-	counts := make(map[string]int)
-
-	input := bufio.NewScanner(os.Stdin)
-
-	for input.Scan() {
-		counts[input.Text()]++
-	}
-
-	for line, n := range counts {
-		if n > 1 {
-			fmt.Printf("%d\t%s\n", n, line)
-		}
-	}
-}
\ No newline at end of file
+	dup.Main(os.Args[1:])
+}
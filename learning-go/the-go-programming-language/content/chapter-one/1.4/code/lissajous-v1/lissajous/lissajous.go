@@ -0,0 +1,78 @@
+// Package lissajous generates GIF animations of random Lissajous figures. it is the program from
+// section 1.4 with its constants turned into Params, so the server in section 1.7 can draw the
+// same thing with the knobs coming from the query string instead of keeping a copy of its own.
+package lissajous
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+	"math/rand"
+)
+
+var palette = []color.Color{color.White, color.Black}
+
+// []color.Color{...} is a composite literal (more specifically a slice), which is just compact notation for creating any composite data type in Go
+// all pixels in the palette are initialized to be the first color in the palette, which ours is White.
+
+const (
+	whiteIndex = 0 // first color in palette
+	blackIndex = 1 // second color in palette
+)
+
+// Params are the knobs of the animation, which were constants in the book.
+type Params struct {
+	Cycles  int     // number of complete x oscillator revolutions
+	Res     float64 // angular resolution
+	Size    int     // image canvas covers [-size..+size]
+	NFrames int     // number of animation frames
+	Delay   int     // delay between frames in 10ms units
+}
+
+// Defaults are the book's constants.
+var Defaults = Params{Cycles: 5, Res: 0.001, Size: 100, NFrames: 64, Delay: 8}
+
+// Bytes is about how much memory Lissajous needs for p: every frame is kept until the GIF
+// is encoded, at one byte per pixel.
+func Bytes(p Params) int64 {
+	side := int64(2*p.Size + 1)
+	return side * side * int64(p.NFrames)
+}
+
+// Lissajous writes the animation for p to out.
+func Lissajous(out io.Writer, p Params) error {
+	freq := rand.Float64() * 3.0
+	anim := gif.GIF{LoopCount: p.NFrames}
+	// this is also a composite literal (more specifically a struct)
+	// anim is a struct of type gif.GIF
+	// this declaration creates a struc that sets LoopCount to the value of nframes. all other fields in the struct are set to 0 of their type
+	phase := 0.0
+	size := float64(p.Size)
+
+	// this is 2 nested for loops.
+	for i := 0; i < p.NFrames; i++ {
+		// with the defaults nframes is 64, so this outer for loop iterates 64 times, which produces each frame.
+
+		rect := image.Rect(0, 0, 2*p.Size+1, 2*p.Size+1)
+		// this rect creates a white palette that is 201x201 with the defaults
+		img := image.NewPaletted(rect, palette)
+		// we place this palette, which is white and black, onto this white rectangle
+
+		for t := 0.0; t < float64(p.Cycles)*2*math.Pi; t += p.Res {
+			// this inner for loop generates a new image and sets some of our pixels to black
+			x := math.Sin(t)
+			y := math.Sin(t*freq + phase)
+			img.SetColorIndex(p.Size+int(x*size+0.5), p.Size+int(y*size+0.5), blackIndex)
+		}
+		phase += 0.1
+		// we append the black pixels to the image using append and we append it to our anim struct. we then also append the delay (80ms with the defaults).
+		anim.Delay = append(anim.Delay, p.Delay)
+		anim.Image = append(anim.Image, img)
+	}
+
+	// anim is encoded into GIF format and written to the output stream "out".
+	// out is of type io.Writer which lets us write out to destinations
+	return gif.EncodeAll(out, &anim)
+}
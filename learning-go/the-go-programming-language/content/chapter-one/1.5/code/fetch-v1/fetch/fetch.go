@@ -0,0 +1,2532 @@
+// Package fetch is fetch-v1, which prints the content found at a URL.
+//
+// exit codes, so scripts can tell failures apart:
+//
+//	0 every URL was fetched
+//	1 usage error (bad flags, no URLs)
+//	2 connection or transport error
+//	3 timeout
+//	4 non-2xx response with -fail or -interval, or a status -expect-status didn't allow,
+//	  or a header that failed an -expect-header check
+//	5 body bigger than -max or smaller than -min-bytes, the download was declined at the -head-first prompt,
+//	  or -O didn't overwrite a file that was already there
+//	6 the body didn't match -sha256
+//	7 the pager failed, or the -pipe command was killed by a signal (its own exit status is printed)
+//
+// a -pipe command that exits with a status of its own passes it on, so fetch -pipe 'grep -q x'
+// exits 1 like grep does when x isn't there.
+//
+// when more than one URL fails the highest code wins.
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"gopl/chapter-one/fetchlib"
+	"gopl/chapter-one/internal/cli"
+)
+
+const (
+	exitOK = iota
+	exitUsage
+	exitTransport
+	exitTimeout
+	exitHTTP
+	exitSkipped
+	exitChecksum
+	exitPipe
+)
+
+// Flags are fetch's flags, parsed by Main
+var Flags = cli.NewFlagSet("fetch")
+
+var fail = Flags.Bool("fail", false, "treat a non-2xx response as an error and skip its body (-expect-status, when given, decides instead)")
+var expectStatus = Flags.String("expect-status", "", "exit 4 unless the status is exactly this, like 204, or in a class like 2xx")
+var timeout = Flags.Duration("timeout", 0, "give up on a request after this long (0 means no limit)")
+var data = Flags.String("d", "", "send this as the request body with a POST (@FILE sends the file, @- standard input)")
+var stdinBody = Flags.Bool("stdin-body", false, "read the request body from standard input and send it with a POST")
+
+var headFirst = Flags.Bool("head-first", false, "send a HEAD first, show the size and type, and ask before downloading")
+var maxSize = Flags.Int64("max", 0, "refuse bodies bigger than this many bytes (0 means no limit)")
+
+// a 200 with an empty or cut-short body is the failure a status check can't see. together with
+// -max this makes a window the body size has to land in
+var minBytes = Flags.Int64("min-bytes", 0, "exit 5 if the body is smaller than this many bytes")
+var pretty = Flags.Bool("pretty", false, "indent JSON responses")
+
+// these change the body on its way out, after -sha256, -min-bytes and -cache have seen it as it
+// came. Go's transport already asks for gzip and unpacks it by itself, but it never asks for
+// deflate, and it leaves the body alone as soon as Accept-Encoding is set with -H
+var compressed = Flags.Bool("compressed", false, "ask for a gzip or deflate body and decompress it, like curl --compressed")
+var toUTF8 = Flags.Bool("utf8", false, "convert a body in the charset its Content-Type names (windows-1252, latin1, utf-16) to UTF-8")
+var plainText = Flags.Bool("text", false, "turn HTML into plain text, dropping its tags, scripts and styles")
+var yes = Flags.Bool("yes", false, "don't ask at the -head-first prompt, just download")
+var include = Flags.Bool("i", false, "print the status line and response headers before the body, like curl -i")
+var drain = Flags.Bool("drain", true, "read what is left of a body we don't use, so its connection can be reused")
+var human = Flags.Bool("h", false, "show sizes in KiB, MiB and GiB instead of bytes")
+var pipe = Flags.String("pipe", "", "send the body through this shell command, like gunzip or \"jq .\", and print what it prints")
+var output = Flags.String("o", "", "write the body to this file instead of stdout")
+
+// -O is wget's way: the file is named by the server's Content-Disposition or the last part of
+// the URL's path, in the current directory. a name picked by someone else shouldn't quietly
+// replace a file we had, so an existing one is left alone unless -clobber
+var remoteName = Flags.Bool("O", false, "write each body to a file named after the URL (or Content-Disposition) instead of stdout")
+var clobber = Flags.Bool("clobber", false, "with -O, overwrite a file that is already there")
+
+// like git, a text body printed to a terminal goes through $PAGER (less -R when it isn't set)
+var noPager = Flags.Bool("no-pager", false, "print straight to the terminal instead of through $PAGER")
+var gzipOutput = Flags.Bool("gzip-output", false, "gzip what -o or -O writes, adding .gz to the name if it isn't there")
+var resume = Flags.Bool("continue", false, "with -o, pick a partial file up where it stopped with a Range request, like curl -C -")
+
+// -segments N downloads a big file over N connections at once, each one asking for its own
+// byte range. the pieces are written straight into their place in FILE.part, and FILE.part.state
+// says how far each one got, so running the same command again after a crash or a Ctrl-C only
+// asks for what is still missing. the server has to say Accept-Ranges: bytes on a HEAD, with a
+// Content-Length, otherwise it is a normal download
+var segments = Flags.Int("segments", 0, "with -o, download in this many byte ranges at once (0 or 1 means one request)")
+
+var limitRate = Flags.Int64("limit-rate", 0, "read the body at no more than this many bytes per second (0 means no limit)")
+var sha = Flags.String("sha256", "", "check the body against this hex SHA-256, printing the body's to stderr either way (- only prints it)")
+
+// a bare host like golang.org gets https:// put in front of it. -http-fallback is for the
+// odd server that still only speaks plain http: when https:// can't get through, http:// is tried
+var httpFallback = Flags.Bool("http-fallback", false, "when https:// fails for a URL given without a scheme, try it again with http://")
+
+// inferred are the URLs withScheme put https:// on, the only ones -http-fallback may touch
+var inferred = make(map[string]bool)
+
+// -cache keeps every body that came with an ETag or a Last-Modified, and asks the server next
+// time whether it has changed. a 304 means the copy on disk is printed, so a URL that is
+// fetched over and over only costs a round trip. -cache-size caps the bodies, the ones used
+// longest ago are thrown out first
+var cacheDir = Flags.String("cache", "", "keep bodies in this directory and only download them again when they have changed")
+var cacheSize = Flags.Int64("cache-size", 100<<20, "with -cache, the most bytes of bodies to keep")
+
+// redirects are followed like a browser does unless -L=false says not to, which is curl's default
+// the other way round. -show-redirects prints every hop to stderr, with how long that hop took
+var followRedirects = Flags.Bool("L", true, "follow redirects (-L=false prints the redirect response itself)")
+var maxRedirects = Flags.Int("max-redirs", 10, "give up after following this many redirects")
+var showRedirects = Flags.Bool("show-redirects", false, "print the status, Location and time of every redirect followed to stderr")
+var timings = Flags.Bool("timings", false, "print DNS, connect, TLS, first byte and total times to stderr, like curl -w")
+var tlsMin = Flags.String("tls-min", "1.2", "oldest TLS version to accept: 1.2 or 1.3")
+
+// without -proxy the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used, like curl does
+var proxy = Flags.String("proxy", "", "send requests through this proxy: http://, https:// or socks5://host:port")
+
+var localAddr = Flags.String("local-addr", "", "make outgoing connections from this local IP, for machines with more than one")
+
+// -host is for virtual hosts: the connection still goes where the URL (or -resolve) points, but
+// the server is told it is being asked for another name. the TLS server name follows -host,
+// and the certificate is checked against it, unless -sni gives one of its own
+var hostHeader = Flags.String("host", "", "send this as the Host header, and as the TLS server name, instead of the URL's host")
+var sni = Flags.String("sni", "", "TLS server name to send and check the certificate against, when it should differ from -host")
+
+// resolve pins host:port to an address of our own choosing, like curl --resolve. only the
+// connection goes there: the Host header and the TLS server name are still the URL's host
+var resolve = fetchlib.Resolve{}
+
+// pins are the -pin hashes, see fetchlib.Pins
+var pins fetchlib.Pins
+
+func init() {
+	Flags.Var(&pins, "pin", "only accept a server whose certificate has this public key, as a base64 or hex SHA-256 of its SPKI, or sha256//base64 like curl (can be repeated, for backup keys)")
+}
+
+func init() {
+	Flags.Var(resolve, "resolve", "connect to addr for host:port, given as host:port:addr (can be repeated)")
+}
+
+// -X, -H and -u make fetch good enough to poke at an API with. -X wins over the GET or POST
+// fetch would pick, and a -H header wins over one fetch sets itself, like the Content-Type of -d
+var method = Flags.String("X", "", "send this method, like PUT or DELETE, instead of GET (or POST with a body)")
+var basicAuth = Flags.String("u", "", "send user:password as HTTP basic auth")
+
+// requestHeaders are the -H headers, added to every request fetch sends
+var requestHeaders headerList
+
+func init() {
+	Flags.Var(&requestHeaders, "H", "send this header, given as \"Key: Value\" (\"Key:\" with no value leaves out one fetch would send, can be repeated)")
+}
+
+// expectHeaders are the -expect-header checks, so a fetch can double as a tiny API contract test
+var expectHeaders headerChecks
+
+func init() {
+	Flags.Var(&expectHeaders, "expect-header", "exit 4 unless header Key contains substring, given as \"Key: substring\" (\"!Key\" means it must be missing, can be repeated)")
+}
+
+// the phase timeouts are separate from each other: -connect-timeout is just the TCP connect, and
+// -response-header-timeout starts once the request is written and stops when the headers arrive.
+// -timeout covers the whole request, body included, so whichever runs out first wins
+var connectTimeout = Flags.Duration("connect-timeout", 0, "give up on connecting after this long (0 means the default of 30s)")
+var headerTimeout = Flags.Duration("response-header-timeout", 0, "give up waiting for the response headers after this long (0 means no limit)")
+var interval = Flags.Duration("interval", 0, "keep fetching every interval and print a status line instead of the body")
+var pollCount = Flags.Int("count", 0, "with -interval, stop after this many rounds (0 means until Ctrl-C)")
+
+// the first request to a host pays for DNS, the TCP connect and the TLS handshake, which makes
+// it look slow next to the rest. -warmup gets that out of the way before anything is counted
+var warmup = Flags.Int("warmup", 0, "with -interval, send this many requests to each URL first and leave them out of the output and the summary")
+
+// -serve replays a remote response from a local listener, handy for testing against something
+// that is slow, flaky or only online some of the time
+var serveAddr = Flags.String("serve", "", "fetch the URL once and serve that body on this address, like :8080")
+var refresh = Flags.Duration("refresh", 0, "with -serve, fetch the URL again this often (0 means never)")
+
+func init() {
+	Flags.BoolVar(timings, "w", false, "short for -timings")
+}
+
+// expectLo and expectHi are -expect-status as a range, so 2xx is 200 to 299 and 204 is 204 to 204
+var expectLo, expectHi int
+
+// stdin is shared so answers to several -head-first prompts come from the same buffer
+var stdin = bufio.NewReader(os.Stdin)
+
+// body is the request body from -d or -stdin-body, nil when we only GET
+var body []byte
+
+// resumeFrom is the size of the partial -o file with -continue. do asks for the bytes from there on
+var resumeFrom int64
+
+// ifRange is the ETag or Last-Modified the partial file was downloaded with. sent as If-Range,
+// it makes the server send the rest only if the file hasn't changed, and all of it if it has
+var ifRange string
+
+// ifNoneMatch and ifModifiedSince are the validators of the -cache copy of the URL being
+// fetched. do sends them so the server can answer 304 instead of sending the body again
+var ifNoneMatch, ifModifiedSince string
+
+// cache is the -cache directory, nil without it
+var cache *diskCache
+
+// Main runs fetch with argv, the command line without the program name, and exits the
+// process when it fails like the program always has.
+func Main(argv []string) {
+	// a bad flag is a usage error like any other, 2 is what we use for transport errors
+	cli.Parse(Flags, argv, exitUsage)
+	if Flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: fetch [flags] url...")
+		os.Exit(exitUsage)
+	}
+	// like exercise 1.8, but https first since that is what most sites want now
+	urls := make([]string, Flags.NArg())
+	for i, arg := range Flags.Args() {
+		u, err := withScheme(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		urls[i] = u
+	}
+
+	if *basicAuth != "" && !strings.Contains(*basicAuth, ":") {
+		fmt.Fprintln(os.Stderr, "fetch: -u wants user:password")
+		os.Exit(exitUsage)
+	}
+	*method = strings.ToUpper(*method)
+	if *data != "" && *stdinBody {
+		fmt.Fprintln(os.Stderr, "fetch: -d and -stdin-body can not be used together")
+		os.Exit(exitUsage)
+	}
+	if name, ok := strings.CutPrefix(*data, "@"); ok {
+		// same as curl: -d @file sends the file, and -d @- is -stdin-body by another name
+		if name == "-" {
+			*stdinBody = true
+		} else {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "fetch: -d: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			body = b
+		}
+	} else if *data != "" {
+		body = []byte(*data)
+	}
+	if *stdinBody {
+		// we read all of stdin up front so every URL gets the same body and the
+		// request can carry a real Content-Length instead of being chunked
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: reading stdin: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		body = b
+	}
+	if *pipe != "" && (*output != "" || *pretty) {
+		fmt.Fprintln(os.Stderr, "fetch: -pipe can't be used with -o or -pretty")
+		os.Exit(exitUsage)
+	}
+	if *remoteName && (*output != "" || *resume || *pipe != "" || *pretty) {
+		fmt.Fprintln(os.Stderr, "fetch: -O can't be used with -o, -continue, -pipe or -pretty")
+		os.Exit(exitUsage)
+	}
+	if *gzipOutput {
+		// appending to a gzip file does make a valid stream, but -continue compares the
+		// file size with byte offsets in the body, and those stop matching once it's compressed
+		if *output == "" && !*remoteName || *resume {
+			fmt.Fprintln(os.Stderr, "fetch: -gzip-output needs -o or -O and can't be used with -continue")
+			os.Exit(exitUsage)
+		}
+		// an -O name isn't known until the response is in, it gets its .gz then
+		if *output != "" && !strings.HasSuffix(*output, ".gz") {
+			*output += ".gz"
+		}
+	}
+	if (*compressed || *toUTF8 || *plainText || *pretty) && (*resume || *segments > 1 || *serveAddr != "") {
+		// -continue and -segments write bytes at their offsets in the body as it is on the server,
+		// and -serve hands out the body it got
+		fmt.Fprintln(os.Stderr, "fetch: -compressed, -utf8, -text and -pretty can't be used with -continue, -segments or -serve")
+		os.Exit(exitUsage)
+	}
+	if *resume && (*output == "" || *include) {
+		fmt.Fprintln(os.Stderr, "fetch: -continue needs -o and can't be used with -i")
+		os.Exit(exitUsage)
+	}
+	if *output != "" && Flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "fetch: -o takes a single URL")
+		os.Exit(exitUsage)
+	}
+	if *expectStatus != "" {
+		var err error
+		if expectLo, expectHi, err = parseStatus(*expectStatus); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if *serveAddr != "" && (Flags.NArg() > 1 || *interval > 0) {
+		fmt.Fprintln(os.Stderr, "fetch: -serve takes a single URL and can't be used with -interval")
+		os.Exit(exitUsage)
+	}
+	if *warmup > 0 && *interval == 0 {
+		fmt.Fprintln(os.Stderr, "fetch: -warmup only makes sense with -interval")
+		os.Exit(exitUsage)
+	}
+	if *refresh > 0 && *serveAddr == "" {
+		fmt.Fprintln(os.Stderr, "fetch: -refresh only makes sense with -serve")
+		os.Exit(exitUsage)
+	}
+	if *cacheDir != "" {
+		if body != nil || *stdinBody || *method != "" && *method != "GET" || *resume {
+			// a POST isn't a GET that can be repeated, and -continue has its own partial file
+			fmt.Fprintln(os.Stderr, "fetch: -cache can't be used with -X, -d, -stdin-body or -continue")
+			os.Exit(exitUsage)
+		}
+		var err error
+		if cache, err = openCache(*cacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: -cache: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if *segments < 0 || *segments > 1 && (*output == "" || Flags.NArg() > 1 || *resume || *gzipOutput || *include || body != nil || *stdinBody || *method != "" && *method != "GET" || *cacheDir != "" || *limitRate > 0) {
+		// each range is written at its offset in the file, which only works for one plain file
+		fmt.Fprintln(os.Stderr, "fetch: -segments needs -o and a single URL, and can't be used with -continue, -gzip-output, -i, -X, -d, -stdin-body, -cache or -limit-rate")
+		os.Exit(exitUsage)
+	}
+	if *maxSize > 0 && *minBytes > *maxSize {
+		fmt.Fprintln(os.Stderr, "fetch: -min-bytes is bigger than -max, no body could pass")
+		os.Exit(exitUsage)
+	}
+	if *stdinBody && *headFirst && !*yes {
+		fmt.Fprintln(os.Stderr, "fetch: -stdin-body uses up stdin, so -head-first needs -yes")
+		os.Exit(exitUsage)
+	}
+
+	// Go kills a program that writes to a closed stdout pipe with SIGPIPE. asking for the
+	// signal turns that into an EPIPE error from the write, which fetch handles itself. not
+	// signal.Ignore: an ignored signal stays ignored in a -pipe or pager command, and then a
+	// cat or grep complains about the broken pipe instead of quietly dying of it like it should
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+
+	client, err := fetchlib.NewClient(fetchlib.Options{
+		Timeout:        *timeout,
+		ConnectTimeout: *connectTimeout,
+		HeaderTimeout:  *headerTimeout,
+		TLSMin:         *tlsMin,
+		ServerName:     fetchlib.ServerName(*hostHeader, *sni),
+		// only for the URLs given here, like the Host header that net/http drops on a redirect elsewhere
+		ServerNameHosts: fetchlib.Hosts(urls),
+		Pins:            pins,
+		Resolve:         resolve,
+		LocalAddr:       *localAddr,
+		Proxy:           *proxy,
+		Redirects:       &fetchlib.Redirects{Follow: *followRedirects, Max: *maxRedirects, OnHop: showHop},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	if *interval > 0 {
+		os.Exit(poll(client, urls))
+	}
+	if *serveAddr != "" {
+		os.Exit(serve(client, urls[0]))
+	}
+
+	if *segments > 1 {
+		os.Exit(fetchSegments(client, urls[0], *output, *segments))
+	}
+
+	code := exitOK
+	for _, url := range urls {
+		if c := fetch(client, url); c > code {
+			code = c
+		}
+	}
+	os.Exit(code)
+}
+
+// fetch prints the body of url and returns the exit code for it.
+func fetch(client *http.Client, url string) int {
+	if *headFirst {
+		if code, ok := checkHead(client, url); !ok {
+			return code
+		}
+	}
+
+	var t *timing
+	if *timings {
+		t = &timing{start: time.Now()}
+		// deferred first so it runs last, once the body has been read
+		defer t.report(os.Stderr)
+	}
+
+	var cached *cacheEntry
+	ifNoneMatch, ifModifiedSince = "", ""
+	if cache != nil {
+		if cached = cache.lookup(url); cached != nil {
+			ifNoneMatch, ifModifiedSince = cached.ETag, cached.LastModified
+		}
+	}
+
+	if *resume {
+		// a missing or empty file is just a normal download
+		if fi, err := os.Stat(*output); err == nil {
+			resumeFrom = fi.Size()
+		}
+		if resumeFrom > 0 {
+			ifRange = readValidator(*output)
+		}
+	}
+
+	resp, err := do(client, url, t)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return errorCode(err)
+	}
+	defer closeBody(resp.Body)
+
+	// from is where this body starts in the -o file, only ever not 0 after a good 206
+	var from int64
+	if *resume {
+		switch {
+		case resumeFrom > 0 && resp.StatusCode == http.StatusPartialContent:
+			// a server that sent some other range would leave a file with a hole or a repeat in it
+			start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+			if err != nil || start != resumeFrom {
+				fmt.Fprintf(os.Stderr, "fetch: %s: asked for bytes from %d, got Content-Range %q\n", url, resumeFrom, resp.Header.Get("Content-Range"))
+				return exitTransport
+			}
+			from = resumeFrom
+		case resumeFrom > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			fmt.Fprintf(os.Stderr, "fetch: %s: nothing past byte %d, %s looks complete already\n", url, resumeFrom, *output)
+			return exitOK
+		case resp.StatusCode < 200 || resp.StatusCode > 299:
+			// an error page must not replace the part we already have
+			fmt.Fprintf(os.Stderr, "fetch: %s: %s, leaving %s alone\n", url, resp.Status, *output)
+			return exitHTTP
+		case resumeFrom > 0 && ifRange != "":
+			// with If-Range a 200 can also mean the file changed, and then a 206 would have glued
+			// the new end onto the old start. either way starting over is the right thing
+			fmt.Fprintf(os.Stderr, "fetch: %s: changed since %s was started (or no range support), downloading all of it again\n", url, *output)
+		case resumeFrom > 0:
+			fmt.Fprintf(os.Stderr, "fetch: %s: the server doesn't do ranges, downloading all of it again\n", url)
+		}
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		// from here on it looks like the 200 it was the first time, so every check and
+		// output flag treats the cached body the same as a downloaded one
+		f, err := os.Open(cache.bodyPath(url))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: %s: not modified, but the cached copy is gone: %v\n", url, err)
+			return exitTransport
+		}
+		defer f.Close()
+		fmt.Fprintf(os.Stderr, "fetch: %s: not modified, using the cached copy\n", url)
+		resp.StatusCode, resp.Status = http.StatusOK, "200 OK"
+		if resp.Header.Get("Content-Type") == "" {
+			resp.Header.Set("Content-Type", cached.ContentType)
+		}
+		resp.ContentLength = cached.Size
+		resp.Body = f
+		switch {
+		case cached.ContentEncoding != "" && !*compressed:
+			// a -compressed run stored it gzipped. without -compressed the transport would have
+			// unpacked it on the way in, so it's unpacked here as well instead of printing gzip
+			body, err := decompress(url, f, cached.ContentEncoding)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "fetch: %s: the cached copy is damaged: %v\n", url, err)
+				return exitTransport
+			}
+			resp.Header.Del("Content-Encoding")
+			resp.ContentLength = -1
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, f}
+		case resp.Header.Get("Content-Encoding") == "":
+			resp.Header.Set("Content-Encoding", cached.ContentEncoding)
+		}
+		cache.touch(url)
+	}
+
+	// -expect-status goes first: -expect-status 404 -fail is asking for the 404, and the
+	// message should say what was expected rather than only what came back
+	if *expectStatus != "" && (resp.StatusCode < expectLo || resp.StatusCode > expectHi) {
+		fmt.Fprintf(os.Stderr, "fetch: %s: expected status %s, got %s\n", url, *expectStatus, resp.Status)
+		return exitHTTP
+	}
+	if *fail && *expectStatus == "" && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		fmt.Fprintf(os.Stderr, "fetch: %s: %s\n", url, resp.Status)
+		return exitHTTP
+	}
+	if failed := expectHeaders.check(resp.Header); len(failed) > 0 {
+		// every check is run so one fetch shows everything that is wrong, not just the first thing
+		for _, f := range failed {
+			fmt.Fprintf(os.Stderr, "fetch: %s: %s\n", url, f)
+		}
+		return exitHTTP
+	}
+
+	out := *output
+	if *remoteName {
+		if out, err = remoteFileName(resp); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: %s: %v\n", url, err)
+			return exitUsage
+		}
+		if *gzipOutput && !strings.HasSuffix(out, ".gz") {
+			out += ".gz"
+		}
+		if _, err := os.Stat(out); err == nil && !*clobber {
+			fmt.Fprintf(os.Stderr, "fetch: %s: %s is already there, leaving it alone (-clobber overwrites it)\n", url, out)
+			return exitSkipped
+		}
+	}
+
+	var r io.Reader = resp.Body
+	if *maxSize > 0 {
+		r = &capReader{r: r, max: *maxSize}
+	}
+	var throttled *rateReader
+	if *limitRate > 0 {
+		throttled = newRateReader(r, *limitRate)
+		r = throttled
+	}
+	var prog *progress
+	if out != "" && isTerminal(os.Stderr) {
+		// a file download prints nothing else, so without this a big one looks stuck
+		prog = &progress{r: r, name: out, of: resp.ContentLength, start: time.Now()}
+		r = prog
+	}
+
+	// the hash is worked out as the body streams past, so checking
+	// it doesn't need a second pass or an extra copy of the body
+	sum := sha256.New()
+	var got byteCount
+	r = io.TeeReader(r, io.MultiWriter(sum, &got))
+	// a body only goes in the cache once all of it has been read and every check has passed
+	var fill *cacheFill
+	if cache != nil && cacheable(resp) {
+		if fill, err = cache.begin(); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: -cache: %v\n", err)
+		} else {
+			r = io.TeeReader(r, fill)
+		}
+	}
+	// after the hash and the cache, so those get the body the server sent
+	if r, err = transform(url, resp, r); err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %s: -compressed: %v\n", url, err)
+		return exitTransport
+	}
+	verify := func() error {
+		// the body has been read by now, so this is its real size. with -o a body that is too small
+		// fails here, before the rename, just like a bad checksum. after a -continue the part that
+		// was already in the file counts too, it's the whole body that has to be big enough
+		if from+int64(got) < *minBytes {
+			return errTooSmall
+		}
+		return checkSum(url, sum.Sum(nil))
+	}
+
+	if *resume {
+		// saved before the body, so a download that dies halfway still knows what it was a part of
+		saveValidator(*output, resp)
+		err = writeResumable(*output, from, r, sum, verify)
+		if err == nil {
+			os.Remove(validatorFile(*output))
+		}
+	} else if out != "" {
+		var n int64
+		err = writeAtomic(out, func(w io.Writer) error {
+			var zw *gzip.Writer
+			if *gzipOutput {
+				zw = gzip.NewWriter(w)
+				w = zw
+			}
+			if *include {
+				writeHeaders(w, resp)
+			}
+			var err error
+			if n, err = io.Copy(w, r); err != nil {
+				return err
+			}
+			// Close writes the gzip footer, without it the file is cut short as far as gunzip is concerned
+			if zw != nil {
+				if err := zw.Close(); err != nil {
+					return err
+				}
+			}
+			// failing here leaves the old file alone instead of the bad download
+			return verify()
+		})
+		if prog != nil {
+			prog.done()
+		}
+		if err == nil && *gzipOutput {
+			if fi, serr := os.Stat(out); serr == nil {
+				fmt.Fprintf(os.Stderr, "fetch: %s: %s, %s on disk\n", out, size(n), size(fi.Size()))
+			}
+		}
+		if err == nil && *remoteName {
+			fmt.Fprintf(os.Stderr, "fetch: %s: saved as %s\n", url, out)
+		}
+	} else if *pipe != "" {
+		err = pipeBody(resp, r, verify)
+	} else {
+		err = printBody(url, resp, r, verify)
+	}
+	if throttled != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %s: %s at %s/s\n", url, size(throttled.n), size(int64(throttled.average())))
+	}
+	if fill != nil {
+		if err != nil {
+			fill.abort()
+		} else if err := cache.commit(url, resp, fill); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: -cache: %v\n", err)
+		}
+	}
+
+	if errors.Is(err, syscall.EPIPE) {
+		// whatever reads our output has stopped, like head after its lines. nothing
+		// more can be printed, and stopping quietly is what Unix tools do here
+		os.Exit(exitOK)
+	}
+	if errors.Is(err, errTooBig) {
+		fmt.Fprintf(os.Stderr, "fetch: %s: body is bigger than -max %s\n", url, size(*maxSize))
+		return exitSkipped
+	}
+	if errors.Is(err, errTooSmall) {
+		fmt.Fprintf(os.Stderr, "fetch: %s: body is %s, smaller than -min-bytes %s\n", url, size(from+int64(got)), size(*minBytes))
+		return exitSkipped
+	}
+	if errors.Is(err, errChecksum) {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitChecksum
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		// the command was writing to our stdout, so this is the same reader gone away as above.
+		// sh reports a command that died of SIGPIPE as 128+13, when it doesn't exec it directly
+		ws, ok := exit.Sys().(syscall.WaitStatus)
+		if ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE || exit.ExitCode() == 128+int(syscall.SIGPIPE) {
+			os.Exit(exitOK)
+		}
+		if *pipe != "" {
+			fmt.Fprintf(os.Stderr, "fetch: %s: -pipe %q: %v\n", url, *pipe, exit)
+			// ExitCode is -1 for a command killed by a signal, which has no status to pass on
+			if code := exit.ExitCode(); code > 0 {
+				return code
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "fetch: %s: %v\n", url, err)
+		}
+		return exitPipe
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: reading %s: %v\n", url, err)
+		return errorCode(err)
+	}
+	return exitOK
+}
+
+// drainLimit is the most closeBody will read to save a connection. past that a new
+// connection is cheaper than downloading the rest of a body nobody wants
+const drainLimit = 256 << 10
+
+// closeBody closes a response body, reading off what is left of it first with -drain.
+// the transport only puts a connection back in the pool once its body has been read to
+// the end, and -fail, -expect-status and -max can all stop reading early. newer Go versions
+// drain a little on Close by themselves, but older ones just drop the connection.
+func closeBody(b io.ReadCloser) {
+	if *drain {
+		io.CopyN(ioutil.Discard, b, drainLimit)
+	}
+	b.Close()
+}
+
+// printBody prints the body from r as it comes in and runs verify once all of it has gone by,
+// so a big body sent to a pipe never has to fit in memory. it is only held back when something
+// has to see all of it first: the pager, which only takes text, a -sha256 to check, since a body
+// that doesn't match isn't printed, and -max, which can't fail a body that is half out already
+// (and keeps what is held to -max). -min-bytes only holds back its first that many bytes.
+func printBody(url string, resp *http.Response, r io.Reader, verify func() error) error {
+	if wantPager() || *maxSize > 0 || *sha != "" && *sha != "-" {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := verify(); err != nil {
+			return err
+		}
+		if wantPager() && isText(b) {
+			return page(resp, b)
+		}
+		if *include {
+			writeHeaders(os.Stdout, resp)
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	head, err := ioutil.ReadAll(io.LimitReader(r, *minBytes))
+	if err != nil {
+		return err
+	}
+	// a body that ended before -min-bytes is all in head, and the check can fail before it is printed
+	short := int64(len(head)) < *minBytes
+	if short {
+		if err := verify(); err != nil {
+			return err
+		}
+	}
+	if *include {
+		writeHeaders(os.Stdout, resp)
+	}
+	if _, err := os.Stdout.Write(head); err != nil {
+		return err
+	}
+	if short {
+		return nil
+	}
+	if _, err := io.Copy(os.Stdout, r); err != nil {
+		return err
+	}
+	return verify()
+}
+
+// wantPager reports whether a text body would be shown through the pager: only when a person
+// is looking at it. a pipe or a file gets the bytes as they are.
+func wantPager() bool {
+	if *noPager || os.Getenv("PAGER") == "cat" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// isText reports whether body is something a pager can show
+func isText(body []byte) bool {
+	return utf8.Valid(body) && bytes.IndexByte(body, 0) < 0
+}
+
+// page runs the pager with the headers and body on its stdin. a pager that can't be started
+// isn't worth failing over, the body is printed straight out instead.
+func page(resp *http.Response, body []byte) error {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -R"
+	}
+	var in bytes.Buffer
+	if *include {
+		writeHeaders(&in, resp)
+	}
+	in.Write(body)
+
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = &in
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// what git does: F quits straight away when it all fits on one screen, X leaves it on the
+	// screen afterwards, R lets colors through. only when the user hasn't set LESS themselves
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+	if err := cmd.Start(); err != nil {
+		_, err = in.WriteTo(os.Stdout)
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("pager %q: %w", pager, err)
+	}
+	return nil
+}
+
+// pipeBody runs the -pipe command with the body streaming into its stdin and its output
+// going straight to ours, so a big download never has to fit in memory. the command runs
+// through sh so quoting and pipes inside it work like they do on the command line.
+func pipeBody(resp *http.Response, r io.Reader, verify func() error) error {
+	if *include {
+		writeHeaders(os.Stdout, resp)
+	}
+	cmd := exec.Command("sh", "-c", *pipe)
+	// with a Reader that isn't a file exec copies it in for us, and doesn't
+	// complain when the command quits before reading all of it
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return verify()
+}
+
+// writeHeaders writes the status line, the headers sorted by name and then a blank line,
+// the way a response looks on the wire (minus the \r's, which would only clutter a terminal).
+func writeHeaders(w io.Writer, resp *http.Response) {
+	fmt.Fprintf(w, "%s %s\n", resp.Proto, resp.Status)
+	keys := make([]string, 0, len(resp.Header))
+	for k := range resp.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range resp.Header[k] {
+			fmt.Fprintf(w, "%s: %s\n", k, v)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// remoteFileName is the -O name for resp: the filename in Content-Disposition if there is one,
+// or else the last part of the path of the URL it finally came from (redirects count), or
+// index.html for a path that ends in a slash. only the base name is ever used, a server
+// can't send us writing into ../.bashrc
+func remoteFileName(resp *http.Response) (string, error) {
+	name := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(resp.Request.URL.Path)
+		if strings.HasSuffix(resp.Request.URL.Path, "/") || name == "/" || name == "." {
+			name = "index.html"
+		}
+	}
+	name = filepath.Base(filepath.FromSlash(name))
+	if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("can't make a safe file name out of %q", name)
+	}
+	return name, nil
+}
+
+// progress prints how far a download has got to stderr, on one line that is rewritten at most
+// five times a second. of is the Content-Length, -1 when the server didn't send one
+type progress struct {
+	r     io.Reader
+	name  string
+	n, of int64
+	start time.Time
+	shown time.Time
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if time.Since(p.shown) >= 200*time.Millisecond {
+		p.show()
+	}
+	return n, err
+}
+
+func (p *progress) show() {
+	p.shown = time.Now()
+	rate := float64(p.n) / time.Since(p.start).Seconds()
+	// \x1b[K clears what was left of a longer line before it
+	if p.of > 0 {
+		fmt.Fprintf(os.Stderr, "\rfetch: %s: %s of %s (%d%%), %s/s\x1b[K", p.name, size(p.n), size(p.of), p.n*100/p.of, size(int64(rate)))
+	} else {
+		fmt.Fprintf(os.Stderr, "\rfetch: %s: %s, %s/s\x1b[K", p.name, size(p.n), size(int64(rate)))
+	}
+}
+
+// done shows the final figures and ends the line, so whatever comes next starts on its own.
+func (p *progress) done() {
+	p.show()
+	fmt.Fprintln(os.Stderr)
+}
+
+// isTerminal reports whether f is a terminal and not a file or a pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// writeAtomic lets write fill a temp file next to name and only renames it into place when write
+// and the close both worked. an error (or a timeout halfway through the body) removes the temp
+// file instead, so name is never left holding half a download.
+func writeAtomic(name string, write func(w io.Writer) error) error {
+	// same directory, so the rename can't cross file systems
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".part-*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes the file private, a normal download should be readable like os.Create's files
+	err = tmp.Chmod(0644)
+	if err == nil {
+		err = write(tmp)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeResumable is -o with -continue. unlike writeAtomic it writes straight into the file,
+// because a half-written file is exactly what the next -continue picks up from. from is the
+// offset the body starts at: the partial file's size after a 206, or 0 to start over.
+func writeResumable(name string, from int64, r io.Reader, sum hash.Hash, verify func() error) error {
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if from > 0 {
+		flags = os.O_RDWR | os.O_APPEND
+	}
+	f, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if from > 0 {
+		// -sha256 is about the whole file, so the part we already have goes through the hash first
+		_, err = io.Copy(sum, f)
+	}
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return verify()
+}
+
+// segmentState is what FILE.part.state holds for -segments. Done is how many bytes of each range
+// are on disk. it is only ever moved forward after the write, so at worst a restart fetches a
+// little again, it never skips anything
+type segmentState struct {
+	URL       string    `json:"url"`
+	Size      int64     `json:"size"`
+	Validator string    `json:"validator,omitempty"`
+	Segments  []segment `json:"segments"`
+}
+
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // the last byte, like in a Range header
+	Done  int64 `json:"done"`
+}
+
+// fetchSegments is -segments: a HEAD to learn the size and whether ranges work, then n GETs
+// at once, each for its own share of the file. the first one to fail stops the rest, with the
+// state saved for next time
+func fetchSegments(client *http.Client, url, out string, n int) int {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitUsage
+	}
+	setHeaders(req)
+	head, err := client.Do(req)
+	if err != nil {
+		err = fetchlib.ExplainTLS(err, *tlsMin)
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return errorCode(err)
+	}
+	head.Body.Close()
+	if head.StatusCode != http.StatusOK || head.ContentLength <= 0 || head.Header.Get("Accept-Ranges") != "bytes" {
+		fmt.Fprintf(os.Stderr, "fetch: %s: no byte ranges on offer (%s, Accept-Ranges %q), downloading in one piece\n",
+			url, head.Status, head.Header.Get("Accept-Ranges"))
+		return fetch(client, url)
+	}
+	total := head.ContentLength
+	if *maxSize > 0 && total > *maxSize {
+		fmt.Fprintf(os.Stderr, "fetch: %s: skipping, bigger than -max %s\n", url, size(*maxSize))
+		return exitSkipped
+	}
+	if total < *minBytes {
+		fmt.Fprintf(os.Stderr, "fetch: %s: %v\n", url, errTooSmall)
+		return exitSkipped
+	}
+	validator := head.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = head.Header.Get("Last-Modified")
+	}
+
+	part, statePath := out+".part", out+".part.state"
+	st := loadSegmentState(statePath)
+	if st == nil || st.URL != url || st.Size != total || st.Validator != validator {
+		if st != nil {
+			fmt.Fprintf(os.Stderr, "fetch: %s: changed since %s was started, starting it over\n", url, part)
+		}
+		st = newSegmentState(url, total, validator, n)
+	} else {
+		var have int64
+		for _, sg := range st.Segments {
+			have += sg.Done
+		}
+		fmt.Fprintf(os.Stderr, "fetch: %s: resuming %s, %s of %s already there\n", url, part, size(have), size(total))
+	}
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err == nil {
+		// the ranges are written at their offsets, so the file is made its full size up front
+		err = f.Truncate(total)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitUsage
+	}
+	defer f.Close()
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// done counters are updated by the range goroutines and read by the saver, so they are atomic
+	done := make([]atomic.Int64, len(st.Segments))
+	for i, sg := range st.Segments {
+		done[i].Store(sg.Done)
+	}
+	save := func() {
+		for i := range st.Segments {
+			st.Segments[i].Done = done[i].Load()
+		}
+		if err := writeAtomic(statePath, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(st)
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		}
+	}
+	save()
+	stopSaver := make(chan struct{})
+	saverDone := make(chan struct{})
+	go func() {
+		defer close(saverDone)
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				save()
+			case <-stopSaver:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	for i, sg := range st.Segments {
+		if sg.Start+sg.Done > sg.End {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fetchRange(ctx, client, url, validator, f, sg, &done[i]); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(stopSaver)
+	<-saverDone
+	save()
+
+	if firstErr != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %s: %v (run it again to pick up where it stopped)\n", url, firstErr)
+		if errors.Is(firstErr, errRangeChanged) {
+			// nothing on disk can be trusted to go with the new version
+			os.Remove(statePath)
+			return exitTransport
+		}
+		return errorCode(firstErr)
+	}
+
+	// -sha256 is about the whole file, so it is read once more now that all of it is there
+	sum := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(sum, f)
+	}
+	if err := checkSum(url, sum.Sum(nil)); err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitChecksum
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitTransport
+	}
+	if err := os.Rename(part, out); err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitUsage
+	}
+	os.Remove(statePath)
+	fmt.Fprintf(os.Stderr, "fetch: %s: %s in %d segments, %.2fs\n", out, size(total), len(st.Segments), time.Since(start).Seconds())
+	return exitOK
+}
+
+// errRangeChanged is what fetchRange fails with when the server sends something other than
+// the range of the version we started with
+var errRangeChanged = errors.New("the file changed on the server, or it ignored the range")
+
+// newSegmentState splits size bytes into n ranges, the last one taking what doesn't divide evenly.
+func newSegmentState(url string, total int64, validator string, n int) *segmentState {
+	if int64(n) > total {
+		n = int(total)
+	}
+	st := &segmentState{URL: url, Size: total, Validator: validator}
+	each := total / int64(n)
+	for i := 0; i < n; i++ {
+		sg := segment{Start: int64(i) * each, End: int64(i+1)*each - 1}
+		if i == n-1 {
+			sg.End = total - 1
+		}
+		st.Segments = append(st.Segments, sg)
+	}
+	return st
+}
+
+// loadSegmentState reads FILE.part.state, nil when there is none or it doesn't make sense.
+func loadSegmentState(name string) *segmentState {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	var st segmentState
+	if json.Unmarshal(b, &st) != nil || len(st.Segments) == 0 {
+		return nil
+	}
+	return &st
+}
+
+// fetchRange downloads what is left of sg into f at its offset, moving done along as it goes.
+// If-Range makes a server whose file has changed send all of it with a 200 instead, which is
+// an error here and not something to write into the middle of the old one
+func fetchRange(ctx context.Context, client *http.Client, url, validator string, f *os.File, sg segment, done *atomic.Int64) error {
+	from := sg.Start + done.Load()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	setHeaders(req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, sg.End))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetchlib.ExplainTLS(err, *tlsMin)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			return errRangeChanged
+		}
+		return fmt.Errorf("bytes %d-%d: %s", from, sg.End, resp.Status)
+	}
+	if start, err := contentRangeStart(resp.Header.Get("Content-Range")); err != nil || start != from {
+		return fmt.Errorf("asked for bytes from %d, got Content-Range %q", from, resp.Header.Get("Content-Range"))
+	}
+
+	buf := make([]byte, 32*1024)
+	want := sg.End - from + 1
+	for want > 0 {
+		m, err := resp.Body.Read(buf[:min(int64(len(buf)), want)])
+		if m > 0 {
+			if _, werr := f.WriteAt(buf[:m], from); werr != nil {
+				return werr
+			}
+			from += int64(m)
+			want -= int64(m)
+			done.Add(int64(m))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if want > 0 {
+		return fmt.Errorf("bytes %d-%d: %w", from, sg.End, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// validatorFile is where -continue keeps the validator of a partial download, next to the file.
+func validatorFile(name string) string {
+	return name + ".continue"
+}
+
+// readValidator returns the validator saved for a partial download, or "" when there is none,
+// which makes the Range request go out without an If-Range like before.
+func readValidator(name string) string {
+	b, err := os.ReadFile(validatorFile(name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// saveValidator remembers what identifies this version of the body. If-Range only takes a strong
+// ETag, so a weak one (W/"...") is passed over for Last-Modified.
+func saveValidator(name string, resp *http.Response) {
+	v := resp.Header.Get("ETag")
+	if v == "" || strings.HasPrefix(v, "W/") {
+		v = resp.Header.Get("Last-Modified")
+	}
+	if v == "" {
+		os.Remove(validatorFile(name))
+		return
+	}
+	if err := os.WriteFile(validatorFile(name), []byte(v+"\n"), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+	}
+}
+
+// diskCache is the -cache directory: one file per body, named by the SHA-256 of its URL, and
+// index.json with what was sent along with each one. the index is read once at the start
+// and written back whenever it changes.
+type diskCache struct {
+	dir   string
+	index map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	// ContentEncoding is kept for -compressed, a 304 doesn't always say the body was gzipped
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	Size            int64     `json:"size"`
+	Used            time.Time `json:"used"` // the last time it was stored or served, for eviction
+}
+
+// openCache makes dir if it isn't there and reads its index. a leading ~/ is the home
+// directory, since -cache=~/.fetchcache gets past the shell without being expanded.
+func openCache(dir string) (*diskCache, error) {
+	if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, rest)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, index: make(map[string]*cacheEntry)}
+	b, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.index); err != nil {
+		// the bodies are no use without their validators, so start over rather than give up
+		fmt.Fprintf(os.Stderr, "fetch: -cache: index.json is damaged (%v), starting with an empty cache\n", err)
+		c.index = make(map[string]*cacheEntry)
+	}
+	return c, nil
+}
+
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *diskCache) bodyPath(url string) string {
+	return filepath.Join(c.dir, cacheKey(url))
+}
+
+// lookup returns the entry for url, or nil when there is none or its body has gone missing.
+func (c *diskCache) lookup(url string) *cacheEntry {
+	e := c.index[cacheKey(url)]
+	if e == nil || e.URL != url {
+		return nil
+	}
+	if _, err := os.Stat(c.bodyPath(url)); err != nil {
+		return nil
+	}
+	return e
+}
+
+// touch marks url as just used, so eviction keeps it longer.
+func (c *diskCache) touch(url string) {
+	if e := c.index[cacheKey(url)]; e != nil {
+		e.Used = time.Now()
+		c.save()
+	}
+}
+
+// cacheable says whether resp is worth keeping: a whole 200 with something to revalidate it by,
+// that the server didn't tell us not to store.
+func cacheable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.Request.Method != "GET" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-store") {
+		return false
+	}
+	return resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// cacheFill is a body on its way into the cache, in a temp file until commit.
+type cacheFill struct {
+	f   *os.File
+	n   int64
+	err error
+}
+
+func (c *diskCache) begin() (*cacheFill, error) {
+	f, err := os.CreateTemp(c.dir, ".fill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFill{f: f}, nil
+}
+
+// Write never fails, a full disk shouldn't stop the body being printed. the error is kept
+// and stops the body from being committed instead
+func (w *cacheFill) Write(b []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.Write(b)
+		w.n += int64(len(b))
+	}
+	return len(b), nil
+}
+
+func (w *cacheFill) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// commit puts a fully read body in place for url and writes the index.
+func (c *diskCache) commit(url string, resp *http.Response, fill *cacheFill) error {
+	if cerr := fill.f.Close(); fill.err == nil {
+		fill.err = cerr
+	}
+	if fill.err == nil && resp.ContentLength >= 0 && fill.n != resp.ContentLength {
+		// something like -max-size stopped reading early, so this isn't the whole body
+		fill.err = fmt.Errorf("%s: got %d of %d bytes, not caching it", url, fill.n, resp.ContentLength)
+	}
+	if fill.err == nil {
+		fill.err = os.Rename(fill.f.Name(), c.bodyPath(url))
+	}
+	if fill.err != nil {
+		os.Remove(fill.f.Name())
+		return fill.err
+	}
+	c.index[cacheKey(url)] = &cacheEntry{
+		URL:             url,
+		ETag:            resp.Header.Get("ETag"),
+		LastModified:    resp.Header.Get("Last-Modified"),
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		Size:            fill.n,
+		Used:            time.Now(),
+	}
+	c.evict()
+	return c.save()
+}
+
+// evict throws out the bodies used longest ago until the rest fit in -cache-size.
+// the one just stored is the newest, so it only goes when it is too big on its own.
+func (c *diskCache) evict() {
+	var total int64
+	keys := make([]string, 0, len(c.index))
+	for k, e := range c.index {
+		total += e.Size
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.index[keys[i]].Used.Before(c.index[keys[j]].Used) })
+	for _, k := range keys {
+		if total <= *cacheSize {
+			break
+		}
+		total -= c.index[k].Size
+		os.Remove(filepath.Join(c.dir, k))
+		delete(c.index, k)
+	}
+}
+
+func (c *diskCache) save() error {
+	b, err := json.MarshalIndent(c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(c.dir, "index.json"), func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	})
+}
+
+// contentRangeStart returns the first byte of a Content-Range like "bytes 100-199/200".
+func contentRangeStart(s string) (int64, error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	first, _, ok2 := strings.Cut(spec, "-")
+	if !ok || !ok2 {
+		return 0, fmt.Errorf("bad Content-Range %q", s)
+	}
+	return strconv.ParseInt(first, 10, 64)
+}
+
+// errChecksum is wrapped by checkSum when the body doesn't match -sha256.
+var errChecksum = errors.New("checksum mismatch")
+
+// checkSum compares got with -sha256. whatever -sha256 is, got is printed to stderr like
+// sha256sum prints it, so a match can be seen and - gives the user one to copy. without -sha256
+// nothing is printed, most fetches aren't about the checksum
+func checkSum(url string, got []byte) error {
+	if *sha == "" {
+		return nil
+	}
+	gotHex := hex.EncodeToString(got)
+	fmt.Fprintf(os.Stderr, "%s  %s\n", gotHex, url)
+	if *sha == "-" {
+		return nil
+	}
+	if !strings.EqualFold(gotHex, *sha) {
+		return fmt.Errorf("%s: %w: expected sha256 %s, got %s", url, errChecksum, strings.ToLower(*sha), gotHex)
+	}
+	return nil
+}
+
+// errTooBig is what capReader fails with once the body goes past -max.
+var errTooBig = errors.New("body is bigger than -max")
+
+// errTooSmall is what the check after the body returns when it was shorter than -min-bytes.
+var errTooSmall = errors.New("body is smaller than -min-bytes")
+
+// byteCount is an io.Writer that only counts what is written to it.
+type byteCount int64
+
+func (c *byteCount) Write(p []byte) (int, error) {
+	*c += byteCount(len(p))
+	return len(p), nil
+}
+
+// capReader passes reads through until more than max bytes have gone by.
+type capReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n+int64(n) > c.max {
+		// the bytes past the limit are held back, so a streaming -pipe never sees more than -max
+		n = int(c.max - c.n)
+		c.n = c.max
+		return n, errTooBig
+	}
+	c.n += int64(n)
+	return n, err
+}
+
+// isJSON reports whether a Content-Type is application/json or a +json type like application/problem+json.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// transform puts the readers for -compressed, -utf8, -text and -pretty on r, in that order: the body
+// has to be unpacked before its charset can be decoded, and decoded before tags or JSON can be found
+// in it. each one works on what it has been handed so far, so none of them needs the whole body
+func transform(url string, resp *http.Response, r io.Reader) (io.Reader, error) {
+	ctype := resp.Header.Get("Content-Type")
+	if *compressed {
+		var err error
+		if r, err = decompress(url, r, resp.Header.Get("Content-Encoding")); err != nil {
+			return nil, err
+		}
+	}
+	if *toUTF8 {
+		r = decodeCharset(url, r, ctype)
+	}
+	if *plainText && isHTML(ctype) {
+		r = &htmlText{r: r}
+	}
+	if *pretty && isJSON(ctype) {
+		r = &jsonIndent{r: r, url: url}
+	}
+	return r, nil
+}
+
+// decompress unpacks a gzip or deflate body. anything else, like br, is left as it came.
+func decompress(url string, r io.Reader, encoding string) (io.Reader, error) {
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case "", "identity":
+		return r, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err == io.EOF {
+			// no body at all, which a 204 or a 304 is allowed to have whatever it says
+			return r, nil
+		}
+		return zr, err
+	case "deflate":
+		// deflate is supposed to come in a zlib wrapper, but some servers send it bare. a zlib
+		// header is a byte with 8 in its low bits and a second byte that makes the pair a multiple of 31
+		br := bufio.NewReader(r)
+		b, err := br.Peek(2)
+		if err != nil {
+			return br, nil
+		}
+		if b[0]&0x0f == 8 && (int(b[0])<<8|int(b[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	fmt.Fprintf(os.Stderr, "fetch: %s: -compressed: can't unpack a %s body, leaving it as it is\n", url, encoding)
+	return r, nil
+}
+
+// decodeCharset converts r from the charset named in contentType to UTF-8. only the single byte
+// Western one and UTF-16 are known, the rest would need tables from golang.org/x/text
+func decodeCharset(url string, r io.Reader, contentType string) io.Reader {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return r
+	}
+	switch charset := strings.ToLower(params["charset"]); charset {
+	case "", "utf-8", "utf8":
+		return r
+	case "windows-1252", "cp1252", "iso-8859-1", "latin1", "l1", "us-ascii", "ascii":
+		// browsers read latin1 and ASCII as windows-1252, and so do most of the pages that say
+		// latin1 when they use its curly quotes. the two only differ in 0x80 to 0x9f anyway
+		return &runeReader{r: r, next: windows1252}
+	case "utf-16be":
+		return &runeReader{r: r, next: utf16Decoder(true, false)}
+	case "utf-16le":
+		return &runeReader{r: r, next: utf16Decoder(false, false)}
+	case "utf-16":
+		// plain utf-16 starts with a byte order mark, and without one it is big endian
+		return &runeReader{r: r, next: utf16Decoder(true, true)}
+	default:
+		fmt.Fprintf(os.Stderr, "fetch: %s: -utf8: don't know the charset %q, leaving it as it is\n", url, charset)
+		return r
+	}
+}
+
+// runeReader reads bytes in some other encoding from r and hands them out as UTF-8. next decodes
+// the character at the start of b and says how many bytes it took, or 0 when b is too short to
+// tell, and a character cut in two by a read waits in in for the rest of it
+type runeReader struct {
+	r    io.Reader
+	next func(b []byte) (rune, int)
+	in   []byte // read but not decoded yet
+	out  []byte // decoded but not handed out yet
+	err  error
+}
+
+func (rr *runeReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			if len(rr.in) == 0 {
+				return 0, rr.err
+			}
+			// the body ended in the middle of a character
+			rr.out, rr.in = utf8.AppendRune(rr.out, utf8.RuneError), nil
+			break
+		}
+		var buf [4096]byte
+		n, err := rr.r.Read(buf[:])
+		rr.in, rr.err = append(rr.in, buf[:n]...), err
+		for len(rr.in) > 0 {
+			c, size := rr.next(rr.in)
+			if size == 0 {
+				break
+			}
+			// a negative rune is a byte order mark, it is used up and not written
+			if c >= 0 {
+				rr.out = utf8.AppendRune(rr.out, c)
+			}
+			rr.in = rr.in[size:]
+		}
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// cp1252 is what windows-1252 has in 0x80 to 0x9f. the rest of it is latin1, which is the first
+// 256 code points of Unicode, so a byte there is its own rune. the five holes map to themselves
+var cp1252 = [32]rune{
+	0x20ac, 0x81, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021, 0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x8d, 0x017d, 0x8f,
+	0x90, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014, 0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x9d, 0x017e, 0x0178,
+}
+
+func windows1252(b []byte) (rune, int) {
+	if c := b[0]; c >= 0x80 && c < 0xa0 {
+		return cp1252[c-0x80], 1
+	}
+	return rune(b[0]), 1
+}
+
+// utf16Decoder decodes UTF-16 in the byte order given, or in the one its byte order mark says
+// when sniff is set. a character past U+FFFF is a pair of surrogates, four bytes
+func utf16Decoder(bigEndian, sniff bool) func([]byte) (rune, int) {
+	return func(b []byte) (rune, int) {
+		if len(b) < 2 {
+			return 0, 0
+		}
+		if sniff {
+			sniff = false
+			switch {
+			case b[0] == 0xfe && b[1] == 0xff:
+				bigEndian = true
+				return -1, 2
+			case b[0] == 0xff && b[1] == 0xfe:
+				bigEndian = false
+				return -1, 2
+			}
+		}
+		unit := func(i int) rune {
+			if bigEndian {
+				return rune(b[i])<<8 | rune(b[i+1])
+			}
+			return rune(b[i+1])<<8 | rune(b[i])
+		}
+		c := unit(0)
+		if !utf16.IsSurrogate(c) {
+			return c, 2
+		}
+		if len(b) < 4 {
+			return 0, 0
+		}
+		if c = utf16.DecodeRune(c, unit(2)); c == utf8.RuneError {
+			// a lone surrogate, only its own two bytes are bad
+			return c, 2
+		}
+		return c, 4
+	}
+}
+
+// htmlText is the text of an HTML page read from r. tags are dropped, and script and style with
+// everything in them, entities like &amp; are turned back into characters, runs of spaces and
+// newlines become one space the way a browser shows them, and a tag that starts a block, like <p>
+// or <br>, starts a new line. it is no HTML parser, only enough to read a page in a terminal
+type htmlText struct {
+	r     io.Reader
+	in    []byte // read but not gone through yet
+	out   []byte
+	err   error
+	inTag bool
+	tag   []byte // the tag so far, from just after its <
+	quote byte   // the quote an attribute value in the tag is in, a > in there doesn't end it
+	skip  string // script or style while inside one
+	space bool   // there was white space since the last character written
+	lines int    // newlines at the end of out, so ten empty divs are one blank line and not ten
+	wrote bool   // anything has been written at all. out is emptied by every Read, so it can't tell
+}
+
+// blockTags start a new line in -text output
+var blockTags = map[string]bool{
+	"p": true, "br": true, "div": true, "li": true, "tr": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "ul": true, "ol": true, "table": true, "title": true, "hr": true, "pre": true,
+	"blockquote": true, "section": true, "article": true, "header": true, "footer": true, "nav": true, "dt": true, "dd": true,
+}
+
+func (h *htmlText) Read(p []byte) (int, error) {
+	for len(h.out) == 0 {
+		if h.err != nil && len(h.in) == 0 {
+			return 0, h.err
+		}
+		if h.err == nil {
+			var buf [4096]byte
+			n, err := h.r.Read(buf[:])
+			h.in, h.err = append(h.in, buf[:n]...), err
+		}
+		h.process()
+	}
+	n := copy(p, h.out)
+	h.out = h.out[n:]
+	return n, nil
+}
+
+// process goes through as much of in as it can. the end of some things, an entity or the
+// </script> that closes a script, may still be in the next read, and those wait in in for it
+func (h *htmlText) process() {
+	done := h.err != nil
+	i := 0
+	for i < len(h.in) {
+		c := h.in[i]
+		switch {
+		case h.skip != "" && !h.inTag:
+			end := "</" + h.skip
+			j := indexFold(h.in[i:], end)
+			if j < 0 {
+				if done {
+					i = len(h.in)
+				} else {
+					// keep enough of the end for a </script cut in two by a read
+					i = max(i, len(h.in)-len(end)+1)
+				}
+				h.in = h.in[i:]
+				return
+			}
+			i += j
+			h.skip = ""
+		case h.inTag:
+			i++
+			h.tagByte(c)
+		case c == '<':
+			i++
+			h.inTag, h.tag, h.quote = true, h.tag[:0], 0
+		case c == '&':
+			j := bytes.IndexByte(h.in[i:min(len(h.in), i+32)], ';')
+			if j < 0 && !done && len(h.in)-i < 32 {
+				h.in = h.in[i:]
+				return
+			}
+			if j < 0 {
+				h.text([]byte("&"))
+				i++
+				break
+			}
+			h.text([]byte(html.UnescapeString(string(h.in[i : i+j+1]))))
+			i += j + 1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			h.space = true
+			i++
+		default:
+			h.text(h.in[i : i+1])
+			i++
+		}
+	}
+	h.in = h.in[:0]
+	if done && h.lines == 0 && h.wrote {
+		// text ends with a newline like any other
+		h.out = append(h.out, '\n')
+		h.lines = 1
+	}
+}
+
+// tagByte adds c to the tag being read, and handles the tag once its > comes along.
+func (h *htmlText) tagByte(c byte) {
+	comment := bytes.HasPrefix(h.tag, []byte("!--"))
+	switch {
+	case comment && c == '>' && bytes.HasSuffix(h.tag, []byte("--")) && len(h.tag) >= 5:
+		// only --> ends a comment, a > or a quote inside one is just text
+		h.inTag = false
+	case comment:
+		// a long comment only needs its start and its last two bytes kept
+		if len(h.tag) > 64 {
+			h.tag = append(h.tag[:3], h.tag[len(h.tag)-2:]...)
+		}
+		h.tag = append(h.tag, c)
+	case h.quote != 0:
+		if c == h.quote {
+			h.quote = 0
+		}
+	case c == '"' || c == '\'':
+		h.quote = c
+	case c == '>':
+		h.inTag = false
+		h.endTag()
+	case len(h.tag) < 64:
+		// the name is all that matters, so that is plenty
+		h.tag = append(h.tag, c)
+	}
+}
+
+// endTag acts on the name of a tag that has just ended.
+func (h *htmlText) endTag() {
+	tag := strings.ToLower(string(h.tag))
+	closing := strings.HasPrefix(tag, "/")
+	name := strings.TrimPrefix(tag, "/")
+	if i := strings.IndexAny(name, " \t\n\r\f/"); i >= 0 {
+		name = name[:i]
+	}
+	if !closing && (name == "script" || name == "style") && !strings.HasSuffix(tag, "/") {
+		h.skip = name
+	}
+	if blockTags[name] && h.wrote && h.lines < 2 {
+		h.out = append(h.out, '\n')
+		h.lines++
+		h.space = false
+	}
+}
+
+// text writes characters of the page, with the space before them if there was any.
+func (h *htmlText) text(b []byte) {
+	if h.skip != "" {
+		return
+	}
+	if h.space && h.lines == 0 && h.wrote {
+		h.out = append(h.out, ' ')
+	}
+	h.out = append(h.out, b...)
+	h.space, h.lines, h.wrote = false, 0, true
+}
+
+// indexFold is bytes.Index for an ASCII sep, ignoring case.
+func indexFold(b []byte, sep string) int {
+	for i := 0; i+len(sep) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(sep)], []byte(sep)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonIndent indents the JSON read from r two spaces a level, the way json.Indent does, but a
+// piece at a time so a big document never has to be in memory. keys stay in the order the server
+// sent them, and strings and numbers are passed on byte for byte. it doesn't check the JSON is
+// valid, but a body that doesn't start with { or [, or has a ] too many, is passed through as it
+// came from there on, and that gets a warning on stderr like a body that stops halfway does
+type jsonIndent struct {
+	r       io.Reader
+	url     string
+	out     []byte
+	err     error
+	depth   int
+	inStr   bool
+	escaped bool
+	start   bool // just wrote a { or [, its newline waits to see whether it's an empty one
+	values  int  // values at the top level so far, a stream of them goes one a line
+	plain   bool // not JSON after all
+	warned  bool
+}
+
+func (j *jsonIndent) Read(p []byte) (int, error) {
+	for len(j.out) == 0 {
+		if j.err != nil {
+			return 0, j.err
+		}
+		var buf [4096]byte
+		n, err := j.r.Read(buf[:])
+		j.err = err
+		for _, c := range buf[:n] {
+			j.add(c)
+		}
+		if err != nil && j.values > 0 && j.depth == 0 && !j.plain {
+			j.out = append(j.out, '\n')
+		}
+		if err == io.EOF && !j.plain && (j.depth > 0 || j.inStr) {
+			j.warn("the JSON stops in the middle")
+		}
+	}
+	n := copy(p, j.out)
+	j.out = j.out[n:]
+	return n, nil
+}
+
+func (j *jsonIndent) add(c byte) {
+	switch {
+	case j.plain:
+		j.out = append(j.out, c)
+		return
+	case j.inStr:
+		j.out = append(j.out, c)
+		if j.escaped {
+			j.escaped = false
+		} else if c == '\\' {
+			j.escaped = true
+		} else if c == '"' {
+			j.inStr = false
+		}
+		return
+	case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		// the white space between tokens is ours to write
+		return
+	case j.depth == 0:
+		if j.values == 0 && c != '{' && c != '[' {
+			j.plain = true
+			j.warn("not JSON, printing it as is")
+			j.out = append(j.out, c)
+			return
+		}
+		if j.values > 0 && (c == '{' || c == '[') {
+			j.out = append(j.out, '\n')
+		}
+	}
+	if j.start {
+		j.start = false
+		if c == '}' || c == ']' {
+			// {} and [] stay on one line
+			j.depth--
+			j.out = append(j.out, c)
+			j.closed()
+			return
+		}
+		j.newline()
+	}
+	switch c {
+	case '{', '[':
+		j.out = append(j.out, c)
+		j.depth++
+		j.start = true
+	case '}', ']':
+		j.depth--
+		if j.depth < 0 {
+			j.plain = true
+			j.warn("a " + string(c) + " with nothing to close, printing the rest as is")
+		} else {
+			j.newline()
+		}
+		j.out = append(j.out, c)
+		j.closed()
+	case ',':
+		j.out = append(j.out, c)
+		j.newline()
+	case ':':
+		j.out = append(j.out, ':', ' ')
+	case '"':
+		j.inStr = true
+		j.out = append(j.out, c)
+	default:
+		j.out = append(j.out, c)
+	}
+}
+
+func (j *jsonIndent) warn(why string) {
+	if !j.warned {
+		j.warned = true
+		fmt.Fprintf(os.Stderr, "fetch: %s: -pretty: %s\n", j.url, why)
+	}
+}
+
+// closed counts a top level value once its last bracket is written.
+func (j *jsonIndent) closed() {
+	if j.depth == 0 {
+		j.values++
+	}
+}
+
+func (j *jsonIndent) newline() {
+	j.out = append(j.out, '\n')
+	for range j.depth {
+		j.out = append(j.out, ' ', ' ')
+	}
+}
+
+// poll is the -interval mode, a tiny uptime monitor. every round fetches each URL once and prints
+// a timestamped status line for it. Ctrl-C (or -count rounds) ends it with a summary.
+func poll(client *http.Client, urls []string) int {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	for _, url := range urls {
+		for i := 0; i < *warmup; i++ {
+			// the response doesn't matter, only that its connection is now open and in the pool
+			if resp, err := do(client, url, nil); err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var ok, failed int
+	// the times of the successful fetches, for the min/avg/max in the summary
+	var fastest, slowest, total time.Duration
+	code := exitOK
+loop:
+	for round := 1; ; round++ {
+		for _, url := range urls {
+			if c, took := pollOnce(client, url); c != exitOK {
+				failed++
+				if c > code {
+					code = c
+				}
+			} else {
+				ok++
+				total += took
+				if ok == 1 || took < fastest {
+					fastest = took
+				}
+				if took > slowest {
+					slowest = took
+				}
+			}
+		}
+		if *pollCount > 0 && round == *pollCount {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			break loop
+		}
+	}
+
+	if ok > 0 {
+		// finer than the status lines, a local server answers well under a millisecond
+		avg := total / time.Duration(ok)
+		fmt.Printf("%d ok, %d failed, min/avg/max %v/%v/%v\n", ok, failed,
+			fastest.Round(time.Microsecond), avg.Round(time.Microsecond), slowest.Round(time.Microsecond))
+	} else {
+		fmt.Printf("%d ok, %d failed\n", ok, failed)
+	}
+	return code
+}
+
+// pollOnce fetches url, throws the body away and prints one status line. it returns how long
+// that took as well. anything but a 2xx counts as a failure here, that is the point of monitoring.
+func pollOnce(client *http.Client, url string) (int, time.Duration) {
+	start := time.Now()
+	resp, err := do(client, url, nil)
+	stamp := start.Format(time.RFC3339)
+	if err != nil {
+		fmt.Printf("%s ERR %v\n", stamp, err)
+		return errorCode(err), 0
+	}
+	r := fetchlib.Read(resp, start, nil)
+	if r.Err != nil {
+		fmt.Printf("%s ERR %v\n", stamp, r.Err)
+		return errorCode(r.Err), 0
+	}
+	fmt.Printf("%s %d %s %s %v %s\n", stamp, r.Status, http.StatusText(r.Status), size(r.Bytes), r.Duration.Round(time.Millisecond), url)
+	if r.Status < 200 || r.Status > 299 {
+		return exitHTTP, r.Duration
+	}
+	return exitOK, r.Duration
+}
+
+// snapshot is one fetched copy of the upstream response, everything -serve needs to replay it
+type snapshot struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// serve is the -serve mode. it fetches url, then answers every request on -serve with that copy,
+// whatever the path. with -refresh a goroutine swaps in a fresh copy from time to time, keeping
+// the old one when the upstream is down, which is the whole point of a local replay.
+func serve(client *http.Client, url string) int {
+	snap, err := takeSnapshot(client, url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		if errors.Is(err, errTooBig) {
+			return exitSkipped
+		}
+		return errorCode(err)
+	}
+	var mu sync.RWMutex
+	// printed before the refresher starts, which could swap snap under us
+	fmt.Fprintf(os.Stderr, "serving %s (%s) on %s\n", url, size(int64(len(snap.body))), *serveAddr)
+
+	if *refresh > 0 {
+		go func() {
+			for range time.Tick(*refresh) {
+				s, err := takeSnapshot(client, url)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "fetch: refresh failed, still serving the old copy: %v\n", err)
+					continue
+				}
+				// an upstream that is down often still answers, with a 502 or a 503. that is no
+				// reason to give up a good copy. this goroutine is the only one that writes snap,
+				// so it can read it without the lock
+				if s.status/100 != 2 && snap.status/100 == 2 {
+					fmt.Fprintf(os.Stderr, "fetch: refresh got %d %s, still serving the old copy\n", s.status, http.StatusText(s.status))
+					continue
+				}
+				mu.Lock()
+				snap = s
+				mu.Unlock()
+			}
+		}()
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		s := snap
+		mu.RUnlock()
+		if s.contentType != "" {
+			w.Header().Set("Content-Type", s.contentType)
+		}
+		w.WriteHeader(s.status)
+		w.Write(s.body)
+	})
+	if err := http.ListenAndServe(*serveAddr, handler); err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitUsage
+	}
+	return exitOK
+}
+
+// takeSnapshot fetches url and keeps the whole body in memory, so -max is worth setting for big ones.
+func takeSnapshot(client *http.Client, url string) (*snapshot, error) {
+	resp, err := do(client, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	if *maxSize > 0 {
+		r = &capReader{r: r, max: *maxSize}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", url, err)
+	}
+	return &snapshot{status: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: b}, nil
+}
+
+// checkHead is the first phase of -head-first. it reports what a HEAD says about the body and
+// decides whether the GET should go ahead. when it shouldn't, the exit code is returned too.
+func checkHead(client *http.Client, url string) (int, bool) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return exitUsage, false
+	}
+	setHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fetchlib.ExplainTLS(err, *tlsMin)
+		fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
+		return errorCode(err), false
+	}
+	resp.Body.Close()
+
+	length := "unknown"
+	if resp.ContentLength >= 0 {
+		length = size(resp.ContentLength)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s, %s, %s\n", url, resp.Status, length, resp.Header.Get("Content-Type"))
+
+	if *maxSize > 0 && resp.ContentLength > *maxSize {
+		fmt.Fprintf(os.Stderr, "fetch: %s: skipping, bigger than -max %s\n", url, size(*maxSize))
+		return exitSkipped, false
+	}
+	if *yes {
+		return exitOK, true
+	}
+
+	fmt.Fprint(os.Stderr, "download? [y/N] ")
+	answer, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "fetch: reading answer: %v\n", err)
+		return exitUsage, false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return exitOK, true
+	}
+	return exitSkipped, false
+}
+
+// do sends a GET, or a POST when there is a request body, or the -X method. t, when not nil,
+// gets the request's timings.
+func do(client *http.Client, url string, t *timing) (*http.Response, error) {
+	verb := "GET"
+	var r io.Reader
+	if body != nil {
+		// a bytes.Reader lets NewRequest fill in ContentLength for us
+		verb, r = "POST", bytes.NewReader(body)
+	}
+	if *method != "" {
+		verb = *method
+	}
+	req, err := http.NewRequest(verb, url, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// same default as curl -d
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if *compressed {
+		// before setHeaders, so an -H Accept-Encoding still has the last word
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	setHeaders(req)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	if ifModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	}
+	if resumeFrom > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	if t != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.trace()))
+	}
+	// a redirect's request gets the same context, which is how showHop finds this
+	req = req.WithContext(context.WithValue(req.Context(), hopKey{}, &hopClock{last: time.Now()}))
+	resp, err := client.Do(req)
+	if err != nil && *httpFallback && inferred[url] {
+		// a URL someone typed https:// into themselves meant it, and is never downgraded
+		plain := "http://" + strings.TrimPrefix(url, "https://")
+		fmt.Fprintf(os.Stderr, "fetch: %s: %v, trying %s\n", url, fetchlib.ExplainTLS(err, *tlsMin), plain)
+		return do(client, plain, t)
+	}
+	if err != nil {
+		return nil, fetchlib.ExplainTLS(err, *tlsMin)
+	}
+	return resp, nil
+}
+
+// setHeaders puts -host, -u and the -H headers on req. every request fetch sends goes through
+// here, the HEADs of -head-first and -segments too, so they ask the same server the same way
+func setHeaders(req *http.Request) {
+	// an empty Host means the URL's, so this is a no-op without -host
+	req.Host = *hostHeader
+	if user, pass, ok := strings.Cut(*basicAuth, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	// the first -H of a name replaces what fetch set, the ones after it add more values
+	seen := map[string]bool{}
+	for _, h := range requestHeaders {
+		switch {
+		case h.key == "Host":
+			// Go ignores a Host in req.Header, it only sends req.Host
+			req.Host = h.value
+		case h.value == "" && h.key == "User-Agent":
+			// without the key Go sends its own, an empty value is how to send none
+			req.Header["User-Agent"] = []string{""}
+		case h.value == "":
+			req.Header.Del(h.key)
+		case !seen[h.key]:
+			req.Header.Set(h.key, h.value)
+		default:
+			req.Header.Add(h.key, h.value)
+		}
+		seen[h.key] = true
+	}
+}
+
+// withScheme checks that raw is an http or https URL, and makes one out of a bare host
+// (with or without a path) by putting https:// in front.
+func withScheme(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+		inferred[raw] = true
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%s: scheme %q isn't supported, only http and https", raw, u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%s: no host in the URL", raw)
+	}
+	return raw, nil
+}
+
+// hopKey is the context key of a request's hopClock.
+type hopKey struct{}
+
+// hopClock is when the latest hop of a redirect chain started.
+type hopClock struct {
+	last time.Time
+}
+
+// showHop is the -show-redirects line for a redirect the client follows. req is the next hop,
+// its Response is the redirect that led there and via is every request made so far.
+func showHop(req *http.Request, via []*http.Request) {
+	if !*showRedirects {
+		return
+	}
+	var took time.Duration
+	if c, ok := req.Context().Value(hopKey{}).(*hopClock); ok {
+		now := time.Now()
+		took, c.last = now.Sub(c.last), now
+	}
+	fmt.Fprintf(os.Stderr, "fetch: redirect %d: %s %s -> %s (%.3fs)\n", len(via), req.Response.Status,
+		via[len(via)-1].URL, req.Response.Header.Get("Location"), took.Seconds())
+}
+
+// timing collects when each phase of a request started and ended, from httptrace's callbacks.
+// a phase that never happened (no TLS for http://, no DNS or connect on a reused connection)
+// keeps zero times and is reported as "-".
+type timing struct {
+	start               time.Time
+	dnsStart, dnsDone   time.Time
+	connStart, connDone time.Time
+	tlsStart, tlsDone   time.Time
+	firstByte           time.Time
+}
+
+func (t *timing) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { t.connStart = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connDone = time.Now() },
+		TLSHandshakeStart:    func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+// report prints one aligned line per phase. first byte and total are counted from the start.
+func (t *timing) report(w io.Writer) {
+	end := time.Now()
+	phase := func(name string, from, to time.Time) {
+		if from.IsZero() || to.IsZero() {
+			fmt.Fprintf(w, "%-12s -\n", name+":")
+			return
+		}
+		fmt.Fprintf(w, "%-12s %v\n", name+":", to.Sub(from).Round(time.Microsecond))
+	}
+	phase("dns", t.dnsStart, t.dnsDone)
+	phase("connect", t.connStart, t.connDone)
+	phase("tls", t.tlsStart, t.tlsDone)
+	phase("first byte", t.start, t.firstByte)
+	phase("total", t.start, end)
+}
+
+// size formats a byte count as "1536 bytes", or as "1.5 KiB" with -h.
+func size(n int64) string {
+	if !*human {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return humanSize(n)
+}
+
+// humanSize picks the biggest binary unit that keeps the number at 1 or more.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		v /= 1024
+		if v < 1024 || unit == "GiB" {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+	}
+	panic("unreachable")
+}
+
+// parseStatus reads an -expect-status value: a status code like 404, or a class like 2xx.
+func parseStatus(s string) (lo, hi int, err error) {
+	if len(s) == 3 && s[0] >= '1' && s[0] <= '5' && strings.ToLower(s[1:]) == "xx" {
+		lo = int(s[0]-'0') * 100
+		return lo, lo + 99, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 100 || n > 599 {
+		return 0, 0, fmt.Errorf("-expect-status must be a status code like 200 or a class like 2xx, not %q", s)
+	}
+	return n, n, nil
+}
+
+// header is one -H. an empty value means the header is taken out instead of sent.
+type header struct {
+	key, value string
+}
+
+type headerList []header
+
+func (h *headerList) String() string {
+	var s []string
+	for _, kv := range *h {
+		s = append(s, kv.key+": "+kv.value)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h *headerList) Set(v string) error {
+	key, value, ok := strings.Cut(v, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return fmt.Errorf("want \"Key: Value\", not %q", v)
+	}
+	*h = append(*h, header{key: http.CanonicalHeaderKey(key), value: strings.TrimSpace(value)})
+	return nil
+}
+
+// headerCheck is one -expect-header. absent checks only look at the key.
+type headerCheck struct {
+	key    string
+	substr string
+	absent bool
+}
+
+type headerChecks []headerCheck
+
+func (h *headerChecks) String() string {
+	var s []string
+	for _, c := range *h {
+		if c.absent {
+			s = append(s, "!"+c.key)
+		} else {
+			s = append(s, c.key+": "+c.substr)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h *headerChecks) Set(v string) error {
+	if key, ok := strings.CutPrefix(v, "!"); ok {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return fmt.Errorf("no header name in %q", v)
+		}
+		*h = append(*h, headerCheck{key: key, absent: true})
+		return nil
+	}
+	key, substr, ok := strings.Cut(v, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("want \"Key: substring\" or \"!Key\", not %q", v)
+	}
+	*h = append(*h, headerCheck{key: key, substr: strings.TrimSpace(substr)})
+	return nil
+}
+
+// check returns a line for every check the headers fail. a header sent more than once
+// passes when any of its values contains the substring.
+func (h headerChecks) check(header http.Header) []string {
+	var failed []string
+	for _, c := range h {
+		values := header.Values(c.key)
+		switch {
+		case c.absent && len(values) > 0:
+			failed = append(failed, fmt.Sprintf("expected no header %s, got %q", c.key, strings.Join(values, ", ")))
+		case c.absent:
+		case len(values) == 0:
+			failed = append(failed, fmt.Sprintf("expected header %s, there is none", c.key))
+		default:
+			found := false
+			for _, v := range values {
+				if strings.Contains(v, c.substr) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				failed = append(failed, fmt.Sprintf("expected %s to contain %q, got %q", c.key, c.substr, strings.Join(values, ", ")))
+			}
+		}
+	}
+	return failed
+}
+
+// rateReader slows reads down to rate bytes per second. it keeps track of how many bytes have gone
+// through and sleeps until the clock says that many bytes were allowed, so the average stays on target.
+type rateReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newRateReader(r io.Reader, rate int64) *rateReader {
+	return &rateReader{r: r, rate: rate, start: time.Now()}
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	// never ask for more than a second's worth, otherwise one big read blows through the limit
+	if int64(len(p)) > rr.rate {
+		p = p[:rr.rate]
+	}
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	// a zero byte read (an empty body, or EOF) has nothing to wait for
+	if n > 0 {
+		// in floats, rr.n * int64(time.Second) would overflow once about 9.2GB had gone by
+		due := time.Duration(float64(rr.n) / float64(rr.rate) * float64(time.Second))
+		if wait := due - time.Since(rr.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// average is the real rate so far in bytes per second.
+func (rr *rateReader) average() float64 {
+	secs := time.Since(rr.start).Seconds()
+	if secs == 0 {
+		return 0
+	}
+	return float64(rr.n) / secs
+}
+
+// errorCode picks between a timeout and any other transport error.
+func errorCode(err error) int {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return exitTimeout
+	}
+	return exitTransport
+}
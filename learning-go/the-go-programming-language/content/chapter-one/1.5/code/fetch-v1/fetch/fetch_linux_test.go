@@ -0,0 +1,154 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// fullListener listens with a backlog of 0 and takes up its one place with a connection of its
+// own, so Linux ignores every connection after that and a dial to it hangs until it times out
+func fullListener(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return l.Addr().String()
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer slow.Close()
+	full := "http://" + fullListener(t)
+	tests := []struct {
+		args   []string
+		code   int
+		stderr string
+	}{
+		{[]string{"-connect-timeout", "200ms", full}, exitTimeout, "i/o timeout"},
+		{[]string{"-response-header-timeout", "200ms", slow.URL}, exitTimeout, "timeout awaiting response headers"},
+		// each one only covers its own phase: connecting to slow is quick, and full never gets as
+		// far as waiting for headers
+		{[]string{"-connect-timeout", "200ms", slow.URL}, exitOK, ""},
+		{[]string{"-response-header-timeout", "200ms", "-timeout", "400ms", full}, exitTimeout, "Client.Timeout"},
+		// -timeout is the whole request, when it is the shorter one it wins
+		{[]string{"-timeout", "200ms", "-response-header-timeout", "5s", slow.URL}, exitTimeout, "Client.Timeout"},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		_, stderr, code := runFetch(t, tt.args...)
+		if code != tt.code || !strings.Contains(stderr, tt.stderr) {
+			t.Errorf("%v: exit %d, %q, want exit %d and %q", tt.args, code, stderr, tt.code, tt.stderr)
+		}
+		if took := time.Since(start); tt.code == exitTimeout && took > 900*time.Millisecond {
+			t.Errorf("%v: took %v, the timeout didn't cut it short", tt.args, took)
+		}
+	}
+}
+
+// openPTY opens a pseudo terminal and returns both ends: what is written to tty comes out of pty
+func openPTY(t *testing.T) (pty, tty *os.File) {
+	t.Helper()
+	pty, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { pty.Close() })
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pty.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatal(errno)
+	}
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pty.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatal(errno)
+	}
+	tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+	return pty, tty
+}
+
+func TestPager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/binary" {
+			w.Write([]byte("bin\x00ary"))
+			return
+		}
+		io.WriteString(w, "a page of text\n")
+	}))
+	defer srv.Close()
+	tests := []struct {
+		args      []string
+		pagerExit string
+		paged     string
+		code      int
+	}{
+		{[]string{srv.URL}, "0", "a page of text\n", exitOK},
+		{[]string{"-i", srv.URL}, "0", "HTTP/1.1 200 OK\n", exitOK},
+		{[]string{"-no-pager", srv.URL}, "0", "", exitOK},
+		{[]string{srv.URL + "/binary"}, "0", "", exitOK},
+		// a pager that fails is fetch failing
+		{[]string{srv.URL}, "3", "a page of text\n", exitPipe},
+	}
+	for _, tt := range tests {
+		pty, tty := openPTY(t)
+		// whatever reaches the terminal has to be read, or a big write would block
+		go io.Copy(io.Discard, pty)
+		paged := filepath.Join(t.TempDir(), "paged")
+		cmd := fetchCmd(tt.args...)
+		// the pager is this test binary again, without FETCH_TEST_ARGS it is a pager and not fetch
+		cmd.Env = append(cmd.Env, "PAGER=env -u FETCH_TEST_ARGS "+os.Args[0], "FETCH_TEST_PAGER="+paged, "FETCH_TEST_PAGER_EXIT="+tt.pagerExit)
+		var stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = tty, &stderr
+		err := cmd.Run()
+		code := cmd.ProcessState.ExitCode()
+		if err != nil && code <= 0 {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(paged)
+		if code != tt.code || !strings.HasPrefix(string(got), tt.paged) || tt.paged == "" && got != nil {
+			t.Errorf("%v: exit %d, pager got %q, want exit %d, %q\n%s", tt.args, code, got, tt.code, tt.paged, stderr.String())
+		}
+	}
+
+	// into a pipe the body goes straight out, a script wants it and not a pager
+	paged := filepath.Join(t.TempDir(), "paged")
+	cmd := fetchCmd(srv.URL)
+	cmd.Env = append(cmd.Env, "PAGER=env -u FETCH_TEST_ARGS "+os.Args[0], "FETCH_TEST_PAGER="+paged)
+	stdout, _, code := run(t, cmd)
+	if _, err := os.Stat(paged); code != exitOK || stdout != "a page of text\n" || !os.IsNotExist(err) {
+		t.Errorf("into a pipe: exit %d, %q, the pager ran: %v", code, stdout, err == nil)
+	}
+}
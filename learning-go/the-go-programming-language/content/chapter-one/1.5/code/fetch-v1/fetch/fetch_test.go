@@ -0,0 +1,1338 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// TestMain runs fetch itself instead of the tests when FETCH_TEST_ARGS is set, so a test can see
+// what the program does end to end, exit code included, by running its own binary that way
+//
+// with FETCH_TEST_PAGER set instead it is a pager: it copies its stdin into that file and exits
+// with FETCH_TEST_PAGER_EXIT
+func TestMain(m *testing.M) {
+	if name, ok := os.LookupEnv("FETCH_TEST_PAGER"); ok && os.Getenv("FETCH_TEST_ARGS") == "" {
+		b, _ := io.ReadAll(os.Stdin)
+		os.WriteFile(name, b, 0o644)
+		code, _ := strconv.Atoi(os.Getenv("FETCH_TEST_PAGER_EXIT"))
+		os.Exit(code)
+	}
+	if args, ok := os.LookupEnv("FETCH_TEST_ARGS"); ok {
+		var argv []string
+		if err := json.Unmarshal([]byte(args), &argv); err != nil {
+			panic(err)
+		}
+		Main(argv)
+	}
+	os.Exit(m.Run())
+}
+
+// fetchCmd is fetch with args, run through TestMain in a process of its own
+func fetchCmd(args ...string) *exec.Cmd {
+	// JSON and not spaces, an argument can have spaces in it
+	argv, _ := json.Marshal(args)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FETCH_TEST_ARGS="+string(argv), "PAGER=cat")
+	return cmd
+}
+
+// run runs cmd and returns what it printed and its exit code
+func run(t *testing.T, cmd *exec.Cmd) (stdout, stderr string, code int) {
+	t.Helper()
+	var out, errOut strings.Builder
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+// runFetch is run(t, fetchCmd(args...)) for a test that needs nothing else set up
+func runFetch(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	return run(t, fetchCmd(args...))
+}
+
+var htmlTextTests = []struct {
+	in, want string
+}{
+	{"", ""},
+	{"hello", "hello\n"},
+	// a block ending and the next one starting leave a blank line between, like paragraphs
+	{"<p>a &amp; b</p><p>c</p>", "a & b\n\nc\n"},
+	{"  lots   of\n\tspace  ", "lots of space\n"},
+	{"<div></div><div></div><div></div>x", "x\n"},
+	{"a<div></div><div></div><div></div>b", "a\n\nb\n"},
+	{"a<br>b<br/>c", "a\nb\nc\n"},
+	{"<script>if (a < b) {}</script>text", "text\n"},
+	{"<STYLE>p { color: red }</STYLE>text", "text\n"},
+	{`<a title="1 > 0">link</a>`, "link\n"},
+	{"<!-- <p> a > b -->after", "after\n"},
+	{"x &lt;y&gt; &#233; &unknown z", "x <y> é &unknown z\n"},
+	{"<title>T</title><h1>Head</h1>body", "T\n\nHead\nbody\n"},
+}
+
+// readAll reads all of r through a buffer of size bytes
+func readAll(r io.Reader, size int) (string, error) {
+	var out strings.Builder
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), err
+		}
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	for _, tt := range htmlTextTests {
+		got, err := readAll(&htmlText{r: strings.NewReader(tt.in)}, 4096)
+		if err != nil || got != tt.want {
+			t.Errorf("htmlText(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// TestHTMLTextSmallReads checks the text is the same however it is read: a byte at a time from the
+// page, a byte at a time out of htmlText, or both.
+func TestHTMLTextSmallReads(t *testing.T) {
+	for _, tt := range htmlTextTests {
+		for _, c := range []struct {
+			name string
+			r    io.Reader
+			size int
+		}{
+			{"one byte in", iotest.OneByteReader(strings.NewReader(tt.in)), 4096},
+			{"one byte out", strings.NewReader(tt.in), 1},
+			{"both", iotest.OneByteReader(strings.NewReader(tt.in)), 1},
+			{"three bytes out", strings.NewReader(tt.in), 3},
+		} {
+			got, err := readAll(&htmlText{r: c.r}, c.size)
+			if err != nil || got != tt.want {
+				t.Errorf("%s: htmlText(%q) = %q, %v, want %q", c.name, tt.in, got, err, tt.want)
+			}
+		}
+	}
+}
+
+// TestHostHeader checks -host and -H Host pick the virtual host, against a server that answers
+// each name with a different page
+func TestHostHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "a.example.com":
+			io.WriteString(w, "site a")
+		case "b.example.com":
+			io.WriteString(w, "site b")
+		default:
+			io.WriteString(w, "default site")
+		}
+	}))
+	defer srv.Close()
+	t.Cleanup(func() { *hostHeader, requestHeaders = "", nil })
+	tests := []struct {
+		host string
+		h    headerList
+		want string
+	}{
+		{"", nil, "default site"},
+		{"a.example.com", nil, "site a"},
+		{"", headerList{{"Host", "b.example.com"}}, "site b"},
+		// -H comes last, so it wins over -host
+		{"a.example.com", headerList{{"Host", "b.example.com"}}, "site b"},
+	}
+	for _, tt := range tests {
+		*hostHeader, requestHeaders = tt.host, tt.h
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		setHeaders(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tt.want {
+			t.Errorf("-host %q -H %v got %q, want %q", tt.host, tt.h.String(), b, tt.want)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer srv.Close()
+	// a server that was there and is gone, so connecting to it is refused
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{srv.URL}, exitOK},
+		{nil, exitUsage},
+		{[]string{"-no-such-flag", srv.URL}, exitUsage},
+		{[]string{"ftp://example.com/"}, exitUsage},
+		{[]string{gone.URL}, exitTransport},
+		{[]string{"-timeout", "100ms", srv.URL + "/slow"}, exitTimeout},
+		{[]string{srv.URL + "/missing"}, exitOK},
+		{[]string{"-fail", srv.URL + "/missing"}, exitHTTP},
+		{[]string{"-max", "1", srv.URL}, exitSkipped},
+		{[]string{"-sha256", strings.Repeat("0", 64), srv.URL}, exitChecksum},
+		// the worst of several failures is the one that decides
+		{[]string{"-fail", gone.URL, srv.URL + "/missing", srv.URL}, exitHTTP},
+		{[]string{"-timeout", "100ms", srv.URL + "/slow", gone.URL}, exitTimeout},
+	}
+	for _, tt := range tests {
+		if _, stderr, code := runFetch(t, tt.args...); code != tt.want {
+			t.Errorf("fetch %s: exit %d, want %d\n%s", strings.Join(tt.args, " "), code, tt.want, stderr)
+		}
+	}
+}
+
+// echoServer answers with the request's method, Content-Length and body
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %d %q", r.Method, r.ContentLength, b)
+	}))
+}
+
+func TestStdinBody(t *testing.T) {
+	srv := echoServer()
+	defer srv.Close()
+	payload := `{"name": "gopher", "bytes": "` + strings.Repeat("x", 100<<10) + `"}`
+	for _, args := range [][]string{{"-stdin-body"}, {"-d", "@-"}} {
+		cmd := fetchCmd(append(args, srv.URL)...)
+		pr, pw := io.Pipe()
+		cmd.Stdin = pr
+		go func() {
+			// in pieces, the way a program writing into the pipe would
+			for i := 0; i < len(payload); i += 4096 {
+				pw.Write([]byte(payload[i:min(i+4096, len(payload))]))
+			}
+			pw.Close()
+		}()
+		stdout, stderr, code := run(t, cmd)
+		want := fmt.Sprintf("POST %d %q", len(payload), payload)
+		if code != exitOK || stdout != want {
+			t.Errorf("%v: exit %d, server got %.60q..., want %.60q...\n%s", args, code, stdout, want, stderr)
+		}
+	}
+
+	if _, _, code := runFetch(t, "-d", "x", "-stdin-body", srv.URL); code != exitUsage {
+		t.Errorf("-d with -stdin-body: exit %d, want %d", code, exitUsage)
+	}
+}
+
+func TestHeadFirst(t *testing.T) {
+	var gets atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			gets.Add(1)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "the body")
+	}))
+	defer srv.Close()
+	tests := []struct {
+		args   []string
+		answer string
+		code   int
+		body   string
+		gets   int32
+	}{
+		// -yes never reads stdin, the empty one here would mean no otherwise
+		{[]string{"-head-first", "-yes"}, "", exitOK, "the body", 1},
+		{[]string{"-head-first"}, "y\n", exitOK, "the body", 1},
+		{[]string{"-head-first"}, "n\n", exitSkipped, "", 0},
+		{[]string{"-head-first"}, "", exitSkipped, "", 0},
+		// the HEAD says 8 bytes, so -max turns it down without asking
+		{[]string{"-head-first", "-yes", "-max", "4"}, "", exitSkipped, "", 0},
+	}
+	for _, tt := range tests {
+		gets.Store(0)
+		cmd := fetchCmd(append(tt.args, srv.URL)...)
+		cmd.Stdin = strings.NewReader(tt.answer)
+		stdout, stderr, code := run(t, cmd)
+		if code != tt.code || stdout != tt.body || gets.Load() != tt.gets {
+			t.Errorf("%v answering %q: exit %d, %q after %d GETs, want exit %d, %q after %d\n%s",
+				tt.args, tt.answer, code, stdout, gets.Load(), tt.code, tt.body, tt.gets, stderr)
+		}
+		if !strings.Contains(stderr, "200 OK, 8 bytes, text/plain") {
+			t.Errorf("%v: the HEAD isn't shown:\n%s", tt.args, stderr)
+		}
+	}
+}
+
+func TestPretty(t *testing.T) {
+	tests := []struct {
+		ctype, in, want string
+		warning         string
+	}{
+		{"application/json", `{"b":1,"a":[true,null,"x, y"],"e":{},"f":[]}`,
+			"{\n  \"b\": 1,\n  \"a\": [\n    true,\n    null,\n    \"x, y\"\n  ],\n  \"e\": {},\n  \"f\": []\n}\n", ""},
+		{"application/problem+json", `[{"k":"{not a brace}"}]`, "[\n  {\n    \"k\": \"{not a brace}\"\n  }\n]\n", ""},
+		// a JSON stream has one value a line
+		{"application/json", `{"a":1}{"a":2}`, "{\n  \"a\": 1\n}\n{\n  \"a\": 2\n}\n", ""},
+		{"application/json", "not json at all", "not json at all", "not JSON"},
+		{"application/json", `{"a":1}]]`, "{\n  \"a\": 1\n}]]", "nothing to close"},
+		{"application/json", `{"a":[1,`, "{\n  \"a\": [\n    1,\n    ", "stops in the middle"},
+		// only JSON is touched, and -pretty doesn't guess from the body
+		{"text/plain", `{"a":1}`, `{"a":1}`, ""},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.ctype)
+			io.WriteString(w, tt.in)
+		}))
+		stdout, stderr, code := runFetch(t, "-pretty", srv.URL)
+		srv.Close()
+		if code != exitOK || stdout != tt.want {
+			t.Errorf("-pretty %s %q: exit %d, %q, want %q", tt.ctype, tt.in, code, stdout, tt.want)
+		}
+		if tt.warning == "" && stderr != "" || !strings.Contains(stderr, tt.warning) {
+			t.Errorf("-pretty %s %q: stderr %q, want a warning with %q", tt.ctype, tt.in, stderr, tt.warning)
+		}
+	}
+}
+
+// statusLine is what -interval prints for each fetch, and summary is its last line
+var (
+	statusLine = regexp.MustCompile(`(?m)^\S+ (\d{3} .*|ERR .*)$`)
+	summary    = regexp.MustCompile(`(?m)^(\d+) ok, (\d+) failed`)
+)
+
+func TestInterval(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/down" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		args       []string
+		hits       int32
+		ok, failed string
+		code       int
+	}{
+		{[]string{"-interval", "10ms", "-count", "3", srv.URL}, 3, "3", "0", exitOK},
+		// every round fetches every URL
+		{[]string{"-interval", "10ms", "-count", "2", srv.URL, srv.URL + "/down"}, 4, "2", "2", exitHTTP},
+	}
+	for _, tt := range tests {
+		hits.Store(0)
+		stdout, stderr, code := runFetch(t, tt.args...)
+		lines := statusLine.FindAllString(stdout, -1)
+		m := summary.FindStringSubmatch(stdout)
+		if code != tt.code || hits.Load() != tt.hits || len(lines) != int(tt.hits) || m == nil || m[1] != tt.ok || m[2] != tt.failed {
+			t.Errorf("%v: exit %d after %d requests, want %d after %d\n%s%s", tt.args, code, hits.Load(), tt.code, tt.hits, stdout, stderr)
+		}
+	}
+}
+
+// TestIntervalInterrupt checks Ctrl-C ends -interval with its summary and no error
+func TestIntervalInterrupt(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer srv.Close()
+	cmd := fetchCmd("-interval", "20ms", srv.URL)
+	var out strings.Builder
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for hits.Load() < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cmd.Process.Signal(os.Interrupt)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("after Ctrl-C: %v\n%s", err, out.String())
+	}
+	m := summary.FindStringSubmatch(out.String())
+	if m == nil || m[1] != strconv.Itoa(len(statusLine.FindAllString(out.String(), -1))) || m[2] != "0" {
+		t.Errorf("summary doesn't match the status lines:\n%s", out.String())
+	}
+}
+
+func TestRateReader(t *testing.T) {
+	tests := []struct {
+		size, rate int64
+		least      time.Duration
+	}{
+		{3000, 10000, 300 * time.Millisecond},
+		// reads smaller than a second's worth still add up to the same wait
+		{500, 1000, 500 * time.Millisecond},
+		// nothing to read is nothing to wait for, and doesn't hang
+		{0, 1, 0},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		rr := newRateReader(bytes.NewReader(make([]byte, tt.size)), tt.rate)
+		got, err := readAll(rr, 64)
+		took := time.Since(start)
+		if err != nil || int64(len(got)) != tt.size {
+			t.Errorf("%d bytes at %d/s: read %d, %v", tt.size, tt.rate, len(got), err)
+		}
+		if took < tt.least || took > tt.least+time.Second {
+			t.Errorf("%d bytes at %d/s took %v, want about %v", tt.size, tt.rate, took, tt.least)
+		}
+		if tt.size > 0 && rr.average() > float64(tt.rate)*1.05 {
+			t.Errorf("%d bytes at %d/s: average %.0f/s", tt.size, tt.rate, rr.average())
+		}
+	}
+}
+
+// TestRateReaderBig checks the throttle still works past 9.2GB, where the bytes so far times
+// a second in nanoseconds no longer fits in an int64. reading a byte on from 10GiB at 1TiB/s is
+// due 10ms after the start, and has to wait for it
+func TestRateReaderBig(t *testing.T) {
+	rr := newRateReader(strings.NewReader("x"), 1<<40)
+	rr.n = 10 << 30
+	start := time.Now()
+	if _, err := rr.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 5*time.Millisecond || took > time.Second {
+		t.Errorf("the read after 10GiB at 1TiB/s took %v, want about 10ms", took)
+	}
+}
+
+func TestOutputAtomic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cut":
+			// says 1000 bytes and stops after 100, like a connection that dies
+			w.Header().Set("Content-Length", "1000")
+			w.Write(make([]byte, 100))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case "/stall":
+			w.Write(make([]byte, 100))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Second)
+		default:
+			io.WriteString(w, "new")
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		args []string
+		path string
+		code int
+		want string
+	}{
+		{nil, "/", exitOK, "new"},
+		{nil, "/cut", exitTransport, "old"},
+		// -timeout runs out halfway through the body
+		{[]string{"-timeout", "200ms"}, "/stall", exitTimeout, "old"},
+		{[]string{"-sha256", strings.Repeat("0", 64)}, "/", exitChecksum, "old"},
+		{[]string{"-min-bytes", "10"}, "/", exitSkipped, "old"},
+	}
+	for _, tt := range tests {
+		for _, existed := range []bool{true, false} {
+			dir := t.TempDir()
+			out := filepath.Join(dir, "out")
+			if existed {
+				os.WriteFile(out, []byte("old"), 0o644)
+			}
+			_, stderr, code := runFetch(t, append(tt.args, "-o", out, srv.URL+tt.path)...)
+			want := tt.want
+			if !existed && want == "old" {
+				want = ""
+			}
+			got, err := os.ReadFile(out)
+			if code != tt.code || string(got) != want || want == "" && !os.IsNotExist(err) {
+				t.Errorf("%v %s with a file there %v: exit %d, file %q (%v), want exit %d, %q\n%s",
+					tt.args, tt.path, existed, code, got, err, tt.code, want, stderr)
+			}
+			// nothing of the download is left lying around next to it
+			if names, _ := filepath.Glob(filepath.Join(dir, ".out.part-*")); len(names) > 0 {
+				t.Errorf("%v %s: left %v behind", tt.args, tt.path, names)
+			}
+		}
+	}
+}
+
+// trusting is fetchCmd for a client that trusts srv's certificate, through SSL_CERT_FILE
+func trusting(t *testing.T, srv *httptest.Server, args ...string) *exec.Cmd {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := fetchCmd(args...)
+	cmd.Env = append(cmd.Env, "SSL_CERT_FILE="+name)
+	return cmd
+}
+
+func TestTimings(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "body") })
+	plain := httptest.NewServer(h)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(h)
+	defer secure.Close()
+	phase := regexp.MustCompile(`(?m)^([a-z ]+): +(\S+)$`)
+	tests := []struct {
+		name string
+		cmd  *exec.Cmd
+		// the phases that have to have a time, the rest have to be -. the URL is an IP, so no DNS
+		timed []string
+	}{
+		{"http", fetchCmd("-timings", plain.URL), []string{"connect", "first byte", "total"}},
+		{"-w", fetchCmd("-w", plain.URL), []string{"connect", "first byte", "total"}},
+		{"https", trusting(t, secure, "-timings", secure.URL), []string{"connect", "tls", "first byte", "total"}},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := run(t, tt.cmd)
+		if code != exitOK || stdout != "body" {
+			t.Errorf("%s: exit %d, %q on stdout\n%s", tt.name, code, stdout, stderr)
+			continue
+		}
+		got := make(map[string]string)
+		for _, m := range phase.FindAllStringSubmatch(stderr, -1) {
+			got[m[1]] = m[2]
+		}
+		for _, name := range []string{"dns", "connect", "tls", "first byte", "total"} {
+			v, ok := got[name]
+			switch {
+			case !ok:
+				t.Errorf("%s: no %s line in\n%s", tt.name, name, stderr)
+			case slices.Contains(tt.timed, name):
+				if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+					t.Errorf("%s: %s is %q, want a time above 0\n%s", tt.name, name, v, stderr)
+				}
+			case v != "-":
+				t.Errorf("%s: %s is %q, want -\n%s", tt.name, name, v, stderr)
+			}
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		in     string
+		lo, hi int
+		ok     bool
+	}{
+		{"200", 200, 200, true},
+		{"204", 204, 204, true},
+		{"599", 599, 599, true},
+		{"2xx", 200, 299, true},
+		{"4XX", 400, 499, true},
+		{"1xx", 100, 199, true},
+		{"6xx", 0, 0, false},
+		{"0xx", 0, 0, false},
+		{"2x", 0, 0, false},
+		{"99", 0, 0, false},
+		{"600", 0, 0, false},
+		{"ok", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		lo, hi, err := parseStatus(tt.in)
+		if lo != tt.lo || hi != tt.hi || (err == nil) != tt.ok {
+			t.Errorf("parseStatus(%q) = %d, %d, %v, want %d, %d, ok %v", tt.in, lo, hi, err, tt.lo, tt.hi, tt.ok)
+		}
+	}
+}
+
+func TestExpectStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(code)
+		io.WriteString(w, "body")
+	}))
+	defer srv.Close()
+	tests := []struct {
+		expect, status string
+		code           int
+		body, stderr   string
+	}{
+		{"200", "200", exitOK, "body", ""},
+		{"201", "200", exitHTTP, "", "expected status 201, got 200 OK"},
+		{"2xx", "204", exitOK, "", ""},
+		{"2xx", "302", exitHTTP, "", "expected status 2xx, got 302 Found"},
+		// the status asked for is a success, even when it is an error otherwise
+		{"404", "404", exitOK, "body", ""},
+		{"4xx", "500", exitHTTP, "", "expected status 4xx, got 500 Internal Server Error"},
+		{"abc", "200", exitUsage, "", "-expect-status must be"},
+	}
+	for _, tt := range tests {
+		// -L=false so the 302 is what is checked, not where it leads
+		stdout, stderr, code := runFetch(t, "-expect-status", tt.expect, "-L=false", srv.URL+"/"+tt.status)
+		if code != tt.code || stdout != tt.body || !strings.Contains(stderr, tt.stderr) {
+			t.Errorf("-expect-status %s on a %s: exit %d, %q, stderr %q, want exit %d, %q, stderr with %q",
+				tt.expect, tt.status, code, stdout, stderr, tt.code, tt.body, tt.stderr)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Zebra", "z")
+		w.Header().Add("X-Apple", "a1")
+		w.Header().Add("X-Apple", "a2")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "the body")
+	}))
+	defer srv.Close()
+	stdout, stderr, code := runFetch(t, "-i", srv.URL)
+	head, body, ok := strings.Cut(stdout, "\n\n")
+	if code != exitOK || !ok || body != "the body" {
+		t.Fatalf("exit %d, %q\n%s", code, stdout, stderr)
+	}
+	lines := strings.Split(head, "\n")
+	if lines[0] != "HTTP/1.1 201 Created" {
+		t.Errorf("status line %q", lines[0])
+	}
+	// sorted by name, a header sent twice on two lines in the order it came
+	var got []string
+	for _, l := range lines[1:] {
+		if strings.HasPrefix(l, "X-") || strings.HasPrefix(l, "Content-Type") {
+			got = append(got, l)
+		}
+	}
+	if !slices.Equal(got, []string{"Content-Type: text/plain", "X-Apple: a1", "X-Apple: a2", "X-Zebra: z"}) {
+		t.Errorf("headers %q", got)
+	}
+	if !slices.IsSorted(lines[1:]) {
+		t.Errorf("headers aren't sorted:\n%s", head)
+	}
+
+	// the same goes into the -o file, so it can be saved along with the body
+	out := filepath.Join(t.TempDir(), "out")
+	if _, stderr, code := runFetch(t, "-i", "-o", out, srv.URL); code != exitOK {
+		t.Fatalf("-i -o: exit %d\n%s", code, stderr)
+	}
+	// all but the Date, which can be a second later the second time
+	date := regexp.MustCompile(`(?m)^Date: .*\n`)
+	if b, _ := os.ReadFile(out); date.ReplaceAllString(string(b), "") != date.ReplaceAllString(stdout, "") {
+		t.Errorf("-i -o wrote %q, want what -i printed, %q", b, stdout)
+	}
+}
+
+// TestDrain checks a body that was turned down still frees its connection for the next request,
+// unless it is so big that reading the rest of it would cost more than a new connection
+func TestDrain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Write(make([]byte, n))
+	}))
+	defer srv.Close()
+	for _, tt := range []struct {
+		size   int
+		reused bool
+	}{
+		{0, true},
+		{100 << 10, true},
+		{drainLimit, true},
+		// more than Close reads off by itself in the Go versions that do: closeBody reads
+		// drainLimit of it, and leaves Close only the rest
+		{drainLimit + drainLimit/2, true},
+		{16 * drainLimit, false},
+	} {
+		client := &http.Client{Transport: &http.Transport{}}
+		var reused []bool
+		for range 3 {
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) }}
+			req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", srv.URL+"?n="+strconv.Itoa(tt.size), nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a body nobody wants, like after -fail or -expect-status turned it down
+			closeBody(resp.Body)
+		}
+		if want := []bool{false, tt.reused, tt.reused}; !slices.Equal(reused, want) {
+			t.Errorf("%d byte body: connections reused %v, want %v", tt.size, reused, want)
+		}
+	}
+}
+
+// TestBrokenPipe is fetch | head: once the reader has gone, fetch stops quietly with 0
+func TestBrokenPipe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("line\n"), 1<<20))
+	}))
+	defer srv.Close()
+	for _, args := range [][]string{{srv.URL}, {"-i", srv.URL}, {"-pipe", "cat", srv.URL}} {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := fetchCmd(args...)
+		var stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = pw, &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		pw.Close()
+		// what head -1 does: read a little and go away
+		buf := make([]byte, 64)
+		if _, err := io.ReadFull(pr, buf); err != nil {
+			t.Fatal(err)
+		}
+		pr.Close()
+		err = cmd.Wait()
+		if err != nil || stderr.Len() > 0 {
+			t.Errorf("%v into a closed pipe: %v, stderr %q", args, err, stderr.String())
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	payload := bytes.Repeat([]byte("binary \x00\xff line\n"), 50000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer srv.Close()
+	tests := []struct {
+		cmd    string
+		code   int
+		stdout string
+	}{
+		{"cat", exitOK, string(payload)},
+		{"wc -l | tr -d ' '", exitOK, "50000\n"},
+		// the command's own exit status is passed on, like grep -q's 1 for no match
+		{"grep -q nothing-like-this", 1, ""},
+		{"cat >/dev/null; exit 3", 3, ""},
+		// one killed by a signal has no status of its own
+		{"kill -TERM $$", exitPipe, ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runFetch(t, "-pipe", tt.cmd, srv.URL)
+		if code != tt.code || stdout != tt.stdout {
+			t.Errorf("-pipe %q: exit %d, %d bytes out, want exit %d, %d bytes\n%s", tt.cmd, code, len(stdout), tt.code, len(tt.stdout), stderr)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	var down atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.test+json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"version": %d}`, version.Load())
+	}))
+	defer upstream.Close()
+	// a free port for fetch to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := fetchCmd("-serve", addr, "-refresh", "50ms", upstream.URL)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	// the path doesn't matter, every one gets the copy
+	served := func() (*http.Response, string) {
+		resp, err := http.Get("http://" + addr + "/any/path")
+		if err != nil {
+			return nil, ""
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+	// waits up to a second for the body to be want
+	waitFor := func(want string) *http.Response {
+		t.Helper()
+		var resp *http.Response
+		var body string
+		for range 100 {
+			if resp, body = served(); body == want {
+				return resp
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("served %q, want %q", body, want)
+		return nil
+	}
+
+	resp := waitFor(`{"version": 1}`)
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Content-Type") != "application/vnd.test+json" {
+		t.Errorf("served %d %s, want the upstream's 202 application/vnd.test+json", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	version.Store(2)
+	waitFor(`{"version": 2}`)
+
+	// an upstream that answers with an error page is down as well, the last good copy stays
+	down.Store(true)
+	version.Store(3)
+	time.Sleep(200 * time.Millisecond)
+	waitFor(`{"version": 2}`)
+}
+
+func TestHeaderChecks(t *testing.T) {
+	header := http.Header{
+		"Content-Type": {"application/json; charset=utf-8"},
+		"Vary":         {"Origin", "Accept-Encoding"},
+	}
+	tests := []struct {
+		flags  []string
+		failed []string
+	}{
+		{[]string{"Content-Type: application/json"}, nil},
+		// names aren't case sensitive, a repeated header passes when any value matches
+		{[]string{"content-type:json", "Vary: Accept"}, nil},
+		{[]string{"Content-Type:"}, nil},
+		{[]string{"!Set-Cookie"}, nil},
+		{[]string{"Content-Type: text/html"}, []string{`expected Content-Type to contain "text/html", got "application/json; charset=utf-8"`}},
+		{[]string{"X-Request-Id: a"}, []string{"expected header X-Request-Id, there is none"}},
+		{[]string{"!Vary"}, []string{`expected no header Vary, got "Origin, Accept-Encoding"`}},
+		// every check is run, not just up to the first that fails
+		{[]string{"X-A: 1", "Vary: Origin", "!Content-Type"}, []string{
+			"expected header X-A, there is none",
+			`expected no header Content-Type, got "application/json; charset=utf-8"`,
+		}},
+	}
+	for _, tt := range tests {
+		var checks headerChecks
+		for _, f := range tt.flags {
+			if err := checks.Set(f); err != nil {
+				t.Fatalf("Set(%q): %v", f, err)
+			}
+		}
+		if got := checks.check(header); !slices.Equal(got, tt.failed) {
+			t.Errorf("%q: failed %q, want %q", tt.flags, got, tt.failed)
+		}
+	}
+	for _, bad := range []string{"no colon", ": x", "!", "! "} {
+		var checks headerChecks
+		if err := checks.Set(bad); err == nil {
+			t.Errorf("Set(%q) worked", bad)
+		}
+	}
+}
+
+func TestExpectHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+	}))
+	defer srv.Close()
+	stdout, _, code := runFetch(t, "-expect-header", "Content-Type: json", "-expect-header", "!Set-Cookie", srv.URL)
+	if code != exitOK || stdout != "{}" {
+		t.Errorf("passing checks: exit %d, %q", code, stdout)
+	}
+	stdout, stderr, code := runFetch(t, "-expect-header", "X-Missing: a", "-expect-header", "!Content-Type", srv.URL)
+	if code != exitHTTP || stdout != "" || !strings.Contains(stderr, "X-Missing") || !strings.Contains(stderr, "no header Content-Type") {
+		t.Errorf("failing checks: exit %d, %q\n%s", code, stdout, stderr)
+	}
+}
+
+func TestContinue(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch r.URL.Path {
+		case "/noranges":
+			io.WriteString(w, content)
+		case "/wrongrange":
+			// starts at 0 whatever was asked for
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, content)
+		default:
+			http.ServeContent(w, r, "f", modTime, strings.NewReader(content))
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		path, have string
+		code       int
+		rang, want string
+	}{
+		{"/", content[:400], exitOK, "bytes=400-", content},
+		{"/", "", exitOK, "", content},
+		// complete already: the 416 means there is nothing left to get
+		{"/", content, exitOK, "bytes=1000-", content},
+		{"/noranges", content[:400], exitOK, "bytes=400-", content},
+		// a range that doesn't start where the file ends would leave a hole or a repeat
+		{"/wrongrange", content[:400], exitTransport, "bytes=400-", content[:400]},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(t.TempDir(), "out")
+		if tt.have != "" {
+			os.WriteFile(out, []byte(tt.have), 0o644)
+		}
+		ranges = nil
+		_, stderr, code := runFetch(t, "-continue", "-o", out, srv.URL+tt.path)
+		got, _ := os.ReadFile(out)
+		if code != tt.code || string(got) != tt.want || !slices.Equal(ranges, []string{tt.rang}) {
+			t.Errorf("%s with %d bytes: exit %d, %d bytes after asking for %q, want exit %d, %d bytes after %q\n%s",
+				tt.path, len(tt.have), code, len(got), ranges, tt.code, len(tt.want), tt.rang, stderr)
+		}
+	}
+}
+
+func TestGzipOutput(t *testing.T) {
+	content := strings.Repeat("compress me please\n", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	tests := []struct {
+		args []string
+		file string
+	}{
+		{[]string{"-o", filepath.Join(dir, "a")}, "a.gz"},
+		{[]string{"-o", filepath.Join(dir, "b.gz")}, "b.gz"},
+	}
+	for _, tt := range tests {
+		_, stderr, code := runFetch(t, append(append([]string{"-gzip-output"}, tt.args...), srv.URL+"/page.txt")...)
+		if code != exitOK {
+			t.Fatalf("%v: exit %d\n%s", tt.args, code, stderr)
+		}
+		checkGzip(t, filepath.Join(dir, tt.file), content)
+		if want := fmt.Sprintf("%d bytes, ", len(content)); !strings.Contains(stderr, want) {
+			t.Errorf("%v: no %q in %q", tt.args, want, stderr)
+		}
+	}
+	// -O names the file after the URL, .gz is added to that
+	cmd := fetchCmd("-gzip-output", "-O", srv.URL+"/page.txt")
+	cmd.Dir = dir
+	if _, stderr, code := run(t, cmd); code != exitOK {
+		t.Fatalf("-O: exit %d\n%s", code, stderr)
+	}
+	checkGzip(t, filepath.Join(dir, "page.txt.gz"), content)
+}
+
+// checkGzip checks name is a whole gzip stream of want
+func checkGzip(t *testing.T, name, want string) {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	// ReadAll only gets to EOF past the footer's checksum, a file cut short fails here
+	got, err := io.ReadAll(zr)
+	if err != nil || string(got) != want {
+		t.Errorf("%s unpacks to %d bytes, %v, want %d", name, len(got), err, len(want))
+	}
+	if fi, _ := f.Stat(); fi.Size() >= int64(len(want)) {
+		t.Errorf("%s is %d bytes, no smaller than the %d it holds", name, fi.Size(), len(want))
+	}
+}
+
+func TestContinueIfRange(t *testing.T) {
+	versions := map[string]string{`"v1"`: strings.Repeat("1", 1000), `"v2"`: strings.Repeat("2", 1000)}
+	for _, tt := range []struct {
+		name, now string
+		status    int
+	}{
+		{"unchanged", `"v1"`, http.StatusPartialContent},
+		{"changed", `"v2"`, http.StatusOK},
+	} {
+		etag, cut := `"v1"`, true
+		var ifRange []string
+		var statuses []int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			if cut {
+				// the first download dies after 400 bytes
+				cut = false
+				w.Header().Set("Content-Length", "1000")
+				io.WriteString(w, versions[etag][:400])
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			ifRange = append(ifRange, r.Header.Get("If-Range"))
+			// through a recorder to see whether ServeContent, which does the If-Range check
+			// against the ETag, answered 200 or 206
+			rec := httptest.NewRecorder()
+			rec.Header().Set("ETag", etag)
+			http.ServeContent(rec, r, "f", time.Time{}, strings.NewReader(versions[etag]))
+			statuses = append(statuses, rec.Code)
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+		}))
+		out := filepath.Join(t.TempDir(), "out")
+		if _, _, code := runFetch(t, "-continue", "-o", out, srv.URL); code == exitOK {
+			t.Fatalf("%s: the cut download worked", tt.name)
+		}
+		if b, _ := os.ReadFile(out); len(b) != 400 {
+			t.Fatalf("%s: %d bytes after the cut download, want 400", tt.name, len(b))
+		}
+		etag = tt.now
+		_, stderr, code := runFetch(t, "-continue", "-o", out, srv.URL)
+		srv.Close()
+		got, _ := os.ReadFile(out)
+		// unchanged is the old start with the rest glued on, changed is the new file from scratch
+		want := versions[tt.now]
+		if code != exitOK || string(got) != want || !slices.Equal(ifRange, []string{`"v1"`}) || !slices.Equal(statuses, []int{tt.status}) {
+			t.Errorf("%s: exit %d, file %.20q... (%d bytes), If-Range %q, answered %v, want %.20q..., If-Range \"v1\", %d\n%s",
+				tt.name, code, got, len(got), ifRange, statuses, want, tt.status, stderr)
+		}
+		if _, err := os.Stat(validatorFile(out)); !os.IsNotExist(err) {
+			t.Errorf("%s: %s is still there after the download finished", tt.name, validatorFile(out))
+		}
+	}
+}
+
+func TestMinBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		w.Write(bytes.Repeat([]byte("x"), n))
+	}))
+	defer srv.Close()
+	tests := []struct {
+		args []string
+		n    int
+		code int
+	}{
+		{[]string{"-min-bytes", "100"}, 100, exitOK},
+		{[]string{"-min-bytes", "100"}, 99, exitSkipped},
+		{[]string{"-min-bytes", "1"}, 0, exitSkipped},
+		// with -max it is a window the size has to land in
+		{[]string{"-min-bytes", "10", "-max", "20"}, 15, exitOK},
+		{[]string{"-min-bytes", "10", "-max", "20"}, 21, exitSkipped},
+		{[]string{"-min-bytes", "30", "-max", "20"}, 25, exitUsage},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runFetch(t, append(tt.args, srv.URL+"?n="+strconv.Itoa(tt.n))...)
+		if code != tt.code {
+			t.Errorf("%v on %d bytes: exit %d, want %d\n%s", tt.args, tt.n, code, tt.code, stderr)
+		}
+		// a body that isn't big enough isn't printed either
+		if tt.code == exitOK && len(stdout) != tt.n || tt.code != exitOK && stdout != "" {
+			t.Errorf("%v on %d bytes: printed %d bytes", tt.args, tt.n, len(stdout))
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the warm-up requests are slow, so they would show in the max if they were counted
+		if hits.Add(1) <= 2 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+	stdout, stderr, code := runFetch(t, "-interval", "10ms", "-count", "3", "-warmup", "2", srv.URL)
+	if code != exitOK || hits.Load() != 5 {
+		t.Fatalf("exit %d after %d requests, want 0 after 5\n%s", code, hits.Load(), stderr)
+	}
+	if lines := statusLine.FindAllString(stdout, -1); len(lines) != 3 {
+		t.Errorf("%d status lines, want 3 without the warm-up ones:\n%s", len(lines), stdout)
+	}
+	m := regexp.MustCompile(`(?m)^3 ok, 0 failed, min/avg/max \S+/\S+/(\S+)$`).FindStringSubmatch(stdout)
+	if m == nil {
+		t.Fatalf("no summary of 3 ok:\n%s", stdout)
+	}
+	if slowest, err := time.ParseDuration(m[1]); err != nil || slowest >= 200*time.Millisecond {
+		t.Errorf("max is %s, a warm-up request was timed:\n%s", m[1], stdout)
+	}
+
+	if _, _, code := runFetch(t, "-warmup", "2", srv.URL); code != exitUsage {
+		t.Errorf("-warmup without -interval: exit %d, want %d", code, exitUsage)
+	}
+}
+
+func TestWithScheme(t *testing.T) {
+	tests := []struct {
+		in, want string
+		inferred bool
+		ok       bool
+	}{
+		{"golang.org", "https://golang.org", true, true},
+		{"golang.org/doc?x=1", "https://golang.org/doc?x=1", true, true},
+		{"localhost:8000/count", "https://localhost:8000/count", true, true},
+		{"http://golang.org", "http://golang.org", false, true},
+		{"HTTPS://golang.org", "HTTPS://golang.org", false, true},
+		{"ftp://golang.org/file", "", false, false},
+		{"file:///etc/passwd", "", false, false},
+		{"https://", "", false, false},
+		{"https://a b", "", false, false},
+	}
+	for _, tt := range tests {
+		clear(inferred)
+		got, err := withScheme(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("withScheme(%q) = %q, %v, want %q, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+		if tt.ok && inferred[got] != tt.inferred {
+			t.Errorf("withScheme(%q): inferred is %v, want %v", tt.in, inferred[got], tt.inferred)
+		}
+	}
+}
+
+func TestHTTPFallback(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "over TLS: %v", r.TLS != nil)
+	})
+	plain := httptest.NewServer(h)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(h)
+	defer secure.Close()
+	bare := func(srv *httptest.Server) string {
+		_, host, _ := strings.Cut(srv.URL, "://")
+		return host
+	}
+	tests := []struct {
+		name   string
+		cmd    *exec.Cmd
+		code   int
+		stdout string
+	}{
+		// https is tried first and is all it takes when it works
+		{"https server", trusting(t, secure, "-http-fallback", bare(secure)), exitOK, "over TLS: true"},
+		{"plain server", fetchCmd(bare(plain)), exitTransport, ""},
+		{"plain server, -http-fallback", fetchCmd("-http-fallback", bare(plain)), exitOK, "over TLS: false"},
+		// a URL that says https means it, it never goes out over plain http
+		{"https:// given", fetchCmd("-http-fallback", "https://"+bare(plain)), exitTransport, ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := run(t, tt.cmd)
+		if code != tt.code || stdout != tt.stdout {
+			t.Errorf("%s: exit %d, %q, want exit %d, %q\n%s", tt.name, code, stdout, tt.code, tt.stdout, stderr)
+		}
+	}
+}
+
+func TestHeaderListSet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want header
+		ok   bool
+	}{
+		{"Accept: application/json", header{"Accept", "application/json"}, true},
+		{"x-request-id:abc", header{"X-Request-Id", "abc"}, true},
+		{"Authorization: Bearer a:b", header{"Authorization", "Bearer a:b"}, true},
+		{"User-Agent:", header{"User-Agent", ""}, true},
+		{"no colon", header{}, false},
+		{": value", header{}, false},
+		{"Two Words: x", header{}, false},
+	}
+	for _, tt := range tests {
+		var h headerList
+		err := h.Set(tt.in)
+		if (err == nil) != tt.ok || tt.ok && (len(h) != 1 || h[0] != tt.want) {
+			t.Errorf("Set(%q) = %v, %v, want %v, ok %v", tt.in, h, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRequestFlags(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		user, pass, _ := r.BasicAuth()
+		fmt.Fprintf(w, "%s %q %q %q %q %q %q", r.Method, r.Header.Get("Content-Type"), r.Header.Values("X-Tag"),
+			r.Header.Values("User-Agent"), user, pass, b)
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "body.json")
+	os.WriteFile(file, []byte(`{"from": "file"}`), 0o644)
+	agent := `["Go-http-client/1.1"]`
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, `GET "" [] ` + agent + ` "" "" ""`},
+		{[]string{"-d", "a=1"}, `POST "application/x-www-form-urlencoded" [] ` + agent + ` "" "" "a=1"`},
+		{[]string{"-d", "@" + file, "-H", "Content-Type: application/json"}, `POST "application/json" [] ` + agent + ` "" "" "{\"from\": \"file\"}"`},
+		{[]string{"-X", "put", "-d", "x"}, `PUT "application/x-www-form-urlencoded" [] ` + agent + ` "" "" "x"`},
+		{[]string{"-X", "DELETE"}, `DELETE "" [] ` + agent + ` "" "" ""`},
+		// the first -H of a name replaces, the rest add to it
+		{[]string{"-H", "X-Tag: a", "-H", "x-tag: b"}, `GET "" ["a" "b"] ` + agent + ` "" "" ""`},
+		{[]string{"-H", "User-Agent: mine/1.0"}, `GET "" [] ["mine/1.0"] "" "" ""`},
+		{[]string{"-H", "User-Agent:"}, `GET "" [] [] "" "" ""`},
+		{[]string{"-d", "x", "-H", "Content-Type:"}, `POST "" [] ` + agent + ` "" "" "x"`},
+		{[]string{"-u", "gopher:p:w"}, `GET "" [] ` + agent + ` "gopher" "p:w" ""`},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runFetch(t, append(tt.args, srv.URL)...)
+		if code != exitOK || stdout != tt.want {
+			t.Errorf("%q: exit %d, server saw\n\t%s\nwant\n\t%s\n%s", tt.args, code, stdout, tt.want, stderr)
+		}
+	}
+	for _, args := range [][]string{{"-u", "no-colon"}, {"-H", "bad"}, {"-d", "@" + file + ".missing"}} {
+		if _, _, code := runFetch(t, append(args, srv.URL)...); code != exitUsage {
+			t.Errorf("%q: exit %d, want %d", args, code, exitUsage)
+		}
+	}
+}
+
+func TestSHA256(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "verify me")
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256([]byte("verify me"))
+	good := hex.EncodeToString(sum[:])
+	tests := []struct {
+		sha    string
+		code   int
+		stdout string
+	}{
+		{good, exitOK, "verify me"},
+		{strings.ToUpper(good), exitOK, "verify me"},
+		// - only prints it, for finding out what to pass next time
+		{"-", exitOK, "verify me"},
+		{strings.Repeat("0", 64), exitChecksum, ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr, code := runFetch(t, "-sha256", tt.sha, srv.URL)
+		if code != tt.code || stdout != tt.stdout {
+			t.Errorf("-sha256 %s: exit %d, %q, want exit %d, %q\n%s", tt.sha, code, stdout, tt.code, tt.stdout, stderr)
+		}
+		// the body's own sum is printed every time, like sha256sum prints it
+		if !strings.Contains(stderr, good+"  "+srv.URL) {
+			t.Errorf("-sha256 %s: the body's sum isn't shown:\n%s", tt.sha, stderr)
+		}
+		if tt.code == exitChecksum && !strings.Contains(stderr, "expected sha256 "+tt.sha) {
+			t.Errorf("-sha256 %s: the mismatch doesn't say what was expected:\n%s", tt.sha, stderr)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	defer func(h bool) { *human = h }(*human)
+	tests := []struct {
+		n      int64
+		plain  string
+		pretty string
+	}{
+		{0, "0 bytes", "0 B"},
+		{1023, "1023 bytes", "1023 B"},
+		{1024, "1024 bytes", "1.0 KiB"},
+		{1536, "1536 bytes", "1.5 KiB"},
+		{1 << 20, "1048576 bytes", "1.0 MiB"},
+		{5<<30 + 1<<29, "5905580032 bytes", "5.5 GiB"},
+		{3 << 40, "3298534883328 bytes", "3072.0 GiB"},
+	}
+	for _, tt := range tests {
+		*human = false
+		if got := size(tt.n); got != tt.plain {
+			t.Errorf("size(%d) = %q, want %q", tt.n, got, tt.plain)
+		}
+		*human = true
+		if got := size(tt.n); got != tt.pretty {
+			t.Errorf("with -h, size(%d) = %q, want %q", tt.n, got, tt.pretty)
+		}
+	}
+}
+
+// TestStreaming checks a transformed body is printed as it comes in: the server sends the first
+// half of a big gzipped page and then waits, and fetch has to have printed text from it by then.
+// a fetch that read the whole body before printing would never get past the first half.
+func TestStreaming(t *testing.T) {
+	page := strings.Repeat("<p>a line of text on the page</p>\n", 1<<16)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, page)
+		zw.Flush()
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+		io.WriteString(zw, page)
+		zw.Close()
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	for _, args := range [][]string{{"-compressed"}, {"-compressed", "-text"}} {
+		cmd := fetchCmd(append(args, srv.URL)...)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan error, 1)
+		go func() {
+			// half the page's text, which can only have come from the first half of the body
+			_, err := io.CopyN(io.Discard, out, int64(len("a line of text on the page\n")<<15))
+			got <- err
+		}()
+		select {
+		case err := <-got:
+			if err != nil {
+				t.Errorf("%v: %v", args, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%v: nothing printed while the server was still sending", args)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
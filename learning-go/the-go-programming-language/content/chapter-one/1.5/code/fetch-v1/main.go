@@ -1,30 +1,15 @@
 // Fetch prints the content found at a URL.
+//
+// the program itself is package fetch, so gopltool can run it as gopltool fetch. its flags and
+// exit codes are described there
 package main
 
 import (
-	"fmt"
-	"net/http"
 	"os"
-	"io/ioutil"
+
+	"gopl/chapter-one/1.5/code/fetch-v1/fetch"
 )
 
 func main() {
-	
-	for _, url := range os.Args[1:] {
-		resp, err := http.Get(url)
-
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "fetch: %v\n", err)
-			os.Exit(1)
-		}
-		b, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "fetch: reading %s: %v\n", url, err)
-			os.Exit(1)
-		}
-
-		fmt.Printf("%s", b)
-	}
-}
\ No newline at end of file
+	fetch.Main(os.Args[1:])
+}
@@ -0,0 +1,2916 @@
+// Package fetchall is the fetchall program, which fetches URLs in parallel and reports their
+// times and sizes.
+package fetchall
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"gopl/chapter-one/fetchlib"
+	"gopl/chapter-one/internal/cli"
+)
+
+// Flags are fetchall's flags, parsed by Main
+var Flags = cli.NewFlagSet("fetchall")
+
+var table = Flags.Bool("table", false, "print the results as an aligned table once every fetch is done")
+
+// turning keep-alives off makes every request pay for a new TCP (and TLS) handshake,
+// which is slower but shows the real connection setup cost
+var noKeepAlive = Flags.Bool("no-keepalive", false, "open a fresh connection for every request")
+
+var retries = Flags.Int("retries", 0, "retry a URL this many times on a 429, a 503 or a transport error worth retrying")
+
+// -retries is per URL, so a thousand URLs at a backend that is down make a thousand times that
+// many requests. -retry-budget caps the retries of the whole run, first come first served
+var retryBudget = Flags.Int64("retry-budget", 0, "retry at most this many times in total across all URLs (0 means no cap)")
+
+// retriesUsed is how many retries have been made, which with -retry-budget is also how much of it is gone
+var retriesUsed atomic.Int64
+
+// only some transport errors are worth a second try: a reset connection or a timeout may well
+// work next time, a name that doesn't resolve or a port nobody listens on won't. -v prints the verdict
+var verbose = Flags.Bool("v", false, "say what kind of transport error each failed attempt was and whether it is retried")
+
+// a Retry-After header can ask for any delay it likes, so we never wait longer than this
+var maxRetryAfter = Flags.Duration("max-retry-after", 30*time.Second, "longest Retry-After delay to honor")
+
+// -backoff is how long we wait before the first retry when the server doesn't tell us,
+// and it doubles for every retry after that, up to -max-retry-after
+var backoffBase = Flags.Duration("backoff", time.Second, "with -retries, wait this long before the first retry and twice as long before each one after it")
+
+// -timeout is for one attempt, body included, so a hung connection is given up on and retried.
+// -max-time is the limit for a URL with all its retries
+var attemptTimeout = Flags.Duration("timeout", 0, "give up on each attempt after this long, body included (0 means no limit)")
+
+// when a backend falls over, every URL to it fails at the same moment and, with the same
+// backoff, they would all come back at the same moment too. -jitter waits a random time
+// between none and the backoff instead (full jitter), which spreads them out. a Retry-After
+// from the server is still honored as it is, that is a time it asked for
+var jitter = Flags.Bool("jitter", false, "wait a random part of each retry backoff, so failed URLs don't all retry at once")
+
+// jitterRand is seeded from -seed. fetches retry from many goroutines, and a rand.Rand
+// isn't safe for that on its own, hence the lock
+var jitterRand struct {
+	sync.Mutex
+	*rand.Rand
+}
+
+var mirror = Flags.String("mirror", "", "save each body under this directory as host/path/index (host/path/index.html for a path ending in /), like wget --mirror")
+
+// -extract-links is the start of a link checker: it lists what each HTML page links to (and the
+// <loc> URLs of a sitemap.xml), and -recurse fetches those links too, each link only once. -depth
+// is how far it goes: 1 is the links on the pages given, 2 the links on those pages as well, and so on.
+// -recurse -depth N is the crawl mode that was asked for as -crawl URL -depth N, but -crawl was
+// already the per-host politeness switch, so the link crawl got a name of its own
+var extractLinks = Flags.Bool("extract-links", false, "list the href and src links of every HTML page fetched, and the URLs in every sitemap")
+var recurse = Flags.Bool("recurse", false, "crawl: fetch the links -extract-links finds as well, -depth links deep (the link crawl is this and not -crawl, which is per-host politeness)")
+var depth = Flags.Int("depth", 1, "how many links away from the URLs given -recurse goes (setting it turns -recurse on)")
+
+// a crawler that follows links by itself is what robots.txt is for, so -recurse asks it before
+// following a link to a host. the URLs given are always fetched, someone asked for those by name.
+// -same-host keeps the crawl on the sites it started on, a page's links to other hosts are left alone
+var obeyRobots = Flags.Bool("robots", true, "with -recurse, don't follow the links robots.txt disallows (the URLs given are fetched anyway)")
+var sameHost = Flags.Bool("same-host", false, "with -recurse, only follow links to the same host as the page they are on")
+
+// robots has the robots.txt of every host -recurse has followed a link to
+var robots = &robotsCache{hosts: make(map[string]*robotsEntry)}
+
+// followed is the -recurse dedup set
+var followed = &linkSet{seen: make(map[string]bool)}
+
+// the same URL given twice is only fetched once, or its bytes are counted twice. URLs are
+// compared after canonicalURL, so HTTP://Example.com:80 and http://example.com/ are one URL
+var allowDup = Flags.Bool("allow-dup", false, "fetch a URL every time it is given, not only the first")
+
+// -interval turns fetchall into a small uptime monitor: the URLs are fetched again every interval,
+// -repeat times or until Ctrl-C, and a table of each one's checks, error rate and latencies is kept
+// up to date. -monitor-log appends every check to a file as a JSON line, for graphing later
+var pollInterval = Flags.Duration("interval", 0, "fetch the URLs again this often and keep a table of how each one is doing")
+var repeat = Flags.Int("repeat", 0, "with -interval, stop after this many rounds (0 means until Ctrl-C)")
+var monitorLog = Flags.String("monitor-log", "", "with -interval, append every check to this file as a JSON line")
+
+// given is the dedup set for the URLs we were handed, from the arguments, -i and -stdin
+var given = &dupSet{first: make(map[string]string)}
+
+// -sort-by holds the output back until the end and prints it in order. only -sort-memory results
+// are kept in memory; past that they go to temp files in sorted runs, which are merged at the end,
+// so a huge run costs disk and a second read instead of RAM. below it nothing touches the disk
+var sortBy = Flags.String("sort-by", "", "print the results at the end, sorted by host (then latency) or by latency")
+var sortMemory = Flags.Int("sort-memory", 10000, "with -sort-by, results to sort in memory before spilling a sorted run to a temp file")
+
+// -budget is for metered links: a HEAD to every URL first says how big each body is, then the
+// smallest ones are picked until the next would go over, which fits in as many URLs as it can.
+// it trusts Content-Length, a URL whose HEAD doesn't give one is skipped as well
+var budget = Flags.Int64("budget", 0, "download at most this many bytes in all, skipping the URLs that would go over (0 means no limit)")
+
+// -shuffle starts the fetches in a random order, so a load test doesn't hit a server's pages
+// in the same order every time. the seed is printed to stderr, and -seed runs the same order again.
+// results only ever came out in the order they finished, so nothing else changes
+var shuffle = Flags.Bool("shuffle", false, "start the fetches in a random order instead of the order given")
+var seed = Flags.Int64("seed", 0, "with -shuffle or -jitter, the seed for the random numbers (0 picks one from the clock)")
+
+// -summary is the one to run over a big list to see what came back: a bar per status code and
+// per content type, so a pile of 404s or an HTML error page where JSON was expected stands out
+var showSummary = Flags.Bool("summary", false, "finish with a histogram of the status codes and content types that came back")
+
+var showByStatus = Flags.Bool("by-status", false, "finish with a table of how many responses got each status, and the bytes per status class")
+
+// byStatus adds up every result for -by-status and -summary, whatever -only-errors leaves out of the output
+var byStatus = statusTally{count: make(map[string]int), bytes: make(map[string]int64), types: make(map[string]int)}
+
+// after a big crawl the 4xx and 5xx pages are what you want to look at, so -split-by-status puts
+// them in a directory of their own, and failed fetches get their error saved under errors/
+var splitByStatus = Flags.Bool("split-by-status", false, "with -mirror, save under 2xx/, 3xx/, 4xx/, 5xx/ or errors/ first")
+
+var onlyErrors = Flags.Bool("only-errors", false, "only report URLs that failed or didn't return 2xx")
+
+var perHost = Flags.Int("per-host", 0, "at most this many requests at once to any one host (0 means no limit)")
+var delay = Flags.Duration("delay", 0, "with -per-host or -crawl, wait this long after a request to a host before starting the next one to it")
+
+// -crawl is the be-polite switch for fetching lots of pages off the same few sites:
+// one request at a time per host with a gap between them, while different hosts still go in parallel
+var crawl = Flags.Bool("crawl", false, "one request at a time per host, -delay apart (1s unless set), hosts still in parallel (to follow links, see -recurse)")
+
+// -concurrency is the fixed limit: a fetch only gets a goroutine once one of the N slots is
+// free, so 50,000 URLs from -i make N goroutines and N connections at a time, not 50,000.
+// the -i and -stdin readers just wait their turn
+var concurrency = Flags.Int("concurrency", 0, "run at most this many fetches at once, starting the next as one finishes (0 means all at once)")
+
+// with -adaptive, how many fetches run at once is worked out as it goes instead of all at once:
+// it creeps up while responses come back fast, and halves when one fails or is slower than -target-latency
+var adaptive = Flags.Bool("adaptive", false, "find a good number of fetches to run at once instead of starting them all")
+var minConcurrency = Flags.Int("min-concurrency", 1, "with -adaptive, never run fewer fetches at once than this")
+var maxConcurrency = Flags.Int("max-concurrency", 32, "with -adaptive, never run more fetches at once than this")
+var targetLatency = Flags.Duration("target-latency", time.Second, "with -adaptive, a fetch slower than this counts as the server struggling")
+
+// the circuit breaker stops a dead host from soaking up every retry of every URL pointing at it.
+// every fetch starts at once without -per-host, -concurrency or -adaptive, so it mostly helps together with those
+var breakAfter = Flags.Int("break-after", 0, "after this many failures in a row to a host, fail its other URLs straight away (0 means never)")
+var breakCooldown = Flags.Duration("break-cooldown", 10*time.Second, "how long a host's circuit stays open before one request is let through to try again")
+
+// circuits holds the -break-after state of every host
+var circuits = &breaker{hosts: make(map[string]*circuit)}
+
+// hosts hands out the -per-host slots
+var hosts = &hostLimiter{hosts: make(map[string]*hostSem), last: make(map[string]time.Time)}
+
+// slots is the -concurrency semaphore and ctl the -adaptive controller, both nil when they're off.
+// Main makes them before anything is fetched
+var slots chan struct{}
+var ctl *aimd
+
+var stdinURLs = Flags.Bool("stdin", false, "also read URLs from stdin like -i, starting each one as its line arrives instead of waiting for the end")
+
+var input = Flags.String("i", "", "read URLs from this file, one per line, as url or label<TAB>url (- for stdin)")
+
+var tlsMin = Flags.String("tls-min", "1.2", "oldest TLS version to accept: 1.2 or 1.3")
+
+// without -proxy the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used, like curl does
+var proxy = Flags.String("proxy", "", "send requests through this proxy: http://, https:// or socks5://host:port")
+
+var localAddr = Flags.String("local-addr", "", "make outgoing connections from this local IP, for machines with more than one")
+
+// -host is for virtual hosts: the connection still goes where the URL (or -resolve) points, but
+// the server is told it is being asked for another name. the TLS server name follows -host,
+// and the certificate is checked against it, unless -sni gives one of its own
+var hostHeader = Flags.String("host", "", "send this as the Host header, and as the TLS server name, instead of the URL's host")
+var sni = Flags.String("sni", "", "TLS server name to send and check the certificate against, when it should differ from -host")
+
+// resolve pins host:port to an address of our own choosing, like curl --resolve. only the
+// connection goes there: the Host header and the TLS server name are still the URL's host
+var resolve = fetchlib.Resolve{}
+
+// pins are the -pin hashes, see fetchlib.Pins
+var pins fetchlib.Pins
+
+func init() {
+	Flags.Var(&pins, "pin", "only accept a server whose certificate has this public key, as a base64 or hex SHA-256 of its SPKI, or sha256//base64 like curl (can be repeated, for backup keys)")
+}
+
+func init() {
+	Flags.Var(resolve, "resolve", "connect to addr for host:port, given as host:port:addr (can be repeated)")
+}
+
+// the phase timeouts are separate from each other: -connect-timeout is just the TCP connect, and
+// -response-header-timeout starts once the request is written and stops when the headers arrive.
+// there is no timeout on the body, a slow one is still waited for
+var connectTimeout = Flags.Duration("connect-timeout", 0, "give up on connecting after this long (0 means the default of 30s)")
+var headerTimeout = Flags.Duration("response-header-timeout", 0, "give up waiting for the response headers after this long (0 means no limit)")
+
+var dryRun = Flags.Bool("dry-run", false, "check and normalize every URL, show what would be fetched and stop")
+
+// the report is one JSON document for CI to keep as an artifact. with it, fetchall exits 1 if anything failed
+var report = Flags.String("report", "", "write every result and summary stats to this file as JSON, and exit 1 if any fetch failed")
+
+// -format json is the streaming cousin of -report: one JSON object per result on stdout as it
+// comes in, and -include-body puts the body in there too, so one file has both the metadata and
+// the content. -format csv is the same records for a spreadsheet. both end with one summary
+// record of the whole run, and the text summary lines go to stderr so they don't get in the way
+var format = cli.Format(Flags, "how to print the results: text, json (one object per line) or csv", "text", "json", "csv")
+var jsonl = Flags.Bool("jsonl", false, "short for -format json")
+var includeBody = Flags.Bool("include-body", false, "with -format json or -report, put the body in each result, as text or base64 and no longer than -max-size (1MiB if unset)")
+
+// HTTP/2 only happens over TLS here, plain http:// URLs always get HTTP/1.1
+var http2 = Flags.String("http2", "auto", "use HTTP/2 with servers that offer it: auto, on (an https:// server that won't is an error) or off")
+
+var summaryInterval = Flags.Duration("summary-interval", 0, "print a progress line to stderr this often during the run (0 means never)")
+
+var human = Flags.Bool("h", false, "show sizes in KiB, MiB and GiB instead of bytes")
+
+// -fail-fast stops the batch at the first failure. fetches still waiting for a -per-host or
+// -adaptive slot are skipped and the ones in flight are cancelled
+var failFast = Flags.Bool("fail-fast", false, "stop everything once a fetch fails to connect or read (or, with -strict, isn't 2xx)")
+var strict = Flags.Bool("strict", false, "with -fail-fast, a non-2xx status counts as a failure too")
+
+// errSkipped is the result of a fetch that -fail-fast stopped or never started
+var errSkipped = errors.New("skipped by -fail-fast")
+
+// -max-time is a hard limit on the whole fetch of one URL. the other timeouts only catch a
+// server that goes quiet, this one also catches a body that trickles in just fast enough
+var maxTime = Flags.Duration("max-time", 0, "give up on a URL this long after starting it, retries and body included (0 means no limit)")
+
+// errMaxTime marks the results of the fetches -max-time cut off
+var errMaxTime = errors.New("hit -max-time")
+
+// -grep looks at each body a line at a time as it streams in, and stops looking at the first
+// match. -max-size puts a limit on how much of a body is read at all, grep or not
+var grep = Flags.String("grep", "", "note whether each body has a line matching this regexp")
+var onlyMatches = Flags.Bool("only-matches", false, "with -grep, only report the URLs whose body matched")
+var maxSize = Flags.Int64("max-size", 0, "read at most this many bytes of each body (0 means all of it)")
+
+// -head sends a HEAD instead of a GET, so the time is the time to the response headers and no body
+// comes down at all. handy for checking a lot of endpoints are up without paying for the pages
+var headOnly = Flags.Bool("head", false, "send HEAD requests and only time the response headers, no bodies are read")
+
+// -limit-rate is per body, so with -n connections the whole run can use up to n times it
+var limitRate = Flags.Int64("limit-rate", 0, "read each body at no more than this many bytes per second (0 means no limit)")
+
+// pattern is -grep, compiled once in main
+var pattern *regexp.Regexp
+
+var print0 = Flags.Bool("print0", false, "with -dry-run, list just the normalized URLs, each ended by a NUL byte, for xargs -0")
+
+var colorMode = Flags.String("color", "auto", "color results by status: auto, always or never")
+
+// useColor is decided once in main from -color and whether stdout is a terminal
+var useColor bool
+
+// client is shared by every goroutine so they can reuse each other's connections
+var client *http.Client
+
+// target is one URL to fetch and the optional label it was given in the -i file
+type target struct {
+	label string
+	url   string
+	depth int // how many links away from a URL that was given, 0 for those themselves
+}
+
+// result is what each fetch goroutine sends back over the channel
+type result struct {
+	label  string
+	url    string
+	status int
+	nbytes int64
+	secs   float64
+	proto  string // what the server answered with, HTTP/1.1 or HTTP/2.0
+	reused bool   // the request went over a connection that was already open
+	cut    bool   // the body was longer than -max-size
+	match  string // "match" or "no match" with -grep, otherwise empty
+	links  []string
+	body   []byte // the start of the body with -include-body
+	text   bool   // body is text, so it can go in the JSON as a string
+	ctype  string // the media type of the Content-Type, without its parameters
+	// throttled means -limit-rate had to hold the body back at least once. a body smaller than
+	// a second's worth fits in the bucket and comes through at full speed, so it stays false
+	throttled bool
+	// attempts is how many requests it took, 1 unless it was retried. 0 means it never got as far as one
+	attempts int
+	err      error
+}
+
+// String is the streaming one-line form of a result.
+func (r result) String() string {
+	if r.err != nil {
+		if r.label != "" {
+			return paint(r.color(), fmt.Sprintf("[%s] %v%s", r.label, r.err, r.tries()))
+		}
+		return paint(r.color(), r.err.Error()+r.tries())
+	}
+	line := fmt.Sprintf("%.2fs %7s %s %s", r.secs, size(r.nbytes), r.proto, r.url)
+	if r.label != "" {
+		line = fmt.Sprintf("%.2fs %7s %s [%s] %s", r.secs, size(r.nbytes), r.proto, r.label, r.url)
+	}
+	if !r.ok() {
+		// without this a 404 looks just like a 200
+		line += fmt.Sprintf(" (%d %s)", r.status, http.StatusText(r.status))
+	}
+	return paint(r.color(), line+r.notes())
+}
+
+// notes are the -grep and -max-size remarks that go after the URL.
+func (r result) notes() string {
+	var s string
+	if r.match != "" {
+		s += " [" + r.match + "]"
+	}
+	if r.cut {
+		s += " (cut at -max-size)"
+	}
+	if r.throttled {
+		s += fmt.Sprintf(" (throttled to %s/s)", size(*limitRate))
+	}
+	return s + r.tries()
+}
+
+// tries says how many attempts a retried URL took, and nothing for the ones that took one.
+func (r result) tries() string {
+	if r.attempts < 2 {
+		return ""
+	}
+	return fmt.Sprintf(" (%d attempts)", r.attempts)
+}
+
+// size is a byte count for the output: the plain number, or KiB, MiB or GiB with -h.
+// the -report file always has plain bytes
+func size(n int64) string {
+	if !*human {
+		return strconv.FormatInt(n, 10)
+	}
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		v /= 1024
+		if v < 1024 || unit == "GiB" {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+	}
+	panic("unreachable")
+}
+
+// ok reports whether the fetch worked and the server answered 2xx.
+func (r result) ok() bool {
+	return r.err == nil && r.status >= 200 && r.status <= 299
+}
+
+// color is the ANSI color code for the result: green for 2xx, yellow for 3xx, red for errors.
+func (r result) color() string {
+	switch {
+	case r.err != nil || r.status >= 400:
+		return "31"
+	case r.status >= 300:
+		return "33"
+	case r.status >= 200:
+		return "32"
+	}
+	return "39" // the terminal's normal color
+}
+
+// paint wraps s in an ANSI color escape when colors are on.
+// every code we use is the same length, which keeps tabwriter's column math right
+func paint(color, s string) string {
+	if !useColor {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Main runs fetchall with argv, the command line without the program name, and exits the
+// process when it fails like the program always has.
+func Main(argv []string) {
+	cli.Parse(Flags, argv, 2)
+
+	if *crawl {
+		// whatever was set explicitly wins, -crawl only fills in the polite defaults
+		if *perHost == 0 {
+			*perHost = 1
+		}
+		if *delay == 0 {
+			*delay = time.Second
+		}
+	}
+	if *delay > 0 && *perHost == 0 {
+		fmt.Fprintln(os.Stderr, "fetchall: -delay needs -per-host or -crawl")
+		os.Exit(1)
+	}
+
+	switch *colorMode {
+	case "auto":
+		// escape codes would only get in the way of whatever is reading a pipe
+		useColor = isTerminal(os.Stdout)
+	case "always":
+		useColor = true
+	case "never":
+	default:
+		fmt.Fprintf(os.Stderr, "fetchall: -color must be auto, always or never, not %q\n", *colorMode)
+		os.Exit(1)
+	}
+
+	targets := make([]target, 0, Flags.NArg())
+	for _, url := range Flags.Args() {
+		targets = append(targets, target{url: url})
+	}
+	if *input != "" {
+		t, err := readTargets(*input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fetchall: %v\n", err)
+			os.Exit(1)
+		}
+		targets = append(targets, t...)
+	}
+
+	if *grep != "" {
+		var err error
+		if pattern, err = regexp.Compile(*grep); err != nil {
+			fmt.Fprintf(os.Stderr, "fetchall: -grep: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	Flags.Visit(func(f *flag.Flag) {
+		if f.Name == "depth" {
+			*recurse = true
+		}
+	})
+	if *depth < 1 {
+		fmt.Fprintln(os.Stderr, "fetchall: -depth has to be 1 or more")
+		os.Exit(1)
+	}
+	if *recurse {
+		*extractLinks = true
+	}
+	if *sortBy != "" && *sortBy != "host" && *sortBy != "latency" {
+		fmt.Fprintf(os.Stderr, "fetchall: -sort-by must be host or latency, not %q\n", *sortBy)
+		os.Exit(1)
+	}
+	if *sortBy != "" && (*table || *sortMemory < 1) {
+		fmt.Fprintln(os.Stderr, "fetchall: -sort-by can't be used with -table, and -sort-memory has to be 1 or more")
+		os.Exit(1)
+	}
+	if *budget > 0 && (*stdinURLs || *recurse) {
+		// -budget has to know every URL before the first GET, -stdin and -recurse find more later
+		fmt.Fprintln(os.Stderr, "fetchall: -budget can't be used with -stdin or -recurse")
+		os.Exit(1)
+	}
+	if *jsonl {
+		*format = "json"
+	}
+	// everything else keeps asking *jsonl, it means just what it always did
+	*jsonl = *format == "json"
+	if *format != "text" && *table {
+		fmt.Fprintln(os.Stderr, "fetchall: -format json or csv can't be used with -table")
+		os.Exit(1)
+	}
+	if *includeBody && !*jsonl && *report == "" {
+		fmt.Fprintln(os.Stderr, "fetchall: -include-body needs -format json or -report")
+		os.Exit(1)
+	}
+	if *extractLinks && !*recurse && *table {
+		fmt.Fprintln(os.Stderr, "fetchall: -extract-links lists links under each line, which -table doesn't have (-recurse works)")
+		os.Exit(1)
+	}
+
+	if *headOnly && (*grep != "" || *mirror != "" || *extractLinks || *includeBody) {
+		// every one of these needs the body, and a HEAD doesn't get one
+		fmt.Fprintln(os.Stderr, "fetchall: -head can't be used with -grep, -mirror, -extract-links, -recurse or -include-body")
+		os.Exit(1)
+	}
+	if *limitRate < 0 {
+		fmt.Fprintln(os.Stderr, "fetchall: -limit-rate can't be negative")
+		os.Exit(1)
+	}
+
+	if *splitByStatus && *mirror == "" {
+		fmt.Fprintln(os.Stderr, "fetchall: -split-by-status needs -mirror")
+		os.Exit(1)
+	}
+
+	if *stdinURLs && (*dryRun || *input == "-") {
+		fmt.Fprintln(os.Stderr, "fetchall: -stdin can't be used with -dry-run or -i -")
+		os.Exit(1)
+	}
+
+	if *repeat < 0 || *repeat > 0 && *pollInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "fetchall: -repeat needs -interval, and can't be negative")
+		os.Exit(1)
+	}
+	if *monitorLog != "" && *pollInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "fetchall: -monitor-log needs -interval")
+		os.Exit(1)
+	}
+	if *pollInterval > 0 && (*stdinURLs || *recurse || *budget > 0 || *sortBy != "" || *table || *report != "" || *format != "text" || *dryRun) {
+		// every round is the same fixed set of URLs, and the table is the only output
+		fmt.Fprintln(os.Stderr, "fetchall: -interval can't be used with -stdin, -recurse, -budget, -sort-by, -table, -report, -format or -dry-run")
+		os.Exit(1)
+	}
+
+	if !*allowDup {
+		kept := targets[:0]
+		at := make(map[string]int) // where each canonical URL is in kept
+		for _, t := range targets {
+			c := canonicalURL(t.url)
+			if given.keep(t.url) {
+				at[c] = len(kept)
+				kept = append(kept, t)
+			} else if i := at[c]; kept[i].label == "" {
+				// the URL is fetched once, under the first label it was given with
+				kept[i].label = t.label
+			}
+		}
+		targets = kept
+	}
+
+	if *dryRun {
+		urls := make([]string, len(targets))
+		for i, t := range targets {
+			urls[i] = t.url
+		}
+		check := checkURLs
+		if *print0 {
+			check = listURLs
+		}
+		if !check(os.Stdout, urls) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -host and -sni are for the targets, not for wherever their redirects go
+	targetURLs := make([]string, len(targets))
+	for i, t := range targets {
+		targetURLs[i] = t.url
+	}
+	var err error
+	client, err = fetchlib.NewClient(fetchlib.Options{
+		Timeout:         *attemptTimeout,
+		ConnectTimeout:  *connectTimeout,
+		HeaderTimeout:   *headerTimeout,
+		TLSMin:          *tlsMin,
+		ServerName:      fetchlib.ServerName(*hostHeader, *sni),
+		ServerNameHosts: fetchlib.Hosts(targetURLs),
+		Pins:            pins,
+		Resolve:         resolve,
+		LocalAddr:       *localAddr,
+		Proxy:           *proxy,
+		NoKeepAlive:     *noKeepAlive,
+		HTTP2:           *http2,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetchall: %v\n", err)
+		os.Exit(1)
+	}
+
+	// before anything is fetched, -budget's HEADs and -interval's rounds wait for the same slots as a normal run
+	if *adaptive {
+		if *minConcurrency < 1 || *maxConcurrency < *minConcurrency {
+			fmt.Fprintln(os.Stderr, "fetchall: need 1 <= -min-concurrency <= -max-concurrency")
+			os.Exit(1)
+		}
+		ctl = newAIMD(*minConcurrency, *maxConcurrency)
+	}
+	if *concurrency < 0 {
+		fmt.Fprintln(os.Stderr, "fetchall: -concurrency can't be negative")
+		os.Exit(1)
+	}
+	if *concurrency > 0 {
+		slots = make(chan struct{}, *concurrency)
+	}
+
+	if *budget > 0 {
+		targets = planBudget(targets, *budget)
+	}
+	if (*shuffle || *jitter) && *seed == 0 {
+		*seed = time.Now().UnixNano()
+		fmt.Fprintf(os.Stderr, "fetchall: seed %d\n", *seed)
+	}
+	if *shuffle {
+		shuffleTargets(targets, *seed)
+	}
+	jitterRand.Rand = rand.New(rand.NewSource(*seed))
+
+	if *pollInterval > 0 {
+		if err := monitor(targets, *pollInterval, *repeat, *monitorLog); err != nil {
+			fmt.Fprintf(os.Stderr, "fetchall: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	start := time.Now()
+	// cancelling ctx is how -fail-fast stops every fetch at once
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan result)
+	// make a channel of results
+
+	var wg sync.WaitGroup
+	// launch is declared first so the fetch goroutines can use it to start the -recurse links
+	var launch func(t target)
+	launch = func(t target) {
+		if ctx.Err() != nil {
+			// fail-fast has already stopped the run, don't even start a goroutine
+			return
+		}
+		host := limitedHost(t.url)
+		// without -per-host a fetch takes its -concurrency slot before it gets a goroutine, so
+		// 50,000 URLs are N goroutines at a time. with it the host has to come first, or a slot
+		// would be held by a fetch waiting on its host while one to another host could be running.
+		// those wait in a goroutine of their own, a few KB each, and the slots still limit the fetches
+		if host == "" && !takeSlot(ctx) {
+			return
+		}
+		if *recurse && t.depth == 0 {
+			// the URLs we were given are fetched anyway, -recurse shouldn't fetch them a second time
+			followed.first(t.url)
+		}
+		wg.Add(1)
+		live.started.Add(1)
+		go func(t target) {
+			// deferred first so it runs last, after a recovered panic has sent its result
+			defer wg.Done()
+			// a panic would otherwise take every other fetch down with it, and main would
+			// never get this URL's result either. turn it into an error result instead
+			defer func() {
+				if p := recover(); p != nil {
+					fmt.Fprintf(os.Stderr, "fetchall: panic fetching %s: %v\n%s", t.url, p, debug.Stack())
+					ch <- result{label: t.label, url: t.url, err: fmt.Errorf("%s: panic: %v", t.url, p)}
+				}
+			}()
+			var leave func(good bool)
+			if host == "" {
+				leave = enter("")
+			} else if leave = admit(ctx, host); leave == nil {
+				// stopped by -fail-fast while it waited
+				ch <- result{label: t.label, url: t.url, err: errSkipped}
+				return
+			}
+			// run by hand once the fetch is done, and deferred for when it panics. a panic leaves r
+			// empty, which -adaptive counts as a failure like any other
+			var r result
+			var once sync.Once
+			release := func() {
+				once.Do(func() {
+					live.inflight.Add(-1)
+					leave(r.ok() && r.secs <= targetLatency.Seconds())
+				})
+			}
+			live.inflight.Add(1)
+			defer release()
+			r = fetchURL(ctx, t.url)
+			if *failFast && (r.err != nil || *strict && !r.ok()) {
+				// here and not only in the loop that reads ch: once the slot below is given back
+				// the next URL would take it and go out before the loop got round to cancelling
+				cancel()
+			}
+			// given back before the links are launched, or with every slot taken by a page
+			// whose links are waiting for a slot, nothing would ever finish
+			release()
+			r.label = t.label
+			if *recurse && t.depth < *depth {
+				// started before this goroutine's wg.Done, so wg can't reach zero and close ch under them.
+				// robots.txt may need fetching here, which only holds up this page's goroutine
+				for _, l := range r.links {
+					if onSameHost(t.url, l) && followed.first(l) && robotsAllow(ctx, l) {
+						launch(target{url: l, depth: t.depth + 1})
+					}
+				}
+			}
+			ch <- r
+		}(t)
+		// for every URL we create a goroutine. if we pass 5 URLs in we get 5 goroutines
+		// (with -concurrency, no more than N of them at a time).
+	}
+
+	// ch is closed once every goroutine has sent its result, which ends the loop below
+	go func() {
+		for _, t := range targets {
+			launch(t)
+		}
+		if *stdinURLs {
+			// each URL is started as soon as its line comes in, so a slow producer
+			// feeding us over a pipe doesn't hold up the fetches it has already sent
+			fromStdin := launch
+			if !*allowDup {
+				fromStdin = func(t target) {
+					if given.keep(t.url) {
+						launch(t)
+					}
+				}
+			}
+			if err := scanTargets(os.Stdin, fromStdin); err != nil {
+				fmt.Fprintf(os.Stderr, "fetchall: reading stdin: %v\n", err)
+			}
+		}
+		wg.Wait()
+		close(ch)
+	}()
+
+	// os.Stdout isn't buffered, so every fmt call is a write of its own, and a result printed by
+	// several of them could reach a pipe in pieces. everything goes through out instead, and it
+	// is flushed after every result so a program reading our pipe sees each fetch as soon as it
+	// finishes, in one piece
+	out := bufio.NewWriter(os.Stdout)
+
+	stopSummary := make(chan struct{})
+	summaryDone := make(chan struct{})
+	if *summaryInterval > 0 {
+		go func() {
+			printSummaries(*summaryInterval, start, stopSummary)
+			close(summaryDone)
+		}()
+	} else {
+		close(summaryDone)
+	}
+
+	var results []result
+	var all []result // every result, for -report, whatever -only-errors and -table leave out
+	var failed, total, skipped, cut int
+	var totalBytes int64
+
+	var csvOut *csv.Writer
+	if *format == "csv" {
+		csvOut = csv.NewWriter(out)
+		csvOut.Write(csvHeader)
+	}
+
+	// emit prints one result the way the output flags ask for
+	emit := func(r result) {
+		if csvOut != nil {
+			csvOut.Write(csvRecord(r))
+			csvOut.Flush()
+			out.Flush()
+			return
+		}
+		if *jsonl {
+			b, err := json.Marshal(newReportResult(r))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "fetchall: %s: %v\n", r.url, err)
+				return
+			}
+			out.Write(append(b, '\n'))
+			out.Flush()
+			return
+		}
+		fmt.Fprintln(out, r)
+		if !*recurse {
+			for _, l := range r.links {
+				fmt.Fprintf(out, "  -> %s\n", l)
+			}
+		}
+		out.Flush()
+	}
+	var sorter *externalSort
+	if *sortBy != "" {
+		sorter = newExternalSort(*sortBy, *sortMemory)
+	}
+
+	for r := range ch {
+		if errors.Is(r.err, errSkipped) {
+			skipped++
+			continue
+		}
+		total++
+		totalBytes += r.nbytes
+		byStatus.add(r)
+		if errors.Is(r.err, errMaxTime) {
+			cut++
+		}
+		if *failFast && ctx.Err() == nil && (r.err != nil || *strict && !r.ok()) {
+			// the fetch goroutine has cancelled already, unless it panicked
+			cancel()
+		}
+		if r.ok() {
+			live.ok.Add(1)
+		} else {
+			live.failed.Add(1)
+		}
+		if *report != "" {
+			all = append(all, r)
+		}
+		if !r.ok() {
+			failed++
+		} else if *onlyErrors {
+			continue
+		}
+		if *onlyMatches && r.match != "match" {
+			continue
+		}
+		if *table {
+			results = append(results, r)
+			continue
+		}
+		if sorter != nil {
+			if err := sorter.add(r); err != nil {
+				fmt.Fprintf(os.Stderr, "fetchall: -sort-by: %v\n", err)
+				sorter.cleanup()
+				os.Exit(1)
+			}
+			continue
+		}
+		emit(r)
+	}
+	// waiting for the ticker goroutine makes sure no progress line turns up after the results
+	close(stopSummary)
+	<-summaryDone
+
+	if sorter != nil {
+		err := sorter.each(emit)
+		sorter.cleanup()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fetchall: -sort-by: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *table {
+		printTable(out, results)
+	}
+
+	// anything that isn't a record would break a JSON lines or CSV file, so the totals go to stderr then
+	var summary io.Writer = out
+	if *format != "text" {
+		summary = os.Stderr
+	}
+	if *showSummary && total > 0 {
+		byStatus.histogram(summary)
+	}
+	if *showByStatus {
+		byStatus.print(summary)
+	}
+	if *onlyErrors {
+		fmt.Fprintf(summary, "%d of %d failed\n", failed, total)
+	}
+	if cut > 0 {
+		fmt.Fprintf(summary, "%d of %d hit -max-time %v\n", cut, total, *maxTime)
+	}
+	dups := given.skippedCount()
+	if dups > 0 {
+		fmt.Fprintf(summary, "%d duplicate URLs skipped (-allow-dup fetches them anyway)\n", dups)
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(summary, "-fail-fast stopped the run: %d fetched (%d failed), %d skipped\n", total, failed, skipped)
+	}
+	elapsed := time.Since(start)
+	fmt.Fprintf(summary, "%.2fs elapsed\n", elapsed.Seconds())
+	// the closing record counts every result, -only-errors and -only-matches leave them all in
+	agg := runSummary{Total: total, OK: total - failed, Failed: failed, Skipped: skipped, Duplicates: dups, Bytes: totalBytes, ElapsedSec: elapsed.Seconds()}
+	switch *format {
+	case "json":
+		b, _ := json.Marshal(struct {
+			Summary runSummary `json:"summary"`
+		}{agg})
+		out.Write(append(b, '\n'))
+	case "csv":
+		csvOut.Write(agg.csvRecord())
+		csvOut.Flush()
+	}
+	if *retryBudget > 0 {
+		fmt.Fprintf(summary, "%d of the -retry-budget of %d retries used\n", retriesUsed.Load(), *retryBudget)
+	}
+	if ctl != nil {
+		fmt.Fprintf(os.Stderr, "fetchall: ran up to %d at once, ending at %d\n", ctl.peak, int(ctl.limit))
+	}
+	// flushed by hand rather than deferred, os.Exit below would skip a defer
+	out.Flush()
+
+	if *report != "" {
+		status := 0
+		if failed > 0 {
+			status = 1
+		}
+		if err := writeReport(*report, all, elapsed, status); err != nil {
+			fmt.Fprintf(os.Stderr, "fetchall: writing report: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	}
+}
+
+// runSummary is the last record of -format json and csv.
+type runSummary struct {
+	Total      int     `json:"total"`
+	OK         int     `json:"ok"`
+	Failed     int     `json:"failed"`
+	Skipped    int     `json:"skipped"`
+	Duplicates int     `json:"duplicates,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	ElapsedSec float64 `json:"elapsed_secs"`
+}
+
+// csvHeader names the -format csv columns. kind is "result" for a URL and "summary" for the last
+// row, which has the run's totals in bytes, secs, ok and failed and leaves the URL columns empty
+var csvHeader = []string{"kind", "url", "label", "status", "content_type", "bytes", "secs", "proto", "attempts", "error", "ok", "failed", "throttled"}
+
+func csvRecord(r result) []string {
+	status, errText := "", ""
+	if r.err != nil {
+		errText = r.err.Error()
+	} else {
+		status = strconv.Itoa(r.status)
+	}
+	secs := strconv.FormatFloat(r.secs, 'f', 3, 64)
+	return []string{"result", r.url, r.label, status, r.ctype, strconv.FormatInt(r.nbytes, 10), secs, r.proto, strconv.Itoa(r.attempts), errText, "", "", strconv.FormatBool(r.throttled)}
+}
+
+func (s runSummary) csvRecord() []string {
+	secs := strconv.FormatFloat(s.ElapsedSec, 'f', 3, 64)
+	return []string{"summary", "", "", "", "", strconv.FormatInt(s.Bytes, 10), secs, "", "", "", strconv.Itoa(s.OK), strconv.Itoa(s.Failed), ""}
+}
+
+// batchReport is the -report file. it is made once at the end so it is always a whole JSON document.
+type batchReport struct {
+	Started    time.Time      `json:"started"`
+	ElapsedSec float64        `json:"elapsed_secs"`
+	Total      int            `json:"total"`
+	OK         int            `json:"ok"`
+	Failed     int            `json:"failed"`
+	Bytes      int64          `json:"bytes"`
+	Secs       timeStats      `json:"secs"`
+	ExitStatus int            `json:"exit_status"`
+	Results    []reportResult `json:"results"`
+}
+
+// timeStats are over the fetches that got a response, since a failed one has no time
+type timeStats struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+type reportResult struct {
+	Label  string  `json:"label,omitempty"`
+	URL    string  `json:"url"`
+	OK     bool    `json:"ok"`
+	Status int     `json:"status,omitempty"`
+	Type   string  `json:"content_type,omitempty"`
+	Bytes  int64   `json:"bytes"`
+	Secs   float64 `json:"secs"`
+	Proto  string  `json:"proto,omitempty"`
+	Reused bool    `json:"reused"`
+	Cut    bool    `json:"cut,omitempty"`
+
+	Throttled bool   `json:"throttled,omitempty"`
+	Match     string `json:"match,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	Attempts int `json:"attempts,omitempty"`
+
+	Links []string `json:"links,omitempty"`
+	// Body is the body as a string when BodyEncoding is "text", and base64 when it is "base64".
+	// BodyTruncated says Body is only the start of it
+	Body          *string `json:"body,omitempty"`
+	BodyEncoding  string  `json:"body_encoding,omitempty"`
+	BodyTruncated bool    `json:"body_truncated,omitempty"`
+}
+
+// newReportResult is the JSON form of r, for -report and -format json.
+func newReportResult(r result) reportResult {
+	rr := reportResult{Label: r.label, URL: r.url, OK: r.ok(), Status: r.status, Bytes: r.nbytes, Secs: r.secs, Proto: r.proto, Reused: r.reused, Cut: r.cut, Match: r.match, Links: r.links, Attempts: r.attempts, Type: r.ctype, Throttled: r.throttled}
+	if r.err != nil {
+		rr.Error = r.err.Error()
+	}
+	if r.body != nil {
+		// a pointer, so an empty body still shows up as "" instead of disappearing
+		body := string(r.body)
+		rr.BodyEncoding = "text"
+		if !r.text {
+			body = base64.StdEncoding.EncodeToString(r.body)
+			rr.BodyEncoding = "base64"
+		}
+		rr.Body = &body
+		rr.BodyTruncated = r.cut || int64(len(r.body)) < r.nbytes
+	}
+	return rr
+}
+
+// writeReport puts the report in a temp file next to name and renames it into place,
+// so a CI job never picks up half a report.
+func writeReport(name string, results []result, elapsed time.Duration, status int) error {
+	rep := batchReport{
+		Started:    time.Now().Add(-elapsed).UTC(),
+		ElapsedSec: elapsed.Seconds(),
+		Total:      len(results),
+		ExitStatus: status,
+		Results:    make([]reportResult, 0, len(results)),
+	}
+	var secs []float64
+	for _, r := range results {
+		rr := newReportResult(r)
+		if r.err == nil {
+			secs = append(secs, r.secs)
+		}
+		if rr.OK {
+			rep.OK++
+		} else {
+			rep.Failed++
+		}
+		rep.Bytes += r.nbytes
+		rep.Results = append(rep.Results, rr)
+	}
+	if len(secs) > 0 {
+		sort.Float64s(secs)
+		rep.Secs = timeStats{
+			Min: secs[0],
+			P50: percentile(secs, 50),
+			P90: percentile(secs, 90),
+			P99: percentile(secs, 99),
+			Max: secs[len(secs)-1],
+		}
+	}
+
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once the rename has happened
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// percentile is the nearest-rank percentile p of sorted.
+func percentile(sorted []float64, p int) float64 {
+	i := (p*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// readTargets reads the -i list. blank lines and lines starting with # are skipped,
+// and a line with a tab in it is a label followed by the URL.
+func readTargets(name string) ([]target, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	var targets []target
+	err := scanTargets(f, func(t target) { targets = append(targets, t) })
+	return targets, err
+}
+
+// scanTargets calls each for every URL line in r as soon as it has been read.
+func scanTargets(r io.Reader, each func(target)) error {
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if label, url, ok := strings.Cut(line, "\t"); ok {
+			each(target{label: strings.TrimSpace(label), url: strings.TrimSpace(url)})
+		} else {
+			each(target{url: line})
+		}
+	}
+	return scan.Err()
+}
+
+func fetch(ctx context.Context, url string) (r result) {
+	// every return below has its attempts filled in here, however far the fetch got
+	attempts := 0
+	defer func() { r.attempts = attempts }()
+
+	u, err := normalizeURL(url)
+	if err != nil {
+		return result{url: url, err: err}
+	}
+	method := "GET"
+	if *headOnly {
+		method = "HEAD"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return result{url: url, err: err}
+	}
+	// an empty Host means the URL's, so this is a no-op without -host
+	req.Host = *hostHeader
+
+	// the -per-host and -concurrency waits are over by now, admit has seen to them
+	if ctx.Err() != nil {
+		return result{url: url, err: errSkipped}
+	}
+	if *breakAfter > 0 && !circuits.allow(req.URL.Host) {
+		return result{url: url, err: fmt.Errorf("%s: circuit open for %s", url, req.URL.Host)}
+	}
+
+	start := time.Now()
+	// httptrace tells us whether the transport handed us a pooled connection
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	if *maxTime > 0 {
+		mctx, cancel := context.WithTimeout(req.Context(), *maxTime)
+		defer cancel()
+		req = req.WithContext(mctx)
+	}
+	// cutOff is the error for a fetch stopped by -max-time, or nil when that isn't what happened
+	cutOff := func() error {
+		if ctx.Err() == nil && errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("%s: %w (%v)", url, errMaxTime, *maxTime)
+		}
+		return nil
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		attempts++
+		resp, err = client.Do(req)
+		if err != nil && *verbose {
+			kind, again := classify(err)
+			verdict := "not retryable"
+			if again {
+				verdict = "retryable"
+			}
+			fmt.Fprintf(os.Stderr, "fetchall: %s: attempt %d: %s error, %s\n", url, attempt+1, kind, verdict)
+		}
+		if *breakAfter > 0 {
+			circuits.record(req.URL.Host, err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests)
+		}
+		// a fetch that -fail-fast or -max-time has stopped won't be retried, so it mustn't use up
+		// -retry-budget that some other fetch could have had
+		if attempt == *retries || !shouldRetry(resp, err) || req.Context().Err() != nil || !takeRetry() {
+			break
+		}
+		wait := backoff(attempt)
+		if resp != nil {
+			if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				wait = d
+			}
+			// drain the body so the connection can go back to the pool
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if wait > *maxRetryAfter {
+			wait = *maxRetryAfter
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			if err := cutOff(); err != nil {
+				return result{url: url, err: err}
+			}
+			return result{url: url, err: errSkipped}
+		}
+		if *breakAfter > 0 && !circuits.allow(req.URL.Host) {
+			// the body was closed above, so there is only the error to report
+			return result{url: url, err: fmt.Errorf("%s: circuit open for %s, not retrying", url, req.URL.Host)}
+		}
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return result{url: url, err: errSkipped}
+	}
+	if err != nil && cutOff() != nil {
+		saveError(req.URL, cutOff())
+		return result{url: url, err: cutOff()}
+	}
+	if err != nil {
+		err = fetchlib.ExplainTLS(err, *tlsMin)
+		saveError(req.URL, err)
+		return result{url: url, err: err}
+	}
+
+	var dst io.Writer = ioutil.Discard
+	var f *os.File
+	if *mirror != "" {
+		root := *mirror
+		if *splitByStatus {
+			root = filepath.Join(root, fmt.Sprintf("%dxx", resp.StatusCode/100))
+		}
+		f, err = createMirrorFile(root, req.URL)
+		if err != nil {
+			resp.Body.Close()
+			return result{url: url, status: resp.StatusCode, err: fmt.Errorf("saving %s: %v", url, err)}
+		}
+		dst = f
+	}
+
+	// the page is kept in memory for -extract-links, up to maxPage
+	var page *bytes.Buffer
+	if *extractLinks && resp.StatusCode/100 == 2 && (isHTML(resp.Header.Get("Content-Type")) || isSitemap(resp)) {
+		page = new(bytes.Buffer)
+		dst = io.MultiWriter(dst, &capWriter{buf: page, max: maxPage})
+	}
+
+	var kept *bytes.Buffer
+	if *includeBody {
+		limit := 1 << 20
+		if *maxSize > 0 {
+			limit = int(*maxSize)
+		}
+		kept = new(bytes.Buffer)
+		dst = io.MultiWriter(dst, &capWriter{buf: kept, max: limit})
+	}
+
+	var body io.Reader = resp.Body
+	var bucket *tokenBucket
+	if *limitRate > 0 {
+		bucket = newTokenBucket(body, *limitRate)
+		body = bucket
+	}
+	if *maxSize > 0 {
+		body = io.LimitReader(body, *maxSize)
+	}
+	var nbytes int64
+	var match string
+	if pattern != nil {
+		// everything the scanner reads is copied on to dst as it goes past
+		cw := &countWriter{w: dst}
+		var found bool
+		found, err = grepLines(io.TeeReader(body, cw))
+		if err == nil {
+			// the scanner stops at the first match, the rest still has to be read
+			_, err = io.Copy(cw, body)
+		}
+		nbytes = cw.n
+		match = "no match"
+		if found {
+			match = "match"
+		}
+	} else {
+		nbytes, err = io.Copy(dst, body)
+		// io.Copy returns the byte count
+	}
+	// a body of exactly -max-size bytes wasn't cut, so look for one more
+	cut := err == nil && *maxSize > 0 && nbytes == *maxSize && readsMore(resp.Body)
+	resp.Body.Close()
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if err != nil && cutOff() != nil {
+		return result{url: url, status: resp.StatusCode, nbytes: nbytes, err: cutOff()}
+	}
+	if err != nil {
+		return result{url: url, status: resp.StatusCode, err: fmt.Errorf("while reading %s: %v", url, err)}
+	}
+
+	var links []string
+	if page != nil {
+		// resp.Request is the last request after redirects, which is what relative links are relative to
+		if isHTML(resp.Header.Get("Content-Type")) {
+			links = pageLinks(resp.Request.URL, page.Bytes())
+		} else {
+			links = sitemapLinks(resp.Request.URL, page.Bytes())
+		}
+	}
+
+	secs := time.Since(start).Seconds()
+	r = result{url: url, status: resp.StatusCode, nbytes: nbytes, secs: secs, proto: resp.Proto, reused: reused, cut: cut, match: match, links: links, ctype: baseType(resp.Header.Get("Content-Type"))}
+	if bucket != nil {
+		r.throttled = bucket.waited
+	}
+	if kept != nil {
+		r.body = kept.Bytes()
+		if r.body == nil {
+			// nothing was written to kept, and a nil body is one -include-body didn't ask for
+			r.body = []byte{}
+		}
+		r.text = isText(resp.Header.Get("Content-Type"), r.body)
+	}
+	return r
+}
+
+// fetchURL is what the fetch goroutines call, fetch unless a test has put something else in
+var fetchURL = fetch
+
+// grepLines reports whether any line read from r matches -grep. lines are allowed to be
+// long, a minified page can be one line, but past a megabyte we stop looking.
+func grepLines(r io.Reader) (bool, error) {
+	scan := bufio.NewScanner(r)
+	scan.Buffer(nil, 1<<20)
+	for scan.Scan() {
+		if pattern.Match(scan.Bytes()) {
+			return true, nil
+		}
+	}
+	if scan.Err() == bufio.ErrTooLong {
+		return false, nil
+	}
+	return false, scan.Err()
+}
+
+// readsMore reports whether r has at least one more byte in it.
+func readsMore(r io.Reader) bool {
+	var b [1]byte
+	n, _ := r.Read(b[:])
+	return n > 0
+}
+
+// tokenBucket slows reads from r down to rate bytes per second. the bucket holds up to a second's
+// worth of tokens and fills back up as time passes, every byte read takes one out, and a read
+// that finds the bucket empty waits for it to fill
+type tokenBucket struct {
+	r      io.Reader
+	rate   float64
+	tokens float64
+	last   time.Time
+	waited bool // some read had to wait, so the limit actually did something
+}
+
+func newTokenBucket(r io.Reader, rate int64) *tokenBucket {
+	// it starts full, so the start of a body isn't held back
+	return &tokenBucket{r: r, rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) Read(p []byte) (int, error) {
+	// reads of a tenth of a second's worth at most keep the flow smooth instead of a burst a second
+	chunk := max(int(b.rate/10), 1)
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	b.fill()
+	if need := float64(len(p)) - b.tokens; need > 0 {
+		b.waited = true
+		time.Sleep(time.Duration(need / b.rate * float64(time.Second)))
+		b.fill()
+	}
+	n, err := b.r.Read(p)
+	b.tokens -= float64(n)
+	return n, err
+}
+
+// fill adds the tokens earned since the last fill, up to a full bucket
+func (b *tokenBucket) fill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+}
+
+// maxPage is how much of a page -extract-links looks through for links
+const maxPage = 4 << 20
+
+// capWriter keeps the first max bytes written to it in buf and quietly drops the rest,
+// so a huge page can't make -extract-links hold all of it in memory
+type capWriter struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if room := c.max - c.buf.Len(); room > 0 {
+		if len(p) > room {
+			c.buf.Write(p[:room])
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// isText reports whether a body can go into JSON as a string: the type has to be textual and
+// the bytes valid UTF-8, which a body cut off in the middle of a character isn't.
+func isText(contentType string, body []byte) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !utf8.Valid(body) {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == "application/xml" || mediaType == "application/javascript" ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// baseType is contentType without its parameters, in lower case, so "text/html; charset=utf-8"
+// and "text/HTML" both come out as text/html. one that doesn't parse is kept as it was.
+func baseType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return contentType
+}
+
+// isHTML reports whether a Content-Type is an HTML page.
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// isSitemap reports whether resp looks like a sitemap: XML, or a gzipped file whose name ends in
+// .xml.gz, which is how big sites often serve theirs.
+func isSitemap(resp *http.Response) bool {
+	switch mediaType := baseType(resp.Header.Get("Content-Type")); mediaType {
+	case "application/xml", "text/xml":
+		return true
+	case "application/gzip", "application/x-gzip", "application/octet-stream":
+		return strings.HasSuffix(resp.Request.URL.Path, ".xml.gz")
+	}
+	return false
+}
+
+// sitemapLinks returns the <loc> URLs of a sitemap, or of a sitemap index, whose <loc>s are more
+// sitemaps that -recurse then reads in turn. XML does have a parser in the standard library, so
+// this one isn't regexps. a gzipped file is unpacked first
+func sitemapLinks(base *url.URL, page []byte) []string {
+	var r io.Reader = bytes.NewReader(page)
+	if bytes.HasPrefix(page, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		r = zr
+	}
+	var links []string
+	seen := make(map[string]bool)
+	dec := xml.NewDecoder(r)
+	inLoc := false
+	var loc strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// io.EOF at the end, and for a broken file whatever came before the break is still good
+			return links
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			inLoc = t.Name.Local == "loc"
+			loc.Reset()
+		case xml.CharData:
+			if inLoc {
+				loc.Write(t)
+			}
+		case xml.EndElement:
+			if !inLoc {
+				continue
+			}
+			inLoc = false
+			u, err := base.Parse(strings.TrimSpace(loc.String()))
+			if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+				continue
+			}
+			u.Fragment = ""
+			if s := u.String(); !seen[s] {
+				seen[s] = true
+				links = append(links, s)
+			}
+		}
+	}
+}
+
+// the standard library has no HTML parser, so links are found with two regexps instead: one for
+// the tags and one for the attributes inside a tag. that is good enough for checking links,
+// though a "<a href" inside a script or a comment gets picked up too. every attribute is matched,
+// not just href and src, so a value like alt="see href=x" is used up by its own attribute and
+// its href=x can't be taken for a link
+var (
+	tagPattern  = regexp.MustCompile(`<[a-zA-Z][^>]*>`)
+	attrPattern = regexp.MustCompile(`\s([^\s"'>/=]+)(\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+)
+
+// pageLinks returns the http and https links in page resolved against base, each once, in the
+// order they first appear. fragments are dropped, since #top is the same page as far as fetching goes.
+func pageLinks(base *url.URL, page []byte) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, tag := range tagPattern.FindAll(page, -1) {
+		for _, m := range attrPattern.FindAllSubmatch(tag, -1) {
+			name := strings.ToLower(string(m[1]))
+			if name != "href" && name != "src" || m[2] == nil {
+				continue
+			}
+			raw := string(m[3]) + string(m[4]) + string(m[5])
+			u, err := base.Parse(html.UnescapeString(strings.TrimSpace(raw)))
+			if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+				continue
+			}
+			u.Fragment = ""
+			if s := u.String(); !seen[s] {
+				seen[s] = true
+				links = append(links, s)
+			}
+		}
+	}
+	return links
+}
+
+// onSameHost is -same-host: whether link goes to the host of the page it was found on. the scheme
+// and port don't matter, http://example.com and https://example.com:8443 are the same site
+func onSameHost(page, link string) bool {
+	if !*sameHost {
+		return true
+	}
+	p, err1 := url.Parse(page)
+	l, err2 := url.Parse(link)
+	return err1 == nil && err2 == nil && strings.EqualFold(p.Hostname(), l.Hostname())
+}
+
+// robotsAllow is -robots: whether the host's robots.txt lets us fetch link. it is only asked once
+// for each link, so a link that is turned down is only reported the once
+func robotsAllow(ctx context.Context, link string) bool {
+	if !*obeyRobots {
+		return true
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	if !robots.allowed(ctx, u) {
+		fmt.Fprintf(os.Stderr, "fetchall: not following %s, robots.txt disallows it\n", link)
+		return false
+	}
+	return true
+}
+
+// robotsCache fetches each host's robots.txt the first time a link there needs it. the entry goes
+// in the map straight away and the fetch is done holding its lock, so links to a host that turn up
+// while its robots.txt is still on the way wait for that one fetch instead of starting their own
+type robotsCache struct {
+	mu    sync.Mutex
+	hosts map[string]*robotsEntry // by scheme://host, robots.txt is for one of them, not both
+}
+
+type robotsEntry struct {
+	mu      sync.Mutex
+	done    bool // rules and blocked are the answer for good
+	retry   time.Time
+	rules   []robotsRule
+	blocked bool // robots.txt couldn't be read, which RFC 9309 says means stay out altogether
+}
+
+// robotsRetry is how long a robots.txt that failed with a 5xx or a network error keeps the host's
+// links out before it's asked for again. the failure may not last, so it isn't the answer for good
+const robotsRetry = 30 * time.Second
+
+// robotsRule is one Allow or Disallow line of the group that applies to us.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+func (c *robotsCache) allowed(ctx context.Context, u *url.URL) bool {
+	key := u.Scheme + "://" + strings.ToLower(u.Host)
+	c.mu.Lock()
+	e := c.hosts[key]
+	if e == nil {
+		e = &robotsEntry{}
+		c.hosts[key] = e
+	}
+	c.mu.Unlock()
+	e.mu.Lock()
+	if !e.done && !time.Now().Before(e.retry) {
+		var lasting bool
+		e.rules, e.blocked, lasting = fetchRobots(ctx, key)
+		if lasting {
+			e.done = true
+		} else if ctx.Err() == nil {
+			e.retry = time.Now().Add(robotsRetry)
+		}
+	}
+	rules, blocked := e.rules, e.blocked
+	e.mu.Unlock()
+	if blocked {
+		return false
+	}
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return robotsPermit(rules, p)
+}
+
+// maxRobots is as much of a robots.txt as is read, the 500 KiB RFC 9309 asks crawlers to read at least
+const maxRobots = 500 << 10
+
+// fetchRobots gets the rules for us from site's robots.txt. a 4xx means there is none and everything
+// is allowed, an error or a 5xx means the site is in trouble and nothing is. lasting is false for
+// those, they may be gone by the next time. it waits its turn for the host and a slot like any
+// other request to site, -delay included, and gives up when ctx, the run's, is done
+func fetchRobots(ctx context.Context, site string) (rules []robotsRule, blocked, lasting bool) {
+	leave := admit(ctx, limitedHost(site))
+	if leave == nil {
+		return nil, true, false
+	}
+	good := false
+	defer func() { leave(good) }()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", site+"/robots.txt", nil)
+	if err != nil {
+		return nil, true, true
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetchall: %s/robots.txt: %v, not following links there for now\n", site, err)
+		return nil, true, false
+	}
+	defer resp.Body.Close()
+	good = resp.StatusCode/100 != 5
+	switch {
+	case resp.StatusCode/100 == 2:
+		return parseRobots(io.LimitReader(resp.Body, maxRobots)), false, true
+	case resp.StatusCode/100 == 4:
+		return nil, false, true
+	case resp.StatusCode/100 == 5:
+		fmt.Fprintf(os.Stderr, "fetchall: %s/robots.txt: %s, not following links there for now\n", site, resp.Status)
+		return nil, true, false
+	}
+	fmt.Fprintf(os.Stderr, "fetchall: %s/robots.txt: %s, not following links there\n", site, resp.Status)
+	return nil, true, true
+}
+
+// parseRobots picks the group of rules for us out of a robots.txt: the one for a User-agent of
+// fetchall if there is one, or else the one for *. a group is one or more User-agent lines and
+// the rules after them, and groups for the same agent count as one
+func parseRobots(r io.Reader) []robotsRule {
+	var ours, star []robotsRule
+	var named bool
+	var agents []string
+	inRules := false
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line, _, _ := strings.Cut(scan.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			if inRules {
+				// a User-agent after rules starts the next group
+				agents, inRules = nil, false
+			}
+			// only the product name counts, the /1.0 after it doesn't
+			name, _, _ := strings.Cut(strings.ToLower(value), "/")
+			agents = append(agents, name)
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				// an empty Disallow allows everything, which is what no rule does too
+				continue
+			}
+			rule := robotsRule{allow: key == "allow", pattern: value}
+			for _, a := range agents {
+				switch a {
+				case "fetchall":
+					ours, named = append(ours, rule), true
+				case "*":
+					star = append(star, rule)
+				}
+			}
+		}
+	}
+	if named {
+		return ours
+	}
+	return star
+}
+
+// robotsPermit is whether path may be fetched. the longest pattern that matches decides, and an
+// Allow wins a tie, so Disallow: / with Allow: /public lets /public/x through
+func robotsPermit(rules []robotsRule, path string) bool {
+	best, allow := -1, true
+	for _, r := range rules {
+		if n := len(r.pattern); n >= best && robotsMatch(r.pattern, path) {
+			if n > best || r.allow {
+				allow = r.allow
+			}
+			best = n
+		}
+	}
+	return allow
+}
+
+// robotsMatch matches path against a robots.txt pattern, which is a prefix of the path where
+// * stands for anything and a $ at the end means the path has to end there.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			// the last part has to be at the very end, not just anywhere after the others
+			return strings.HasSuffix(path, part)
+		}
+		j := strings.Index(path, part)
+		if j < 0 {
+			return false
+		}
+		path = path[j+len(part):]
+	}
+	return !anchored || path == ""
+}
+
+// linkSet is every URL -recurse has started, so a link on several pages is fetched once.
+type linkSet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// first reports whether u is new, and remembers it. u is canonicalized first, so a page
+// linking to /about and another to /./about doesn't make -recurse fetch it twice
+func (s *linkSet) first(u string) bool {
+	u = canonicalURL(u)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen[u] {
+		return false
+	}
+	s.seen[u] = true
+	return true
+}
+
+// dupSet remembers which URL came first for each canonical URL, so a skipped duplicate can
+// say what it was a duplicate of. -stdin adds to it while fetches are running, hence the lock
+type dupSet struct {
+	mu      sync.Mutex
+	first   map[string]string
+	skipped int
+}
+
+// keep reports whether u should be fetched, and says on stderr when it is skipped.
+func (d *dupSet) keep(u string) bool {
+	c := canonicalURL(u)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if orig, ok := d.first[c]; ok {
+		d.skipped++
+		if orig == u {
+			fmt.Fprintf(os.Stderr, "fetchall: skipping %s, it was given already\n", u)
+		} else {
+			fmt.Fprintf(os.Stderr, "fetchall: skipping %s, it is the same URL as %s\n", u, orig)
+		}
+		return false
+	}
+	d.first[c] = u
+	return true
+}
+
+func (d *dupSet) skippedCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.skipped
+}
+
+// canonicalURL is u written the one way, for telling whether two URLs are the same: scheme and
+// host lowercased, the default port dropped, an empty path made /, . and .. segments resolved
+// and the #fragment left off, since it never reaches the server. a trailing slash is kept,
+// /docs and /docs/ are two different pages to most servers. a URL that doesn't parse is
+// compared as it is
+func canonicalURL(u string) string {
+	p, err := url.Parse(u)
+	if err != nil || p.Host == "" {
+		return u
+	}
+	p.Scheme = strings.ToLower(p.Scheme)
+	host, port := strings.ToLower(p.Hostname()), p.Port()
+	if port == "80" && p.Scheme == "http" || port == "443" && p.Scheme == "https" {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	p.Host = host
+	if p.Path == "" {
+		p.Path = "/"
+	} else {
+		// /docs/, /docs/. and /docs/x/.. all name the directory, so they all keep its slash
+		dir := strings.HasSuffix(p.Path, "/") || strings.HasSuffix(p.Path, "/.") || strings.HasSuffix(p.Path, "/..")
+		cleaned := path.Clean(p.Path)
+		if dir && cleaned != "/" {
+			cleaned += "/"
+		}
+		if cleaned != p.Path {
+			p.Path = cleaned
+			p.RawPath = ""
+		}
+	}
+	p.Fragment, p.RawFragment = "", ""
+	return p.String()
+}
+
+// shuffleTargets puts targets in a random order for -shuffle, the same order every time
+// for the same seed. -stdin URLs aren't in it, they still start as they come in
+func shuffleTargets(targets []target, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+}
+
+// planBudget sends a HEAD to every target and returns the ones that fit in budget,
+// in the order they were given. the others are listed on stderr with the reason.
+func planBudget(targets []target, budget int64) []target {
+	sizes := make([]int64, len(targets))
+	var wg sync.WaitGroup
+	// the HEADs wait for the same limits as the GETs, in the same order launch takes them, so
+	// -concurrency 10 over 50,000 URLs is 10 HEADs at a time and not 50,000
+	ctx := context.Background()
+	for i, t := range targets {
+		host := limitedHost(t.url)
+		if host == "" {
+			takeSlot(ctx)
+		}
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			var leave func(good bool)
+			if host == "" {
+				leave = enter("")
+			} else {
+				leave = admit(ctx, host)
+			}
+			sizes[i] = headSize(url)
+			leave(sizes[i] >= 0)
+		}(i, t.url)
+	}
+	wg.Wait()
+
+	order := make([]int, len(targets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]] < sizes[order[b]] })
+
+	keep := make([]bool, len(targets))
+	var planned int64
+	for _, i := range order {
+		switch {
+		case sizes[i] < 0:
+			fmt.Fprintf(os.Stderr, "fetchall: -budget: skipping %s, its size is unknown\n", targets[i].url)
+		case planned+sizes[i] > budget:
+			fmt.Fprintf(os.Stderr, "fetchall: -budget: skipping %s (%s), it would go over\n", targets[i].url, size(sizes[i]))
+		default:
+			planned += sizes[i]
+			keep[i] = true
+		}
+	}
+	var kept []target
+	for i, t := range targets {
+		if keep[i] {
+			kept = append(kept, t)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "fetchall: -budget: fetching %d of %d URLs, %s of the %s budget\n", len(kept), len(targets), size(planned), size(budget))
+	return kept
+}
+
+// headSize is the Content-Length a HEAD for url reports, or -1 when there is none to be had.
+func headSize(raw string) int64 {
+	u, err := normalizeURL(raw)
+	if err != nil {
+		return -1
+	}
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return -1
+	}
+	req.Host = *hostHeader
+	r := fetchlib.Do(client, req, nil)
+	if r.Err != nil || r.Status/100 != 2 {
+		return -1
+	}
+	n, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// sortRecord is a result as -sort-by writes it to its run files, with every field the printers
+// read. the error only survives as text, which is all the output needs from it: the errors.Is
+// checks are done before a result is sorted.
+type sortRecord struct {
+	Host      string
+	Label     string
+	URL       string
+	Status    int
+	Bytes     int64
+	Secs      float64
+	Proto     string
+	Reused    bool
+	Cut       bool
+	Match     string
+	Links     []string
+	Body      []byte
+	Text      bool
+	CType     string
+	Attempts  int
+	Throttled bool
+	Err       string
+}
+
+func newSortRecord(r result) sortRecord {
+	rec := sortRecord{Label: r.label, URL: r.url, Status: r.status, Bytes: r.nbytes, Secs: r.secs, Proto: r.proto, Reused: r.reused, Cut: r.cut, Match: r.match, Links: r.links,
+		Body: r.body, Text: r.text, CType: r.ctype, Attempts: r.attempts, Throttled: r.throttled}
+	if u, err := normalizeURL(r.url); err == nil {
+		rec.Host = u.Hostname()
+	}
+	if r.err != nil {
+		rec.Err = r.err.Error()
+	}
+	return rec
+}
+
+func (rec sortRecord) result() result {
+	r := result{label: rec.Label, url: rec.URL, status: rec.Status, nbytes: rec.Bytes, secs: rec.Secs, proto: rec.Proto, reused: rec.Reused, cut: rec.Cut, match: rec.Match, links: rec.Links,
+		body: rec.Body, text: rec.Text, ctype: rec.CType, attempts: rec.Attempts, throttled: rec.Throttled}
+	if rec.Err != "" {
+		r.err = errors.New(rec.Err)
+	}
+	return r
+}
+
+// fasterThan is the -sort-by latency order: quickest first, and failures, which have no
+// latency worth the name, after all of them.
+func fasterThan(a, b *sortRecord) bool {
+	if (a.Err == "") != (b.Err == "") {
+		return a.Err == ""
+	}
+	return a.Secs < b.Secs
+}
+
+// externalSort is a merge sort that spills to disk. add sorts every max results into a run
+// file, and each merges the runs, each of which is read one record at a time.
+type externalSort struct {
+	less func(a, b *sortRecord) bool
+	max  int
+	buf  []sortRecord
+	runs []*os.File
+}
+
+func newExternalSort(by string, inMemory int) *externalSort {
+	less := fasterThan
+	if by == "host" {
+		less = func(a, b *sortRecord) bool {
+			if a.Host != b.Host {
+				return a.Host < b.Host
+			}
+			return fasterThan(a, b)
+		}
+	}
+	return &externalSort{less: less, max: inMemory}
+}
+
+func (s *externalSort) add(r result) error {
+	s.buf = append(s.buf, newSortRecord(r))
+	if len(s.buf) < s.max {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill writes buf out sorted as one run, one JSON record per line.
+func (s *externalSort) spill() error {
+	s.sortBuf()
+	f, err := os.CreateTemp("", "fetchall-sort-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f) // before anything can fail, so cleanup finds it
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range s.buf {
+		if err := enc.Encode(&s.buf[i]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// sortBuf is stable, so results that tie keep the order they came in.
+func (s *externalSort) sortBuf() {
+	sort.SliceStable(s.buf, func(i, j int) bool { return s.less(&s.buf[i], &s.buf[j]) })
+}
+
+// each calls fn with every result in order. when nothing was spilled it is an ordinary sort.
+func (s *externalSort) each(fn func(result)) error {
+	if len(s.runs) == 0 {
+		s.sortBuf()
+		for _, rec := range s.buf {
+			fn(rec.result())
+		}
+		return nil
+	}
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	// the next record of every run sits in the heap, the smallest on top
+	h := &runHeap{less: s.less}
+	decoders := make([]*json.Decoder, len(s.runs))
+	next := func(run int) error {
+		var rec sortRecord
+		err := decoders[run].Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heap.Push(h, runHead{rec, run})
+		return nil
+	}
+	for i, f := range s.runs {
+		decoders[i] = json.NewDecoder(bufio.NewReader(f))
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		top := heap.Pop(h).(runHead)
+		fn(top.rec.result())
+		if err := next(top.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanup removes the run files. main calls it by hand, os.Exit doesn't run defers.
+func (s *externalSort) cleanup() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+type runHead struct {
+	rec sortRecord
+	run int
+}
+
+// runHeap is a container/heap of the runs' next records. ties go to the earlier run, which
+// came earlier in the input, so the merge is as stable as the in-memory sort.
+type runHeap struct {
+	heads []runHead
+	less  func(a, b *sortRecord) bool
+}
+
+func (h *runHeap) Len() int { return len(h.heads) }
+func (h *runHeap) Less(i, j int) bool {
+	a, b := &h.heads[i], &h.heads[j]
+	if h.less(&a.rec, &b.rec) {
+		return true
+	}
+	if h.less(&b.rec, &a.rec) {
+		return false
+	}
+	return a.run < b.run
+}
+func (h *runHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h *runHeap) Push(x any)    { h.heads = append(h.heads, x.(runHead)) }
+func (h *runHeap) Pop() any {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+// countWriter passes writes on to w and counts the bytes.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// statusTally counts results by status code, with transport failures under "error", and
+// adds up the bytes of each status class. main is the only one touching it, so no lock.
+type statusTally struct {
+	count map[string]int
+	bytes map[string]int64 // by class, like "2xx"
+	types map[string]int   // by media type, for -summary
+}
+
+func (t statusTally) add(r result) {
+	if r.err != nil {
+		t.count["error"]++
+		return
+	}
+	ctype := r.ctype
+	if ctype == "" {
+		ctype = "(none)"
+	}
+	t.types[ctype]++
+	t.count[strconv.Itoa(r.status)]++
+	t.bytes[fmt.Sprintf("%dxx", r.status/100)] += r.nbytes
+}
+
+// codes are the status codes seen, in order, with errors last.
+func (t statusTally) codes() []string {
+	codes := make([]string, 0, len(t.count))
+	for code := range t.count {
+		if code != "error" {
+			codes = append(codes, code)
+		}
+	}
+	// three-digit codes sort the same as strings and as numbers
+	sort.Strings(codes)
+	if t.count["error"] > 0 {
+		codes = append(codes, "error")
+	}
+	return codes
+}
+
+// print writes the codes in order with errors last, then a line per class with its bytes.
+func (t statusTally) print(out io.Writer) {
+	codes := t.codes()
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCOUNT")
+	for _, code := range codes {
+		fmt.Fprintf(tw, "%s\t%d\n", code, t.count[code])
+	}
+	classes := make([]string, 0, len(t.bytes))
+	for class := range t.bytes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	fmt.Fprintln(tw, "\nCLASS\tBYTES")
+	for _, class := range classes {
+		fmt.Fprintf(tw, "%s\t%s\n", class, size(t.bytes[class]))
+	}
+	tw.Flush()
+}
+
+// histogram is -summary: the status codes in order, then the content types, most common first,
+// each with its count and a bar. the longest bar is 40 wide and the rest are scaled to it
+func (t statusTally) histogram(out io.Writer) {
+	types := make([]string, 0, len(t.types))
+	for ctype := range t.types {
+		types = append(types, ctype)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if t.types[types[i]] != t.types[types[j]] {
+			return t.types[types[i]] > t.types[types[j]]
+		}
+		return types[i] < types[j]
+	})
+
+	most := 0
+	for _, n := range t.count {
+		most = max(most, n)
+	}
+	for _, n := range t.types {
+		most = max(most, n)
+	}
+	bar := func(n int) string {
+		// anything seen at all gets at least one #
+		return strings.Repeat("#", max(1, n*40/most))
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCOUNT\t")
+	for _, code := range t.codes() {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", code, t.count[code], bar(t.count[code]))
+	}
+	fmt.Fprintln(tw, "\nCONTENT TYPE\tCOUNT\t")
+	for _, ctype := range types {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", ctype, t.types[ctype], bar(t.types[ctype]))
+	}
+	tw.Flush()
+}
+
+// printTable lines the results up in columns. tabwriter works out how wide each column has to be.
+func printTable(out io.Writer, results []result) {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tBYTES\tTIME\tPROTO\tREUSED\tLABEL\tURL\n", paint("39", "STATUS"))
+	for _, r := range results {
+		label := r.label
+		if label == "" {
+			label = "-"
+		}
+		if r.err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t%s\t%s (%v)\n", paint(r.color(), "ERR"), label, r.url, r.err)
+			continue
+		}
+		status := paint(r.color(), strconv.Itoa(r.status))
+		fmt.Fprintf(tw, "%s\t%s\t%.2fs\t%s\t%t\t%s\t%s%s\n", status, size(r.nbytes), r.secs, r.proto, r.reused, label, r.url, r.notes())
+	}
+	tw.Flush()
+}
+
+// normalizeURL checks that raw is an http or https URL with a host and puts it in a standard
+// form: lowercase host and no port when it is the scheme's default one.
+func normalizeURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	// url.Parse already lowercases the scheme
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q: scheme must be http or https", raw)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%q: no host", raw)
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]" // an IPv6 address still needs its brackets
+	} else {
+		u.Host = host
+	}
+	return u, nil
+}
+
+// checkURLs is -dry-run. it prints what each URL would turn into without
+// sending anything, and reports false if any of them is no good.
+func checkURLs(out io.Writer, urls []string) bool {
+	ok := true
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tURL\tSCHEME\tHOST")
+	for _, raw := range urls {
+		u, err := normalizeURL(raw)
+		if err != nil {
+			ok = false
+			fmt.Fprintf(tw, "BAD\t%s\t-\t-\t(%v)\n", raw, err)
+			continue
+		}
+		fmt.Fprintf(tw, "OK\t%s\t%s\t%s\n", u, u.Scheme, u.Hostname())
+	}
+	tw.Flush()
+	return ok
+}
+
+// listURLs is -dry-run with -print0. the good URLs go to out in their normalized form, each
+// followed by a NUL the way find -print0 does it, and the bad ones are reported on stderr.
+func listURLs(out io.Writer, urls []string) bool {
+	ok := true
+	w := bufio.NewWriter(out)
+	for _, raw := range urls {
+		u, err := normalizeURL(raw)
+		if err != nil {
+			ok = false
+			fmt.Fprintf(os.Stderr, "fetchall: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\x00", u)
+	}
+	w.Flush()
+	return ok
+}
+
+// createMirrorFile creates the file that u's body is saved to under root.
+func createMirrorFile(root string, u *url.URL) (*os.File, error) {
+	name, err := mirrorPath(root, u)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
+
+// saveError writes why u couldn't be fetched to where its body would have gone under
+// -mirror's errors/ directory, so -split-by-status leaves a file behind for every URL.
+func saveError(u *url.URL, fetchErr error) {
+	if *mirror == "" || !*splitByStatus {
+		return
+	}
+	f, err := createMirrorFile(filepath.Join(*mirror, "errors"), u)
+	if err == nil {
+		_, err = fmt.Fprintln(f, fetchErr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fetchall: saving the error for %s: %v\n", u, err)
+	}
+}
+
+// mirrorPath maps a URL onto root/host/path. a path ending in "/" (or no path at all) is a
+// directory, so it gets an index.html, and any other path is a directory too with the body in
+// a file called index. on the web /a and /a/b can both be there, but on disk a can't be a file
+// and a directory at once, so every segment of the path is a directory and only the index
+// files are files. ".." can't climb out of root because path.Clean on a rooted path drops it,
+// and every segment is sanitized so it is a plain file name.
+func mirrorPath(root string, u *url.URL) (string, error) {
+	host := sanitize(u.Host)
+	if host == "" {
+		return "", fmt.Errorf("no host in %q", u.String())
+	}
+
+	p := path.Clean("/" + u.Path)
+	if p == "/" || strings.HasSuffix(u.Path, "/") {
+		p = path.Join(p, "index.html")
+	} else {
+		p = path.Join(p, "index")
+	}
+
+	parts := []string{root, host}
+	for _, seg := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		parts = append(parts, sanitize(seg))
+	}
+	name := filepath.Join(parts...)
+
+	// belt and braces: the result has to stay inside root
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q escapes %s", u.String(), root)
+	}
+	return name, nil
+}
+
+// sanitize keeps letters, digits and a few safe punctuation marks and replaces the rest with "_".
+func sanitize(seg string) string {
+	s := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '-' || r == '_':
+			return r
+		}
+		return '_'
+	}, seg)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// hostLimiter is a semaphore per host. a host's entry only lives while some goroutine is using or
+// waiting for it, so a long run over many hosts doesn't keep a channel around for every host it has seen.
+// last is the exception: -delay has to remember when each host was last done with, but that's
+// only a time per host, not a channel.
+type hostLimiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSem
+	last  map[string]time.Time
+}
+
+type hostSem struct {
+	slots chan struct{}
+	users int // goroutines holding or waiting for a slot
+}
+
+// acquire waits for a slot for host and then for -delay to have passed since the last request to it.
+// it gives up and returns false, holding nothing, when ctx is done first.
+func (l *hostLimiter) acquire(ctx context.Context, host string) bool {
+	l.mu.Lock()
+	s := l.hosts[host]
+	if s == nil {
+		s = &hostSem{slots: make(chan struct{}, *perHost)}
+		l.hosts[host] = s
+	}
+	s.users++
+	l.mu.Unlock()
+
+	// blocking happens outside the lock so other hosts aren't held up
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.leave(host, s)
+		l.mu.Unlock()
+		return false
+	}
+
+	if *delay > 0 {
+		l.mu.Lock()
+		wait := time.Until(l.last[host].Add(*delay))
+		l.mu.Unlock()
+		// sleeping while holding the slot is what keeps the next request to this host behind us
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				l.mu.Lock()
+				<-s.slots
+				l.leave(host, s)
+				l.mu.Unlock()
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// leave is a goroutine done with host's entry, it goes once nobody else is using it. l.mu is held
+func (l *hostLimiter) leave(host string, s *hostSem) {
+	s.users--
+	if s.users == 0 {
+		delete(l.hosts, host)
+	}
+}
+
+func (l *hostLimiter) release(host string) {
+	l.mu.Lock()
+	s := l.hosts[host]
+	if *delay > 0 {
+		l.last[host] = time.Now()
+	}
+	<-s.slots
+	l.leave(host, s)
+	l.mu.Unlock()
+}
+
+// limitedHost is the host -per-host limits url by, or "" without -per-host.
+func limitedHost(url string) string {
+	if *perHost == 0 {
+		return ""
+	}
+	u, err := normalizeURL(url)
+	if err != nil {
+		// fetch fails it straight away, there's no host to wait for
+		return ""
+	}
+	return u.Host
+}
+
+// takeSlot waits for a -concurrency slot, or returns false when ctx is done first.
+func takeSlot(ctx context.Context) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// enter waits for an -adaptive slot when -adaptive is on, once host (when not "") and a
+// -concurrency slot are held already. it returns what gives all three back: it can be called
+// more than once and only does it the first time. good says how the request went, for -adaptive
+func enter(host string) func(good bool) {
+	if ctl != nil {
+		ctl.acquire()
+	}
+	var once sync.Once
+	return func(good bool) {
+		once.Do(func() {
+			if ctl != nil {
+				ctl.release(good)
+			}
+			if slots != nil {
+				<-slots
+			}
+			if host != "" {
+				hosts.release(host)
+			}
+		})
+	}
+}
+
+// admit waits for everything a request to host has to wait for before it goes out, in this order:
+// the host's -per-host slot and -delay, a -concurrency slot and an -adaptive one. host is "" when
+// there's no -per-host. it returns nil, holding nothing, when ctx is done before it has them all,
+// and otherwise enter's func to give them back
+func admit(ctx context.Context, host string) func(good bool) {
+	if host != "" && !hosts.acquire(ctx, host) {
+		return nil
+	}
+	if !takeSlot(ctx) {
+		if host != "" {
+			hosts.release(host)
+		}
+		return nil
+	}
+	return enter(host)
+}
+
+// uptime is the -interval record of one URL. the latencies are only of the checks that got a
+// 2xx, a fast 500 would otherwise make a broken site look quick
+type uptime struct {
+	target
+	checks, errors int
+	last           result
+	min, max, sum  float64
+}
+
+func (u *uptime) add(r result) {
+	u.checks++
+	u.last = r
+	if !r.ok() {
+		u.errors++
+		return
+	}
+	if u.checks-u.errors == 1 || r.secs < u.min {
+		u.min = r.secs
+	}
+	if r.secs > u.max {
+		u.max = r.secs
+	}
+	u.sum += r.secs
+}
+
+// monitor is the -interval loop. each round fetches every target at once and waits for all of
+// them, the next round starts interval after the last one started. Ctrl-C stops it cleanly: the
+// round in flight is cancelled and its unfinished checks aren't counted, so the last table
+// printed only has real answers in it
+func monitor(targets []target, interval time.Duration, rounds int, logName string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var logFile *os.File
+	if logName != "" {
+		var err error
+		if logFile, err = os.OpenFile(logName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return err
+		}
+		defer logFile.Close()
+	}
+	// the escape codes redraw the table in place on a terminal, anywhere else
+	// every round gets a fresh copy under the last one
+	redraw := isTerminal(os.Stdout)
+
+	stats := make([]uptime, len(targets))
+	for i, t := range targets {
+		stats[i].target = t
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for round := 1; rounds == 0 || round <= rounds; round++ {
+		results := make([]result, len(targets))
+		var wg sync.WaitGroup
+		for i, t := range targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// a round waits for -per-host, -delay, -concurrency and -adaptive like any other run,
+				// or every check of a big list would hit its servers at the same moment
+				leave := admit(ctx, limitedHost(t.url))
+				if leave == nil {
+					results[i] = result{url: t.url, err: context.Canceled}
+					return
+				}
+				results[i] = fetch(ctx, t.url)
+				leave(results[i].ok() && results[i].secs <= targetLatency.Seconds())
+			}()
+		}
+		wg.Wait()
+		when := time.Now()
+		for i, r := range results {
+			if ctx.Err() != nil && errors.Is(r.err, context.Canceled) {
+				// it was us who stopped it, not the server failing
+				continue
+			}
+			r.label = targets[i].label
+			stats[i].add(r)
+			if logFile != nil {
+				b, _ := json.Marshal(struct {
+					Time  time.Time `json:"time"`
+					Round int       `json:"round"`
+					reportResult
+				}{when, round, newReportResult(r)})
+				if _, err := logFile.Write(append(b, '\n')); err != nil {
+					return err
+				}
+			}
+		}
+		if redraw {
+			fmt.Print("\x1b[H\x1b[2J")
+		}
+		fmt.Printf("round %d at %s, every %v, Ctrl-C to stop\n", round, when.Format("15:04:05"), interval)
+		printUptime(os.Stdout, stats)
+
+		if rounds != 0 && round == rounds {
+			break
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// printUptime is the -interval table, a row per URL in the order they were given.
+func printUptime(w io.Writer, stats []uptime) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tCHECKS\tERRORS\tLAST\tMIN\tAVG\tMAX")
+	for _, u := range stats {
+		name := u.url
+		if u.label != "" {
+			name = "[" + u.label + "] " + u.url
+		}
+		last := "-"
+		switch {
+		case u.checks == 0:
+		case u.last.err != nil:
+			last = "error"
+		default:
+			last = strconv.Itoa(u.last.status)
+		}
+		rate := 0.0
+		if u.checks > 0 {
+			rate = 100 * float64(u.errors) / float64(u.checks)
+		}
+		lat := "-\t-\t-"
+		if ok := u.checks - u.errors; ok > 0 {
+			lat = fmt.Sprintf("%.3fs\t%.3fs\t%.3fs", u.min, u.sum/float64(ok), u.max)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%s\t%s\n", name, u.checks, rate, last, lat)
+	}
+	tw.Flush()
+}
+
+// live are the counters behind -summary-interval. the fetch goroutines and main update them
+// while the summary goroutine reads them, hence the atomics
+var live struct {
+	started  atomic.Int64 // URLs handed to a goroutine, which with -stdin keeps growing
+	inflight atomic.Int64
+	ok       atomic.Int64
+	failed   atomic.Int64
+}
+
+// printSummaries prints a progress line to stderr every interval until stop is closed.
+func printSummaries(interval time.Duration, start time.Time, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			ok, failed := live.ok.Load(), live.failed.Load()
+			done := ok + failed
+			rate := float64(done) / time.Since(start).Seconds()
+			fmt.Fprintf(os.Stderr, "fetchall: %d/%d done, %d in flight, %d ok, %d failed, %.1f req/s\n",
+				done, live.started.Load(), live.inflight.Load(), ok, failed, rate)
+		}
+	}
+}
+
+// aimd is the -adaptive limit on fetches in flight. it works like TCP's congestion window:
+// additive increase, multiplicative decrease. every good result adds 1/limit, so the limit goes up by
+// about one for each round of fetches, and every bad one halves it. the goroutines all start
+// straight away like without -adaptive, they just wait in acquire until the limit lets them go.
+type aimd struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    float64 // a float so the 1/limit steps add up
+	min, max float64
+	inflight int
+	peak     int // most fetches that were ever running together
+}
+
+func newAIMD(lo, hi int) *aimd {
+	c := &aimd{limit: float64(lo), min: float64(lo), max: float64(hi)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *aimd) acquire() {
+	c.mu.Lock()
+	for c.inflight >= int(c.limit) {
+		c.cond.Wait()
+	}
+	c.inflight++
+	if c.inflight > c.peak {
+		c.peak = c.inflight
+	}
+	c.mu.Unlock()
+}
+
+// release gives the slot back and grows or shrinks the limit depending on how the fetch went.
+func (c *aimd) release(good bool) {
+	c.mu.Lock()
+	c.inflight--
+	if good {
+		c.limit = math.Min(c.max, c.limit+1/c.limit)
+	} else {
+		c.limit = math.Max(c.min, c.limit/2)
+	}
+	c.mu.Unlock()
+	// the limit may have gone up by more than one slot's worth, so wake every waiter to check
+	c.cond.Broadcast()
+}
+
+// breaker is a circuit breaker per host. a host's circuit is closed (requests go through) until
+// -break-after failures in a row open it. while it is open requests fail without being sent, and
+// once -break-cooldown has passed a single request is let through as a probe: if it works the
+// circuit closes again, if not it stays open for another cooldown.
+type breaker struct {
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures  int       // in a row
+	openUntil time.Time // when the next probe may go out
+	probing   bool      // a probe is in flight, everyone else keeps waiting
+}
+
+// allow reports whether a request to host may go out.
+func (b *breaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.hosts[host]
+	if c == nil || c.failures < *breakAfter {
+		return true
+	}
+	if c.probing || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// record notes how a request to host went. a success forgets the host altogether.
+func (b *breaker) record(host string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		delete(b.hosts, host)
+		return
+	}
+	c := b.hosts[host]
+	if c == nil {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= *breakAfter {
+		c.openUntil = time.Now().Add(*breakCooldown)
+	}
+}
+
+// backoff is how long to wait after attempt (0 is the first) failed, when there is no Retry-After.
+func backoff(attempt int) time.Duration {
+	d := *maxRetryAfter
+	if attempt < 30 && *backoffBase<<attempt < d {
+		d = *backoffBase << attempt
+	}
+	if *jitter && d > 0 {
+		jitterRand.Lock()
+		d = time.Duration(jitterRand.Int63n(int64(d) + 1))
+		jitterRand.Unlock()
+	}
+	return d
+}
+
+// shouldRetry reports whether an attempt failed in a way that might work next time.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		_, again := classify(err)
+		return again
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// takeRetry claims one retry from -retry-budget, and reports false once it has run out.
+func takeRetry() bool {
+	for {
+		used := retriesUsed.Load()
+		if *retryBudget > 0 && used >= *retryBudget {
+			return false
+		}
+		// a plain Add could take the budget past the cap when two goroutines get here at once
+		if retriesUsed.CompareAndSwap(used, used+1) {
+			return true
+		}
+	}
+}
+
+// classify names the kind of transport error err is and says whether a retry could help.
+// kinds we don't know about aren't retried, since that can't make anything worse.
+func classify(err error) (kind string, retryable bool) {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled", false
+	case errors.As(err, &dnsErr):
+		// NXDOMAIN is an answer, a DNS server that timed out or failed for now isn't
+		if dnsErr.IsNotFound {
+			return "dns not found", false
+		}
+		return "dns", dnsErr.IsTimeout || dnsErr.IsTemporary
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused", false
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset", true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// the server closed a kept-alive connection just as we reused it
+		return "connection closed", true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout", true
+	}
+	var certErr *tls.CertificateVerificationError
+	var alert tls.AlertError
+	if errors.As(err, &certErr) || errors.As(err, &alert) {
+		return "tls", false
+	}
+	return "other", false
+}
+
+// retryAfter turns a Retry-After header into a delay. the header is either a number of
+// seconds ("120") or an HTTP date ("Wed, 21 Oct 2015 07:28:00 GMT").
+func retryAfter(h string, now time.Time) (time.Duration, bool) {
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(h)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	// a date in the past means we can go again right away
+	return 0, true
+}
@@ -0,0 +1,1865 @@
+package fetchall
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs fetchall itself instead of the tests when FETCHALL_TEST_ARGS is set, so a test can
+// see what the whole program does, flags, output and exit code, by running its own binary that way.
+// the flags are package variables, so two runs in the one process would get in each other's way
+//
+// with FETCHALL_TEST_PANIC set as well, fetching a URL with that in it panics
+func TestMain(m *testing.M) {
+	if s := os.Getenv("FETCHALL_TEST_PANIC"); s != "" {
+		fetchURL = func(ctx context.Context, url string) result {
+			if strings.Contains(url, s) {
+				panic("boom")
+			}
+			return fetch(ctx, url)
+		}
+	}
+	if args, ok := os.LookupEnv("FETCHALL_TEST_ARGS"); ok {
+		var argv []string
+		if err := json.Unmarshal([]byte(args), &argv); err != nil {
+			panic(err)
+		}
+		Main(argv)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fetchallCmd is fetchall with args, run through TestMain in a process of its own
+func fetchallCmd(args ...string) *exec.Cmd {
+	// JSON and not spaces, an argument can have spaces in it
+	argv, _ := json.Marshal(args)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FETCHALL_TEST_ARGS="+string(argv))
+	return cmd
+}
+
+// run runs cmd and returns what it printed and its exit code
+func run(t *testing.T, cmd *exec.Cmd) (stdout, stderr string, code int) {
+	t.Helper()
+	var out, errOut strings.Builder
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), cmd.ProcessState.ExitCode()
+}
+
+// runFetchall is run(t, fetchallCmd(args...)) for a test that needs nothing else set up
+func runFetchall(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	return run(t, fetchallCmd(args...))
+}
+
+// jsonResults decodes -format json output into its results, leaving out the summary record
+func jsonResults(t *testing.T, out string) []reportResult {
+	t.Helper()
+	var results []reportResult
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, `{"summary"`) {
+			continue
+		}
+		var r reportResult
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// sortResults are results with every field set that a printer reads
+var sortResults = []result{
+	{label: "home", url: "https://a.example/", status: 200, nbytes: 1234, secs: 0.5, proto: "HTTP/2.0", reused: true,
+		match: "match", links: []string{"https://a.example/b"}, body: []byte("<html>"), text: true, ctype: "text/html", attempts: 2},
+	{url: "https://b.example/img", status: 200, nbytes: 3, secs: 0.1, proto: "HTTP/1.1", cut: true,
+		body: []byte{0xff, 0x00, 0x01}, ctype: "image/png", throttled: true, attempts: 1},
+	{url: "https://a.example/slow", status: 503, secs: 2, proto: "HTTP/1.1", attempts: 3},
+	{url: "https://c.example/", err: errors.New("https://c.example/: connection refused"), attempts: 1},
+}
+
+// same is reflect.DeepEqual with the errors compared by their text, which is all a sortRecord keeps
+func same(a, b result) bool {
+	if fmt.Sprint(a.err) != fmt.Sprint(b.err) {
+		return false
+	}
+	a.err, b.err = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func TestSortRecordRoundTrip(t *testing.T) {
+	for _, r := range sortResults {
+		if got := newSortRecord(r).result(); !same(got, r) {
+			t.Errorf("newSortRecord(%+v).result() = %+v", r, got)
+		}
+	}
+}
+
+// TestExternalSort sorts once in memory and once spilling a run every record, which sends every
+// record through its JSON form on disk.
+func TestExternalSort(t *testing.T) {
+	tests := []struct {
+		by   string
+		want []string // URLs in order
+	}{
+		{"latency", []string{"https://b.example/img", "https://a.example/", "https://a.example/slow", "https://c.example/"}},
+		{"host", []string{"https://a.example/", "https://a.example/slow", "https://b.example/img", "https://c.example/"}},
+	}
+	for _, tt := range tests {
+		for _, mem := range []int{100, 1} {
+			s := newExternalSort(tt.by, mem)
+			for _, r := range sortResults {
+				if err := s.add(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []result
+			if err := s.each(func(r result) { got = append(got, r) }); err != nil {
+				t.Fatal(err)
+			}
+			s.cleanup()
+			var urls []string
+			for _, r := range got {
+				urls = append(urls, r.url)
+				for _, want := range sortResults {
+					if want.url == r.url && !same(r, want) {
+						t.Errorf("-sort-by %s, %d in memory: %s came back as %+v, want %+v", tt.by, mem, r.url, r, want)
+					}
+				}
+			}
+			if !reflect.DeepEqual(urls, tt.want) {
+				t.Errorf("-sort-by %s, %d in memory: %q, want %q", tt.by, mem, urls, tt.want)
+			}
+		}
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     []robotsRule
+	}{
+		{"empty", "", nil},
+		{"star", "User-agent: *\nDisallow: /private\nAllow: /private/ok\n",
+			[]robotsRule{{false, "/private"}, {true, "/private/ok"}}},
+		{"ours wins over star", "User-agent: *\nDisallow: /\n\nUser-agent: fetchall\nDisallow: /admin\n",
+			[]robotsRule{{false, "/admin"}}},
+		{"other agents ignored", "User-agent: googlebot\nDisallow: /\n", nil},
+		{"version and case", "user-agent: FetchAll/1.0\ndisallow: /x # not /y\n", []robotsRule{{false, "/x"}}},
+		{"shared group", "User-agent: other\nUser-agent: *\nDisallow: /both\n", []robotsRule{{false, "/both"}}},
+		{"groups merge", "User-agent: *\nDisallow: /a\n\nUser-agent: other\nDisallow: /b\n\nUser-agent: *\nDisallow: /c\n",
+			[]robotsRule{{false, "/a"}, {false, "/c"}}},
+		{"empty disallow", "User-agent: *\nDisallow:\n", nil},
+		{"junk lines", "hello\nUser-agent: *\nno colon here\nDisallow: /z\n", []robotsRule{{false, "/z"}}},
+	}
+	for _, tt := range tests {
+		if got := parseRobots(strings.NewReader(tt.in)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseRobots = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/anything", true},
+		{"/private", "/private", true},
+		{"/private", "/private/x", true},
+		{"/private", "/public", false},
+		{"/*.pdf", "/docs/a.pdf", true},
+		{"/*.pdf", "/docs/a.pdf?dl=1", true},
+		{"/*.pdf$", "/docs/a.pdf?dl=1", false},
+		{"/*.pdf$", "/docs/a.pdf", true},
+		{"/a$", "/a", true},
+		{"/a$", "/ab", false},
+		{"/a*b*c", "/a-b-c-d", true},
+		{"/a*c*b", "/a-b-c", false},
+		{"/*/edit$", "/x/edit/edit", true},
+	}
+	for _, tt := range tests {
+		if got := robotsMatch(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRobotsPermit(t *testing.T) {
+	rules := []robotsRule{{false, "/"}, {true, "/public"}, {false, "/public/secret"}, {true, "/same"}, {false, "/same"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/", false},
+		{"/other", false},
+		{"/public/x", true},
+		{"/public/secret/y", false},
+		{"/same", true}, // an Allow wins a tie
+	}
+	for _, tt := range tests {
+		if got := robotsPermit(rules, tt.path); got != tt.want {
+			t.Errorf("robotsPermit(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// TestRobotsRetry checks a robots.txt that failed with a 5xx is asked for again later, while
+// one that worked is kept.
+func TestRobotsRetry(t *testing.T) {
+	var asked atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if asked.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "User-agent: *\nDisallow: /private\n")
+	}))
+	defer srv.Close()
+	client = srv.Client()
+	cache := &robotsCache{hosts: make(map[string]*robotsEntry)}
+	ctx := context.Background()
+	page, _ := url.Parse(srv.URL + "/page")
+	private, _ := url.Parse(srv.URL + "/private")
+
+	if cache.allowed(ctx, page) {
+		t.Errorf("allowed after a 503, want everything kept out")
+	}
+	if asked.Load() != 1 {
+		t.Errorf("robots.txt asked for %d times, want 1", asked.Load())
+	}
+	// as if robotsRetry had gone by
+	for _, e := range cache.hosts {
+		e.retry = time.Time{}
+	}
+	if !cache.allowed(ctx, page) || cache.allowed(ctx, private) {
+		t.Errorf("after the retry, /page or /private came out wrong")
+	}
+	if asked.Load() != 2 {
+		t.Errorf("robots.txt asked for %d times, want 2: it's kept once it has worked", asked.Load())
+	}
+}
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"HTTP://Example.COM", "http://example.com/"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:80/a", "https://example.com:80/a"},
+		{"http://example.com/a/./b", "http://example.com/a/b"},
+		{"http://example.com/a/b/../c", "http://example.com/a/c"},
+		{"http://example.com//a//b", "http://example.com/a/b"},
+		{"http://example.com/docs", "http://example.com/docs"},
+		{"http://example.com/docs/", "http://example.com/docs/"},
+		{"http://example.com/docs/.", "http://example.com/docs/"},
+		{"http://example.com/docs/x/..", "http://example.com/docs/"},
+		{"http://example.com/docs/./", "http://example.com/docs/"},
+		{"http://example.com/..", "http://example.com/"},
+		{"http://example.com/a?q=1#top", "http://example.com/a?q=1"},
+		{"http://[::1]:8080/", "http://[::1]:8080/"},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		if got := canonicalURL(tt.in); got != tt.want {
+			t.Errorf("canonicalURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMirrorPath(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"http://example.com", "example.com/index.html"},
+		{"http://example.com/", "example.com/index.html"},
+		{"http://example.com/a", "example.com/a/index"},
+		{"http://example.com/a/", "example.com/a/index.html"},
+		{"http://example.com/a/b.css", "example.com/a/b.css/index"},
+		{"http://example.com:8080/a", "example.com_8080/a/index"},
+		{"http://example.com/../../etc/passwd", "example.com/etc/passwd/index"},
+		{"http://example.com/a%20b/c:d", "example.com/a_b/c_d/index"},
+		{"http://example.com/a/..%2f", "example.com/index.html"},
+		{"http://example.com/a/index", "example.com/a/index/index"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mirrorPath("root", u)
+		if err != nil {
+			t.Errorf("mirrorPath(%q): %v", tt.in, err)
+			continue
+		}
+		if got = filepath.ToSlash(got); got != "root/"+tt.want {
+			t.Errorf("mirrorPath(%q) = %q, want %q", tt.in, got, "root/"+tt.want)
+		}
+	}
+	if _, err := mirrorPath("root", &url.URL{Path: "/a"}); err == nil {
+		t.Error("mirrorPath with no host worked, want an error")
+	}
+}
+
+// a file and the directory a longer path needs can't be the same name, whichever comes first
+func TestMirrorNesting(t *testing.T) {
+	for _, order := range [][]string{{"/a", "/a/b", "/a/"}, {"/a/b", "/a/", "/a"}} {
+		root := t.TempDir()
+		for _, p := range order {
+			f, err := createMirrorFile(root, &url.URL{Scheme: "http", Host: "example.com", Path: p})
+			if err != nil {
+				t.Errorf("%v: creating %s: %v", order, p, err)
+				continue
+			}
+			f.Close()
+		}
+	}
+}
+
+// TestTableColumns checks every column of -table starts at the same place on every row, however
+// wide the values in the rows above and below it are
+func TestTableColumns(t *testing.T) {
+	results := []result{
+		{url: "https://a.example/", status: 200, nbytes: 5, secs: 0.1, proto: "HTTP/1.1"},
+		{label: "a much longer label", url: "https://b.example/a/long/path", status: 404, nbytes: 123456789, secs: 12.5, proto: "HTTP/2.0", reused: true},
+		{label: "x", url: "https://c.example/", err: errors.New("connection refused")},
+	}
+	var out strings.Builder
+	printTable(&out, results)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1+len(results) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), 1+len(results), out.String())
+	}
+
+	// where each column starts, from the header: a column is a run of non-spaces after two spaces or more
+	header := lines[0]
+	starts := []int{0}
+	for i := 2; i < len(header); i++ {
+		if header[i] != ' ' && header[i-1] == ' ' && header[i-2] == ' ' {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) != 7 {
+		t.Fatalf("header %q has %d columns, want 7", header, len(starts))
+	}
+	for _, line := range lines[1:] {
+		for _, at := range starts[1:] {
+			if at >= len(line) || line[at] == ' ' || line[at-1] != ' ' || line[at-2] != ' ' {
+				t.Errorf("row %q doesn't start a column at %d like the header %q", line, at, header)
+				break
+			}
+		}
+	}
+	if !strings.Contains(lines[3], "ERR") || !strings.Contains(lines[3], "(connection refused)") {
+		t.Errorf("error row %q, want ERR and the error", lines[3])
+	}
+}
+
+// TestNoKeepAlive fetches two pages off one server one after the other: the second reuses the first
+// one's connection, unless -no-keepalive is on, when each gets a new one
+func TestNoKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		flags  []string
+		conns  int64
+		reused bool
+	}{
+		{nil, 1, true},
+		{[]string{"-no-keepalive"}, 2, false},
+	} {
+		var conns atomic.Int64
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}))
+		srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+			if s == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		srv.Start()
+
+		args := append(tt.flags, "-concurrency", "1", "-format", "json", srv.URL+"/a", srv.URL+"/b")
+		out, errOut, code := runFetchall(t, args...)
+		srv.Close()
+		if code != 0 {
+			t.Fatalf("%v: exit %d: %s", tt.flags, code, errOut)
+		}
+		results := jsonResults(t, out)
+		if len(results) != 2 {
+			t.Fatalf("%v: got %d results, want 2:\n%s", tt.flags, len(results), out)
+		}
+		// whichever finished second is the one that could have reused a connection
+		if results[0].Reused || results[1].Reused != tt.reused {
+			t.Errorf("%v: reused %t then %t, want false then %t", tt.flags, results[0].Reused, results[1].Reused, tt.reused)
+		}
+		if conns.Load() != tt.conns {
+			t.Errorf("%v: the server saw %d connections, want %d", tt.flags, conns.Load(), tt.conns)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		h    string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"soon", 0, false},
+		{"Wed, 21 Oct 2015 07:28:30 GMT", 30 * time.Second, true},
+		{"Wed, 21 Oct 2015 08:28:00 GMT", time.Hour, true},
+		// the RFC 850 and asctime forms are HTTP dates too
+		{"Wednesday, 21-Oct-15 07:29:00 GMT", time.Minute, true},
+		{"Wed Oct 21 07:28:10 2015", 10 * time.Second, true},
+		// already gone, so no wait at all
+		{"Wed, 21 Oct 2015 07:00:00 GMT", 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.h, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %t, want %v, %t", tt.h, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestRetryAfterHonored has a server say to come back straight away, which fetchall does instead of
+// waiting out a -backoff of a minute
+func TestRetryAfterHonored(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", r.URL.Query().Get("after"))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	for _, after := range []string{"0", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)} {
+		hits.Store(0)
+		start := time.Now()
+		out, errOut, code := runFetchall(t, "-retries", "1", "-backoff", "1m", "-format", "json", srv.URL+"/?after="+url.QueryEscape(after))
+		if code != 0 {
+			t.Fatalf("exit %d: %s", code, errOut)
+		}
+		if took := time.Since(start); took > 10*time.Second {
+			t.Errorf("Retry-After %q: took %v, the -backoff and not the header", after, took)
+		}
+		if r := jsonResults(t, out); len(r) != 1 || r[0].Status != 200 || r[0].Attempts != 2 {
+			t.Errorf("Retry-After %q: got %s, want a 200 on the second attempt", after, out)
+		}
+	}
+}
+
+// statusServer answers /NNN with status NNN, and anything else with a 200
+func statusServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			code = http.StatusOK
+		}
+		w.WriteHeader(code)
+		io.WriteString(w, "body")
+	}))
+}
+
+func TestColor(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	tests := []struct {
+		mode  string
+		codes []string // the escape codes that have to be there, nil for none at all
+	}{
+		{"always", []string{"\x1b[32m", "\x1b[33m", "\x1b[31m", "\x1b[0m"}},
+		{"never", nil},
+		// stdout is a pipe here, not a terminal
+		{"auto", nil},
+	}
+	for _, tt := range tests {
+		for _, table := range []bool{false, true} {
+			args := []string{"-color", tt.mode, srv.URL + "/ok", srv.URL + "/304", srv.URL + "/404"}
+			if table {
+				args = append([]string{"-table"}, args...)
+			}
+			out, errOut, code := runFetchall(t, args...)
+			if code != 0 {
+				t.Fatalf("-color %s: exit %d: %s", tt.mode, code, errOut)
+			}
+			if tt.codes == nil && strings.Contains(out, "\x1b[") {
+				t.Errorf("-color %s (table %t): escape codes in %q", tt.mode, table, out)
+			}
+			for _, c := range tt.codes {
+				if !strings.Contains(out, c) {
+					t.Errorf("-color %s (table %t): no %q in %q", tt.mode, table, c, out)
+				}
+			}
+		}
+	}
+	if _, errOut, code := runFetchall(t, "-color", "sometimes", srv.URL); code != 1 || !strings.Contains(errOut, "auto, always or never") {
+		t.Errorf("-color sometimes: exit %d, %q, want 1 and the choices", code, errOut)
+	}
+}
+
+// closedURL is a URL nothing is listening on any more
+func closedURL() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL + "/gone"
+}
+
+func TestOnlyErrors(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	gone := closedURL()
+	out, errOut, code := runFetchall(t, "-only-errors", srv.URL+"/ok", srv.URL+"/404", srv.URL+"/201", srv.URL+"/500", gone)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasSuffix(line, "elapsed") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want the three failures and the count:\n%s", len(lines), out)
+	}
+	for _, want := range []string{"/404 (404 Not Found)", "/500 (500 Internal Server Error)", gone} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "/ok") || strings.Contains(out, "/201") {
+		t.Errorf("a 2xx made it into\n%s", out)
+	}
+	if lines[3] != "3 of 5 failed" {
+		t.Errorf("last line %q, want 3 of 5 failed", lines[3])
+	}
+}
+
+// gauge counts requests in flight and remembers the most there ever were at once
+type gauge struct {
+	now, peak atomic.Int64
+}
+
+func (g *gauge) enter() {
+	n := g.now.Add(1)
+	for p := g.peak.Load(); n > p && !g.peak.CompareAndSwap(p, n); p = g.peak.Load() {
+	}
+}
+
+func (g *gauge) leave() { g.now.Add(-1) }
+
+// slowServer takes wait to answer each request, counting them in its own gauge and in all
+func slowServer(wait time.Duration, all *gauge) (*httptest.Server, *gauge) {
+	g := new(gauge)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.enter()
+		all.enter()
+		time.Sleep(wait)
+		g.leave()
+		all.leave()
+		io.WriteString(w, "ok")
+	}))
+	return srv, g
+}
+
+// TestPerHost sends ten URLs to each of two hosts with -per-host 2: no host ever has more than two
+// at once, and the two hosts are still fetched side by side
+func TestPerHost(t *testing.T) {
+	var all gauge
+	a, aGauge := slowServer(50*time.Millisecond, &all)
+	defer a.Close()
+	b, bGauge := slowServer(50*time.Millisecond, &all)
+	defer b.Close()
+
+	args := []string{"-per-host", "2"}
+	for i := range 10 {
+		args = append(args, fmt.Sprintf("%s/%d", a.URL, i), fmt.Sprintf("%s/%d", b.URL, i))
+	}
+	out, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if n := strings.Count(out, "\n"); n != 21 {
+		t.Errorf("got %d lines, want 20 results and the time:\n%s", n, out)
+	}
+	for name, g := range map[string]*gauge{"a": aGauge, "b": bGauge} {
+		if p := g.peak.Load(); p != 2 {
+			t.Errorf("host %s had up to %d requests at once, want 2", name, p)
+		}
+	}
+	if p := all.peak.Load(); p < 3 {
+		t.Errorf("up to %d requests at once in all, want the hosts in parallel", p)
+	}
+}
+
+// TestDryRun checks -dry-run lists the URLs without sending a single request for them
+func TestDryRun(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer srv.Close()
+	upper := strings.Replace(srv.URL, "http://127.0.0.1", "HTTP://127.0.0.1", 1)
+
+	out, errOut, code := runFetchall(t, "-dry-run", srv.URL+"/a", upper+"/b")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	for _, want := range []string{"OK  " + srv.URL + "/a", "OK  " + srv.URL + "/b"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%s", want, out)
+		}
+	}
+
+	out, _, code = runFetchall(t, "-dry-run", srv.URL+"/a", "ftp://example.com/", "http:///nohost")
+	if code != 1 || strings.Count(out, "BAD") != 2 {
+		t.Errorf("with bad URLs: exit %d, want 1 and both BAD:\n%s", code, out)
+	}
+
+	out, _, code = runFetchall(t, "-dry-run", "-print0", srv.URL+"/a", upper+"/b")
+	if want := srv.URL + "/a\x00" + srv.URL + "/b\x00"; code != 0 || out != want {
+		t.Errorf("-print0: exit %d, %q, want 0 and %q", code, out, want)
+	}
+	// bad ones are left out, and said so on stderr
+	out, errOut, code = runFetchall(t, "-dry-run", "-print0", "ftp://example.com/", srv.URL+"/a b")
+	if want := srv.URL + "/a%20b\x00"; code != 1 || out != want || !strings.Contains(errOut, `"ftp://example.com/": scheme must be http or https`) {
+		t.Errorf("-print0 with a bad URL: exit %d, %q, %q, want 1 and %q", code, out, errOut, want)
+	}
+
+	if hits.Load() != 0 {
+		t.Errorf("the server got %d requests, want none", hits.Load())
+	}
+}
+
+// TestLabels reads a -i file with labeled and unlabeled lines, comments and blanks, the labels
+// have to turn up next to their URLs in each output
+func TestLabels(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	list := filepath.Join(t.TempDir(), "urls")
+	lines := "# the home page\nhome\t" + srv.URL + "/home\n\n" + srv.URL + "/plain\n  broken \t " + srv.URL + "/404\n"
+	if err := os.WriteFile(list, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, errOut, code := runFetchall(t, "-i", list)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	for _, want := range []string{"[home] " + srv.URL + "/home", "[broken] " + srv.URL + "/404 (404", "HTTP/1.1 " + srv.URL + "/plain"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%s", want, out)
+		}
+	}
+
+	out, _, _ = runFetchall(t, "-i", list, "-table")
+	for _, want := range []string{"  home  ", "  broken  ", "  -  "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("-table: no %q in\n%s", want, out)
+		}
+	}
+
+	out, _, _ = runFetchall(t, "-i", list, "-format", "json")
+	labels := make(map[string]string)
+	for _, r := range jsonResults(t, out) {
+		labels[strings.TrimPrefix(r.URL, srv.URL)] = r.Label
+	}
+	if want := map[string]string{"/home": "home", "/plain": "", "/404": "broken"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("-format json labels %v, want %v", labels, want)
+	}
+
+	// a URL given twice is fetched once, and keeps the label even when the first time had none
+	out, _, _ = runFetchall(t, "-i", list, srv.URL+"/home")
+	if strings.Count(out, "/home") != 1 || !strings.Contains(out, "[home]") {
+		t.Errorf("home given twice:\n%s", out)
+	}
+}
+
+func TestReport(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	dir := t.TempDir()
+
+	for _, tt := range []struct {
+		urls   []string
+		code   int
+		ok     int
+		failed int
+		bytes  int64 // the 500 has a body as well
+	}{
+		{[]string{srv.URL + "/a", srv.URL + "/b"}, 0, 2, 0, 8},
+		{[]string{srv.URL + "/a", srv.URL + "/500", closedURL()}, 1, 1, 2, 8},
+	} {
+		name := filepath.Join(dir, "report.json")
+		_, errOut, code := runFetchall(t, append([]string{"-report", name}, tt.urls...)...)
+		if code != tt.code {
+			t.Errorf("%v: exit %d, want %d: %s", tt.urls, code, tt.code, errOut)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("the report isn't JSON: %v\n%s", err, data)
+		}
+		for _, f := range []string{"started", "elapsed_secs", "total", "ok", "failed", "bytes", "secs", "exit_status", "results"} {
+			if _, ok := fields[f]; !ok {
+				t.Errorf("%v: no %q in the report\n%s", tt.urls, f, data)
+			}
+		}
+		var rep batchReport
+		if err := json.Unmarshal(data, &rep); err != nil {
+			t.Fatal(err)
+		}
+		if rep.Total != len(tt.urls) || rep.OK != tt.ok || rep.Failed != tt.failed || rep.ExitStatus != tt.code || len(rep.Results) != len(tt.urls) {
+			t.Errorf("%v: total %d, ok %d, failed %d, exit_status %d, %d results", tt.urls, rep.Total, rep.OK, rep.Failed, rep.ExitStatus, len(rep.Results))
+		}
+		if rep.Bytes != tt.bytes {
+			t.Errorf("%v: %d bytes, want %d", tt.urls, rep.Bytes, tt.bytes)
+		}
+		if rep.Secs.Min <= 0 || rep.Secs.Min > rep.Secs.P50 || rep.Secs.P50 > rep.Secs.Max {
+			t.Errorf("%v: secs %+v out of order", tt.urls, rep.Secs)
+		}
+		// the temp file is renamed into place, nothing is left behind
+		if left, _ := filepath.Glob(name + ".tmp-*"); len(left) > 0 {
+			t.Errorf("left behind: %v", left)
+		}
+	}
+}
+
+// TestPanic has the fetch of one URL panic: the batch still finishes, the URL gets an error result,
+// and the -concurrency slot it held is given back for the URLs after it
+func TestPanic(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	cmd := fetchallCmd("-concurrency", "1", "-report", filepath.Join(t.TempDir(), "report.json"), srv.URL+"/panic", srv.URL+"/a", srv.URL+"/b")
+	cmd.Env = append(cmd.Env, "FETCHALL_TEST_PANIC=/panic")
+	out, errOut, code := run(t, cmd)
+	if code != 1 {
+		t.Errorf("exit %d, want 1 for the failed fetch", code)
+	}
+	if !strings.Contains(out, srv.URL+"/panic: panic: boom") {
+		t.Errorf("no error result for /panic in\n%s", out)
+	}
+	for _, u := range []string{"/a", "/b"} {
+		if !strings.Contains(out, "HTTP/1.1 "+srv.URL+u) {
+			t.Errorf("no result for %s in\n%s", u, out)
+		}
+	}
+	if !strings.Contains(errOut, "fetchall: panic fetching "+srv.URL+"/panic: boom") || !strings.Contains(errOut, "goroutine") {
+		t.Errorf("stderr has no panic and stack:\n%s", errOut)
+	}
+}
+
+// TestFlushPipe reads fetchall's stdout through a pipe: the fast URL's line has to come through
+// while the slow one is still being held up, not together with it at the end
+func TestFlushPipe(t *testing.T) {
+	hold := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-hold
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	released := false
+	release := func() {
+		if !released {
+			close(hold)
+			released = true
+		}
+	}
+	defer release()
+
+	cmd := fetchallCmd(srv.URL+"/slow", srv.URL+"/fast")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		scan := bufio.NewScanner(stdout)
+		for scan.Scan() {
+			lines <- scan.Text()
+		}
+		close(lines)
+	}()
+
+	select {
+	case line := <-lines:
+		if !strings.HasSuffix(line, srv.URL+"/fast") {
+			t.Errorf("first line %q, want /fast", line)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no line while /slow was held up, the output waited for it")
+	}
+	release()
+	var rest []string
+	for line := range lines {
+		rest = append(rest, line)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 2 || !strings.HasSuffix(rest[0], srv.URL+"/slow") || !strings.HasSuffix(rest[1], "elapsed") {
+		t.Errorf("after /fast came %q, want /slow and the time", rest)
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	c := newAIMD(1, 4)
+	steps := []struct {
+		good bool
+		want float64
+	}{
+		{true, 2},
+		{true, 2.5},
+		{true, 2.9},
+		{false, 1.45},
+		{false, 1}, // not below -min-concurrency
+		{true, 2},
+		{true, 2.5},
+		{true, 2.9},
+		{true, 3.245},
+		{true, 3.553},
+		{true, 3.835},
+		{true, 4}, // nor above -max-concurrency
+		{false, 2},
+	}
+	for i, s := range steps {
+		c.acquire()
+		c.release(s.good)
+		if math.Abs(c.limit-s.want) > 0.001 {
+			t.Fatalf("step %d (good %t): limit %.3f, want %.3f", i, s.good, c.limit, s.want)
+		}
+	}
+}
+
+// TestAdaptive has a server that answers fast and then gets slow: -adaptive lets more fetches run
+// at once while it's fast and cuts back once it's slower than -target-latency
+func TestAdaptive(t *testing.T) {
+	var all gauge
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		all.enter()
+		defer all.leave()
+		if hits.Add(1) > 20 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	args := []string{"-adaptive", "-max-concurrency", "8", "-target-latency", "50ms"}
+	for i := range 30 {
+		args = append(args, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	_, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	i := strings.Index(errOut, "fetchall: ran up to")
+	if i < 0 {
+		t.Fatalf("no -adaptive line in %q", errOut)
+	}
+	var peak, end int
+	if _, err := fmt.Sscanf(errOut[i:], "fetchall: ran up to %d at once, ending at %d", &peak, &end); err != nil {
+		t.Fatalf("%v in %q", err, errOut)
+	}
+	if peak < 3 || end >= peak {
+		t.Errorf("ran up to %d at once, ending at %d: want it to grow and then shrink", peak, end)
+	}
+	if p := all.peak.Load(); p > int64(peak) {
+		t.Errorf("the server saw %d at once, more than the %d fetchall says it ran", p, peak)
+	}
+}
+
+// TestBreaker has a host that always fails: after -break-after failures in a row its other URLs
+// fail without a request, and they say so
+func TestBreaker(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	args := []string{"-break-after", "3", "-concurrency", "1"}
+	for i := range 10 {
+		args = append(args, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	out, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if hits.Load() != 3 {
+		t.Errorf("the server got %d requests, want 3", hits.Load())
+	}
+	if n := strings.Count(out, "circuit open for "+strings.TrimPrefix(srv.URL, "http://")); n != 7 {
+		t.Errorf("%d URLs short-circuited, want 7:\n%s", n, out)
+	}
+}
+
+// TestBreakerProbe walks one host's circuit through opening, a failed probe and a good one
+func TestBreakerProbe(t *testing.T) {
+	defer func(n int, d time.Duration) { *breakAfter, *breakCooldown = n, d }(*breakAfter, *breakCooldown)
+	*breakAfter, *breakCooldown = 2, 20*time.Millisecond
+	b := &breaker{hosts: make(map[string]*circuit)}
+	const host = "a.example"
+
+	b.record(host, false)
+	if !b.allow(host) {
+		t.Fatal("the circuit opened after one failure, want two")
+	}
+	b.record(host, false)
+	if b.allow(host) || !b.allow("b.example") {
+		t.Fatal("after two failures the host is let through, or another host isn't")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow(host) {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow(host) {
+		t.Fatal("a second request while the probe is out")
+	}
+	b.record(host, false)
+	if b.allow(host) {
+		t.Fatal("the probe failed, but the circuit let the next one through straight away")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow(host) {
+		t.Fatal("no probe after the second cooldown")
+	}
+	b.record(host, true)
+	if !b.allow(host) || !b.allow(host) {
+		t.Fatal("the probe worked, but the circuit didn't close")
+	}
+}
+
+// TestSummaryInterval runs for a few -summary-interval ticks: progress lines go to stderr while it
+// runs, and none of them to stdout or after the results
+func TestSummaryInterval(t *testing.T) {
+	var all gauge
+	srv, _ := slowServer(200*time.Millisecond, &all)
+	defer srv.Close()
+	out, errOut, code := runFetchall(t, "-summary-interval", "50ms", srv.URL+"/a", srv.URL+"/b")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	progress := regexp.MustCompile(`^fetchall: (\d+)/2 done, (\d+) in flight, \d+ ok, \d+ failed, [\d.]+ req/s$`)
+	var n int
+	for _, line := range strings.Split(strings.TrimSpace(errOut), "\n") {
+		m := progress.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("stderr line %q isn't a progress line", line)
+			continue
+		}
+		n++
+		if m[1] != "0" || m[2] != "2" {
+			t.Errorf("%q: want 0 done and 2 in flight while the server holds both", line)
+		}
+	}
+	if n == 0 {
+		t.Errorf("no progress lines in %q", errOut)
+	}
+	if strings.Contains(out, "in flight") {
+		t.Errorf("progress on stdout:\n%s", out)
+	}
+}
+
+func TestSize(t *testing.T) {
+	defer func(h bool) { *human = h }(*human)
+	tests := []struct {
+		n      int64
+		plain  string
+		pretty string
+	}{
+		{0, "0", "0 B"},
+		{1023, "1023", "1023 B"},
+		{1024, "1024", "1.0 KiB"},
+		{1536, "1536", "1.5 KiB"},
+		{1<<20 - 1, "1048575", "1024.0 KiB"},
+		{1 << 20, "1048576", "1.0 MiB"},
+		{5<<30 + 1<<29, "5905580032", "5.5 GiB"},
+		// there's no TiB, GiB goes on up
+		{3 << 40, "3298534883328", "3072.0 GiB"},
+	}
+	for _, tt := range tests {
+		*human = false
+		if got := size(tt.n); got != tt.plain {
+			t.Errorf("size(%d) = %q, want %q", tt.n, got, tt.plain)
+		}
+		*human = true
+		if got := size(tt.n); got != tt.pretty {
+			t.Errorf("with -h, size(%d) = %q, want %q", tt.n, got, tt.pretty)
+		}
+	}
+}
+
+// TestStdinStreaming feeds -stdin one line at a time: the first URL is fetched while the pipe is
+// still open, before the next line has even been written
+func TestStdinStreaming(t *testing.T) {
+	got := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.URL.Path
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	cmd := fetchallCmd("-stdin", srv.URL+"/arg")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	wait := func(want string) {
+		t.Helper()
+		select {
+		case p := <-got:
+			if p != want {
+				t.Errorf("the server got %s, want %s", p, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no request for %s while stdin is still open", want)
+		}
+	}
+	wait("/arg")
+	io.WriteString(stdin, "# not a URL\n\nfirst\t"+srv.URL+"/one\n")
+	wait("/one")
+	// the same URL again is skipped, like one given twice on the command line
+	io.WriteString(stdin, srv.URL+"/one\n"+srv.URL+"/two\n")
+	wait("/two")
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	close(got)
+	for p := range got {
+		t.Errorf("another request for %s", p)
+	}
+	for _, want := range []string{srv.URL + "/arg", "[first] " + srv.URL + "/one", srv.URL + "/two", "1 duplicate URLs skipped"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("no %q in\n%s", want, out.String())
+		}
+	}
+}
+
+// TestFailFast has the first URL fail with -concurrency 1: the ones after it are skipped, and the
+// server never hears from them
+func TestFailFast(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/500" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	rest := []string{srv.URL + "/a", srv.URL + "/b", srv.URL + "/c", srv.URL + "/d"}
+
+	tests := []struct {
+		flags []string
+		first string
+		hits  int64 // the failing URL's own request, when it got as far as the server
+	}{
+		{[]string{"-fail-fast"}, closedURL(), 0},
+		{[]string{"-fail-fast", "-strict"}, srv.URL + "/500", 1},
+	}
+	for _, tt := range tests {
+		hits.Store(0)
+		args := append(append(tt.flags, "-concurrency", "1", tt.first), rest...)
+		out, errOut, code := runFetchall(t, args...)
+		if code != 0 {
+			t.Fatalf("%v: exit %d: %s", tt.flags, code, errOut)
+		}
+		if hits.Load() != tt.hits {
+			t.Errorf("%v: the server got %d requests, want %d", tt.flags, hits.Load(), tt.hits)
+		}
+		if !strings.Contains(out, "-fail-fast stopped the run: 1 fetched (1 failed), ") {
+			t.Errorf("%v: no fail-fast summary in\n%s", tt.flags, out)
+		}
+	}
+
+	// without -strict a 500 is a fetch that worked
+	hits.Store(0)
+	out, _, _ := runFetchall(t, append([]string{"-fail-fast", "-concurrency", "1", srv.URL + "/500"}, rest...)...)
+	if hits.Load() != 5 || strings.Contains(out, "stopped the run") {
+		t.Errorf("-fail-fast without -strict stopped at a 500 (%d requests):\n%s", hits.Load(), out)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	pages := map[string]string{
+		"/yes":  "<p>hello</p>\n<p>needle here</p>\n",
+		"/no":   "<p>hello</p>\n<p>just hay</p>\n",
+		"/late": strings.Repeat("hay\n", 50000) + "a needle at the end",
+		"/case": "NEEDLE\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, pages[r.URL.Path])
+	}))
+	defer srv.Close()
+	var urls []string
+	for p := range pages {
+		urls = append(urls, srv.URL+p)
+	}
+
+	out, errOut, code := runFetchall(t, append([]string{"-grep", "needle", "-format", "json"}, urls...)...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	want := map[string]string{"/yes": "match", "/no": "no match", "/late": "match", "/case": "no match"}
+	for _, r := range jsonResults(t, out) {
+		p := strings.TrimPrefix(r.URL, srv.URL)
+		if r.Match != want[p] {
+			t.Errorf("%s: %q, want %q", p, r.Match, want[p])
+		}
+		// the body is read to the end after a match, so the size is the whole of it
+		if r.Bytes != int64(len(pages[p])) {
+			t.Errorf("%s: %d bytes, want %d", p, r.Bytes, len(pages[p]))
+		}
+	}
+
+	out, _, _ = runFetchall(t, append([]string{"-grep", "(?i)needle", "-only-matches"}, urls...)...)
+	for p := range pages {
+		if got := strings.Contains(out, srv.URL+p+" [match]"); got != (p != "/no") {
+			t.Errorf("-only-matches: %s listed %t:\n%s", p, got, out)
+		}
+	}
+
+	if _, errOut, code := runFetchall(t, "-grep", "(", srv.URL); code != 1 || !strings.Contains(errOut, "-grep:") {
+		t.Errorf("a bad -grep: exit %d, %q", code, errOut)
+	}
+}
+
+// arrivals is a server that notes when each request to it came in
+func arrivals() (*httptest.Server, func() []time.Time) {
+	var mu sync.Mutex
+	var at []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		at = append(at, time.Now())
+		mu.Unlock()
+		io.WriteString(w, "ok")
+	}))
+	return srv, func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(at)
+	}
+}
+
+// TestCrawlDelay sends five URLs to each of two hosts with -crawl: each host's requests are at
+// least -delay apart, and the two hosts don't wait for each other
+func TestCrawlDelay(t *testing.T) {
+	const gap = 100 * time.Millisecond
+	a, aTimes := arrivals()
+	defer a.Close()
+	b, bTimes := arrivals()
+	defer b.Close()
+	var args []string
+	for i := range 5 {
+		args = append(args, fmt.Sprintf("%s/%d", a.URL, i), fmt.Sprintf("%s/%d", b.URL, i))
+	}
+
+	start := time.Now()
+	_, errOut, code := runFetchall(t, append([]string{"-crawl", "-delay", gap.String()}, args...)...)
+	took := time.Since(start)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	for name, times := range map[string][]time.Time{"a": aTimes(), "b": bTimes()} {
+		if len(times) != 5 {
+			t.Fatalf("host %s got %d requests, want 5", name, len(times))
+		}
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d < gap {
+				t.Errorf("host %s: request %d came %v after the one before, want at least %v", name, i, d, gap)
+			}
+		}
+	}
+	// one host after the other would be nine gaps
+	if took > 8*gap {
+		t.Errorf("took %v, the hosts waited for each other", took)
+	}
+
+	if _, errOut, code := runFetchall(t, "-delay", "1s", a.URL); code != 1 || !strings.Contains(errOut, "-delay needs -per-host or -crawl") {
+		t.Errorf("-delay alone: exit %d, %q", code, errOut)
+	}
+}
+
+func TestSplitByStatus(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	gone := closedURL()
+	dir := t.TempDir()
+	_, errOut, code := runFetchall(t, "-mirror", dir, "-split-by-status", srv.URL+"/ok", srv.URL+"/404", srv.URL+"/500", gone)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	tests := []struct {
+		url, class, body string
+	}{
+		{srv.URL + "/ok", "2xx", "body"},
+		{srv.URL + "/404", "4xx", "body"},
+		{srv.URL + "/500", "5xx", "body"},
+		{gone, "errors", "connection refused"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		name, err := mirrorPath(filepath.Join(dir, tt.class), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if !strings.Contains(string(data), tt.body) {
+			t.Errorf("%s under %s/ has %q, want %q in it", tt.url, tt.class, data, tt.body)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	var classes []string
+	for _, e := range entries {
+		classes = append(classes, e.Name())
+	}
+	if want := []string{"2xx", "4xx", "5xx", "errors"}; !reflect.DeepEqual(classes, want) {
+		t.Errorf("%s has %v, want %v", dir, classes, want)
+	}
+
+	if _, errOut, code := runFetchall(t, "-split-by-status", srv.URL); code != 1 || !strings.Contains(errOut, "needs -mirror") {
+		t.Errorf("-split-by-status alone: exit %d, %q", code, errOut)
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/docs/guide/")
+	page := `<html><head>
+<link rel="stylesheet" href="/css/site.css">
+<script src='app.js'></script>
+</head><body>
+<a href="intro.html#top">intro</a>
+<a href="../api/">api</a>
+<a HREF = https://other.example/x?a=1&amp;b=2>other</a>
+<a href="//cdn.example/lib.js">cdn</a>
+<a href="?page=2">next</a>
+<img src="img/a.png" alt="not a link: href=nope">
+<a href="mailto:me@example.com">mail</a>
+<a href="javascript:void(0)">js</a>
+<a href="#only-a-fragment">same page</a>
+<a href="intro.html">intro again</a>
+<a href="  spaced.html  ">spaced</a>
+<a name="anchor">no link</a>
+<a download href>no value, no link</a>
+<a title='see src="x.png"' data-href="y" Href="last.html">last</a>
+<p>href="text/not/in/a/tag"</p>
+</body></html>`
+	want := []string{
+		"https://example.com/css/site.css",
+		"https://example.com/docs/guide/app.js",
+		"https://example.com/docs/guide/intro.html",
+		"https://example.com/docs/api/",
+		"https://other.example/x?a=1&b=2",
+		"https://cdn.example/lib.js",
+		"https://example.com/docs/guide/?page=2",
+		"https://example.com/docs/guide/img/a.png",
+		"https://example.com/docs/guide/",
+		"https://example.com/docs/guide/spaced.html",
+		"https://example.com/docs/guide/last.html",
+	}
+	if got := pageLinks(base, []byte(page)); !reflect.DeepEqual(got, want) {
+		t.Errorf("pageLinks =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestRecurse crawls a page one link deep: the links on it are fetched once each, and the ones on
+// those pages aren't, they're two deep
+func TestRecurse(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<a href="/a">a</a> <a href="b">b</a> <a href="/a#again">a again</a> <a href="/">home</a>`)
+		case "/a":
+			io.WriteString(w, `<a href="/deep">deep</a>`)
+		}
+	}))
+	defer srv.Close()
+
+	out, errOut, code := runFetchall(t, "-recurse", "-robots=false", srv.URL+"/")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if want := map[string]int{"/": 1, "/a": 1, "/b": 1}; !reflect.DeepEqual(hits, want) {
+		t.Errorf("requests %v, want %v\n%s", hits, want, out)
+	}
+
+	out, _, _ = runFetchall(t, "-extract-links", srv.URL+"/a")
+	if !strings.Contains(out, "  -> "+srv.URL+"/deep\n") {
+		t.Errorf("-extract-links didn't list /deep under /a:\n%s", out)
+	}
+}
+
+// TestIncludeBody decodes -format json -include-body and checks each body against what was served
+func TestIncludeBody(t *testing.T) {
+	bodies := map[string]struct {
+		ctype, body string
+	}{
+		"/text":  {"text/plain; charset=utf-8", "héllo\nworld\n"},
+		"/json":  {"application/json", `{"a":[1,2]}`},
+		"/bin":   {"application/octet-stream", "\x00\x01\xff\xfe"},
+		"/bad":   {"text/plain", "not \xff utf-8"},
+		"/empty": {"text/plain", ""},
+		"/big":   {"text/plain", strings.Repeat("x", 5000)},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := bodies[r.URL.Path]
+		w.Header().Set("Content-Type", b.ctype)
+		io.WriteString(w, b.body)
+	}))
+	defer srv.Close()
+	args := []string{"-format", "json", "-include-body", "-max-size", "4096"}
+	for p := range bodies {
+		args = append(args, srv.URL+p)
+	}
+	out, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	results := jsonResults(t, out)
+	// -sort-by sends every result through a temp file and back, the bodies have to come out the same
+	out, errOut, code = runFetchall(t, append([]string{"-sort-by", "host", "-sort-memory", "1"}, args...)...)
+	if code != 0 {
+		t.Fatalf("-sort-by: exit %d: %s", code, errOut)
+	}
+	results = append(results, jsonResults(t, out)...)
+	if len(results) != 2*len(bodies) {
+		t.Fatalf("got %d results, want %d", len(results), 2*len(bodies))
+	}
+	for _, r := range results {
+		p := strings.TrimPrefix(r.URL, srv.URL)
+		if r.Body == nil {
+			t.Errorf("%s: no body", p)
+			continue
+		}
+		got, enc := *r.Body, "text"
+		if r.BodyEncoding == "base64" {
+			b, err := base64.StdEncoding.DecodeString(got)
+			if err != nil {
+				t.Errorf("%s: %v", p, err)
+				continue
+			}
+			got, enc = string(b), "base64"
+		}
+		want := bodies[p].body
+		truncated := len(want) > 4096
+		if truncated {
+			want = want[:4096]
+		}
+		if got != want || r.BodyEncoding != enc || r.BodyTruncated != truncated {
+			t.Errorf("%s: body %q as %s (truncated %t), want %q", p, got, r.BodyEncoding, r.BodyTruncated, want)
+		}
+		if wantEnc := map[bool]string{true: "base64", false: "text"}[p == "/bin" || p == "/bad"]; r.BodyEncoding != wantEnc {
+			t.Errorf("%s: encoded as %s, want %s", p, r.BodyEncoding, wantEnc)
+		}
+	}
+
+	if _, errOut, code := runFetchall(t, "-include-body", srv.URL+"/text"); code != 1 || !strings.Contains(errOut, "-include-body needs") {
+		t.Errorf("-include-body alone: exit %d, %q", code, errOut)
+	}
+}
+
+// TestRetryBudget has ten URLs that always get a 503 and three retries each, but only five retries
+// in the -retry-budget: the server sees the ten first tries and five retries, and no more
+func TestRetryBudget(t *testing.T) {
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	args := []string{"-retries", "3", "-retry-budget", "5", "-backoff", "1ms"}
+	for i := range 10 {
+		args = append(args, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	out, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if hits.Load() != 15 {
+		t.Errorf("the server got %d requests, want 15", hits.Load())
+	}
+	if !strings.Contains(out, "5 of the -retry-budget of 5 retries used") {
+		t.Errorf("no budget line in\n%s", out)
+	}
+}
+
+// TestTakeRetry has goroutines race for the budget: between them they get exactly all of it
+func TestTakeRetry(t *testing.T) {
+	defer func(n int64) { *retryBudget = n }(*retryBudget)
+	*retryBudget = 1000
+	retriesUsed.Store(0)
+	defer retriesUsed.Store(0)
+
+	var got atomic.Int64
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for takeRetry() {
+				got.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got.Load() != 1000 || retriesUsed.Load() != 1000 {
+		t.Errorf("took %d retries (%d used), want 1000", got.Load(), retriesUsed.Load())
+	}
+}
+
+// TestBudget serves pages of known sizes: -budget fetches the smallest ones that fit, in the order
+// given, and says why it skips each of the others
+func TestBudget(t *testing.T) {
+	sizes := map[string]int{"/a": 300, "/b": 100, "/c": 500, "/d": 200, "/e": 50}
+	var mu sync.Mutex
+	var gets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nolength" {
+			// flushing first makes it chunked, so there's no Content-Length for the HEAD
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "x")
+			return
+		}
+		if r.Method == "GET" {
+			mu.Lock()
+			gets = append(gets, r.URL.Path)
+			mu.Unlock()
+		}
+		io.WriteString(w, strings.Repeat("x", sizes[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	args := []string{"-budget", "400", "-format", "json"}
+	for _, p := range []string{"/a", "/b", "/c", "/d", "/e", "/nolength"} {
+		args = append(args, srv.URL+p)
+	}
+	out, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	// smallest first: /e, /b and /d make 350, and /a would take it to 650
+	var fetched []string
+	var total int64
+	for _, r := range jsonResults(t, out) {
+		fetched = append(fetched, strings.TrimPrefix(r.URL, srv.URL))
+		total += r.Bytes
+	}
+	slices.Sort(fetched)
+	if want := []string{"/b", "/d", "/e"}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %v, want %v", fetched, want)
+	}
+	slices.Sort(gets)
+	if want := []string{"/b", "/d", "/e"}; !reflect.DeepEqual(gets, want) {
+		t.Errorf("GETs for %v, want %v", gets, want)
+	}
+	if total > 400 {
+		t.Errorf("%d bytes fetched, over the budget", total)
+	}
+	for _, want := range []string{
+		"skipping " + srv.URL + "/a (300), it would go over",
+		"skipping " + srv.URL + "/c (500), it would go over",
+		"skipping " + srv.URL + "/nolength, its size is unknown",
+		"fetching 3 of 6 URLs, 350 of the 400 budget",
+	} {
+		if !strings.Contains(errOut, want) {
+			t.Errorf("no %q in\n%s", want, errOut)
+		}
+	}
+}
+
+func TestStatusTally(t *testing.T) {
+	tally := statusTally{count: make(map[string]int), bytes: make(map[string]int64), types: make(map[string]int)}
+	for _, r := range []result{
+		{status: 200, nbytes: 100, ctype: "text/html"},
+		{status: 200, nbytes: 50, ctype: "text/html"},
+		{status: 204},
+		{status: 404, nbytes: 10, ctype: "text/html"},
+		{status: 500, nbytes: 7, ctype: "application/json"},
+		{status: 500, nbytes: 3, ctype: "application/json"},
+		{status: 500, ctype: "application/json"},
+		{err: errors.New("refused")},
+		{err: errors.New("timeout")},
+	} {
+		tally.add(r)
+	}
+	var out strings.Builder
+	tally.print(&out)
+	want := `STATUS  COUNT
+200     2
+204     1
+404     1
+500     3
+error   2
+
+CLASS  BYTES
+2xx    150
+4xx    10
+5xx    10
+`
+	if out.String() != want {
+		t.Errorf("print:\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	tally.histogram(&out)
+	// the blank line ends a tabwriter block, so each half is lined up on its own
+	want = `STATUS  COUNT  
+200     2      ##########################
+204     1      #############
+404     1      #############
+500     3      ########################################
+error   2      ##########################
+
+CONTENT TYPE      COUNT  
+application/json  3      ########################################
+text/html         3      ########################################
+(none)            1      #############
+`
+	if out.String() != want {
+		t.Errorf("histogram:\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// TestByStatus counts what -only-errors leaves out of the output as well
+func TestByStatus(t *testing.T) {
+	srv := statusServer()
+	defer srv.Close()
+	out, errOut, code := runFetchall(t, "-by-status", "-only-errors", srv.URL+"/a", srv.URL+"/b", srv.URL+"/404", srv.URL+"/500", closedURL())
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	table := regexp.MustCompile(`(?m)^(200|404|500|error) +(\d+)$`)
+	got := make(map[string]string)
+	for _, m := range table.FindAllStringSubmatch(out, -1) {
+		got[m[1]] = m[2]
+	}
+	if want := map[string]string{"200": "2", "404": "1", "500": "1", "error": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("counts %v, want %v\n%s", got, want, out)
+	}
+}
+
+func TestShuffleTargets(t *testing.T) {
+	var given []string
+	for i := range 20 {
+		given = append(given, fmt.Sprintf("https://example.com/%d", i))
+	}
+	order := func(seed int64) []string {
+		ts := make([]target, len(given))
+		for i, u := range given {
+			ts[i] = target{url: u}
+		}
+		shuffleTargets(ts, seed)
+		urls := make([]string, len(ts))
+		for i, t := range ts {
+			urls[i] = t.url
+		}
+		return urls
+	}
+	first := order(42)
+	if !reflect.DeepEqual(order(42), first) {
+		t.Error("the same seed gave two different orders")
+	}
+	if reflect.DeepEqual(order(43), first) {
+		t.Error("seeds 42 and 43 gave the same order")
+	}
+	if reflect.DeepEqual(first, given) {
+		t.Error("seed 42 left the targets in order")
+	}
+	sorted, want := slices.Clone(first), slices.Clone(given)
+	slices.Sort(sorted)
+	slices.Sort(want)
+	if !reflect.DeepEqual(sorted, want) {
+		t.Errorf("%v isn't a permutation of the targets", first)
+	}
+}
+
+// TestShuffle runs -shuffle one fetch at a time: the server gets the URLs in shuffleTargets' order
+// for that -seed, and a run without -seed says which one it picked
+func TestShuffle(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	var ts []target
+	args := []string{"-shuffle", "-seed", "7", "-concurrency", "1"}
+	for i := range 10 {
+		u := fmt.Sprintf("%s/%d", srv.URL, i)
+		ts = append(ts, target{url: u})
+		args = append(args, u)
+	}
+	shuffleTargets(ts, 7)
+	var want []string
+	for _, t := range ts {
+		want = append(want, strings.TrimPrefix(t.url, srv.URL))
+	}
+
+	_, errOut, code := runFetchall(t, args...)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests came in as %v, want %v", got, want)
+	}
+	if strings.Contains(errOut, "seed") {
+		t.Errorf("the seed was given, but it's printed: %q", errOut)
+	}
+	if _, errOut, _ := runFetchall(t, "-shuffle", srv.URL); !regexp.MustCompile(`^fetchall: seed -?\d+\n$`).MatchString(errOut) {
+		t.Errorf("without -seed, stderr %q, want the seed picked", errOut)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	defer func(j bool, b, m time.Duration, r *rand.Rand) {
+		*jitter, *backoffBase, *maxRetryAfter, jitterRand.Rand = j, b, m, r
+	}(*jitter, *backoffBase, *maxRetryAfter, jitterRand.Rand)
+	*backoffBase, *maxRetryAfter = 100*time.Millisecond, time.Second
+
+	ceiling := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second, time.Second}
+	*jitter = false
+	for attempt, want := range ceiling {
+		if got := backoff(attempt); got != want {
+			t.Errorf("without -jitter, backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+	if got := backoff(100); got != time.Second {
+		t.Errorf("backoff(100) = %v, want -max-retry-after, not an overflow", got)
+	}
+
+	*jitter = true
+	delays := func(seed int64) []time.Duration {
+		jitterRand.Rand = rand.New(rand.NewSource(seed))
+		var ds []time.Duration
+		for range 20 {
+			for attempt := range ceiling {
+				ds = append(ds, backoff(attempt))
+			}
+		}
+		return ds
+	}
+	first := delays(1)
+	if !reflect.DeepEqual(delays(1), first) {
+		t.Error("the same -seed gave different delays")
+	}
+	distinct := make(map[time.Duration]bool)
+	for i, d := range first {
+		if top := ceiling[i%len(ceiling)]; d < 0 || d > top {
+			t.Errorf("attempt %d: %v, want between 0 and %v", i%len(ceiling), d, top)
+		}
+		distinct[d] = true
+	}
+	if len(distinct) < len(first)/2 {
+		t.Errorf("only %d different delays in %d, that isn't random", len(distinct), len(first))
+	}
+}
+
+// TestJitterDelays retries a URL that keeps failing with -jitter and a -seed: the time between the
+// attempts is the delays that seed gives, and each under its backoff
+func TestJitterDelays(t *testing.T) {
+	var mu sync.Mutex
+	var at []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		at = append(at, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	const base = 100 * time.Millisecond
+	_, errOut, code := runFetchall(t, "-retries", "3", "-backoff", base.String(), "-jitter", "-seed", "5", srv.URL)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if len(at) != 4 {
+		t.Fatalf("%d attempts, want 4", len(at))
+	}
+	r := rand.New(rand.NewSource(5))
+	for i := 1; i < len(at); i++ {
+		top := base << (i - 1)
+		want := time.Duration(r.Int63n(int64(top) + 1))
+		if got := at[i].Sub(at[i-1]); got < want || got > want+100*time.Millisecond {
+			t.Errorf("retry %d came %v after the attempt before, want %v (of at most %v)", i, got, want, top)
+		}
+	}
+}
+
+// TestMaxTime checks -max-time stops a fetch whose body is still trickling in at its deadline,
+// and counts it in the summary
+func TestMaxTime(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			if _, err := io.WriteString(w, "drip\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		flags []string
+		code  int
+	}{
+		{nil, 0},
+		// a URL cut off is a failed fetch, which is what -report's exit status counts
+		{[]string{"-report", filepath.Join(t.TempDir(), "report.json")}, 1},
+	} {
+		start := time.Now()
+		out, errOut, code := runFetchall(t, append(append(tt.flags, "-max-time", "200ms"), srv.URL)...)
+		took := time.Since(start)
+		if code != tt.code {
+			t.Errorf("%v: exit %d, want %d: %s", tt.flags, code, tt.code, errOut)
+		}
+		// the test binary starting up is in there too, so only well past the deadline is wrong
+		if took < 200*time.Millisecond || took > 2*time.Second {
+			t.Errorf("%v: took %v, -max-time was 200ms", tt.flags, took)
+		}
+		if !strings.Contains(out, srv.URL+": hit -max-time (200ms)\n") {
+			t.Errorf("%v: no -max-time result in\n%s", tt.flags, out)
+		}
+		if !strings.Contains(out, "1 of 1 hit -max-time 200ms\n") {
+			t.Errorf("%v: no -max-time summary in\n%s", tt.flags, out)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	// wrapped the way client.Do hands them back
+	do := func(err error) error { return &url.Error{Op: "Get", URL: "http://example.com", Err: err} }
+	tests := []struct {
+		err       error
+		kind      string
+		retryable bool
+	}{
+		{do(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), "connection reset", true},
+		{do(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}), "connection reset", true},
+		{do(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), "connection refused", false},
+		{do(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nx.example", IsNotFound: true}}), "dns not found", false},
+		{do(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}}), "dns", true},
+		{do(&net.DNSError{Err: "server misbehaving", Name: "flaky.example", IsTemporary: true}), "dns", true},
+		{do(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), "timeout", true},
+		{do(context.DeadlineExceeded), "timeout", true},
+		{do(io.ErrUnexpectedEOF), "connection closed", true},
+		{do(io.EOF), "connection closed", true},
+		{do(context.Canceled), "canceled", false},
+		{do(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), "tls", false},
+		{do(tls.AlertError(42)), "tls", false},
+		{do(errors.New("unsupported protocol scheme")), "other", false},
+	}
+	for _, tt := range tests {
+		kind, retryable := classify(tt.err)
+		if kind != tt.kind || retryable != tt.retryable {
+			t.Errorf("classify(%v) = %q, %v, want %q, %v", tt.err, kind, retryable, tt.kind, tt.retryable)
+		}
+	}
+}
+
+// TestClassifyRetries checks the retry decision end to end: a listener that resets every
+// connection is tried again, a port nothing listens on isn't
+func TestClassifyRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int64
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			// read the request first, so the reset can't come before it has been sent
+			bufio.NewReader(c).ReadString('\n')
+			// no linger makes Close send a RST instead of a FIN
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}
+	}()
+
+	_, errOut, _ := runFetchall(t, "-v", "-retries", "2", "-backoff", "10ms", "http://"+ln.Addr().String()+"/")
+	if accepted.Load() != 3 {
+		t.Errorf("a resetting server got %d connections, want 3:\n%s", accepted.Load(), errOut)
+	}
+	if !strings.Contains(errOut, "attempt 1: connection reset error, retryable") {
+		t.Errorf("the reset isn't called retryable:\n%s", errOut)
+	}
+
+	_, errOut, _ = runFetchall(t, "-v", "-retries", "2", "-backoff", "10ms", closedURL())
+	if n := strings.Count(errOut, "connection refused error, not retryable"); n != 1 || strings.Contains(errOut, "attempt 2") {
+		t.Errorf("a closed port was tried more than once:\n%s", errOut)
+	}
+}
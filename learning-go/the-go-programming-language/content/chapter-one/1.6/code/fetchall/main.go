@@ -1,53 +1,15 @@
 // Fetchall fetches URLs in parallel and reports their times and sizes
-
+//
+// the program itself is package fetchall, so gopltool can run it as gopltool fetchall. its
+// flags are described there
 package main
 
 import (
-	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
-	"time"
+
+	"gopl/chapter-one/1.6/code/fetchall/fetchall"
 )
 
 func main() {
-
-	start := time.Now()
-	ch := make(chan string)
-	// make a channel of strings
-
-	for _, url := range os.Args[1:] {
-		go fetch(url, ch)
-		// for every URL we create a goroutine. if we pass 5 URLs in we get 5 goroutines.
-	}
-
-	for range os.Args[1:] {
-		fmt.Println(<-ch)
-	}
-
-	fmt.Printf("%.2fs elapsed\n", time.Since(start).Seconds())
+	fetchall.Main(os.Args[1:])
 }
-
-func fetch(url string, ch chan<- string) {
-	
-	start := time.Now()
-	resp, err := http.Get(url)
-
-	if err != nil {
-		ch <- fmt.Sprint(err)
-		return
-	}
-
-	nbytes, err := io.Copy(ioutil.Discard, resp.Body)
-	// io.Copy returns the byte count
-	resp.Body.Close()
-
-	if err != nil {
-		ch <- fmt.Sprint("while reading %s: %v", url, err)
-		return
-	}
-
-	secs := time.Since(start).Seconds()
-	ch <- fmt.Sprintf("%.2fs %7d %s", secs, nbytes, url)
-}
\ No newline at end of file
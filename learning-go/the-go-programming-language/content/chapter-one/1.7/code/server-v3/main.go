@@ -1,47 +1,14 @@
 // minimal HTTP reporting server
-
+//
+// the server itself is package server, so gopltool can run it as gopltool serve
 package main
 
 import (
-	"fmt"
-	"log"
-	"net/http"
-	"sync"
-)
+	"os"
 
-var mu sync.Mutex
-var count int
+	"gopl/chapter-one/1.7/code/server-v3/server"
+)
 
-// the main function connects any URLs with a path beginning with "/" to a handler and starts a server which is listening for requests on port 8000
 func main() {
-	// when a request arrives, its given to the handeler
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/count", counter)
-	log.Fatal(http.ListenAndServe("localhost:8100", nil))
+	server.Main(os.Args[1:])
 }
-
-// handler echoes the Path component of the requested URL.
-func handler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "%s %s %s\n", r.Method, r.URL, r.Proto)
-
-	for k, v := range r.Header {
-		fmt.Fprintf(w, "Header[%q] = %q\n", k, v)
-	}
-	fmt.Fprintf(w, "Host = %q\n", r.Host)
-	fmt.Fprintf(w, "RemoteAddr = %q\n", r.RemoteAddr)
-
-	if err := r.ParseForm(); err != nil {
-		log.Print(err)
-	}
-
-	for k, v := range r.Form {
-		fmt.Fprintf(w, "Form[%q] = %q\n", k, v)
-	}
-}
-
-func counter(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	fmt.Fprintf(w, "Count %d\n", count)
-	mu.Unlock()
-	// we add these mu.Lock() and mu.Unlock() so that we do not face a race condition and that only one goroutine accesses a variable at a time
-}
\ No newline at end of file
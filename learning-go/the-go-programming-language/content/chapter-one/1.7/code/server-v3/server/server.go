@@ -0,0 +1,3606 @@
+// Package server is server-v3, a minimal HTTP reporting server.
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"gopl/chapter-one/1.4/code/lissajous-v1/lissajous"
+	"gopl/chapter-one/internal/cli"
+)
+
+var mu sync.Mutex
+var count int
+
+// countSamples and snapshots are how /count?since= works out a delta, both guarded by mu like count
+var countSamples = &sampleRing{}
+var snapshots = make(map[string]countSample)
+
+// a client can name as many snapshots as it likes, so past this many the oldest one goes
+const maxSnapshots = 100
+
+// Flags are the server's flags, parsed by Main. -config and reloads go through them as well
+var Flags = cli.NewFlagSet("server")
+
+var maxBody = Flags.Int64("max-body", 1<<20, "maximum request body size in bytes")
+var cors = Flags.Bool("cors", false, "send CORS headers on the reporting endpoints")
+var corsOrigin = Flags.String("cors-origin", "*", "value of Access-Control-Allow-Origin when -cors is set")
+var logFormat = Flags.String("log-format", "text", "log format: text or json")
+var maxUpload = Flags.Int64("max-upload", 1<<30, "maximum /upload body size in bytes")
+var maxInflight = Flags.Int("max-inflight", 0, "answer 503 instead of queuing once this many requests are being handled (0 means no limit)")
+var drainDelay = Flags.Duration("drain-delay", 5*time.Second, "on SIGINT or SIGTERM, how long /readyz reports 503 before the server stops taking connections")
+var shutdownTimeout = Flags.Duration("shutdown-timeout", 10*time.Second, "how long in-flight requests get to finish during shutdown")
+var dashboardRefresh = Flags.Int("dashboard-refresh", 5, "seconds between reloads of the /dashboard page (0 turns reloading off)")
+var envFile = Flags.String("env-file", "", "file of KEY=VALUE settings that is read again on SIGHUP")
+var idleShutdown = Flags.Duration("idle-shutdown", 0, "shut down by itself after this long without a request, for throwaway dev servers (0 means never)")
+var tlsCert = Flags.String("tls-cert", "", "certificate file, with -tls-key, to also serve HTTPS on -tls-addr")
+var tlsKey = Flags.String("tls-key", "", "private key file for -tls-cert")
+var tlsAddr = Flags.String("tls-addr", "localhost:8443", "where the HTTPS listener goes when -tls-cert is set")
+var rateLimitFlag = Flags.String("rate-limit", "", "let each client IP make RATE requests a second with bursts of BURST, as RATE or RATE/BURST (empty means no limit)")
+var trustedProxies = Flags.String("trusted-proxies", "", "comma-separated CIDRs (or IPs) of proxies whose X-Forwarded-For is believed when rate limiting")
+
+// routeLimits is the -rate-limit-route flag, one PREFIX=RATE[/BURST] per use
+var routeLimits = limitFlag{}
+
+var redactHeaders = Flags.String("redact", "Authorization,Proxy-Authorization,Cookie,Set-Cookie", "comma-separated headers whose values / and /proxy/history show as [redacted]")
+var showHeaders = Flags.String("show-headers", "", "comma-separated headers that / shows, leaving out the rest (empty shows them all)")
+
+var addr = Flags.String("addr", "localhost:8100", "where the HTTP listener goes, :8100 listens on every interface")
+
+// -cert and -key are shorter names for -tls-cert and -tls-key, both set the same variables
+func init() {
+	Flags.Var(routeLimits, "rate-limit-route", "a -rate-limit for paths starting with PREFIX, as PREFIX=RATE[/BURST], can be repeated")
+	Flags.StringVar(tlsCert, "cert", "", "same as -tls-cert")
+	Flags.StringVar(tlsKey, "key", "", "same as -tls-key")
+}
+
+var redirectHTTP = Flags.Bool("redirect-http", false, "with -tls-cert, answer every plain HTTP request with a redirect to the HTTPS listener")
+var dedupHeaders = Flags.Bool("dedup-headers", false, "on /, print each header once with its values joined, and say when it was sent more than once")
+var trailerDump = Flags.Bool("trailer-dump", false, "on /, read the whole body and print the trailers that came after it")
+var upstream = Flags.String("upstream", "", "reverse proxy /proxy/ to this server, like http://localhost:9000")
+var proxyAllow = Flags.String("proxy-allow", "", "comma-separated hosts (host or host:port) that /proxy?target= may forward to, * for any (empty turns ?target= off)")
+var proxyHistorySize = Flags.Int("proxy-history", 50, "how many proxied exchanges /proxy/history keeps (0 keeps none)")
+var cacheSize = Flags.Int("cache-size", 0, "with -upstream, keep this many responses in an LRU cache (0 means no cache)")
+var storeFlag = Flags.String("store", "memory", "where /count and the per-path stats are kept: memory, or file:PATH to keep them across restarts")
+var accessLogPath = Flags.String("access-log", "", "write the access log here instead of in with the server log: - for stdout, or a file that is rotated")
+var accessLogMax = Flags.Int64("access-log-max-size", 10<<20, "with -access-log=FILE, rotate the file once it would grow past this many bytes")
+var accessLogKeep = Flags.Int("access-log-keep", 3, "with -access-log=FILE, how many rotated files (FILE.1, FILE.2, ...) to keep")
+var uploadDir = Flags.String("upload-dir", "", "on /, save the files of a multipart/form-data body in this directory")
+var kvMaxKeys = Flags.Int("kv-max-keys", 1000, "how many keys /kv holds at most, a PUT of a new one past that gets a 507")
+
+// -record keeps every request that comes in as a JSON file, and -replay sends a directory of
+// them to another server later, so a bug a client ran into can be played back against a fix
+var recordDir = Flags.String("record", "", "write every request (method, headers, body) to this directory as a JSON fixture for -replay")
+var replayDir = Flags.String("replay", "", "instead of serving, send the requests -record wrote in this directory to -replay-target and exit")
+var replayTarget = Flags.String("replay-target", "", "with -replay, the server to send them to, like http://localhost:9000 (a path there goes in front of the recorded ones)")
+var replaySpeed = Flags.Float64("replay-speed", 1, "with -replay, 1 keeps the gaps between the requests as they were recorded, 2 halves them, 0 sends them back to back")
+
+// the endpoints that say something about the server rather than echo the request can be put
+// behind a password. with -auth-user or -api-key set, the -protect paths want one of them and the
+// rest stay open. /live is among them by default, its events carry the same totals /count and
+// /metrics do along with every request that comes in. SERVER_AUTH_USER and SERVER_API_KEY do
+// the same from the environment or -env-file, which keeps the secret out of ps
+var authUser = Flags.String("auth-user", "", "user:password that HTTP Basic auth has to send for the -protect paths")
+var apiKey = Flags.String("api-key", "", "key that an X-API-Key header can send instead, for the -protect paths")
+var protect = Flags.String("protect", "/count,/metrics,/dashboard,/live,/proxy/history", "comma-separated path prefixes that need -auth-user or -api-key once one is set")
+
+// -config is a JSON file of the same settings the flags have, named like them, so a long
+// command line can live in a file: {"addr": ":8100", "rate-limit-route": ["/upload=1/2"]}.
+// a flag given on the command line wins over the file. SIGHUP reads it again, see loadConfig
+var configFile = Flags.String("config", "", "JSON file of settings named like the flags, read again on SIGHUP")
+var staticRoot = Flags.String("root", "", "serve the files in this directory under /static/")
+var dirListing = Flags.Bool("dir-listing", false, "with -root, list the files of a directory that has no index.html")
+var unixSocket = Flags.String("unix", "", "listen on this Unix socket instead of -addr, for a reverse proxy on the same machine")
+
+// the main function connects any URLs with a path beginning with "/" to a handler and starts a server which is listening for requests on port 8000
+// Main runs server with argv, the command line without the program name, and exits the
+// process when it fails like the program always has.
+func Main(argv []string) {
+	cli.Parse(Flags, argv, 2)
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "server: -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *replayDir != "" {
+		// replaying is a client, none of the serving setup below is wanted for it
+		os.Exit(replay(*replayDir, *replayTarget, *replaySpeed))
+	}
+
+	// the level lives in a LevelVar so a reload can change it under the running handlers
+	opts := &slog.HandlerOptions{Level: logLevel}
+	newLogger := func(w io.Writer) *slog.Logger {
+		if *logFormat == "json" {
+			return slog.New(slog.NewJSONHandler(w, opts))
+		}
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		fmt.Fprintf(os.Stderr, "server: -log-format must be text or json, not %q\n", *logFormat)
+		os.Exit(1)
+	}
+	slog.SetDefault(newLogger(os.Stderr))
+	accessLog = slog.Default()
+	switch *accessLogPath {
+	case "":
+	case "-":
+		accessLog = newLogger(os.Stdout)
+	default:
+		if *accessLogMax <= 0 || *accessLogKeep < 0 {
+			fmt.Fprintln(os.Stderr, "server: -access-log-max-size has to be positive and -access-log-keep can't be negative")
+			os.Exit(1)
+		}
+		f, err := openRotating(*accessLogPath, *accessLogMax, *accessLogKeep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "server: -access-log: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		accessLog = newLogger(f)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "server: -tls-cert and -tls-key go together")
+		os.Exit(1)
+	}
+	if *cacheSize < 0 || *cacheSize > 0 && *upstream == "" {
+		fmt.Fprintln(os.Stderr, "server: -cache-size needs -upstream, and can't be negative")
+		os.Exit(1)
+	}
+	if *redirectHTTP && *tlsCert == "" {
+		fmt.Fprintln(os.Stderr, "server: -redirect-http needs -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "server: %v\n", err)
+		os.Exit(1)
+	}
+	apply(c)
+	store, err := openStore(*storeFlag)
+	if err == nil {
+		err = restoreCounts(store)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "server: -store: %v\n", err)
+		os.Exit(1)
+	}
+	if *uploadDir != "" {
+		if uploads, err = os.OpenRoot(*uploadDir); err != nil {
+			fmt.Fprintf(os.Stderr, "server: -upload-dir: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	go saveCountsEvery(store, storeInterval)
+	go reloadOnHangup()
+
+	// when a request arrives, its given to the handeler
+	handle("", "/", handler)
+	handle("GET", "/count", counter)
+	handle("POST", "/count/snapshot", countSnapshot)
+	handle("GET", "/slowbody", slowBody)
+	handle("GET", "/lissajous", lissajousHandler)
+	handle("", "/raw", rawDump)
+	handle("POST PUT PATCH", "/echo", echo)
+	handle("POST", "/upload", upload)
+	handle("GET", "/dashboard", dashboard)
+	handle("GET", "/metrics", metricsHandler)
+	handle("GET", "/live", liveHandler)
+	handle("GET", "/healthz", healthz)
+	handle("GET", "/kv", kv.list)
+	handle("GET PUT DELETE", "/kv/", kv.serveKey)
+	go kv.expireEvery(time.Minute)
+	if c.static != nil {
+		// the handler looks the files up in cfg() every time, so a reload can point it somewhere else
+		handle("GET", "/static/", http.StripPrefix("/static", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg().static.ServeHTTP(w, r)
+		})).ServeHTTP)
+	}
+	handle("GET", "/readyz", readyz)
+	if *proxyHistorySize < 0 {
+		fmt.Fprintln(os.Stderr, "server: -proxy-history can't be negative")
+		os.Exit(1)
+	}
+	history := newProxyHistory(*proxyHistorySize)
+	handle("", "/proxy", recordExchanges(history, targetProxy(*proxyAllow)).ServeHTTP)
+	// more specific than /proxy/, so it wins even with -upstream, at the cost of upstream's own /history
+	handle("GET", "/proxy/history", history.serve)
+	if *upstream != "" {
+		u, err := url.Parse(*upstream)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "server: -upstream wants a URL like http://host:port, not %q\n", *upstream)
+			os.Exit(1)
+		}
+		var proxy http.Handler = http.StripPrefix("/proxy", httputil.NewSingleHostReverseProxy(u))
+		if *cacheSize > 0 {
+			proxy = cacheResponses(newResponseCache(*cacheSize), proxy)
+		}
+		handle("", "/proxy/", recordExchanges(history, proxy).ServeHTTP)
+	}
+	var h http.Handler = http.DefaultServeMux
+	if *maxInflight > 0 {
+		h = shed(*maxInflight, h)
+	}
+	// outside shed, a client that is over its limit shouldn't take up one of the slots. it is
+	// always in the chain, a reload can turn limits on that weren't there at the start
+	h = limitRequests(requireAuth(h))
+	go expireBuckets(time.Minute)
+	if *recordDir != "" {
+		// outermost, the requests that were limited or turned away for auth are worth having too
+		rec, err := newRecorder(*recordDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "server: -record: %v\n", err)
+			os.Exit(1)
+		}
+		h = recordRequests(rec, h)
+	}
+	// every request goes through logRequests before the mux picks a handler, so shed requests are logged too
+	srv := &http.Server{Addr: *addr, Handler: logRequests(h)}
+	servers := []*http.Server{srv}
+	if *tlsCert != "" {
+		// the HTTPS server has the same handlers, it only differs in how it listens
+		tlsSrv := &http.Server{Addr: *tlsAddr, Handler: logRequests(h)}
+		// taken from cfg() for every handshake, so a renewed certificate only needs a SIGHUP
+		tlsSrv.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cfg().cert, nil
+		}}
+		servers = append(servers, tlsSrv)
+		if *redirectHTTP {
+			srv.Handler = logRequests(redirectToHTTPS(*tlsAddr))
+		}
+		go func() {
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				slog.Error("https server stopped", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(servers...)
+		close(stopped)
+	}()
+	if *unixSocket != "" {
+		err = serveUnix(srv, *unixSocket)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	}
+	// ListenAndServe returns as soon as Shutdown starts, the requests still running are waited for here
+	<-stopped
+	// nothing is counted any more, so this save has everything
+	if err := saveCounts(store); err != nil {
+		slog.Error("saving counts", "store", *storeFlag, "err", err)
+	}
+	if *unixSocket != "" {
+		// closing the listener normally unlinks the socket already, this is for when it didn't
+		os.Remove(*unixSocket)
+	}
+}
+
+// serveUnix is ListenAndServe for a Unix socket. a socket file left over from a server that
+// crashed would make Listen fail, so it is removed first, but only if it really is a socket.
+func serveUnix(srv *http.Server, path string) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	slog.Info("listening", "unix", path)
+	return srv.Serve(l)
+}
+
+// stats is what logRequests has seen, for /dashboard.
+var stats = &requestStats{paths: make(map[string]int)}
+
+// the / handler answers for any path at all, so a client could grow the per-path map forever.
+// past maxPaths different ones, new paths are counted together under otherPaths
+const maxPaths = 100
+const otherPaths = "(other)"
+
+// recentSize is how many of the latest requests /dashboard lists
+const recentSize = 20
+
+type requestStats struct {
+	mu     sync.Mutex
+	total  int
+	paths  map[string]int
+	recent []recentRequest // ring buffer, next is where the next one goes
+	next   int
+}
+
+type recentRequest struct {
+	Time     time.Time
+	Path     string
+	Status   int
+	Duration time.Duration
+}
+
+func (s *requestStats) record(path string, status int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	if _, ok := s.paths[path]; !ok && len(s.paths) >= maxPaths {
+		path = otherPaths
+	}
+	s.paths[path]++
+	r := recentRequest{Time: time.Now(), Path: path, Status: status, Duration: d}
+	if len(s.recent) < recentSize {
+		s.recent = append(s.recent, r)
+	} else {
+		s.recent[s.next] = r
+	}
+	s.next = (s.next + 1) % recentSize
+}
+
+// pathCount is one row of the dashboard's per-path table.
+type pathCount struct {
+	Path  string
+	Count int
+}
+
+// snapshot copies the stats out so the page can be rendered without holding the lock.
+// paths come sorted and recent requests newest first.
+func (s *requestStats) snapshot() (total int, paths []pathCount, recent []recentRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, n := range s.paths {
+		paths = append(paths, pathCount{p, n})
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Path < paths[j].Path })
+	for i := 1; i <= len(s.recent); i++ {
+		recent = append(recent, s.recent[(s.next-i+len(s.recent))%len(s.recent)])
+	}
+	return s.total, paths, recent
+}
+
+// html/template escapes everything it fills in for where it ends up in the page, so a request
+// for a path like /<script> shows up as text. nothing here is marked as safe HTML for that reason
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+<title>server dashboard</title>
+</head>
+<body>
+<h1>{{.Total}} requests</h1>
+<h2>by path</h2>
+<table>
+<tr><th>path</th><th>requests</th></tr>
+{{range .Paths}}<tr><td>{{.Path}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+<h2>latest</h2>
+<table>
+<tr><th>time</th><th>path</th><th>status</th><th>duration</th></tr>
+{{range .Recent}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Path}}</td><td>{{.Status}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// dashboard renders the request stats as a small HTML page that reloads itself.
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	total, paths, recent := stats.snapshot()
+	var buf bytes.Buffer
+	// rendering into a buffer first means a template error can still become a proper 500
+	err := dashboardPage.Execute(&buf, struct {
+		Refresh int
+		Total   int
+		Paths   []pathCount
+		Recent  []recentRequest
+	}{*dashboardRefresh, total, paths, recent})
+	if err != nil {
+		requestLogger(r).Error("rendering dashboard", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// staticFiles is the -root file server. it goes through an os.Root, which refuses any name that
+// would end up outside the directory, a symlink pointing out of it included, so the .. checks
+// don't all have to be right here. dotfiles are left out as well, so a -root that happens to be
+// a checkout doesn't hand out its .git or .env
+type staticFiles struct {
+	root    *os.Root
+	fsys    fs.FS
+	listing bool
+}
+
+func openStatic(dir string, listing bool) (*staticFiles, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &staticFiles{root: root, fsys: root.FS(), listing: listing}, nil
+}
+
+// ServeHTTP gets the path with /static already taken off. http.ServeContent does the rest of
+// the work: Content-Type from the extension or by sniffing the start of the file, Range for
+// seeking in audio and video, and the If-None-Match, If-Modified-Since and If-Range checks
+func (s *staticFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	if hiddenPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+	fi, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		// no difference between missing, unreadable and outside the root, so a client can't probe
+		http.NotFound(w, r)
+		return
+	}
+	if fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// relative, like http.FileServer does it, since r.URL.Path doesn't have /static any more
+			w.Header().Set("Location", path.Base(r.URL.Path)+"/")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, "index.html")
+		if ifi, err := fs.Stat(s.fsys, index); err == nil && !ifi.IsDir() {
+			name, fi = index, ifi
+		} else if s.listing {
+			s.list(w, r, name)
+			return
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// size and modification time change whenever the file does, which is all an ETag needs,
+	// and it saves reading the whole file to hash it. ServeContent compares it for us
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+}
+
+// hiddenPath reports whether any part of name starts with a dot.
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part != "." && strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+var listingPage = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Dir}}</title>
+</head>
+<body>
+<h1>{{.Dir}}</h1>
+<table>
+{{if ne .Dir "/static/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Link}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ModTime.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type listingEntry struct {
+	Name    string
+	Link    string
+	Size    string
+	ModTime time.Time
+}
+
+// list is the -dir-listing page for dir, directories first and then files, each sorted by name.
+func (s *staticFiles) list(w http.ResponseWriter, r *http.Request, dir string) {
+	des, err := fs.ReadDir(s.fsys, dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var entries []listingEntry
+	for _, de := range des {
+		if strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+		// Stat and not de.Info, so a symlink is listed as what it points to, and one that points
+		// out of the root, which ServeHTTP would 404, isn't listed at all
+		fi, err := fs.Stat(s.fsys, path.Join(dir, de.Name()))
+		if err != nil {
+			continue
+		}
+		e := listingEntry{Name: de.Name(), Size: strconv.FormatInt(fi.Size(), 10), ModTime: fi.ModTime()}
+		if fi.IsDir() {
+			e.Name += "/"
+			e.Size = "-"
+		}
+		// a name with a ? or # in it would cut the link short if it wasn't escaped
+		e.Link = (&url.URL{Path: e.Name}).String()
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		di, dj := strings.HasSuffix(entries[i].Name, "/"), strings.HasSuffix(entries[j].Name, "/")
+		if di != dj {
+			return di
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	var buf bytes.Buffer
+	err = listingPage.Execute(&buf, struct {
+		Dir     string
+		Entries []listingEntry
+	}{"/static" + r.URL.Path, entries})
+	if err != nil {
+		requestLogger(r).Error("rendering listing", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// draining is set once shutdown has begun
+var draining atomic.Bool
+
+// lastRequest is when logRequests last saw a request start or finish, in unix nanoseconds.
+// it starts out as the start of the server, so -idle-shutdown counts from there
+var lastRequest atomic.Int64
+
+// inFlight is how many requests logRequests has let in that haven't finished yet. the server
+// isn't idle while one is running, however long ago it started
+var inFlight atomic.Int64
+
+func init() {
+	lastRequest.Store(time.Now().UnixNano())
+}
+
+// idleTimer returns a channel that is closed once d has gone by with no request running and none
+// starting. it checks a few times per d rather than once, so a request near the end of the wait
+// doesn't buy a whole extra d, but not more often than every 10ms, and NewTicker panics on a 0.
+func idleTimer(d time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	check := min(max(d/10, 10*time.Millisecond), time.Second)
+	go func() {
+		ticker := time.NewTicker(check)
+		defer ticker.Stop()
+		for range ticker.C {
+			if inFlight.Load() == 0 && time.Since(time.Unix(0, lastRequest.Load())) >= d {
+				close(done)
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// healthz says the process is up. it keeps answering 200 while the server drains.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz says whether new traffic is welcome. it turns 503 as soon as shutdown begins,
+// so a load balancer stops sending requests while the ones already here finish.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, marks the server as draining, gives load
+// balancers -drain-delay to notice /readyz, and then shuts the servers down, letting in-flight requests
+// finish for up to -shutdown-timeout.
+func shutdownOnSignal(servers ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	var idle <-chan struct{}
+	if *idleShutdown > 0 {
+		idle = idleTimer(*idleShutdown)
+	}
+	select {
+	case s := <-sig:
+		draining.Store(true)
+		slog.Info("draining", "signal", s.String(), "delay", *drainDelay)
+		time.Sleep(*drainDelay)
+	case <-idle:
+		// nobody has been sending us anything, so there is nobody to drain for
+		draining.Store(true)
+		slog.Info("idle, shutting down", "idle", *idleShutdown)
+	}
+
+	// with -tls-cert there are two servers. they shut down side by side within the one -shutdown-timeout
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	// a /live stream never finishes by itself, Shutdown would wait for it until the timeout
+	live.close()
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Error("shutdown", "addr", srv.Addr, "err", err)
+				failed.Store(true)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	if !failed.Load() {
+		slog.Info("server stopped")
+	}
+}
+
+// redirectToHTTPS sends every request to the same host and path on the HTTPS listener at addr.
+// it is a 307 and not a 308, browsers remember a 308 for good, which gets in the way the day
+// this dev server runs without TLS again
+func redirectToHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := "https://" + net.JoinHostPort(host, port) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	})
+}
+
+// handler echoes the Path component of the requested URL.
+func handler(w http.ResponseWriter, r *http.Request) {
+	// MaxBytesReader stops a client from making us read (and keep in memory) an endless body.
+	// the body has to be read before we write anything, otherwise we can no longer send a 413
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	count++
+	n := count
+	countSamples.add(time.Now(), count)
+	mu.Unlock()
+	live.publish("count", struct {
+		Count int `json:"count"`
+	}{n})
+
+	headers := filterHeaders(r.Header)
+	if wantsJSON(r) {
+		writeRequestJSON(w, r, headers, body)
+		return
+	}
+
+	fmt.Fprintf(w, "%s %s %s\n", r.Method, r.URL, r.Proto)
+
+	// maps come back in a random order, so we sort the keys (and values) to make
+	// the same request always produce the same output
+	if *dedupHeaders {
+		writeDedupedHeaders(w, headers)
+	} else {
+		for _, k := range sortedKeys(headers) {
+			fmt.Fprintf(w, "Header[%q] = %q\n", k, sortedValues(headers[k]))
+		}
+	}
+	fmt.Fprintf(w, "Host = %q\n", r.Host)
+	fmt.Fprintf(w, "RemoteAddr = %q\n", r.RemoteAddr)
+
+	for _, k := range sortedKeys(r.Form) {
+		fmt.Fprintf(w, "Form[%q] = %q\n", k, sortedValues(r.Form[k]))
+	}
+	body.write(w)
+
+	if *trailerDump {
+		// trailers are headers that come after the body, so -show-headers and -redact apply to
+		// them as well. one declared in the Trailer header but never sent has no values
+		trailers := filterHeaders(r.Trailer)
+		if len(trailers) == 0 {
+			fmt.Fprintln(w, "no trailers")
+		}
+		for _, k := range sortedKeys(trailers) {
+			fmt.Fprintf(w, "Trailer[%q] = %q\n", k, sortedValues(trailers[k]))
+		}
+	}
+}
+
+// uploads is -upload-dir, nil without it. an os.Root, so a file name a client made up can't put
+// the file anywhere but in there
+var uploads *os.Root
+
+// multipartMemory is how much of a multipart body's files ParseMultipartForm keeps in memory,
+// the rest goes to temporary files that net/http removes after the handler
+const multipartMemory = 1 << 20
+
+// bodyPreview is how much of a text body / shows
+const bodyPreview = 1 << 10
+
+// bodyDump is what / found in the request body, nil when there was none.
+type bodyDump struct {
+	Type    string          `json:"type,omitempty"`
+	Bytes   int64           `json:"bytes"`
+	JSON    json.RawMessage `json:"json,omitempty"`
+	Text    string          `json:"text,omitempty"`
+	Partial bool            `json:"partial,omitempty"` // Text is only the first bodyPreview bytes
+	Error   string          `json:"error,omitempty"`
+	Files   []fileDump      `json:"files,omitempty"`
+}
+
+// fileDump is one file of a multipart/form-data body.
+type fileDump struct {
+	Field string `json:"field"`
+	Name  string `json:"name"`
+	Type  string `json:"type,omitempty"`
+	Bytes int64  `json:"bytes"`
+	Saved string `json:"saved,omitempty"`
+}
+
+// byteCounter counts what is read through it, a multipart body is gone by the time we could ask.
+type byteCounter struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readBody reads the whole body for /, parsing it by its Content-Type: a form into r.Form
+// like before, multipart/form-data into r.Form and the list of files, and JSON or text kept
+// for showing. reading it to the end is also what makes the trailers show up in r.Trailer for
+// -trailer-dump. ok is false once the 413 for a body over -max-body has been sent
+func readBody(w http.ResponseWriter, r *http.Request) (*bodyDump, bool) {
+	counted := &byteCounter{ReadCloser: http.MaxBytesReader(w, r.Body, cfg().maxBody)}
+	r.Body = counted
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var err error
+	if mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(multipartMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return nil, false
+		}
+		requestLogger(r).Error("parsing form", "err", err)
+	}
+	// a form has been read by now, anything else is still all there
+	rest, err := io.ReadAll(r.Body)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return nil, false
+		}
+		requestLogger(r).Error("reading body", "err", err)
+	}
+	if counted.n == 0 {
+		return nil, true
+	}
+
+	d := &bodyDump{Type: mediaType, Bytes: counted.n}
+	switch {
+	case mediaType == "multipart/form-data":
+		if r.MultipartForm != nil {
+			d.Files = multipartFiles(r)
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		// already in r.Form
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, rest, "", "  "); err != nil {
+			d.Error = "invalid JSON: " + err.Error()
+			d.Text, d.Partial = preview(rest)
+		} else {
+			d.JSON = buf.Bytes()
+		}
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml"):
+		d.Text, d.Partial = preview(rest)
+	}
+	return d, true
+}
+
+// preview is the start of a text body, cut at bodyPreview.
+func preview(b []byte) (string, bool) {
+	if len(b) > bodyPreview {
+		return string(b[:bodyPreview]), true
+	}
+	return string(b), false
+}
+
+// multipartFiles lists the files in r's multipart form, saving them to -upload-dir if it's set.
+// the fields come sorted, so the same request lists its files in the same order
+func multipartFiles(r *http.Request) []fileDump {
+	var files []fileDump
+	for _, field := range sortedFileFields(r.MultipartForm.File) {
+		for _, fh := range r.MultipartForm.File[field] {
+			f := fileDump{Field: field, Name: fh.Filename, Type: fh.Header.Get("Content-Type"), Bytes: fh.Size}
+			if uploads != nil {
+				saved, err := saveUpload(fh)
+				if err != nil {
+					requestLogger(r).Error("saving upload", "file", fh.Filename, "err", err)
+				}
+				f.Saved = saved
+			}
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func sortedFileFields(m map[string][]*multipart.FileHeader) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveUpload copies fh into -upload-dir and returns the name it got. only the last part of the
+// name the client sent is used, without any leading dots, and a name that is already taken gets
+// -1, -2 and so on before its extension instead of replacing the file that is there
+func saveUpload(fh *multipart.FileHeader) (string, error) {
+	name := fh.Filename
+	// a browser on Windows can send the whole path, with backslashes
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "upload"
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	src, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	for i := 0; i < 1000; i++ {
+		try := name
+		if i > 0 {
+			try = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+		dst, err := uploads.OpenFile(try, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(dst, src)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			uploads.Remove(try)
+			return "", err
+		}
+		return try, nil
+	}
+	return "", fmt.Errorf("no free name for %q", name)
+}
+
+// write is the text form of d for /.
+func (d *bodyDump) write(w io.Writer) {
+	if d == nil {
+		return
+	}
+	fmt.Fprintf(w, "Body = %d bytes", d.Bytes)
+	if d.Type != "" {
+		fmt.Fprintf(w, " of %s", d.Type)
+	}
+	fmt.Fprintln(w)
+	for _, f := range d.Files {
+		fmt.Fprintf(w, "File[%q] = %q (%d bytes", f.Field, f.Name, f.Bytes)
+		if f.Type != "" {
+			fmt.Fprintf(w, ", %s", f.Type)
+		}
+		fmt.Fprint(w, ")")
+		if f.Saved != "" {
+			fmt.Fprintf(w, " saved as %q", f.Saved)
+		}
+		fmt.Fprintln(w)
+	}
+	if d.Error != "" {
+		fmt.Fprintf(w, "Body error = %s\n", d.Error)
+	}
+	if d.JSON != nil {
+		fmt.Fprintf(w, "%s\n", d.JSON)
+	}
+	if d.Text != "" {
+		fmt.Fprintf(w, "Body text = %q", d.Text)
+		if d.Partial {
+			fmt.Fprint(w, " (cut short)")
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// headerSet turns a comma-separated list of header names into a set of canonical ones.
+func headerSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			set[textproto.CanonicalMIMEHeaderKey(h)] = true
+		}
+	}
+	return set
+}
+
+// filterHeaders is what / is allowed to show of h: only the -show-headers ones when that is
+// set, and with the values of the -redact ones replaced. a redacted header is still listed, it
+// is useful to see that a token was sent even when we don't print it. h itself isn't changed
+func filterHeaders(h http.Header) http.Header {
+	show, redact := headerSet(*showHeaders), headerSet(*redactHeaders)
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		ck := textproto.CanonicalMIMEHeaderKey(k)
+		if len(show) > 0 && !show[ck] {
+			continue
+		}
+		if redact[ck] {
+			v = make([]string, len(v))
+			for i := range v {
+				v[i] = "[redacted]"
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// writeRequestJSON is the ?format=json form of /, the same things the text lists as one document.
+// values are sorted like they are in the text, so the same request gives the same bytes
+func writeRequestJSON(w http.ResponseWriter, r *http.Request, headers http.Header, body *bodyDump) {
+	sorted := func(m map[string][]string) map[string][]string {
+		out := make(map[string][]string, len(m))
+		for k, v := range m {
+			out[k] = sortedValues(v)
+		}
+		return out
+	}
+	doc := struct {
+		Method     string              `json:"method"`
+		URL        string              `json:"url"`
+		Proto      string              `json:"proto"`
+		Host       string              `json:"host"`
+		RemoteAddr string              `json:"remote_addr"`
+		Headers    map[string][]string `json:"headers"`
+		Form       map[string][]string `json:"form"`
+		Body       *bodyDump           `json:"body,omitempty"`
+		Trailers   map[string][]string `json:"trailers,omitempty"`
+	}{r.Method, r.URL.String(), r.Proto, r.Host, r.RemoteAddr, sorted(headers), sorted(r.Form), body, nil}
+	if *trailerDump {
+		doc.Trailers = sorted(filterHeaders(r.Trailer))
+	}
+	writeJSON(w, r, doc)
+}
+
+// writeDedupedHeaders is the -dedup-headers form of the header list. net/http already puts most
+// names into canonical form, but it leaves alone the ones with characters it doesn't expect, so
+// they are run through CanonicalMIMEHeaderKey here too before being merged. the values are kept
+// in the order they came in (RFC 9110 says a list header means the same as its lines joined with
+// commas, in order), except Cookie, whose pieces are joined with "; " instead (RFC 6265).
+func writeDedupedHeaders(w io.Writer, h http.Header) {
+	merged := make(map[string][]string)
+	for k, v := range h {
+		ck := textproto.CanonicalMIMEHeaderKey(k)
+		merged[ck] = append(merged[ck], v...)
+	}
+	for _, k := range sortedKeys(merged) {
+		sep := ", "
+		if k == "Cookie" {
+			sep = "; "
+		}
+		fmt.Fprintf(w, "Header[%q] = %q", k, strings.Join(merged[k], sep))
+		if n := len(merged[k]); n > 1 {
+			fmt.Fprintf(w, " (sent %d times)", n)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// sortedKeys returns the keys of a header or form map in order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedValues returns a sorted copy so the request itself is left alone.
+func sortedValues(v []string) []string {
+	v = append([]string(nil), v...)
+	sort.Strings(v)
+	return v
+}
+
+// bodyTooLarge sends a 413 if err came from hitting the MaxBytesReader limit.
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooBig *http.MaxBytesError
+	if !errors.As(err, &tooBig) {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("request body larger than %d bytes", tooBig.Limit), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// rawDump sends the request back as close to the wire format as we can get it: request line,
+// headers and body, via httputil.DumpRequest. net/http has already parsed the headers by the time
+// we see them, so names come back in canonical form, but nothing is filtered out or reformatted by us
+func rawDump(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg().maxBody)
+	b, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b)
+}
+
+// echo sends the request body straight back with the same Content-Type, a loopback for
+// testing clients that send bodies. only methods that carry a body are registered for it
+func echo(w http.ResponseWriter, r *http.Request) {
+	limit := cfg().maxBody
+	if r.ContentLength > limit {
+		// we know it won't fit before reading a byte, so we can still say so properly
+		http.Error(w, fmt.Sprintf("request body larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if r.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+	// io.Copy streams it, so the body never has to fit in memory. a chunked body that goes over
+	// the limit halfway through gets cut off, since the 200 has already been sent by then
+	if _, err := io.Copy(w, r.Body); err != nil {
+		requestLogger(r).Error("echoing body", "err", err)
+	}
+}
+
+// upload reads the whole body and answers with its size and SHA-256, so a client can check
+// that what it sent is what arrived. nothing is kept: the body goes through the hash and is
+// dropped, which is why it gets its own limit, a lot bigger than -max-body
+func upload(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > *maxUpload {
+		http.Error(w, fmt.Sprintf("request body larger than %d bytes", *maxUpload), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, *maxUpload)
+	h := sha256.New()
+	n, err := io.Copy(h, r.Body)
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		requestLogger(r).Error("reading upload", "err", err)
+		http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, r, struct {
+		Bytes  int64  `json:"bytes"`
+		SHA256 string `json:"sha256"`
+	}{n, hex.EncodeToString(h.Sum(nil))})
+}
+
+// kv is the store behind /kv, a small key/value playground that lives as long as the server does
+var kv = &kvStore{items: make(map[string]kvItem)}
+
+// kvStore is a map that many handlers use at once. count makes do with a plain Mutex since every
+// request changes it, but most requests here only look, so an RWMutex lets any number of GETs read
+// at the same time and only a PUT or a DELETE has to wait for them to have the map to itself
+type kvStore struct {
+	mu    sync.RWMutex
+	items map[string]kvItem
+}
+
+type kvItem struct {
+	value   []byte
+	ctype   string
+	updated time.Time
+	expires time.Time // zero means never
+}
+
+// live is whether the item is still there at now. an expired one stays in the map until
+// expireEvery gets to it, but it is gone as far as anyone asking can tell
+func (it kvItem) live(now time.Time) bool {
+	return it.expires.IsZero() || now.Before(it.expires)
+}
+
+// kvJSON is how an item is shown. the value is a string when it is UTF-8 and base64 when it isn't
+type kvJSON struct {
+	Key       string     `json:"key"`
+	Value     *string    `json:"value,omitempty"`
+	Base64    bool       `json:"value_base64,omitempty"`
+	Type      string     `json:"content_type,omitempty"`
+	Bytes     int        `json:"bytes"`
+	Updated   time.Time  `json:"updated"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	ExpiresIn string     `json:"expires_in,omitempty"`
+}
+
+// show is it as JSON, with its value unless this is for the listing.
+func (it kvItem) show(key string, withValue bool, now time.Time) kvJSON {
+	j := kvJSON{Key: key, Type: it.ctype, Bytes: len(it.value), Updated: it.updated}
+	if withValue {
+		v := string(it.value)
+		if !utf8.Valid(it.value) {
+			v, j.Base64 = base64.StdEncoding.EncodeToString(it.value), true
+		}
+		j.Value = &v
+	}
+	if !it.expires.IsZero() {
+		j.Expires = &it.expires
+		j.ExpiresIn = it.expires.Sub(now).Round(time.Second).String()
+	}
+	return j
+}
+
+// serveKey is /kv/{key}: GET reads it, PUT stores the body under it, with ?ttl=30s to have it
+// go away again, and DELETE removes it. the key is everything after /kv/, slashes and all
+func (s *kvStore) serveKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	if key == "" {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			s.list(w, r)
+			return
+		}
+		http.Error(w, "want a key, like /kv/name", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.RLock()
+		it, ok := s.items[key]
+		s.mu.RUnlock()
+		if !ok || !it.live(now) {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, it.show(key, true, now))
+	case http.MethodPut:
+		s.put(w, r, key, now)
+	case http.MethodDelete:
+		s.mu.Lock()
+		it, ok := s.items[key]
+		delete(s.items, key)
+		s.mu.Unlock()
+		if !ok || !it.live(now) {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// put stores the request body under key. it answers 201 for a new key and 200 for one that
+// was already there, with the item as it is now either way
+func (s *kvStore) put(w http.ResponseWriter, r *http.Request, key string, now time.Time) {
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			http.Error(w, "bad ttl, want a duration like 30s or 5m", http.StatusBadRequest)
+			return
+		}
+	}
+	// the whole value is kept in memory, so it gets -max-body like / does
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg().maxBody))
+	if err != nil {
+		if bodyTooLarge(w, err) {
+			return
+		}
+		http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	it := kvItem{value: b, ctype: r.Header.Get("Content-Type"), updated: now}
+	if ttl > 0 {
+		it.expires = now.Add(ttl)
+	}
+
+	s.mu.Lock()
+	old, had := s.items[key]
+	had = had && old.live(now)
+	if !had && len(s.items) >= *kvMaxKeys {
+		// expired ones still in the map don't count, so make room by dropping them first
+		s.dropExpired(now)
+	}
+	if !had && len(s.items) >= *kvMaxKeys {
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("the store is full at %d keys (-kv-max-keys)", *kvMaxKeys), http.StatusInsufficientStorage)
+		return
+	}
+	s.items[key] = it
+	s.mu.Unlock()
+
+	if !had {
+		w.Header().Set("Location", r.URL.Path)
+		// writeJSON only sets the Content-Type, so the status has to be written after it and before the body
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, r, it.show(key, false, now))
+}
+
+// list is /kv, every key with its size and expiry but not its value, sorted by key. ?prefix=
+// only lists the keys that start with it
+func (s *kvStore) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	now := time.Now()
+	keys := []kvJSON{}
+	s.mu.RLock()
+	for key, it := range s.items {
+		if strings.HasPrefix(key, prefix) && it.live(now) {
+			keys = append(keys, it.show(key, false, now))
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	writeJSON(w, r, struct {
+		Count int      `json:"count"`
+		Keys  []kvJSON `json:"keys"`
+	}{len(keys), keys})
+}
+
+// expireEvery removes the expired items every interval. they are already invisible by then,
+// this is only so that keys nobody asks for again don't take up memory (and -kv-max-keys) forever
+func (s *kvStore) expireEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		s.mu.Lock()
+		s.dropExpired(now)
+		s.mu.Unlock()
+	}
+}
+
+// dropExpired deletes the items that have expired by now. s.mu has to be held
+func (s *kvStore) dropExpired(now time.Time) {
+	for key, it := range s.items {
+		if !it.live(now) {
+			delete(s.items, key)
+		}
+	}
+}
+
+func counter(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+	mu.Lock()
+	n := count
+	var base countSample
+	var err error
+	if since != "" {
+		base, err = baseline(since)
+	}
+	mu.Unlock()
+	// we add these mu.Lock() and mu.Unlock() so that we do not face a race condition and that only one goroutine accesses a variable at a time
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if since != "" {
+		// with ?since= the count is only what came in after the baseline
+		n -= base.count
+		if wantsJSON(r) {
+			writeJSON(w, r, struct {
+				Count int       `json:"count"`
+				Since time.Time `json:"since"`
+			}{n, base.time})
+			return
+		}
+		fmt.Fprintf(w, "Count %d since %s\n", n, base.time.Format(time.RFC3339))
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, r, struct {
+			Count int `json:"count"`
+		}{n})
+		return
+	}
+	fmt.Fprintf(w, "Count %d\n", n)
+}
+
+// countSnapshot saves the count right now under ?name=, for a later /count?since=name.
+func countSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	mu.Lock()
+	if _, ok := snapshots[name]; !ok && len(snapshots) >= maxSnapshots {
+		oldest := ""
+		for k, v := range snapshots {
+			if oldest == "" || v.time.Before(snapshots[oldest].time) {
+				oldest = k
+			}
+		}
+		delete(snapshots, oldest)
+	}
+	snap := countSample{time: time.Now(), count: count}
+	snapshots[name] = snap
+	mu.Unlock()
+
+	if wantsJSON(r) {
+		writeJSON(w, r, struct {
+			Name  string    `json:"name"`
+			Count int       `json:"count"`
+			Time  time.Time `json:"time"`
+		}{name, snap.count, snap.time})
+		return
+	}
+	fmt.Fprintf(w, "Snapshot %q at %d\n", name, snap.count)
+}
+
+// baseline turns ?since= into the count at that point. it can be an RFC 3339 time, unix seconds,
+// a duration meaning that long ago (like 5m), or the name of a snapshot. mu must be held.
+func baseline(since string) (countSample, error) {
+	if s, ok := snapshots[since]; ok {
+		return s, nil
+	}
+	var t time.Time
+	if d, err := time.ParseDuration(since); err == nil {
+		t = time.Now().Add(-d)
+	} else if secs, err := strconv.ParseInt(since, 10, 64); err == nil {
+		t = time.Unix(secs, 0)
+	} else if t, err = time.Parse(time.RFC3339, since); err != nil {
+		return countSample{}, fmt.Errorf("since %q is not a time, a duration or a snapshot name", since)
+	}
+	n, ok := countSamples.at(t)
+	if !ok {
+		return countSample{}, fmt.Errorf("since %s is older than the samples we keep", t.Format(time.RFC3339))
+	}
+	return countSample{time: t, count: n}, nil
+}
+
+// countSample is the count as it was at some moment.
+type countSample struct {
+	time  time.Time
+	count int
+}
+
+// countStore is where the counts go to survive a restart. Load is called once at startup,
+// Save every storeInterval and once more when the server stops
+type countStore interface {
+	Load() (storedCounts, error)
+	Save(storedCounts) error
+}
+
+// storedCounts is what a countStore keeps: the /count counter and the /dashboard totals.
+type storedCounts struct {
+	Count int            `json:"count"`
+	Total int            `json:"total"`
+	Paths map[string]int `json:"paths"`
+}
+
+// a crash loses at most this much counting, the stores are cheap enough to write this often
+const storeInterval = 10 * time.Second
+
+// openStore turns -store into a countStore. sqlite: is refused with a reason, database/sql
+// needs a driver from outside the standard library and this program doesn't have a go.mod to pull one in
+func openStore(spec string) (countStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "memory":
+		return memoryStore{}, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file: needs a path, like file:counts.json")
+		}
+		return fileStore{arg}, nil
+	case "sqlite":
+		return nil, errors.New("sqlite needs a database driver that isn't built in, use file:PATH")
+	}
+	return nil, fmt.Errorf("%q isn't memory or file:PATH", spec)
+}
+
+// memoryStore is how the server always worked: the counts start at 0 on every run.
+type memoryStore struct{}
+
+func (memoryStore) Load() (storedCounts, error) { return storedCounts{}, nil }
+func (memoryStore) Save(storedCounts) error     { return nil }
+
+// fileStore keeps the counts in a JSON file. a missing file is a first run.
+type fileStore struct {
+	path string
+}
+
+func (f fileStore) Load() (storedCounts, error) {
+	var c storedCounts
+	b, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%s: %v", f.path, err)
+	}
+	return c, nil
+}
+
+// Save writes a temp file next to the real one and renames it over it, so a crash halfway
+// through leaves the old counts and not half a JSON document
+func (f fileStore) Save(c storedCounts) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".counts-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// restoreCounts puts what store had back into count and stats, before any request comes in.
+func restoreCounts(store countStore) error {
+	c, err := store.Load()
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	count = c.Count
+	if count > 0 {
+		// the samples from before the restart are gone, so /count?since= can only go back to now
+		countSamples.add(time.Now(), count)
+		countSamples.restored = true
+	}
+	mu.Unlock()
+	stats.mu.Lock()
+	stats.total = c.Total
+	for p, n := range c.Paths {
+		stats.paths[p] = n
+	}
+	stats.mu.Unlock()
+	return nil
+}
+
+// saveCounts hands the counts as they are right now to store.
+func saveCounts(store countStore) error {
+	mu.Lock()
+	c := storedCounts{Count: count}
+	mu.Unlock()
+	stats.mu.Lock()
+	c.Total = stats.total
+	c.Paths = make(map[string]int, len(stats.paths))
+	for p, n := range stats.paths {
+		c.Paths[p] = n
+	}
+	stats.mu.Unlock()
+	return store.Save(c)
+}
+
+func saveCountsEvery(store countStore, d time.Duration) {
+	for range time.Tick(d) {
+		if err := saveCounts(store); err != nil {
+			slog.Error("saving counts", "store", *storeFlag, "err", err)
+		}
+	}
+}
+
+// at most one sample per second is kept, so the ring goes back sampleSize seconds in which
+// something was counted, and further than that when the server sat idle in between
+const sampleSize = 3600
+
+// sampleRing remembers how the count grew. it is a ring buffer like requestStats.recent,
+// next is where the next sample goes
+type sampleRing struct {
+	samples  []countSample
+	next     int
+	restored bool // the first sample is a count restored from -store, not 0 at startup
+}
+
+func (s *sampleRing) add(t time.Time, n int) {
+	if len(s.samples) > 0 {
+		last := &s.samples[(s.next-1+len(s.samples))%len(s.samples)]
+		if last.time.Truncate(time.Second).Equal(t.Truncate(time.Second)) {
+			*last = countSample{t, n}
+			return
+		}
+	}
+	if len(s.samples) < sampleSize {
+		s.samples = append(s.samples, countSample{t, n})
+	} else {
+		s.samples[s.next] = countSample{t, n}
+	}
+	s.next = (s.next + 1) % sampleSize
+}
+
+// at returns the count at time t, which is the newest sample from t or before. before the first
+// sample the count was 0, unless the ring has wrapped or the count was restored, in which case the answer is gone.
+func (s *sampleRing) at(t time.Time) (int, bool) {
+	for i := 1; i <= len(s.samples); i++ {
+		c := s.samples[(s.next-i+len(s.samples))%len(s.samples)]
+		if !c.time.After(t) {
+			return c.count, true
+		}
+	}
+	return 0, len(s.samples) < sampleSize && !s.restored
+}
+
+// wantsJSON reports whether the client asked for JSON, with ?format=json or an Accept header.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON sends v as JSON. the same state has to give byte-for-byte the same body so clients
+// can cache and diff it: encoding/json writes struct fields in declaration order and sorts map
+// keys, so that holds as long as v is made of structs, maps and slices, and slices that come
+// from ranging over a map are sorted before they get here
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		requestLogger(r).Error("encoding json", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// slowBody sends ?size= bytes at ?rate= bytes per second. the headers go out straight away,
+// so a client sees a quick first byte and then a slow transfer (good for testing read timeouts)
+func slowBody(w http.ResponseWriter, r *http.Request) {
+	size, err := queryInt(r, "size", 1024)
+	if err != nil || size < 0 {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+	rate, err := queryInt(r, "rate", 100)
+	if err != nil || rate <= 0 {
+		http.Error(w, "bad rate", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// we write a tenth of the rate every tenth of a second
+	const tick = 100 * time.Millisecond
+	chunk := rate / 10
+	if chunk == 0 {
+		chunk = 1
+	}
+	interval := time.Duration(int64(tick) * int64(chunk) * 10 / int64(rate))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	flusher.Flush()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for sent := 0; sent < size; {
+		n := chunk
+		if size-sent < n {
+			n = size - sent
+		}
+		if _, err := w.Write([]byte(strings.Repeat("x", n))); err != nil {
+			return
+		}
+		flusher.Flush()
+		sent += n
+		if sent == size {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			// the client hung up
+			return
+		}
+	}
+}
+
+// lissajousWork caps cycles/res*nframes, the number of points drawn in total. every knob is
+// fine on its own, but ?cycles=100&res=0.0001&nframes=256 would keep the server busy for ages
+const lissajousWork = 20_000_000
+
+// lissajousMemory caps the frames, which are all kept until the GIF is encoded. ?size=1000 on
+// its own is 4 MB a frame, and with ?nframes=256 that would be a gigabyte for one request
+const lissajousMemory = 64 << 20
+
+// lissajousHandler sends an animated GIF like the book's server does in section 1.7, with
+// ?cycles=, ?res=, ?size=, ?nframes= and ?delay= in place of its constants. anything missing
+// gets the book's value and anything out of range is a 400 saying what is allowed
+func lissajousHandler(w http.ResponseWriter, r *http.Request) {
+	p := lissajous.Defaults
+	var err error
+	bad := func(name string, lo, hi any) {
+		http.Error(w, fmt.Sprintf("bad %s, it wants a number from %v to %v", name, lo, hi), http.StatusBadRequest)
+	}
+	if p.Cycles, err = queryInt(r, "cycles", p.Cycles); err != nil || p.Cycles < 1 || p.Cycles > 100 {
+		bad("cycles", 1, 100)
+		return
+	}
+	if p.Res, err = queryFloat(r, "res", p.Res); err != nil || !(p.Res >= 0.0001 && p.Res <= 1) {
+		bad("res", 0.0001, 1)
+		return
+	}
+	if p.Size, err = queryInt(r, "size", p.Size); err != nil || p.Size < 1 || p.Size > 1000 {
+		bad("size", 1, 1000)
+		return
+	}
+	if p.NFrames, err = queryInt(r, "nframes", p.NFrames); err != nil || p.NFrames < 1 || p.NFrames > 256 {
+		bad("nframes", 1, 256)
+		return
+	}
+	if p.Delay, err = queryInt(r, "delay", p.Delay); err != nil || p.Delay < 0 || p.Delay > 1000 {
+		bad("delay", 0, 1000)
+		return
+	}
+	if float64(p.Cycles)/p.Res*float64(p.NFrames) > lissajousWork {
+		http.Error(w, "too much to draw, use fewer cycles or frames or a bigger res", http.StatusBadRequest)
+		return
+	}
+	if lissajous.Bytes(p) > lissajousMemory {
+		http.Error(w, "too big to keep in memory, use a smaller size or fewer frames", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	if err := lissajous.Lissajous(w, p); err != nil {
+		// the headers are gone already, so all we can do is log it
+		slog.Debug("lissajous", "err", err)
+	}
+}
+
+// queryFloat is queryInt for a number that may have a fractional part.
+func queryFloat(r *http.Request, name string, def float64) (float64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// queryInt reads an integer query parameter, falling back to def when it is missing.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// handle registers h for pattern and only lets method through, so the method checks live in one place
+// instead of inside every handler. method can list several methods separated by spaces, and an empty
+// method accepts anything, which is what the inspector wants. a GET endpoint also answers HEAD, and any
+// other method gets a 405 with an Allow header listing what would work
+func handle(method, pattern string, h http.HandlerFunc) {
+	if method == "" {
+		http.HandleFunc(pattern, h)
+		return
+	}
+
+	allowed := make(map[string]bool)
+	for _, m := range strings.Fields(method) {
+		allowed[m] = true
+	}
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allow := strings.Join(strings.Fields(method), ", ")
+	if allowed[http.MethodGet] {
+		allow += ", " + http.MethodHead
+	}
+	allow += ", " + http.MethodOptions
+	h = withCORS(allow, h)
+
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case allowed[r.Method]:
+		case r.Method == http.MethodOptions:
+			w.Header().Set("Allow", allow)
+			if !*cors {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			// withCORS answers the preflight
+		default:
+			w.Header().Set("Allow", allow)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// withCORS lets a browser page on another origin read the endpoint when -cors is set.
+// a preflight OPTIONS request is answered directly and never reaches h
+func withCORS(methods string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !*cors {
+			h(w, r)
+			return
+		}
+		origin := cfg().corsOrigin
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			// the answer depends on the Origin header so caches must keep them apart
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ctxKey is the type of our context keys, so they can't clash with anyone else's
+type ctxKey int
+
+const requestIDKey ctxKey = 0
+
+// logRequests logs one line per request with its method, path, status, duration and ID.
+// the ID is the client's X-Request-Id when it sent one, otherwise a random one, and it
+// is sent back in the response so a client can find its request in the log
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlight.Add(1)
+		lastRequest.Store(start.UnixNano())
+		// stored again at the end, so the idle time counts from when the last request finished
+		defer func() {
+			lastRequest.Store(time.Now().UnixNano())
+			inFlight.Add(-1)
+		}()
+
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		d := time.Since(start)
+		stats.record(r.URL.Path, rec.status, d)
+		metrics.observe(r.Method, r.URL.Path, rec.status, d)
+		live.publish("request", liveRequest{r.Method, r.URL.Path, rec.status, d.Seconds() * 1000})
+		accessLog.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", d,
+			"remote_addr", r.RemoteAddr,
+			"request_id", id)
+	})
+}
+
+// live is the hub behind /live. handler and logRequests publish to it whether or not anyone is
+// listening, publish is only a lock and a map length when nobody is
+var live = &liveHub{subs: make(map[*liveSub]bool)}
+
+// maxLiveClients caps how many /live streams can be open, each one holds a goroutine and a buffer
+const maxLiveClients = 100
+
+// liveBuffer is how many events a /live client can fall behind by. one that falls further
+// behind is dropped rather than making publish wait for it, a slow browser tab should never
+// slow down the requests being counted. EventSource reconnects by itself after the retry delay
+const liveBuffer = 64
+
+type liveHub struct {
+	mu     sync.Mutex
+	subs   map[*liveSub]bool
+	closed bool
+}
+
+// liveSub is one /live client. gone is closed when the hub drops it, for lagging or for shutdown
+type liveSub struct {
+	events chan liveEvent
+	gone   chan struct{}
+}
+
+type liveEvent struct {
+	name string
+	data []byte
+}
+
+// liveRequest is the request event, one per request logRequests sees.
+type liveRequest struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+var errLiveFull = errors.New("too many /live clients")
+
+func (h *liveHub) subscribe() (*liveSub, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, http.ErrServerClosed
+	}
+	if len(h.subs) >= maxLiveClients {
+		return nil, errLiveFull
+	}
+	s := &liveSub{events: make(chan liveEvent, liveBuffer), gone: make(chan struct{})}
+	h.subs[s] = true
+	return s, nil
+}
+
+// unsubscribe is for a client that went away by itself. one the hub already dropped is a no-op
+func (h *liveHub) unsubscribe(s *liveSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(s)
+}
+
+// drop needs h.mu held.
+func (h *liveHub) drop(s *liveSub) {
+	if h.subs[s] {
+		delete(h.subs, s)
+		close(s.gone)
+	}
+}
+
+// publish sends v as JSON to every client, dropping the ones whose buffer is full.
+func (h *liveHub) publish(name string, v any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("encoding live event", "event", name, "err", err)
+		return
+	}
+	e := liveEvent{name, data}
+	for s := range h.subs {
+		select {
+		case s.events <- e:
+		default:
+			h.drop(s)
+		}
+	}
+}
+
+// close drops every client and turns new ones away, for shutdown.
+func (h *liveHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.drop(s)
+	}
+}
+
+// liveHandler is /live, a Server-Sent Events stream (what EventSource in a browser reads) of a
+// count event every time / counts a request and a request event for every request at all. it
+// starts with the current count and the per-path totals, and the events keep those up to date,
+// so a dashboard never has to poll /count. a WebSocket would need a package from outside the
+// standard library, and the updates only go one way anyway
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, err := live.subscribe()
+	if err != nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer live.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// subscribed before the snapshot is taken, so nothing can happen in between that is in neither
+	mu.Lock()
+	n := count
+	mu.Unlock()
+	_, paths, _ := stats.snapshot()
+	if paths == nil {
+		paths = []pathCount{}
+	}
+	write := func(name string, data []byte) bool {
+		_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+		flusher.Flush()
+		return err == nil
+	}
+	hello, _ := json.Marshal(struct {
+		Count int         `json:"count"`
+		Paths []pathCount `json:"paths"`
+	}{n, paths})
+	fmt.Fprint(w, "retry: 2000\n")
+	if !write("hello", hello) {
+		return
+	}
+
+	// a comment line now and then finds dead connections, and keeps proxies from timing the stream out
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-sub.events:
+			if !write(e.name, e.data) {
+				return
+			}
+		case <-ping.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			if err != nil {
+				return
+			}
+		case <-sub.gone:
+			// lagged or shutting down, either way the client should come back later
+			write("bye", []byte("{}"))
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// metrics is what logRequests has seen per method and path, for /metrics.
+var metrics = &metricRegistry{paths: make(map[string]bool), series: make(map[metricKey]*metricSeries)}
+
+// latencyWindow is how many of the latest durations each series keeps for its percentiles.
+// an exact percentile over every request would need every duration, so this is the
+// latest-traffic view, which is the one you want when something just got slow anyway
+const latencyWindow = 1024
+
+// the methods that get a series of their own, anything else is counted as OTHER so a client
+// can't make up methods to grow the registry. paths are capped the way requestStats does it
+var metricMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+type metricKey struct {
+	method, path string
+}
+
+type metricRegistry struct {
+	mu     sync.Mutex
+	paths  map[string]bool
+	series map[metricKey]*metricSeries
+}
+
+type metricSeries struct {
+	count    int
+	statuses map[int]int
+	sum      time.Duration
+	latest   []time.Duration // ring buffer of the last latencyWindow, next is where the next one goes
+	next     int
+}
+
+func (m *metricRegistry) observe(method, path string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !metricMethods[method] {
+		method = "OTHER"
+	}
+	if !m.paths[path] {
+		if len(m.paths) >= maxPaths {
+			path = otherPaths
+		}
+		m.paths[path] = true
+	}
+	k := metricKey{method, path}
+	s := m.series[k]
+	if s == nil {
+		s = &metricSeries{statuses: make(map[int]int)}
+		m.series[k] = s
+	}
+	s.count++
+	s.statuses[status]++
+	s.sum += d
+	if len(s.latest) < latencyWindow {
+		s.latest = append(s.latest, d)
+	} else {
+		s.latest[s.next] = d
+	}
+	s.next = (s.next + 1) % latencyWindow
+}
+
+// metricRow is one series copied out of the registry, with its percentiles worked out.
+type metricRow struct {
+	metricKey
+	count         int
+	statuses      map[int]int
+	sum           time.Duration
+	p50, p90, p99 time.Duration
+}
+
+// rows copies every series out sorted by path and then method, so the lock isn't held while writing.
+func (m *metricRegistry) rows() []metricRow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := make([]metricRow, 0, len(m.series))
+	for k, s := range m.series {
+		sorted := append([]time.Duration(nil), s.latest...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		statuses := make(map[int]int, len(s.statuses))
+		for c, n := range s.statuses {
+			statuses[c] = n
+		}
+		rows = append(rows, metricRow{k, s.count, statuses, s.sum,
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99)})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].path != rows[j].path {
+			return rows[i].path < rows[j].path
+		}
+		return rows[i].method < rows[j].method
+	})
+	return rows
+}
+
+// percentile is the nearest-rank percentile of sorted, 0 when there is nothing.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (p*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// metricsHandler shows the registry as a table, or in the Prometheus text format with
+// ?format=prometheus or when the scraper's Accept header asks for text/plain;version=0.0.4
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	rows := metrics.rows()
+	if r.URL.Query().Get("format") == "prometheus" || strings.Contains(r.Header.Get("Accept"), "version=0.0.4") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tPATH\tREQUESTS\tSTATUSES\tP50\tP90\tP99")
+	for _, row := range rows {
+		var codes []string
+		for _, c := range sortedStatuses(row.statuses) {
+			codes = append(codes, fmt.Sprintf("%d:%d", c, row.statuses[c]))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%v\t%v\t%v\n", row.method, row.path, row.count,
+			strings.Join(codes, " "), row.p50.Round(time.Microsecond), row.p90.Round(time.Microsecond), row.p99.Round(time.Microsecond))
+	}
+	tw.Flush()
+}
+
+func sortedStatuses(m map[int]int) []int {
+	codes := make([]int, 0, len(m))
+	for c := range m {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+// writePrometheus writes rows as a counter of requests by method, path and status, and a
+// summary of their durations. the quantiles are over the latest latencyWindow requests of each
+// series, which is what a Prometheus summary's quantiles are meant to be anyway
+func writePrometheus(w io.Writer, rows []metricRow) {
+	fmt.Fprintln(w, "# HELP http_requests_total Requests handled, by method, path and status.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, row := range rows {
+		for _, c := range sortedStatuses(row.statuses) {
+			fmt.Fprintf(w, "http_requests_total{method=%s,path=%s,status=\"%d\"} %d\n",
+				promLabel(row.method), promLabel(row.path), c, row.statuses[c])
+		}
+	}
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds How long requests took, by method and path.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds summary")
+	for _, row := range rows {
+		labels := fmt.Sprintf("method=%s,path=%s", promLabel(row.method), promLabel(row.path))
+		for _, q := range []struct {
+			q string
+			d time.Duration
+		}{{"0.5", row.p50}, {"0.9", row.p90}, {"0.99", row.p99}} {
+			fmt.Fprintf(w, "http_request_duration_seconds{%s,quantile=\"%s\"} %g\n", labels, q.q, q.d.Seconds())
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %g\n", labels, row.sum.Seconds())
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, row.count)
+	}
+}
+
+// promLabel quotes a label value the way the exposition format wants: backslash, double
+// quote and newline escaped, and nothing else
+func promLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+// accessLog is where logRequests writes its one line per request. it is the server log unless
+// -access-log sends it somewhere of its own
+var accessLog *slog.Logger
+
+// rotatingFile is the -access-log file. when a write would take it past max bytes, FILE.1 becomes
+// FILE.2 and so on, FILE becomes FILE.1 and a new FILE is started, and the oldest past keep goes.
+// a lock makes sure two requests finishing together don't both rotate
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	keep int
+	f    *os.File
+	size int64
+}
+
+func openRotating(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, max: maxSize, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open carries on with whatever is in the file already, a restart shouldn't throw the log away.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(b)) > r.max {
+		if err := r.rotate(); err != nil {
+			// keep logging to the old file rather than lose the lines
+			fmt.Fprintf(os.Stderr, "server: rotating %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.keep == 0 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+		for i := r.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			if oerr := r.open(); oerr != nil {
+				return oerr
+			}
+			return err
+		}
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// limit is a token bucket's shape: it refills at rate tokens a second and holds at most burst.
+type limit struct {
+	rate  float64
+	burst float64
+}
+
+// parseLimit reads RATE or RATE/BURST. the burst defaults to the rate, rounded up so a rate
+// under one a second still lets a single request through
+func parseLimit(s string) (limit, error) {
+	rs, bs, hasBurst := strings.Cut(s, "/")
+	rate, err := strconv.ParseFloat(rs, 64)
+	if err != nil || !(rate > 0) {
+		return limit{}, fmt.Errorf("rate %q isn't a positive number", rs)
+	}
+	l := limit{rate: rate, burst: math.Ceil(rate)}
+	if hasBurst {
+		b, err := strconv.Atoi(bs)
+		if err != nil || b < 1 {
+			return limit{}, fmt.Errorf("burst %q isn't a positive whole number", bs)
+		}
+		l.burst = float64(b)
+	}
+	return l, nil
+}
+
+// limitFlag maps path prefixes to their limits for -rate-limit-route.
+type limitFlag map[string]limit
+
+func (f limitFlag) String() string {
+	var parts []string
+	for p, l := range f {
+		parts = append(parts, fmt.Sprintf("%s=%g/%g", p, l.rate, l.burst))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (f limitFlag) Set(s string) error {
+	prefix, spec, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("want PREFIX=RATE[/BURST] with PREFIX starting with /, not %q", s)
+	}
+	l, err := parseLimit(spec)
+	if err != nil {
+		return err
+	}
+	f[prefix] = l
+	return nil
+}
+
+// rateLimiter keeps one token bucket per route and client IP. the route is the longest
+// -rate-limit-route prefix that matches, or "" for the -rate-limit default, so a client
+// that uses up its /upload allowance can still fetch everything else.
+type rateLimiter struct {
+	def     *limit // nil when only some routes are limited
+	routes  map[string]limit
+	trusted []*net.IPNet
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+}
+
+type bucketKey struct {
+	route, ip string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens was worked out
+}
+
+// newRateLimiter returns nil when no flag asks for a limit.
+func newRateLimiter(def string, routes limitFlag, trusted string) (*rateLimiter, error) {
+	if def == "" && len(routes) == 0 {
+		if trusted != "" {
+			return nil, errors.New("-trusted-proxies only matters with -rate-limit or -rate-limit-route")
+		}
+		return nil, nil
+	}
+	l := &rateLimiter{routes: routes, buckets: make(map[bucketKey]*bucket)}
+	if def != "" {
+		d, err := parseLimit(def)
+		if err != nil {
+			return nil, fmt.Errorf("-rate-limit: %v", err)
+		}
+		l.def = &d
+	}
+	for _, c := range strings.Split(trusted, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			// a bare IP is a network of one
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("-trusted-proxies: %v", err)
+		}
+		l.trusted = append(l.trusted, n)
+	}
+	return l, nil
+}
+
+// sameLimits says whether l and o limit the same routes the same way and trust the same
+// proxies, so a reload can keep o and the buckets it has filled in. false if either is nil
+func (l *rateLimiter) sameLimits(o *rateLimiter) bool {
+	if l == nil || o == nil {
+		return false
+	}
+	sameDef := l.def == nil && o.def == nil || l.def != nil && o.def != nil && *l.def == *o.def
+	return sameDef && maps.Equal(l.routes, o.routes) &&
+		slices.EqualFunc(l.trusted, o.trusted, func(a, b *net.IPNet) bool { return a.String() == b.String() })
+}
+
+// route picks the limit for path, false when it isn't limited at all.
+func (l *rateLimiter) route(path string) (string, limit, bool) {
+	best := ""
+	for p := range l.routes {
+		if strings.HasPrefix(path, p) && len(p) > len(best) {
+			best = p
+		}
+	}
+	if best != "" {
+		return best, l.routes[best], true
+	}
+	if l.def != nil {
+		return "", *l.def, true
+	}
+	return "", limit{}, false
+}
+
+func (l *rateLimiter) isTrusted(ip net.IP) bool {
+	for _, n := range l.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only believed when the
+// connection comes from a trusted proxy, anyone else could put whatever they like in it. each
+// proxy appends the address it got the request from, so the client is the rightmost entry that
+// isn't one of our own proxies
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		if !l.isTrusted(hop) {
+			return hop.String()
+		}
+	}
+	return host
+}
+
+// take spends a token from the bucket for k, or says how long until there is one.
+func (l *rateLimiter) take(k bucketKey, lim limit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: lim.burst, last: now}
+		l.buckets[k] = b
+	}
+	b.tokens = math.Min(lim.burst, b.tokens+now.Sub(b.last).Seconds()*lim.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / lim.rate * float64(time.Second))
+}
+
+// requireAuth keeps the -protect paths to clients that send the -api-key in X-API-Key or the
+// -auth-user with Basic auth. no credentials at all gets a 401, so a browser asks for them, and
+// wrong ones a 403. it sits inside limitRequests, so guessing a password is rate limited too
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := cfg()
+		// a CORS preflight has no credentials in it by design, the request after it does
+		if c.authUser == "" && c.apiKey == "" || r.Method == http.MethodOptions || !protectedPath(c.protect, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		user, pass, basic := r.BasicAuth()
+		switch {
+		case c.apiKey != "" && key != "" && sameSecret(key, c.apiKey):
+		case c.authUser != "" && basic && sameSecret(user+":"+pass, c.authUser):
+		case key == "" && !basic:
+			if c.authUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="server", charset="UTF-8"`)
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		default:
+			requestLogger(r).Warn("bad credentials", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// protectedPath says whether path is one of prefixes or under it, so /count is protected along
+// with /count/snapshot but /counter isn't.
+func protectedPath(prefixes []string, path string) bool {
+	for _, p := range prefixes {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSecret compares in constant time. ConstantTimeCompare returns straight away when the
+// lengths differ, so both sides are hashed first, which makes them the same length
+func sameSecret(got, want string) bool {
+	g, w := sha256.Sum256([]byte(got)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
+
+// limitRequests answers 429 with a Retry-After, in whole seconds and at least 1, once a client's
+// bucket is empty. the limiter is the one in cfg(), nil when nothing is limited
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := cfg().limiter
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, lim, ok := l.route(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed, wait := l.take(bucketKey{route, l.clientIP(r)}, lim, time.Now()); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// expireBuckets throws away, every interval, the buckets of the current limiter that have refilled
+// all the way. a full bucket is the same as no bucket at all, so nothing is forgotten, and clients
+// that went away stop taking up memory. a limiter a reload replaced with different limits is simply
+// dropped, buckets and all
+func expireBuckets(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		l := cfg().limiter
+		if l == nil {
+			continue
+		}
+		l.mu.Lock()
+		for k, b := range l.buckets {
+			lim := l.routes[k.route]
+			if k.route == "" {
+				lim = *l.def
+			}
+			if b.tokens+now.Sub(b.last).Seconds()*lim.rate >= lim.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// shed lets at most n requests into next at once. the rest get a 503 straight away instead of
+// waiting, since a client that is told to come back later is better off than one stuck in a queue
+// that only grows. the buffered channel is the semaphore: a request holds a slot while it runs
+func shed(n int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// targetProxy is /proxy?target=URL, a reverse proxy whose upstream comes with each request. the
+// target is used as it is, path and query included. an open proxy on a machine inside a network
+// can be pointed at anything that network can reach, so only the -proxy-allow hosts are let through
+func targetProxy(allow string) http.HandlerFunc {
+	hosts := make(map[string]bool)
+	for _, h := range strings.Split(allow, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts[h] = true
+		}
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// the handler has already checked the target, this is just carrying it out
+			target, _ := url.Parse(pr.In.URL.Query().Get("target"))
+			pr.Out.URL = target
+			pr.Out.Host = target.Host
+			pr.SetXForwarded()
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("target")
+		target, err := url.Parse(raw)
+		if raw == "" || err != nil || target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+			http.Error(w, "want ?target= with an http:// or https:// URL", http.StatusBadRequest)
+			return
+		}
+		host := strings.ToLower(target.Host)
+		if !hosts["*"] && !hosts[host] && !hosts[strings.ToLower(target.Hostname())] {
+			http.Error(w, fmt.Sprintf("%s isn't in -proxy-allow", host), http.StatusForbidden)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// proxyHistory is the ring buffer behind /proxy/history, the last size exchanges that went
+// through a proxy. a request is added once its response is done, so the ring only ever holds
+// finished ones and nothing in it changes after it goes in
+type proxyHistory struct {
+	mu    sync.Mutex
+	size  int
+	ring  []*exchange // next is where the next one goes
+	next  int
+	total int
+}
+
+// exchange is one request and the response to it, as /proxy/history shows them. both sets of
+// headers go through filterHeaders, so an upstream's Set-Cookie is redacted like a Cookie is
+type exchange struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration_ns"`
+	Remote   string        `json:"remote_addr"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Request  exchangeHalf  `json:"request"`
+	Response exchangeHalf  `json:"response"`
+}
+
+type exchangeHalf struct {
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body"`
+	Base64    bool        `json:"body_base64,omitempty"` // Body wasn't UTF-8, so it is base64
+	Bytes     int64       `json:"bytes"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// historyBody is how much of each body an exchange keeps. enough to see what an API was sent
+// and what it said, without fifty copies of a download sitting in memory
+const historyBody = 16 << 10
+
+func newProxyHistory(size int) *proxyHistory {
+	return &proxyHistory{size: size}
+}
+
+func (h *proxyHistory) add(e *exchange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.total++
+	if len(h.ring) < h.size {
+		h.ring = append(h.ring, e)
+	} else {
+		h.ring[h.next] = e
+	}
+	h.next = (h.next + 1) % h.size
+}
+
+// last returns up to n exchanges, newest first.
+func (h *proxyHistory) last(n int) (total int, out []*exchange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := 1; i <= len(h.ring) && len(out) < n; i++ {
+		out = append(out, h.ring[(h.next-i+len(h.ring))%len(h.ring)])
+	}
+	return h.total, out
+}
+
+// serve is /proxy/history, as JSON. ?n= asks for fewer than all of them
+func (h *proxyHistory) serve(w http.ResponseWriter, r *http.Request) {
+	n, err := queryInt(r, "n", h.size)
+	if err != nil || n < 0 {
+		http.Error(w, "bad n", http.StatusBadRequest)
+		return
+	}
+	total, recent := h.last(n)
+	if recent == nil {
+		recent = []*exchange{}
+	}
+	writeJSON(w, r, struct {
+		Total     int         `json:"total"`
+		Kept      int         `json:"kept"`
+		Exchanges []*exchange `json:"exchanges"`
+	}{total, h.size, recent})
+}
+
+// recordExchanges lets next answer and puts what went back and forth into h. bodies are copied
+// on their way past, so the upstream and the client see them exactly as they would without it
+func recordExchanges(h *proxyHistory, next http.Handler) http.Handler {
+	if h.size == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &exchange{Time: time.Now(), Remote: r.RemoteAddr, Method: r.Method, URL: r.URL.String()}
+		e.Request.Header = filterHeaders(r.Header)
+		reqBody := &bodyCopy{}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeBody{ReadCloser: r.Body, copy: reqBody}
+		}
+		rec := &exchangeRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		e.Duration = time.Since(e.Time)
+		reqBody.fill(&e.Request)
+		e.Response.Status = rec.status
+		e.Response.Header = filterHeaders(rec.Header())
+		rec.body.fill(&e.Response)
+		h.add(e)
+	})
+}
+
+// bodyCopy keeps the first historyBody bytes of a body and counts the rest.
+type bodyCopy struct {
+	buf       bytes.Buffer
+	n         int64
+	truncated bool
+}
+
+func (c *bodyCopy) write(b []byte) {
+	c.n += int64(len(b))
+	if room := historyBody - c.buf.Len(); len(b) > room {
+		b, c.truncated = b[:room], true
+	}
+	c.buf.Write(b)
+}
+
+func (c *bodyCopy) fill(half *exchangeHalf) {
+	half.Bytes, half.Truncated = c.n, c.truncated
+	if b := c.buf.Bytes(); utf8.Valid(b) {
+		half.Body = string(b)
+	} else {
+		half.Body, half.Base64 = base64.StdEncoding.EncodeToString(b), true
+	}
+}
+
+// teeBody is a request body that copies what the proxy reads out of it.
+type teeBody struct {
+	io.ReadCloser
+	copy *bodyCopy
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.copy.write(p[:n])
+	return n, err
+}
+
+// exchangeRecorder passes the response on to the client and keeps a bodyCopy of it.
+type exchangeRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bodyCopy
+}
+
+func (rec *exchangeRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.wroteHeader = true
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *exchangeRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.body.write(b[:n])
+	return n, err
+}
+
+// Flush is passed on like statusRecorder's, ReverseProxy flushes streamed responses as they come.
+func (rec *exchangeRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// responseCache is the -cache-size LRU for the -upstream proxy. entries sits in use order with
+// the most recent at the front, so the one to evict is always at the back.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	entries *list.List
+	byKey   map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key     string
+	vary    []string // the request headers the response said it Varies on
+	varyKey string   // and what they were in the request it answered
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// maxCachedBody keeps one big download from filling memory, a bigger body is passed on but not kept
+const maxCachedBody = 1 << 20
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{size: size, entries: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+// get returns a fresh entry for key and moves it to the front. stale ones are dropped on the way.
+func (c *responseCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	cr := e.Value.(*cachedResponse)
+	if time.Now().After(cr.expires) {
+		c.entries.Remove(e)
+		delete(c.byKey, key)
+		return nil, false
+	}
+	c.entries.MoveToFront(e)
+	return cr, true
+}
+
+func (c *responseCache) put(cr *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byKey[cr.key]; ok {
+		c.entries.Remove(e)
+	}
+	c.byKey[cr.key] = c.entries.PushFront(cr)
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.byKey, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// cacheResponses answers GET and HEAD from c when it can, and otherwise lets next answer and
+// keeps the response if upstream's Cache-Control gives it a max-age and doesn't say no-store.
+// every response says X-Cache: HIT or MISS. a request with no-store of its own skips the cache,
+// and so does one with Authorization or a Cookie, whose answer is likely that user's alone.
+//
+// a response with Vary is only a hit for a request that sent the same values of the headers it
+// names. only the latest of those is kept for a URL, which is all an Origin or an
+// Accept-Encoding needs, and a Vary: * is never kept at all
+func cacheResponses(c *responseCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead || hasDirective(r.Header, "no-store") ||
+			r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+			w.Header().Set("X-Cache", "MISS")
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Method + " " + r.URL.String()
+		if cr, ok := c.get(key); ok && varyKey(r.Header, cr.vary) == cr.varyKey {
+			for k, v := range cr.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Age", strconv.Itoa(int(time.Since(cr.stored).Seconds())))
+			w.WriteHeader(cr.status)
+			w.Write(cr.body)
+			return
+		}
+		rec := &cacheRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.maxAge > 0 && !rec.tooBig {
+			now := time.Now()
+			c.put(&cachedResponse{key, rec.vary, varyKey(r.Header, rec.vary), rec.status, rec.header, rec.body.Bytes(), now, now.Add(rec.maxAge)})
+		}
+	})
+}
+
+// varyNames is the header names in h's Vary, false for a Vary: * that no request can match.
+func varyNames(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			switch {
+			case name == "*":
+				return nil, false
+			case name != "" && !slices.Contains(names, name):
+				names = append(names, name)
+			}
+		}
+	}
+	return names, true
+}
+
+// varyKey is what the request in h sent for the headers names, to tell apart the requests a
+// Vary response answers differently
+func varyKey(h http.Header, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %q\n", name, h.Values(name))
+	}
+	return b.String()
+}
+
+// cacheRecorder passes the response straight on to the client, keeping a copy for the cache.
+// whether it is worth keeping is settled in WriteHeader, from the headers upstream sent
+type cacheRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	header      http.Header
+	maxAge      time.Duration
+	vary        []string
+	body        bytes.Buffer
+	tooBig      bool
+}
+
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = code
+	h := rec.ResponseWriter.Header()
+	vary, ok := varyNames(h)
+	if code == http.StatusOK && ok && !hasDirective(h, "no-store") && !hasDirective(h, "private") && h.Get("Set-Cookie") == "" {
+		rec.maxAge, rec.vary = maxAge(h), vary
+	}
+	rec.header = h.Clone()
+	// logRequests has already put this request's ID in, a hit has to keep its own
+	rec.header.Del("X-Request-Id")
+	h.Set("X-Cache", "MISS")
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	if rec.maxAge > 0 && !rec.tooBig {
+		if rec.body.Len()+len(b) > maxCachedBody {
+			rec.tooBig = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush is passed on like statusRecorder's, ReverseProxy flushes streamed responses as they come.
+func (rec *cacheRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// hasDirective says whether the Cache-Control header has directive in it, like no-store.
+func hasDirective(h http.Header, directive string) bool {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(d), directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAge is the max-age in Cache-Control, or 0 when there is none or it doesn't parse.
+func maxAge(h http.Header) time.Duration {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if !ok || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if secs, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 0
+}
+
+// fixture is one recorded request, the way -record writes it and -replay reads it back. the
+// body is a string when it is text and base64 when it isn't, so the files can still be read
+// and edited by hand for the usual JSON and form bodies
+type fixture struct {
+	Time       time.Time   `json:"time"`
+	RequestID  string      `json:"request_id,omitempty"`
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Proto      string      `json:"proto"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+	Base64     bool        `json:"body_base64,omitempty"`
+	// a body over -max-body is cut off in the file, the handler still gets all of it
+	Truncated bool `json:"body_truncated,omitempty"`
+	// what this server answered, -replay compares the target's status with it
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// recorder names the fixtures: a sequence number first so ls and -replay have them in the order
+// they came in, then the method and path so a directory of them can be looked through
+type recorder struct {
+	dir string
+	seq atomic.Int64
+}
+
+// newRecorder makes dir if it isn't there, and carries on numbering after the fixtures already
+// in it, so recording again into the same directory adds to it instead of overwriting
+func newRecorder(dir string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recorder{dir: dir}
+	for _, e := range entries {
+		num, _, _ := strings.Cut(e.Name(), "-")
+		if n, err := strconv.ParseInt(num, 10, 64); err == nil && n > rec.seq.Load() {
+			rec.seq.Store(n)
+		}
+	}
+	return rec, nil
+}
+
+// recordRequests writes a fixture for every request once it has been answered. the body is read
+// up front (up to -max-body) and handed to the handler again, followed by whatever was left
+func recordRequests(rec *recorder, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := fixture{Time: time.Now(), Method: r.Method, URI: r.RequestURI, Proto: r.Proto,
+			Host: r.Host, RemoteAddr: r.RemoteAddr, Header: r.Header.Clone()}
+		f.RequestID, _ = r.Context().Value(requestIDKey).(string)
+		body, err := io.ReadAll(io.LimitReader(r.Body, cfg().maxBody+1))
+		if err != nil {
+			// the handler can find out about it for itself, from the rest of the body
+			slog.Warn("record: reading body", "err", err)
+		}
+		if int64(len(body)) > cfg().maxBody {
+			f.Truncated = true
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if f.Truncated {
+			body = body[:cfg().maxBody]
+		}
+		if utf8.Valid(body) {
+			f.Body = string(body)
+		} else {
+			f.Body, f.Base64 = base64.StdEncoding.EncodeToString(body), true
+		}
+
+		// numbered now rather than once it is answered, so a quick request that came in after a
+		// slow one still comes after it in ls and in -replay
+		seq := rec.seq.Add(1)
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+		f.Status = sr.status
+		f.ContentType = sr.Header().Get("Content-Type")
+		if err := rec.write(seq, f); err != nil {
+			slog.Error("record", "uri", f.URI, "err", err)
+		}
+	})
+}
+
+// write saves f as number seq. it goes through a temp file so -replay never picks up
+// half of one, and only the owner can read it: the headers can have passwords and cookies in them
+func (rec *recorder) write(seq int64, f fixture) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%06d-%s%s.json", seq, f.Method, fixtureSlug(f.URI))
+	tmp, err := os.CreateTemp(rec.dir, ".record-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(rec.dir, name))
+}
+
+// fixtureSlug turns the path into something that can be in a file name: /kv/a%20b?x=1 is -kv-a_20b
+func fixtureSlug(uri string) string {
+	p, _, _ := strings.Cut(uri, "?")
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	slug := []byte("-")
+	for _, c := range []byte(p) {
+		switch {
+		case c == '/':
+			slug = append(slug, '-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_':
+			slug = append(slug, c)
+		default:
+			slug = append(slug, '_')
+		}
+		if len(slug) == 60 {
+			break
+		}
+	}
+	return string(slug)
+}
+
+// hopHeaders belong to the connection the request was recorded on, not to the request, so
+// -replay leaves them out. Content-Length is worked out again from the body
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// replay sends the fixtures in dir to target in the order of their names, waiting between them
+// as long as the recording did divided by speed. it prints one line per request with the status
+// next to the recorded one, and returns the exit status: 1 if a request failed or got a
+// different status, 2 if it couldn't start.
+//
+// a fixture whose body was cut off at -max-body counts as failed without being sent, the target
+// would only get part of the request and the status would say nothing. an event stream like
+// /live is skipped: it only ends when the client hangs up, so the client's timeout would fail it
+// every time
+func replay(dir, target string, speed float64) int {
+	base, err := url.Parse(target)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		fmt.Fprintf(os.Stderr, "server: -replay needs -replay-target to be an http or https URL, not %q\n", target)
+		return 2
+	}
+	if speed < 0 {
+		fmt.Fprintln(os.Stderr, "server: -replay-speed can't be negative")
+		return 2
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(names) == 0 {
+		fmt.Fprintf(os.Stderr, "server: -replay: no fixtures in %s\n", dir)
+		return 2
+	}
+	sort.Strings(names)
+
+	// a redirect is the answer we want to compare, not something to follow
+	client := &http.Client{Timeout: 30 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	var first time.Time
+	start := time.Now()
+	sent, failed, differed, skipped := 0, 0, 0, 0
+	for _, name := range names {
+		var f fixture
+		b, err := os.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(b, &f)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "server: -replay: %s: %v\n", filepath.Base(name), err)
+			failed++
+			continue
+		}
+		if f.Truncated {
+			fmt.Fprintf(os.Stderr, "server: -replay: %s: the body was cut off when it was recorded, not sending it\n", filepath.Base(name))
+			failed++
+			continue
+		}
+		if isEventStream(f) {
+			fmt.Printf("SKIP %-6s %s: event stream\n", f.Method, f.URI)
+			skipped++
+			continue
+		}
+		// the gaps are kept from the first request rather than from the one before, so the time
+		// a slow request took doesn't push all the ones after it back
+		if first.IsZero() {
+			first = f.Time
+		} else if speed > 0 {
+			due := start.Add(time.Duration(float64(f.Time.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+
+		req, err := replayRequest(base, f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "server: -replay: %s: %v\n", filepath.Base(name), err)
+			failed++
+			continue
+		}
+		sent++
+		t := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("ERR %-6s %s: %v\n", f.Method, f.URI, err)
+			failed++
+			continue
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		d := time.Since(t)
+		mark := ""
+		if resp.StatusCode != f.Status {
+			mark = fmt.Sprintf(" (recorded %d)", f.Status)
+			differed++
+		}
+		fmt.Printf("%d %-6s %s %dB %v%s\n", resp.StatusCode, f.Method, f.URI, n, d.Round(time.Millisecond), mark)
+	}
+	fmt.Printf("%d sent in %v, %d failed, %d with a different status, %d skipped\n",
+		sent, time.Since(start).Round(time.Millisecond), failed, differed, skipped)
+	if failed > 0 || differed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// isEventStream says whether f was a Server-Sent Events request: it got a stream back, or it
+// asked for one the way EventSource does
+func isEventStream(f fixture) bool {
+	ct, _, _ := mime.ParseMediaType(f.ContentType)
+	return ct == "text/event-stream" || strings.Contains(f.Header.Get("Accept"), "text/event-stream")
+}
+
+// replayRequest builds the request f recorded, aimed at base: its path goes after base's, so a
+// target of http://host/v2 sends a recorded /kv/a to http://host/v2/kv/a
+func replayRequest(base *url.URL, f fixture) (*http.Request, error) {
+	recorded, err := url.ParseRequestURI(f.URI)
+	if err != nil {
+		return nil, err
+	}
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + recorded.Path
+	u.RawPath = ""
+	u.RawQuery = recorded.RawQuery
+	body := []byte(f.Body)
+	if f.Base64 {
+		if body, err = base64.StdEncoding.DecodeString(f.Body); err != nil {
+			return nil, fmt.Errorf("body: %v", err)
+		}
+	}
+	req, err := http.NewRequest(f.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = f.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	if len(body) == 0 {
+		// a GET with an empty Body would otherwise go out with Content-Length: 0
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	return req, nil
+}
+
+// requestLogger is the default logger with the request's ID attached.
+func requestLogger(r *http.Request) *slog.Logger {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return slog.Default().With("request_id", id)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status code a handler wrote and how much body came after it,
+// so the middleware can log them.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes through to the real writer, /slowbody needs it to stream.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// config is the part of the setup that can change while the server runs. handlers get it
+// through cfg() on every request, and a reload swaps in a whole new one, so a request never
+// sees half of an old config and half of a new one.
+type config struct {
+	logLevel   slog.Level
+	maxBody    int64
+	corsOrigin string
+	limiter    *rateLimiter     // nil without -rate-limit and -rate-limit-route
+	static     *staticFiles     // nil without -root
+	cert       *tls.Certificate // nil without -tls-cert
+	authUser   string           // user:password, "" for no Basic auth
+	apiKey     string
+	protect    []string
+}
+
+var current atomic.Pointer[config]
+
+var logLevel = new(slog.LevelVar)
+
+func cfg() *config {
+	return current.Load()
+}
+
+// apply makes c the config and closes the old one's -root. a request that is serving a file
+// from the old root right now has the file open already, and an open file outlives its Root.
+func apply(c *config) {
+	logLevel.Set(c.logLevel)
+	if old := current.Swap(c); old != nil && old.static != nil {
+		old.static.root.Close()
+	}
+}
+
+// loadConfig starts from the flags, then lets SERVER_LOG_LEVEL, SERVER_MAX_BODY and
+// SERVER_CORS_ORIGIN override them, first from the environment and then from -env-file.
+// a process can't have its environment changed from outside, so the file is the part
+// worth editing before a SIGHUP.
+//
+// with -config the flags are what the command line and the file say together, the file being
+// read again each time. the settings that can change this way are log-level, max-body,
+// cors-origin, the rate limits, root and dir-listing, and the certificate in tls-cert and
+// tls-key. the listeners and the log handler are only set up once, anything else that changed
+// is logged as needing a restart
+func loadConfig() (*config, error) {
+	setting := func(name string) string { return Flags.Lookup(name).Value.String() }
+	routes := routeLimits
+	level := slog.LevelInfo
+	if *configFile != "" {
+		file, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		setting = func(name string) string {
+			f := Flags.Lookup(name)
+			if vals, ok := file[name]; ok && !cmdline[name] {
+				return vals[len(vals)-1]
+			}
+			if cmdline[name] {
+				return f.Value.String()
+			}
+			return f.DefValue
+		}
+		if !cmdline["rate-limit-route"] {
+			routes = limitFlag{}
+			for _, v := range file["rate-limit-route"] {
+				if err := routes.Set(v); err != nil {
+					return nil, fmt.Errorf("rate-limit-route: %v", err)
+				}
+			}
+		}
+		if vals, ok := file["log-level"]; ok {
+			if err := level.UnmarshalText([]byte(vals[0])); err != nil {
+				return nil, fmt.Errorf("log-level: %v", err)
+			}
+		}
+		warnRestart(file)
+	}
+	maxBodySetting, err := strconv.ParseInt(setting("max-body"), 10, 64)
+	if err != nil || maxBodySetting <= 0 {
+		return nil, fmt.Errorf("max-body: %q is not a positive number of bytes", setting("max-body"))
+	}
+	c := &config{logLevel: level, maxBody: maxBodySetting, corsOrigin: setting("cors-origin"),
+		authUser: setting("auth-user"), apiKey: setting("api-key")}
+	for _, p := range strings.Split(setting("protect"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			c.protect = append(c.protect, p)
+		}
+	}
+
+	if c.limiter, err = newRateLimiter(setting("rate-limit"), routes, setting("trusted-proxies")); err != nil {
+		return nil, err
+	}
+	// a new limiter starts every client with a full bucket, so one that is the same as before is
+	// kept, or a client being held back would be let off every time the config is reloaded
+	if old := cfg(); old != nil && c.limiter.sameLimits(old.limiter) {
+		c.limiter = old.limiter
+	}
+	cert, key := setting("tls-cert"), setting("tls-key")
+	if (cert == "") != (*tlsCert == "") {
+		// same for the HTTPS listener
+		slog.Warn("setting needs a restart to change", "key", "tls-cert", "value", cert)
+		cert, key = *tlsCert, *tlsKey
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("tls-cert: %v", err)
+		}
+		c.cert = &pair
+	}
+	if c.authUser != "" && !strings.Contains(c.authUser, ":") {
+		return nil, errors.New("auth-user wants user:password")
+	}
+
+	settings := make(map[string]string)
+	for _, key := range []string{"SERVER_LOG_LEVEL", "SERVER_MAX_BODY", "SERVER_CORS_ORIGIN", "SERVER_AUTH_USER", "SERVER_API_KEY"} {
+		if v, ok := os.LookupEnv(key); ok {
+			settings[key] = v
+		}
+	}
+	if *envFile != "" {
+		data, err := os.ReadFile(*envFile)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", *envFile, i+1)
+			}
+			settings[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	for k, v := range settings {
+		switch k {
+		case "SERVER_LOG_LEVEL":
+			if err := c.logLevel.UnmarshalText([]byte(v)); err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+		case "SERVER_MAX_BODY":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%s: %q is not a positive number of bytes", k, v)
+			}
+			c.maxBody = n
+		case "SERVER_CORS_ORIGIN":
+			c.corsOrigin = v
+		case "SERVER_AUTH_USER":
+			// checked like -auth-user, or a value without its colon would lock everyone out
+			if v != "" && !strings.Contains(v, ":") {
+				return nil, fmt.Errorf("%s wants user:password", k)
+			}
+			c.authUser = v
+		case "SERVER_API_KEY":
+			c.apiKey = v
+		case "SERVER_LOG_FORMAT":
+			// the log handler is built once in main, so this one needs a restart
+			if v != *logFormat {
+				slog.Warn("setting needs a restart to change", "key", k, "value", v)
+			}
+		default:
+			slog.Warn("unknown setting, ignored", "key", k)
+		}
+	}
+
+	// the root is opened last, so a reload that fails on anything else doesn't leave one open
+	root, listing := setting("root"), setting("dir-listing") == "true"
+	if (root == "") != (*staticRoot == "") {
+		// /static/ is only there when it was at the start
+		slog.Warn("setting needs a restart to change", "key", "root", "value", root)
+		root = *staticRoot
+	}
+	if root != "" {
+		if c.static, err = openStatic(root, listing); err != nil {
+			return nil, fmt.Errorf("root: %v", err)
+		}
+	} else if listing {
+		return nil, errors.New("dir-listing needs root")
+	}
+	return c, nil
+}
+
+// cmdline are the flags given on the command line, by their long names. the -config file
+// doesn't get to change those, at the start or on a reload
+var cmdline = make(map[string]bool)
+
+// flagAliases are the short names that set the same variable as a long one. a setting is
+// always talked about by its long name, whichever one was used
+var flagAliases = map[string]string{"cert": "tls-cert", "key": "tls-key"}
+
+// reloadable are the settings loadConfig takes from the file again on SIGHUP.
+var reloadable = map[string]bool{
+	"log-level": true, "max-body": true, "cors-origin": true, "rate-limit": true, "rate-limit-route": true,
+	"trusted-proxies": true, "root": true, "dir-listing": true, "tls-cert": true, "tls-key": true,
+	"auth-user": true, "api-key": true, "protect": true,
+}
+
+// readConfigFile reads the -config file into the values flag.Set would be given for each
+// setting, more than one for a list like rate-limit-route. a name that isn't a flag is an
+// error, so a typo doesn't go unnoticed. log-level is the one setting that has no flag
+func readConfigFile(name string) (map[string][]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	d := json.NewDecoder(bytes.NewReader(data))
+	// numbers stay as they were written, 1048576 shouldn't come back as 1.048576e+06
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	settings := make(map[string][]string)
+	for k, v := range raw {
+		if long, ok := flagAliases[k]; ok {
+			k = long
+		}
+		if k == "config" || k != "log-level" && Flags.Lookup(k) == nil {
+			return nil, fmt.Errorf("%s: %q is not a setting", name, k)
+		}
+		list, ok := v.([]any)
+		if !ok {
+			list = []any{v}
+		}
+		for _, item := range list {
+			switch item := item.(type) {
+			case string:
+				settings[k] = append(settings[k], item)
+			case json.Number, bool:
+				settings[k] = append(settings[k], fmt.Sprint(item))
+			default:
+				return nil, fmt.Errorf("%s: %s wants a string, number or boolean, or a list of them", name, k)
+			}
+		}
+		if len(settings[k]) == 0 {
+			return nil, fmt.Errorf("%s: %s is an empty list", name, k)
+		}
+	}
+	return settings, nil
+}
+
+// applyConfigFile sets the flags the command line left alone from the -config file, before
+// anything has read them. flag.Set checks each value like it would on the command line
+func applyConfigFile(name string) error {
+	Flags.Visit(func(f *flag.Flag) {
+		long := f.Name
+		if l, ok := flagAliases[long]; ok {
+			long = l
+		}
+		cmdline[long] = true
+	})
+	file, err := readConfigFile(name)
+	if err != nil {
+		return err
+	}
+	for k, vals := range file {
+		if cmdline[k] || k == "log-level" {
+			continue
+		}
+		for _, v := range vals {
+			if err := Flags.Set(k, v); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// warnRestart logs the settings in file that differ from what the server is running with
+// but only take effect at the start.
+func warnRestart(file map[string][]string) {
+	for k, vals := range file {
+		if reloadable[k] || cmdline[k] {
+			continue
+		}
+		if v := vals[len(vals)-1]; v != Flags.Lookup(k).Value.String() {
+			slog.Warn("setting needs a restart to change", "key", k, "value", v)
+		}
+	}
+}
+
+// reloadOnHangup reads the config again every time the process gets a SIGHUP. open
+// connections are left alone, a bad file is logged and the old config stays in place.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, err := loadConfig()
+		if err != nil {
+			slog.Error("reload failed, keeping the old config", "err", err)
+			continue
+		}
+		apply(c)
+		slog.Info("config reloaded", "log_level", c.logLevel, "max_body", c.maxBody, "cors_origin", c.corsOrigin,
+			"rate_limited", c.limiter != nil)
+	}
+}
@@ -0,0 +1,1173 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain gives the handlers the config the flags' defaults make, which Main would have
+// applied before serving anything
+func TestMain(m *testing.M) {
+	c, err := loadConfig()
+	if err != nil {
+		panic(err)
+	}
+	apply(c)
+	// the tests look at what the handlers answer, what they log is only noise in go test -v
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	accessLog = slog.Default()
+	os.Exit(m.Run())
+}
+
+// withConfig runs the rest of the test with the config change makes to a copy of the current one
+func withConfig(t *testing.T, change func(c *config)) {
+	t.Helper()
+	old := cfg()
+	c := *old
+	change(&c)
+	current.Store(&c)
+	t.Cleanup(func() { current.Store(old) })
+}
+
+// setFlag sets the flag name for the rest of the test
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := Flags.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// serve sends req to h and returns what it answered
+func serve(h http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+// testRoutes puts a GET-only and a POST and PUT endpoint on the default mux through handle, the
+// way Main puts the real ones there. once, since the mux panics on a pattern registered twice
+var testRoutes = sync.OnceFunc(func() {
+	handle("GET", "/test/get", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "got") })
+	handle("POST PUT", "/test/write", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "wrote") })
+})
+
+// route sends req through the default mux
+func route(req *http.Request) *httptest.ResponseRecorder {
+	testRoutes()
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	return w
+}
+
+func TestMaxBody(t *testing.T) {
+	withConfig(t, func(c *config) { c.maxBody = 10 })
+	tests := []struct {
+		name string
+		h    http.HandlerFunc
+		body string
+		want int
+	}{
+		{"/", handler, "0123456789", http.StatusOK},
+		{"/", handler, "0123456789a", http.StatusRequestEntityTooLarge},
+		{"/raw", rawDump, "0123456789", http.StatusOK},
+		{"/raw", rawDump, "0123456789a", http.StatusRequestEntityTooLarge},
+		{"/echo", echo, "0123456789", http.StatusOK},
+		{"/echo", echo, "0123456789a", http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.name, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "text/plain")
+		if w := serve(tt.h, req); w.Code != tt.want {
+			t.Errorf("%s with %d bytes: %d, want %d", tt.name, len(tt.body), w.Code, tt.want)
+		}
+	}
+}
+
+func TestFixtureSlug(t *testing.T) {
+	tests := []struct{ uri, want string }{
+		{"/", ""},
+		{"/?x=1", ""},
+		{"/count", "-count"},
+		{"/kv/a%20b?x=1", "-kv-a_20b"},
+		{"/static/site.css", "-static-site.css"},
+		{"/a//b/", "-a--b"},
+		{"/ünï", "-__n__"},
+		{"/" + strings.Repeat("x", 100), "-" + strings.Repeat("x", 59)},
+	}
+	for _, tt := range tests {
+		if got := fixtureSlug(tt.uri); got != tt.want {
+			t.Errorf("fixtureSlug(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestReplayRequest(t *testing.T) {
+	tests := []struct{ target, uri, want string }{
+		{"http://host", "/kv/a?x=1", "http://host/kv/a?x=1"},
+		{"http://host/", "/kv/a", "http://host/kv/a"},
+		{"http://host/v2", "/kv/a", "http://host/v2/kv/a"},
+		{"https://host:8443/v2/", "/", "https://host:8443/v2/"},
+	}
+	for _, tt := range tests {
+		base, _ := url.Parse(tt.target)
+		f := fixture{Method: "PUT", URI: tt.uri, Body: "hi",
+			Header: http.Header{"X-Test": {"1"}, "Connection": {"close"}, "Content-Length": {"99"}}}
+		req, err := replayRequest(base, f)
+		if err != nil {
+			t.Errorf("replayRequest(%s, %s): %v", tt.target, tt.uri, err)
+			continue
+		}
+		if req.URL.String() != tt.want {
+			t.Errorf("replayRequest(%s, %s) goes to %s, want %s", tt.target, tt.uri, req.URL, tt.want)
+		}
+		if req.Header.Get("X-Test") != "1" || req.Header.Get("Connection") != "" || req.ContentLength != 2 {
+			t.Errorf("replayRequest(%s, %s) has headers %v and length %d", tt.target, tt.uri, req.Header, req.ContentLength)
+		}
+	}
+}
+
+// what -record writes, -replay sends again: the same methods, paths and bodies, and the
+// recorded statuses to compare with
+func TestRecordReplay(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.RequestURI()+" "+string(b))
+		mu.Unlock()
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	})
+	dir := t.TempDir()
+	rec, err := newRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := httptest.NewServer(recordRequests(rec, h))
+	defer recording.Close()
+	for _, r := range []struct{ method, path, body string }{
+		{"GET", "/a?x=1", ""}, {"POST", "/echo", "hello"}, {"GET", "/missing", ""},
+	} {
+		req, _ := http.NewRequest(r.method, recording.URL+r.path, strings.NewReader(r.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	recorded := slices.Clone(got)
+	got = nil
+
+	target := httptest.NewServer(h)
+	defer target.Close()
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	status := replay(dir, target.URL, 0)
+	os.Stdout.Close()
+	os.Stdout = stdout
+	if status != 0 {
+		t.Errorf("replay returned %d, want 0", status)
+	}
+	if !slices.Equal(got, recorded) {
+		t.Errorf("replayed %q, recorded %q", got, recorded)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	withConfig(t, func(c *config) { c.corsOrigin = "https://app.example" })
+	preflight := func() *http.Request {
+		req := httptest.NewRequest("OPTIONS", "/test/get", nil)
+		req.Header.Set("Origin", "https://app.example")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		return req
+	}
+	get := func() *http.Request {
+		req := httptest.NewRequest("GET", "/test/get", nil)
+		req.Header.Set("Origin", "https://app.example")
+		return req
+	}
+
+	w := route(preflight())
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight without -cors: %d with %v, want a plain 204", w.Code, w.Header())
+	}
+
+	setFlag(t, "cors", "true")
+	w = route(preflight())
+	if w.Code != http.StatusNoContent {
+		t.Errorf("preflight: %d, want 204", w.Code)
+	}
+	for k, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("preflight %s = %q, want %q", k, got, want)
+		}
+	}
+
+	w = route(get())
+	if w.Code != http.StatusOK || w.Body.String() != "got" {
+		t.Errorf("GET: %d %q, want 200 got", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("GET Access-Control-Allow-Origin = %q, want https://app.example", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("GET Vary = %q, want Origin", got)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         int
+		allow        string
+	}{
+		{"GET", "/test/get", http.StatusOK, ""},
+		{"HEAD", "/test/get", http.StatusOK, ""},
+		{"POST", "/test/get", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"DELETE", "/test/get", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"OPTIONS", "/test/get", http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{"PUT", "/test/write", http.StatusOK, ""},
+		{"GET", "/test/write", http.StatusMethodNotAllowed, "POST, PUT, OPTIONS"},
+	}
+	for _, tt := range tests {
+		w := route(httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want || w.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s: %d with Allow %q, want %d with %q", tt.method, tt.path, w.Code, w.Header().Get("Allow"), tt.want, tt.allow)
+		}
+	}
+}
+
+func TestSlowBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(slowBody))
+	defer srv.Close()
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "?size=300&rate=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	headers := time.Since(start)
+	b, err := io.ReadAll(resp.Body)
+	total := time.Since(start)
+	if err != nil || len(b) != 300 || resp.ContentLength != 300 {
+		t.Fatalf("got %d bytes, Content-Length %d, %v, want 300", len(b), resp.ContentLength, err)
+	}
+	// 100 bytes a tick: the first straight away and the other two a tick apart
+	if headers > 100*time.Millisecond || total < 200*time.Millisecond {
+		t.Errorf("headers after %v and the body after %v, want the headers at once and the body in 200ms or more", headers, total)
+	}
+
+	for _, q := range []string{"size=-1", "rate=0", "rate=x"} {
+		if w := serve(slowBody, httptest.NewRequest("GET", "/slowbody?"+q, nil)); w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: %d, want 400", q, w.Code)
+		}
+	}
+}
+
+// what /raw sends back can be read as a request again, with every header and the body intact
+func TestRawDump(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(rawDump))
+	defer srv.Close()
+	req, _ := http.NewRequest("POST", srv.URL+"/raw?x=1", strings.NewReader("a=1&b=2"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("X-Multi", "one")
+	req.Header.Add("X-Multi", "two")
+	req.Header.Set("Authorization", "Bearer t")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dump, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/raw: %d %s", resp.StatusCode, dump)
+	}
+	back, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(dump)))
+	if err != nil {
+		t.Fatalf("reading the dump back: %v\n%s", err, dump)
+	}
+	body, _ := io.ReadAll(back.Body)
+	if back.Method != "POST" || back.RequestURI != "/raw?x=1" || string(body) != "a=1&b=2" {
+		t.Errorf("dump came back as %s %s with body %q", back.Method, back.RequestURI, body)
+	}
+	for _, k := range []string{"Content-Type", "X-Multi", "Authorization"} {
+		if !slices.Equal(back.Header[k], req.Header[k]) {
+			t.Errorf("%s came back as %q, sent %q", k, back.Header[k], req.Header[k])
+		}
+	}
+}
+
+func TestFormOrder(t *testing.T) {
+	dump := func() string {
+		req := httptest.NewRequest("POST", "/?z=2&z=1", strings.NewReader("c=3&a=1&b=2&a=0"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-B", "b")
+		req.Header.Set("X-A", "a")
+		return serve(handler, req).Body.String()
+	}
+	first := dump()
+	var form, headers []string
+	for _, line := range strings.Split(first, "\n") {
+		switch {
+		case strings.HasPrefix(line, "Form["):
+			form = append(form, line)
+		case strings.HasPrefix(line, "Header["):
+			headers = append(headers, line)
+		}
+	}
+	want := []string{`Form["a"] = ["0" "1"]`, `Form["b"] = ["2"]`, `Form["c"] = ["3"]`, `Form["z"] = ["1" "2"]`}
+	if !slices.Equal(form, want) {
+		t.Errorf("form lines are\n%s\nwant\n%s", strings.Join(form, "\n"), strings.Join(want, "\n"))
+	}
+	if !slices.IsSorted(headers) {
+		t.Errorf("header lines aren't sorted:\n%s", strings.Join(headers, "\n"))
+	}
+	for range 5 {
+		if again := dump(); again != first {
+			t.Fatalf("the same request gave\n%s\nand then\n%s", first, again)
+		}
+	}
+}
+
+func TestEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(echo))
+	defer srv.Close()
+	tests := []struct{ ctype, body string }{
+		{"application/json", `{"a": [1, 2]}`},
+		{"application/octet-stream", "\x00\xff\x01 binary"},
+		{"", "no type"},
+		{"text/plain", ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(srv.URL, tt.ctype, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tt.body {
+			t.Errorf("echo of %q came back as %q", tt.body, b)
+		}
+		if tt.ctype != "" && resp.Header.Get("Content-Type") != tt.ctype {
+			t.Errorf("echo of a %s body came back as %s", tt.ctype, resp.Header.Get("Content-Type"))
+		}
+		if resp.ContentLength != int64(len(tt.body)) {
+			t.Errorf("echo of %q has Content-Length %d", tt.body, resp.ContentLength)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	old := accessLog
+	accessLog = slog.New(slog.NewJSONHandler(&buf, nil))
+	t.Cleanup(func() { accessLog = old })
+
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "tea")
+	}))
+	req := httptest.NewRequest("GET", "/pot?x=1", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get("X-Request-Id"); got != "abc123" {
+		t.Errorf("X-Request-Id sent back as %q, want abc123", got)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q: %v", buf.String(), err)
+	}
+	want := map[string]any{"msg": "request", "method": "GET", "path": "/pot", "status": 418.0,
+		"bytes": 3.0, "request_id": "abc123", "remote_addr": "192.0.2.1:1234"}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %v", k, line[k], v)
+		}
+	}
+	for _, k := range []string{"time", "level", "duration"} {
+		if _, ok := line[k]; !ok {
+			t.Errorf("no %s in %s", k, buf.String())
+		}
+	}
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	env := filepath.Join(t.TempDir(), "server.env")
+	if err := os.WriteFile(env, []byte("SERVER_MAX_BODY=100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "env-file", env)
+	withConfig(t, func(*config) {})
+	// a SIGHUP nobody is listening for kills the process, this keeps it alive until
+	// reloadOnHangup has started listening too
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go reloadOnHangup()
+
+	for _, want := range []int64{100, 200} {
+		if err := os.WriteFile(env, []byte(fmt.Sprintf("SERVER_MAX_BODY=%d\n", want)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// sent until it works, the first one can come before reloadOnHangup is listening
+		deadline := time.Now().Add(5 * time.Second)
+		for cfg().maxBody != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("max body is still %d after SIGHUP, want %d", cfg().maxBody, want)
+			}
+			syscall.Kill(os.Getpid(), syscall.SIGHUP)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestShed(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := shed(2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() { h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) })
+		<-started
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("with both slots taken: %d with Retry-After %q, want a 503 with one", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	wg.Wait()
+	// a slot is free again once a slow request is done
+	go func() { <-started }()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("after the slow requests finished: %d, want 200", w.Code)
+	}
+}
+
+// the same state has to give the same bytes every time, or snapshots and caches see a change
+// where there is none. maps go through sorted keys on the way out, this catches one that doesn't
+func TestStableOutput(t *testing.T) {
+	for i, path := range []string{"/a", "/b", "/c", "/d"} {
+		metrics.observe("GET", path, 200+i, time.Duration(i)*time.Millisecond)
+		metrics.observe("POST", path, 500, time.Millisecond)
+	}
+	form := func() *http.Request {
+		req := httptest.NewRequest("POST", "/?format=json&z=1&a=2", strings.NewReader("c=3&b=2&a=1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, k := range []string{"X-D", "X-C", "X-B", "X-A"} {
+			req.Header.Add(k, "2")
+			req.Header.Add(k, "1")
+		}
+		return req
+	}
+	get := func(target string) func() *http.Request {
+		return func() *http.Request { return httptest.NewRequest("GET", target, nil) }
+	}
+	tests := []struct {
+		h   http.HandlerFunc
+		req func() *http.Request
+	}{
+		{handler, form},
+		{counter, get("/count?format=json")},
+		{metricsHandler, get("/metrics")},
+		{metricsHandler, get("/metrics?format=prometheus")},
+	}
+	for _, tt := range tests {
+		first := serve(tt.h, tt.req()).Body.String()
+		for range 10 {
+			if again := serve(tt.h, tt.req()).Body.String(); again != first {
+				t.Errorf("%s gave\n%s\nand then\n%s", tt.req().URL, first, again)
+				break
+			}
+		}
+	}
+}
+
+// shutdownServer runs shutdownOnSignal for srv, closing the channel it returns once it is done.
+// a SIGTERM that nobody is listening for kills the process, so one is caught here as well until
+// shutdownOnSignal has its own. the state a shutdown leaves behind is put back after the test
+func shutdownServer(t *testing.T, srv *httptest.Server) <-chan struct{} {
+	t.Helper()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	t.Cleanup(func() {
+		signal.Stop(sig)
+		draining.Store(false)
+		live.mu.Lock()
+		live.closed = false
+		live.mu.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		shutdownOnSignal(srv.Config)
+		close(done)
+	}()
+	return done
+}
+
+// get fetches url and returns the status, or 0 when the request failed
+func get(url string) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDrain(t *testing.T) {
+	setFlag(t, "drain-delay", "300ms")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/healthz", healthz)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	if got := get(srv.URL + "/readyz"); got != http.StatusOK {
+		t.Fatalf("/readyz before shutdown: %d, want 200", got)
+	}
+
+	done := shutdownServer(t, srv)
+	for !draining.Load() {
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		time.Sleep(10 * time.Millisecond)
+	}
+	// still inside -drain-delay: the server is up but says it doesn't want more
+	if got := get(srv.URL + "/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while draining: %d, want 503", got)
+	}
+	if got := get(srv.URL + "/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz while draining: %d, want 200", got)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't shut down after -drain-delay")
+	}
+	if got := get(srv.URL + "/healthz"); got != 0 {
+		t.Errorf("/healthz after shutdown: %d, want no answer", got)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	old := stats
+	stats = &requestStats{paths: make(map[string]int)}
+	t.Cleanup(func() { stats = old })
+	setFlag(t, "dashboard-refresh", "7")
+	stats.record("/a", 200, time.Millisecond)
+	stats.record("/a", 404, time.Millisecond)
+	stats.record(`/<script>alert("x")</script>`, 200, time.Millisecond)
+
+	w := serve(dashboard, httptest.NewRequest("GET", "/dashboard", nil))
+	page := w.Body.String()
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("/dashboard: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"<h1>3 requests</h1>",
+		"<tr><td>/a</td><td>2</td></tr>",
+		`<meta http-equiv="refresh" content="7">`,
+		"&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the page has no %s:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Errorf("a path went into the page unescaped:\n%s", page)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(upload))
+	defer srv.Close()
+	setFlag(t, "max-upload", "1000")
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"hello\n", http.StatusOK},
+		{strings.Repeat("x", 1000), http.StatusOK},
+		{strings.Repeat("x", 1001), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		// a reader with no Len, so the body is chunked and only the limit while reading can stop it
+		resp, err := http.Post(srv.URL, "application/octet-stream", io.MultiReader(strings.NewReader(tt.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Bytes  int64  `json:"bytes"`
+			SHA256 string `json:"sha256"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%d bytes: %d, want %d", len(tt.body), resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		sum := sha256.Sum256([]byte(tt.body))
+		if err != nil || got.Bytes != int64(len(tt.body)) || got.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%d bytes: got %+v, %v, want %d and %x", len(tt.body), got, err, len(tt.body), sum)
+		}
+	}
+}
+
+func TestCountSince(t *testing.T) {
+	countOf := func(target string) int {
+		w := serve(counter, httptest.NewRequest("GET", target, nil))
+		var got struct{ Count int }
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %d %s", target, w.Code, w.Body)
+		}
+		return got.Count
+	}
+	if w := serve(countSnapshot, httptest.NewRequest("POST", "/count/snapshot?name=before", nil)); w.Code != http.StatusOK {
+		t.Fatalf("snapshot: %d %s", w.Code, w.Body)
+	}
+	before := countOf("/count?format=json")
+	for range 3 {
+		serve(handler, httptest.NewRequest("GET", "/", nil))
+	}
+	if got := countOf("/count?format=json&since=before"); got != 3 {
+		t.Errorf("count since the snapshot = %d, want 3", got)
+	}
+	if got := countOf("/count?format=json"); got != before+3 {
+		t.Errorf("count = %d, want %d", got, before+3)
+	}
+	// the samples go back to the start of the test at least, so an hour ago is the whole count
+	if got := countOf("/count?format=json&since=1h"); got != before+3 {
+		t.Errorf("count since an hour ago = %d, want %d", got, before+3)
+	}
+	if w := serve(counter, httptest.NewRequest("GET", "/count?since=nonsense", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("?since=nonsense: %d, want 400", w.Code)
+	}
+}
+
+func TestSampleRing(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var s sampleRing
+	for i := range 3 {
+		s.add(start.Add(time.Duration(i)*time.Second), 10*(i+1))
+	}
+	// a second sample in the same second replaces the one before
+	s.add(start.Add(2*time.Second+time.Millisecond), 35)
+	tests := []struct {
+		at   time.Duration
+		want int
+		ok   bool
+	}{
+		{-time.Second, 0, true},
+		{0, 10, true},
+		{1500 * time.Millisecond, 20, true},
+		{time.Hour, 35, true},
+	}
+	for _, tt := range tests {
+		if got, ok := s.at(start.Add(tt.at)); got != tt.want || ok != tt.ok {
+			t.Errorf("at(start%+v) = %d, %v, want %d, %v", tt.at, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// once the ring has wrapped, what came before its oldest sample is gone
+	for i := range sampleSize {
+		s.add(start.Add(time.Duration(10+i)*time.Second), i)
+	}
+	if _, ok := s.at(start); ok {
+		t.Error("at(start) worked after the ring wrapped")
+	}
+}
+
+func TestServeUnix(t *testing.T) {
+	// not t.TempDir, its path can be longer than the 108 bytes a socket path may have
+	dir, err := os.MkdirTemp("", "unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "s")
+
+	// what a crashed server leaves behind: the socket file with nobody listening on it
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	srv := &http.Server{Handler: http.HandlerFunc(healthz)}
+	served := make(chan error, 1)
+	go func() { served <- serveUnix(srv, path) }()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	for range 100 {
+		if resp, err = client.Get("http://unix/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok\n" {
+		t.Errorf("over the socket: %d %q, want 200 \"ok\\n\"", resp.StatusCode, body)
+	}
+
+	srv.Close()
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("serveUnix returned %v, want ErrServerClosed", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket is still there after the server closed: %v", err)
+	}
+
+	// a file that isn't a socket is somebody else's, it is left alone
+	if err := os.WriteFile(path, []byte("mine"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := serveUnix(&http.Server{}, path); err == nil {
+		t.Error("serveUnix took over a regular file")
+	}
+	if b, _ := os.ReadFile(path); string(b) != "mine" {
+		t.Errorf("the regular file became %q", b)
+	}
+}
+
+func TestIdleShutdown(t *testing.T) {
+	setFlag(t, "idle-shutdown", "100ms")
+	release := make(chan struct{})
+	srv := httptest.NewServer(logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})))
+	defer srv.Close()
+
+	// a request that runs longer than -idle-shutdown keeps the server up
+	got := make(chan int)
+	go func() { got <- get(srv.URL) }()
+	for inFlight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := shutdownServer(t, srv)
+	select {
+	case <-done:
+		t.Fatal("shut down with a request still running")
+	case <-time.After(300 * time.Millisecond):
+	}
+	close(release)
+	if status := <-got; status != http.StatusOK {
+		t.Errorf("the slow request: %d, want 200", status)
+	}
+
+	// and once it is done, nothing more comes in
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't shut down after going idle")
+	}
+	if !draining.Load() {
+		t.Error("not draining after the idle shutdown")
+	}
+	if status := get(srv.URL); status != 0 {
+		t.Errorf("after the idle shutdown: %d, want no answer", status)
+	}
+}
+
+// selfSigned writes a certificate for 127.0.0.1 and its key into dir and returns their paths
+// and a pool with the certificate in it, for a client that should trust it
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	certFile, keyFile, pool := selfSigned(t, t.TempDir())
+	setFlag(t, "tls-cert", certFile)
+	setFlag(t, "tls-key", keyFile)
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cert == nil {
+		t.Fatal("loadConfig didn't load -tls-cert")
+	}
+	withConfig(t, func(cur *config) { cur.cert = c.cert })
+
+	// the HTTPS listener the way Main sets it up, with the certificate taken from cfg()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsSrv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s over TLS: %v", r.URL.RequestURI(), r.TLS != nil)
+	})}
+	tlsSrv.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cfg().cert, nil
+	}}
+	go tlsSrv.ServeTLS(l, "", "")
+	defer tlsSrv.Close()
+
+	plain := httptest.NewServer(redirectToHTTPS(l.Addr().String()))
+	defer plain.Close()
+	var hops []string
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			hops = append(hops, req.URL.String())
+			return nil
+		},
+	}
+	resp, err := client.Get(plain.URL + "/a/b?c=d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	want := "https://" + l.Addr().String() + "/a/b?c=d"
+	if len(hops) != 1 || hops[0] != want {
+		t.Errorf("redirected to %q, want [%q]", hops, want)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "/a/b?c=d over TLS: true" {
+		t.Errorf("after the redirect: %d %q", resp.StatusCode, body)
+	}
+
+	// the plain listener answers the redirect itself with a 307, which keeps the method and body
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = noFollow.Post(plain.URL+"/upload", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("POST over plain HTTP: %d, want 307", resp.StatusCode)
+	}
+}
+
+func TestDedupHeaders(t *testing.T) {
+	req := func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Add("Accept", "text/html")
+		r.Header.Add("Accept", "application/json;q=0.5")
+		r.Header.Add("Cookie", "a=1")
+		r.Header.Add("Cookie", "b=2")
+		// set straight into the map, as net/http does for a name it doesn't canonicalize
+		r.Header["x-odd"] = []string{"1"}
+		r.Header["X-Odd"] = []string{"2"}
+		return r
+	}
+	tests := []struct {
+		dedup     string
+		want, not []string
+	}{
+		{"false", []string{
+			`Header["Accept"] = ["application/json;q=0.5" "text/html"]`,
+			`Header["X-Odd"] = ["2"]`,
+			`Header["x-odd"] = ["1"]`,
+		}, []string{"sent"}},
+		{"true", []string{
+			`Header["Accept"] = "text/html, application/json;q=0.5" (sent 2 times)`,
+			// Cookie is in -redact by default, but the ; it is joined with still shows
+			`Header["Cookie"] = "[redacted]; [redacted]" (sent 2 times)`,
+		}, []string{`"x-odd"`}},
+	}
+	for _, tt := range tests {
+		setFlag(t, "dedup-headers", tt.dedup)
+		got := serve(handler, req()).Body.String()
+		for _, line := range tt.want {
+			if !strings.Contains(got, line) {
+				t.Errorf("-dedup-headers=%s: no %s in\n%s", tt.dedup, line, got)
+			}
+		}
+		for _, s := range tt.not {
+			if strings.Contains(got, s) {
+				t.Errorf("-dedup-headers=%s: %s in\n%s", tt.dedup, s, got)
+			}
+		}
+	}
+	// the two spellings of X-Odd are one header, sent twice; which came first depends on the map
+	setFlag(t, "dedup-headers", "true")
+	got := serve(handler, req()).Body.String()
+	if !strings.Contains(got, `Header["X-Odd"] = "1, 2" (sent 2 times)`) && !strings.Contains(got, `Header["X-Odd"] = "2, 1" (sent 2 times)`) {
+		t.Errorf("x-odd and X-Odd aren't merged:\n%s", got)
+	}
+}
+
+func TestTrailerDump(t *testing.T) {
+	setFlag(t, "trailer-dump", "true")
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+	tests := []struct {
+		trailer   http.Header
+		want, not []string
+	}{
+		{nil, []string{"no trailers\n"}, []string{"Trailer["}},
+		// X-Later is declared and never given a value, so it shows up empty
+		{http.Header{"X-Checksum": {"abc"}, "X-Later": nil}, []string{`Trailer["X-Checksum"] = ["abc"]`, `Trailer["X-Later"] = []`}, []string{"no trailers"}},
+		{http.Header{"Authorization": {"Bearer secret"}}, []string{`Trailer["Authorization"] = ["[redacted]"]`}, []string{"secret"}},
+	}
+	for _, tt := range tests {
+		// a body of unknown length is sent chunked, which is what a trailer needs
+		req, err := http.NewRequest("POST", srv.URL, io.MultiReader(strings.NewReader("chunked body")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		req.Trailer = tt.trailer
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		got := string(b)
+		for _, s := range tt.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("trailer %v: no %s in\n%s", tt.trailer, s, got)
+			}
+		}
+		for _, s := range tt.not {
+			if strings.Contains(got, s) {
+				t.Errorf("trailer %v: %s in\n%s", tt.trailer, s, got)
+			}
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	hits := make(map[string]int)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Language")
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/star":
+			w.Header().Set("Vary", "*")
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/nocache":
+		default:
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		fmt.Fprintf(w, "%s #%d", r.URL.Path, hits[r.URL.Path])
+	})
+	// room for two, so the third URL pushes out whichever was used longest ago
+	h := cacheResponses(newResponseCache(2), backend)
+
+	tests := []struct {
+		method, path, header string
+		xcache, body         string
+	}{
+		{"GET", "/a", "", "MISS", "/a #1"},
+		{"GET", "/a", "", "HIT", "/a #1"},
+		{"HEAD", "/a", "", "MISS", ""},
+		{"GET", "/a", "Cache-Control: no-store", "MISS", "/a #3"},
+		{"GET", "/a", "Authorization: Bearer x", "MISS", "/a #4"},
+		{"GET", "/a", "Cookie: s=1", "MISS", "/a #5"},
+		{"POST", "/a", "", "MISS", "/a #6"},
+		{"GET", "/a", "", "HIT", "/a #1"},
+		{"GET", "/nostore", "", "MISS", "/nostore #1"},
+		{"GET", "/nostore", "", "MISS", "/nostore #2"},
+		{"GET", "/nocache", "", "MISS", "/nocache #1"},
+		{"GET", "/nocache", "", "MISS", "/nocache #2"},
+		{"GET", "/star", "", "MISS", "/star #1"},
+		{"GET", "/star", "", "MISS", "/star #2"},
+		{"GET", "/vary", "Accept-Language: en", "MISS", "/vary #1"},
+		{"GET", "/vary", "Accept-Language: en", "HIT", "/vary #1"},
+		{"GET", "/vary", "Accept-Language: de", "MISS", "/vary #2"},
+		// /a and HEAD /a were in the cache before /vary, HEAD /a was used longest ago and is gone
+		{"GET", "/a", "", "HIT", "/a #1"},
+		{"GET", "/b", "", "MISS", "/b #1"},
+		// /b pushed out /vary, /a was used after it
+		{"GET", "/a", "", "HIT", "/a #1"},
+		{"GET", "/vary", "Accept-Language: de", "MISS", "/vary #3"},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if k, v, ok := strings.Cut(tt.header, ": "); ok {
+			req.Header.Set(k, v)
+		}
+		w := serve(h.ServeHTTP, req)
+		if got := w.Header().Get("X-Cache"); got != tt.xcache {
+			t.Errorf("%d: %s %s %s: X-Cache %s, want %s", i, tt.method, tt.path, tt.header, got, tt.xcache)
+		}
+		if tt.method != "HEAD" && w.Body.String() != tt.body {
+			t.Errorf("%d: %s %s %s: %q, want %q", i, tt.method, tt.path, tt.header, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"outside/secret.txt": "secret",
+		"root/a.txt":         "0123456789",
+		"root/sub/b.css":     "body{}",
+		"root/.env":          "KEY=secret",
+		"root/.git/config":   "secret",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "root", "out")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openStatic(filepath.Join(dir, "root"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.root.Close()
+	fetch := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		// straight into URL.Path, so nothing on the way gets to clean it up first
+		req.URL.Path = path
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return serve(s.ServeHTTP, req)
+	}
+
+	// what the /static handler gets after StripPrefix, none of which may leave root or show a dotfile
+	for _, p := range []string{
+		"/../outside/secret.txt",
+		"/sub/../../outside/secret.txt",
+		"../outside/secret.txt",
+		"/out/secret.txt",
+		"/out/",
+		"/.env",
+		"/.git/config",
+		"/sub/../.env",
+		"/missing.txt",
+	} {
+		if w := fetch(p); w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("%s: %d %q, want 404", p, w.Code, w.Body.String())
+		}
+	}
+
+	w := fetch("/a.txt")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("/a.txt: %d %s %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Error("/a.txt has no ETag")
+	}
+	if w := fetch("/a.txt", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("/a.txt with its ETag: %d, want 304", w.Code)
+	}
+	if w := fetch("/a.txt", "Range", "bytes=2-4"); w.Code != http.StatusPartialContent || w.Body.String() != "234" ||
+		w.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("/a.txt bytes=2-4: %d %q %s", w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+	}
+	if w := fetch("/sub/b.css"); !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("/sub/b.css is %s", w.Header().Get("Content-Type"))
+	}
+	if w := fetch("/sub"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "sub/" {
+		t.Errorf("/sub: %d to %q, want 301 to sub/", w.Code, w.Header().Get("Location"))
+	}
+
+	w = fetch("/")
+	body := w.Body.String()
+	for _, want := range []string{`href="sub/"`, `href="a.txt"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing has no %s:\n%s", want, body)
+		}
+	}
+	// and the symlink out of root isn't listed either, ServeHTTP would only 404 it
+	if strings.Contains(body, ".env") || strings.Contains(body, ".git") || strings.Contains(body, "out") {
+		t.Errorf("listing shows a dotfile or the symlink:\n%s", body)
+	}
+	s.listing = false
+	if w := fetch("/"); w.Code != http.StatusNotFound {
+		t.Errorf("/ without -dir-listing: %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,394 @@
+// Package fetchlib is the HTTP client fetch-v1 and fetchall share. they fetch in different ways,
+// one URL at a time with its body printed or thousands of them at once, but they connect the same
+// way: the TLS version, the -pin, -resolve, -proxy and -local-addr settings, the phase timeouts and
+// what happens on a redirect are all set up here, so a fix to one of them lands in both.
+package fetchlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options is how a client connects. the zero value is a client like http.DefaultClient, except
+// that it wants TLS 1.2 or newer.
+type Options struct {
+	// Timeout is for the whole request, body included (0 means no limit)
+	Timeout time.Duration
+	// ConnectTimeout is just the TCP connect (0 means the default of 30s), and HeaderTimeout
+	// starts once the request is written and stops when the headers arrive (0 means no limit)
+	ConnectTimeout time.Duration
+	HeaderTimeout  time.Duration
+
+	// TLSMin is the oldest TLS version to accept, "1.2" or "1.3" ("" is 1.2)
+	TLSMin string
+	// ServerName is the TLS server name to send and check the certificate against, "" for the URL's host
+	ServerName string
+	// ServerNameHosts, when there are any, are the hosts ServerName is for. a connection to any other
+	// host, like the one a redirect to another site makes, sends that host's own name as usual
+	ServerNameHosts []string
+	// Pins, when there are any, are the public keys the server's certificate has to have one of
+	Pins Pins
+	// Resolve sends the connections for a host:port to another address
+	Resolve Resolve
+	// LocalAddr is the IP to make connections from, "" lets the system pick
+	LocalAddr string
+	// Proxy is an http://, https:// or socks5:// proxy. "" means the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables, like curl does
+	Proxy string
+
+	// NoKeepAlive opens a fresh connection for every request
+	NoKeepAlive bool
+	// HTTP2 is auto (or ""), on or off. it only ever happens over TLS, plain http:// is always HTTP/1.1.
+	// on makes an https:// response that didn't come over HTTP/2 an error
+	HTTP2 string
+
+	// Redirects is the redirect policy, nil follows up to 10 like net/http does
+	Redirects *Redirects
+}
+
+// NewClient makes the client o describes. its errors are about the option that was wrong, with
+// the name of the flag both programs give it.
+func NewClient(o Options) (*http.Client, error) {
+	t, err := NewTransport(o)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Transport: t, Timeout: o.Timeout}
+	if o.ServerName != "" && len(o.ServerNameHosts) > 0 {
+		// a transport of its own for the other hosts, a tls.Config's name is for every connection
+		// and a connection pool doesn't know what name its connections were made with
+		other := t.Clone()
+		other.TLSClientConfig.ServerName = ""
+		hosts := make(map[string]bool)
+		for _, h := range o.ServerNameHosts {
+			hosts[strings.ToLower(h)] = true
+		}
+		c.Transport = byHost{hosts: hosts, named: t, other: other}
+	}
+	if o.HTTP2 == "on" {
+		c.Transport = requireHTTP2{c.Transport}
+	}
+	if o.Redirects != nil {
+		c.CheckRedirect = o.Redirects.Check
+	}
+	return c, nil
+}
+
+// NewTransport is the transport of NewClient, for a caller that wants to wrap it.
+func NewTransport(o Options) (*http.Transport, error) {
+	if o.TLSMin == "" {
+		o.TLSMin = "1.2"
+	}
+	minVersion, err := ParseTLSVersion(o.TLSMin)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableKeepAlives = o.NoKeepAlive
+	t.TLSClientConfig = &tls.Config{MinVersion: minVersion, ServerName: o.ServerName}
+	if len(o.Pins) > 0 {
+		t.TLSClientConfig.VerifyConnection = o.Pins.verify
+	}
+	// the same settings as the default transport's dialer, plus the connect timeout and the local address
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if o.ConnectTimeout > 0 {
+		dialer.Timeout = o.ConnectTimeout
+	}
+	if o.LocalAddr != "" {
+		ip, err := ParseLocalAddr(o.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	resolve := o.Resolve
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if to, ok := resolve[strings.ToLower(addr)]; ok {
+			addr = to
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	t.ResponseHeaderTimeout = o.HeaderTimeout
+	switch o.HTTP2 {
+	case "", "auto":
+		// the cloned default transport already offers HTTP/2 to TLS servers that want it
+	case "on":
+		// NewClient is what fails a server that won't speak it, this only makes sure it's offered
+		t.ForceAttemptHTTP2 = true
+	case "off":
+		// a non-nil empty map is how net/http is told not to do HTTP/2 at all
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	default:
+		return nil, fmt.Errorf("-http2 must be auto, on or off, not %q", o.HTTP2)
+	}
+	if o.Proxy != "" {
+		u, err := ParseProxy(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	return t, nil
+}
+
+// requireHTTP2 is the round tripper for -http2 on. the transport can only offer HTTP/2, it's the
+// server that picks, so the only way to insist on it is to turn down whatever else comes back
+type requireHTTP2 struct {
+	http.RoundTripper
+}
+
+func (t requireHTTP2) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && req.URL.Scheme == "https" && resp.ProtoMajor != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s answered in %s, and -http2 is on", req.URL.Host, resp.Proto)
+	}
+	return resp, err
+}
+
+// byHost sends the requests for hosts through named, the transport with Options.ServerName in it,
+// and every other request through other.
+type byHost struct {
+	hosts        map[string]bool
+	named, other *http.Transport
+}
+
+func (t byHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hosts[strings.ToLower(req.URL.Hostname())] {
+		return t.named.RoundTrip(req)
+	}
+	return t.other.RoundTrip(req)
+}
+
+// Redirects is what a client does when it gets a redirect.
+type Redirects struct {
+	// Follow false hands the 3xx back as the response, with its body unread, like curl without -L
+	Follow bool
+	// Max is how many redirects are followed before giving up
+	Max int
+	// OnHop, when set, is called for every redirect that is followed, before the limit is checked.
+	// req is the next hop, its Response is the redirect that led there
+	OnHop func(req *http.Request, via []*http.Request)
+}
+
+// Check is the client's CheckRedirect. via is every request made so far, the first one included.
+func (p *Redirects) Check(req *http.Request, via []*http.Request) error {
+	if !p.Follow {
+		return http.ErrUseLastResponse
+	}
+	if p.OnHop != nil && req.Response != nil {
+		p.OnHop(req, via)
+	}
+	if len(via) > p.Max {
+		return fmt.Errorf("stopped after %d redirects (-max-redirs)", p.Max)
+	}
+	return nil
+}
+
+// Result is what came of one request, enough for a status line or a row of a table.
+type Result struct {
+	URL      string // the URL the body came from, after any redirects
+	Status   int    // 0 when there was no response
+	Proto    string
+	Header   http.Header
+	Bytes    int64         // how much of the body was read
+	Duration time.Duration // from sending the request to the end of the body
+	Err      error
+}
+
+// Do sends req, copies the body to w (or throws it away when w is nil) and closes it. a
+// response that isn't 2xx isn't an error here, the caller decides what a 404 means.
+func Do(client *http.Client, req *http.Request, w io.Writer) Result {
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{URL: req.URL.String(), Duration: time.Since(start), Err: err}
+	}
+	return Read(resp, start, w)
+}
+
+// Read is the second half of Do, for a response that was sent some other way. start is when
+// its request was sent.
+func Read(resp *http.Response, start time.Time, w io.Writer) Result {
+	if w == nil {
+		w = io.Discard
+	}
+	n, err := io.Copy(w, resp.Body)
+	resp.Body.Close()
+	r := Result{URL: resp.Request.URL.String(), Status: resp.StatusCode, Proto: resp.Proto,
+		Header: resp.Header, Bytes: n, Duration: time.Since(start)}
+	if err != nil {
+		r.Err = fmt.Errorf("reading %s: %w", r.URL, err)
+	}
+	return r
+}
+
+// ParseTLSVersion turns a -tls-min value into a crypto/tls version.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("-tls-min must be 1.2 or 1.3, not %q", s)
+}
+
+// ParseProxy checks a -proxy URL. the transport knows how to talk to all three kinds itself.
+func ParseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("-proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("-proxy must be an http://, https:// or socks5:// URL, not %q", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("-proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// Resolve is the -resolve list, from "host:port" to the "addr:port" to dial instead. it is a
+// flag.Value, so a program can hand a Resolve{} straight to flag.Var.
+type Resolve map[string]string
+
+func (r Resolve) String() string {
+	var pins []string
+	for from, to := range r {
+		pins = append(pins, from+"="+to)
+	}
+	sort.Strings(pins)
+	return strings.Join(pins, ",")
+}
+
+// Set takes host:port:addr. addr can be an IPv6 address, with or without brackets.
+func (r Resolve) Set(v string) error {
+	host, rest, ok1 := strings.Cut(v, ":")
+	port, addr, ok2 := strings.Cut(rest, ":")
+	if !ok1 || !ok2 || host == "" {
+		return fmt.Errorf("want host:port:addr, not %q", v)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("bad port in %q", v)
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if net.ParseIP(addr) == nil {
+		return fmt.Errorf("%q in %q is not an IP address", addr, v)
+	}
+	r[strings.ToLower(net.JoinHostPort(host, port))] = net.JoinHostPort(addr, port)
+	return nil
+}
+
+// Pins is the -pin list, each a SHA-256 of a certificate's SubjectPublicKeyInfo. with any set,
+// the leaf certificate's public key has to have one of them or the handshake fails, even when
+// the certificate is otherwise fine. the key is pinned and not the certificate, so a renewal
+// that keeps the key still passes. the normal CA check still happens first, pinning only
+// narrows which of the valid certificates are accepted.
+type Pins [][sha256.Size]byte
+
+func (p *Pins) String() string {
+	var s []string
+	for _, pin := range *p {
+		s = append(s, "sha256//"+base64.StdEncoding.EncodeToString(pin[:]))
+	}
+	return strings.Join(s, ",")
+}
+
+// Set takes the hash in base64 (what openssl and curl print) or in hex, with or without sha256//.
+func (p *Pins) Set(v string) error {
+	v = strings.TrimPrefix(v, "sha256//")
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(b) != sha256.Size {
+		b, err = hex.DecodeString(v)
+	}
+	if err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("%q is not a SHA-256 in base64 or hex", v)
+	}
+	*p = append(*p, [sha256.Size]byte(b))
+	return nil
+}
+
+// verify is the VerifyConnection hook for the pins. it runs after the certificate chain has been
+// checked, so the leaf is known to be good for the host and only its key is left to look at.
+func (p Pins) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("-pin: the server sent no certificate")
+	}
+	got := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range p {
+		if got == pin {
+			return nil
+		}
+	}
+	return fmt.Errorf("-pin: the certificate's public key is sha256//%s, which isn't pinned", base64.StdEncoding.EncodeToString(got[:]))
+}
+
+// ServerName is the name -host and -sni put in the TLS handshake, "" to leave it to the URL.
+// a port in host is for the Host header only.
+func ServerName(host, sni string) string {
+	if sni != "" {
+		return sni
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Hosts are the host names of urls, for ServerNameHosts. one that doesn't parse is left out.
+func Hosts(urls []string) []string {
+	var hosts []string
+	for _, s := range urls {
+		if u, err := url.Parse(s); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// ParseLocalAddr checks that a -local-addr is an IP this machine actually has. binding to
+// anything else fails on every connection with a not very helpful "cannot assign requested address".
+func ParseLocalAddr(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("-local-addr must be an IP address, not %q", s)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("-local-addr: %v", err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("-local-addr %s is not an address of this machine", s)
+}
+
+// ExplainTLS adds a hint to handshake errors caused by the server only offering TLS versions
+// older than tlsMin. crypto/tls reports this a few different ways depending on which side
+// notices first, so we go by the message.
+func ExplainTLS(err error, tlsMin string) error {
+	msg := err.Error()
+	if strings.Contains(msg, "protocol version") || strings.Contains(msg, "unsupported protocol") {
+		return fmt.Errorf("%w (the server doesn't offer TLS %s or newer, see -tls-min)", err, tlsMin)
+	}
+	return err
+}
@@ -0,0 +1,454 @@
+package fetchlib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTLSVersion(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseTLSVersion(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"http://proxy:3128", false},
+		{"https://proxy:443", false},
+		{"socks5://127.0.0.1:1080", false},
+		{"ftp://proxy:21", true},
+		{"http://", true},
+		{"proxy:3128", true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseProxy(tt.in); (err != nil) != tt.wantErr {
+			t.Errorf("ParseProxy(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResolveSet(t *testing.T) {
+	tests := []struct {
+		in       string
+		from, to string
+		wantErr  bool
+	}{
+		{"example.com:443:127.0.0.1", "example.com:443", "127.0.0.1:443", false},
+		{"Example.COM:80:10.0.0.1", "example.com:80", "10.0.0.1:80", false},
+		{"example.com:443:[::1]", "example.com:443", "[::1]:443", false},
+		{"example.com:443:::1", "example.com:443", "[::1]:443", false},
+		{"example.com:443", "", "", true},
+		{":443:127.0.0.1", "", "", true},
+		{"example.com:http:127.0.0.1", "", "", true},
+		{"example.com:443:not-an-ip", "", "", true},
+	}
+	for _, tt := range tests {
+		r := Resolve{}
+		err := r.Set(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && r[tt.from] != tt.to {
+			t.Errorf("Set(%q) maps %s to %q, want %q", tt.in, tt.from, r[tt.from], tt.to)
+		}
+	}
+}
+
+func TestPinsSet(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{b64, false},
+		{"sha256//" + b64, false},
+		{hex.EncodeToString(sum[:]), false},
+		{"sha256//abc", true},
+		{hex.EncodeToString(sum[:8]), true},
+	}
+	for _, tt := range tests {
+		var p Pins
+		err := p.Set(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (len(p) != 1 || p[0] != sum) {
+			t.Errorf("Set(%q) = %v, want the hash of key", tt.in, p.String())
+		}
+	}
+}
+
+func TestServerName(t *testing.T) {
+	tests := []struct{ host, sni, want string }{
+		{"", "", ""},
+		{"example.com", "", "example.com"},
+		{"example.com:8443", "", "example.com"},
+		{"example.com", "other.example", "other.example"},
+	}
+	for _, tt := range tests {
+		if got := ServerName(tt.host, tt.sni); got != tt.want {
+			t.Errorf("ServerName(%q, %q) = %q, want %q", tt.host, tt.sni, got, tt.want)
+		}
+	}
+}
+
+// redirector sends /0 to /1 to /2 and so on, and answers /N with 200 and the path
+func redirector() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(r.URL.Path, "/%d", &n)
+		if n < 3 {
+			http.Redirect(w, r, fmt.Sprintf("/%d", n+1), http.StatusFound)
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+}
+
+func TestRedirects(t *testing.T) {
+	srv := redirector()
+	defer srv.Close()
+	tests := []struct {
+		name       string
+		policy     Redirects
+		wantStatus int
+		wantErr    bool
+		wantHops   int
+	}{
+		{"follow", Redirects{Follow: true, Max: 10}, 200, false, 3},
+		{"don't follow", Redirects{Follow: false, Max: 10}, 302, false, 0},
+		{"too many", Redirects{Follow: true, Max: 2}, 0, true, 3},
+		{"just enough", Redirects{Follow: true, Max: 3}, 200, false, 3},
+	}
+	for _, tt := range tests {
+		hops := 0
+		tt.policy.OnHop = func(*http.Request, []*http.Request) { hops++ }
+		c, err := NewClient(Options{Redirects: &tt.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", srv.URL+"/0", nil)
+		r := Do(c, req, nil)
+		if r.Status != tt.wantStatus || (r.Err != nil) != tt.wantErr || hops != tt.wantHops {
+			t.Errorf("%s: status %d, error %v, %d hops, want %d, error %v, %d hops",
+				tt.name, r.Status, r.Err, hops, tt.wantStatus, tt.wantErr, tt.wantHops)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello, world")
+	}))
+	c, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body strings.Builder
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	r := Do(c, req, &body)
+	if r.Err != nil || r.Status != 200 || r.Bytes != 12 || body.String() != "hello, world" || r.Proto != "HTTP/1.1" || r.Duration <= 0 {
+		t.Errorf("Do / = %+v with body %q", r, body.String())
+	}
+
+	// a 404 is a result like any other, not an error
+	req, _ = http.NewRequest("GET", srv.URL+"/missing", nil)
+	if r := Do(c, req, nil); r.Err != nil || r.Status != 404 {
+		t.Errorf("Do /missing = status %d, error %v, want 404 and no error", r.Status, r.Err)
+	}
+
+	srv.Close()
+	req, _ = http.NewRequest("GET", srv.URL+"/", nil)
+	if r := Do(c, req, nil); r.Err == nil || r.Status != 0 {
+		t.Errorf("Do on a closed server = status %d, error %v, want an error", r.Status, r.Err)
+	}
+}
+
+func TestResolveDial(t *testing.T) {
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	// Set keeps the port, and the test server's isn't 80, so the entry is made by hand
+	resolve := Resolve{"backend.test:80": u.Host}
+	c, err := NewClient(Options{Resolve: resolve})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://backend.test/", nil)
+	if r := Do(c, req, nil); r.Err != nil || r.Status != 200 {
+		t.Fatalf("Do = %+v", r)
+	}
+	if host != "backend.test" {
+		t.Errorf("server saw Host %q, want backend.test", host)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var asked string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxy is sent the whole URL, not just the path
+		asked = r.RequestURI
+		io.WriteString(w, "from the proxy")
+	}))
+	defer proxy.Close()
+	c, err := NewClient(Options{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body strings.Builder
+	req, _ := http.NewRequest("GET", "http://nowhere.test/page", nil)
+	if r := Do(c, req, &body); r.Err != nil || body.String() != "from the proxy" {
+		t.Fatalf("Do = %+v with body %q", r, body.String())
+	}
+	if asked != "http://nowhere.test/page" {
+		t.Errorf("proxy was asked for %q, want http://nowhere.test/page", asked)
+	}
+}
+
+// tlsClient is a client for srv's self-signed certificate with the options in o.
+func tlsClient(t *testing.T, srv *httptest.Server, o Options) *http.Client {
+	t.Helper()
+	c, err := NewClient(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	for _, tr := range transports(c.Transport) {
+		tr.TLSClientConfig.RootCAs = roots
+	}
+	return c
+}
+
+// transports are the *http.Transports under rt, whatever NewClient wrapped them in
+func transports(rt http.RoundTripper) []*http.Transport {
+	switch rt := rt.(type) {
+	case *http.Transport:
+		return []*http.Transport{rt}
+	case requireHTTP2:
+		return transports(rt.RoundTripper)
+	case byHost:
+		return []*http.Transport{rt.named, rt.other}
+	}
+	return nil
+}
+
+func TestPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	good := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	bad := sha256.Sum256([]byte("some other key"))
+	tests := []struct {
+		name    string
+		pins    Pins
+		wantErr bool
+	}{
+		{"no pins", nil, false},
+		{"matching pin", Pins{good}, false},
+		{"backup pin first", Pins{bad, good}, false},
+		{"wrong pin", Pins{bad}, true},
+	}
+	for _, tt := range tests {
+		c := tlsClient(t, srv, Options{Pins: tt.pins})
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		r := Do(c, req, nil)
+		if (r.Err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, r.Err, tt.wantErr)
+		}
+		if tt.wantErr && r.Err != nil && !strings.Contains(r.Err.Error(), "isn't pinned") {
+			t.Errorf("%s: error %q doesn't say the key isn't pinned", tt.name, r.Err)
+		}
+	}
+}
+
+func TestTLSMin(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	tests := []struct {
+		min     string
+		wantErr bool
+	}{
+		{"1.2", false},
+		{"1.3", true},
+	}
+	for _, tt := range tests {
+		c := tlsClient(t, srv, Options{TLSMin: tt.min})
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		r := Do(c, req, nil)
+		if (r.Err != nil) != tt.wantErr {
+			t.Errorf("-tls-min %s: error = %v, want error %v", tt.min, r.Err, tt.wantErr)
+			continue
+		}
+		if r.Err != nil && !strings.Contains(ExplainTLS(r.Err, tt.min).Error(), "see -tls-min") {
+			t.Errorf("-tls-min %s: ExplainTLS(%q) gives no hint", tt.min, r.Err)
+		}
+	}
+}
+
+// TestServerNameHosts checks -sni is only sent to the hosts it is for: a redirect to another host
+// gets that host's own name, the way net/http doesn't carry a Host header over to it either.
+func TestServerNameHosts(t *testing.T) {
+	var names []string
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names = append(names, r.TLS.ServerName)
+		if strings.HasPrefix(r.Host, "a.") {
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+			http.Redirect(w, r, "https://b.example.com:"+port+"/", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	// the test certificate is for *.example.com, so every name here checks out
+	resolve := Resolve{"a.example.com:" + port: addr, "b.example.com:" + port: addr}
+	tests := []struct {
+		name  string
+		hosts []string
+		want  []string
+	}{
+		{"scoped", Hosts([]string{"https://a.example.com:" + port + "/"}), []string{"vhost.example.com", "b.example.com"}},
+		{"everywhere", nil, []string{"vhost.example.com", "vhost.example.com"}},
+	}
+	for _, tt := range tests {
+		names = nil
+		c := tlsClient(t, srv, Options{ServerName: "vhost.example.com", ServerNameHosts: tt.hosts, Resolve: resolve})
+		req, _ := http.NewRequest("GET", "https://a.example.com:"+port+"/", nil)
+		if r := Do(c, req, nil); r.Err != nil || r.Status != 200 {
+			t.Fatalf("%s: Do = %+v", tt.name, r)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: server names sent %q, want %q", tt.name, names, tt.want)
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	tests := []struct {
+		http2     string
+		srv       *httptest.Server
+		wantProto string // "" is an error
+	}{
+		{"auto", h1, "HTTP/1.1"},
+		{"auto", h2, "HTTP/2.0"},
+		{"on", h1, ""},
+		{"on", h2, "HTTP/2.0"},
+		{"off", h2, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		c := tlsClient(t, tt.srv, Options{HTTP2: tt.http2})
+		req, _ := http.NewRequest("GET", tt.srv.URL, nil)
+		r := Do(c, req, nil)
+		if tt.wantProto == "" && (r.Err == nil || !strings.Contains(r.Err.Error(), "-http2 is on")) {
+			t.Errorf("-http2 %s against %s: proto %q, error %v, want an -http2 error", tt.http2, tt.srv.URL, r.Proto, r.Err)
+		}
+		if tt.wantProto != "" && (r.Err != nil || r.Proto != tt.wantProto) {
+			t.Errorf("-http2 %s against %s: proto %q, error %v, want %s", tt.http2, tt.srv.URL, r.Proto, r.Err, tt.wantProto)
+		}
+	}
+}
+
+func TestNewClientErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+	}{
+		{"tls-min", Options{TLSMin: "1.0"}},
+		{"proxy", Options{Proxy: "ftp://proxy:21"}},
+		{"local-addr", Options{LocalAddr: "not an ip"}},
+		{"local-addr elsewhere", Options{LocalAddr: "192.0.2.1"}},
+		{"http2", Options{HTTP2: "maybe"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewClient(tt.o); err == nil {
+			t.Errorf("%s: NewClient(%+v) gave no error", tt.name, tt.o)
+		}
+	}
+}
+
+// TestLocalAddr needs an address besides loopback to tell the one asked for from the one the
+// system would have picked anyway
+func TestLocalAddr(t *testing.T) {
+	var local net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() {
+			local = n.IP
+			break
+		}
+	}
+	if local == nil {
+		t.Skip("no IPv4 address but loopback")
+	}
+	var from string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	c, err := NewClient(Options{LocalAddr: local.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:"+port+"/", nil)
+	if r := Do(c, req, nil); r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if from != local.String() {
+		t.Errorf("the connection came from %s, want %s", from, local)
+	}
+}
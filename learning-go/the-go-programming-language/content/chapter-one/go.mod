@@ -0,0 +1,6 @@
+module gopl/chapter-one
+
+go 1.25
+
+// exercise 1.4 was skipped and has no main yet, which ./... would trip over
+ignore ./1.3/code/excercises/excercise-1.4
@@ -0,0 +1,127 @@
+// Gopltool runs the chapter one programs as subcommands of one command:
+//
+//	gopltool echo -s , a b c
+//	gopltool dup -format json *.txt
+//	gopltool fetch -pretty https://example.com/api
+//	gopltool fetchall -h a.com b.com
+//	gopltool serve -addr :8100
+//	gopltool -version
+//
+// every program is a package next to its own main.go, and that main.go only calls it, so the
+// book's layout still has its program in each section and go run still works there. gopltool
+// imports all of them and calls the one asked for with the rest of the arguments. they parse
+// their flags through internal/cli, so -help, -version and a -format they don't know are
+// handled the same way in each.
+//
+// -format before the subcommand is passed on to it: dup and fetchall both have a -format with json
+// in it, so gopltool -format json dup and gopltool -format json fetchall mean the same kind of thing.
+// the programs that have no -format say so instead of being handed a flag they'd reject.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopl/chapter-one/1.2/code/excercises/excercise-1.3/echo"
+	"gopl/chapter-one/1.3/code/dup-v1/dup"
+	"gopl/chapter-one/1.5/code/fetch-v1/fetch"
+	"gopl/chapter-one/1.6/code/fetchall/fetchall"
+	"gopl/chapter-one/1.7/code/server-v3/server"
+	"gopl/chapter-one/internal/cli"
+)
+
+// command is one subcommand: what it does, its Main and its flags, which say what -format takes
+type command struct {
+	about string
+	main  func(argv []string)
+	flags *flag.FlagSet
+}
+
+var commands = map[string]command{
+	"echo":     {"print the arguments", echo.Main, echo.Flags},
+	"dup":      {"count repeated lines", dup.Main, dup.Flags},
+	"fetch":    {"print what a URL returns", fetch.Main, fetch.Flags},
+	"fetchall": {"fetch URLs in parallel and report their times and sizes", fetchall.Main, fetchall.Flags},
+	"serve":    {"run the reporting HTTP server", server.Main, server.Flags},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run is gopltool with args, the command line without its name. it returns the exit status for
+// the mistakes gopltool catches itself. the subcommand exits by itself when it fails, and run
+// returns 0 once it is done.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("gopltool", flag.ContinueOnError)
+	showVersion := flags.Bool("version", false, "print the version and the Go it was built with")
+	format := flags.String("format", "", "passed on to the subcommand as its -format (dup and fetchall have one)")
+	flags.SetOutput(stderr)
+	flags.Usage = func() { usage(stderr, flags) }
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if *showVersion || flags.Arg(0) == "version" {
+		fmt.Fprintf(stdout, "gopltool %s %s\n", cli.Version, runtime.Version())
+		return 0
+	}
+	if flags.NArg() == 0 {
+		usage(stderr, flags)
+		return 2
+	}
+	if flags.Arg(0) == "help" {
+		usage(stdout, flags)
+		return 0
+	}
+
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "gopltool: no command %q, see gopltool help\n", name)
+		return 2
+	}
+	argv := flags.Args()[1:]
+	if *format != "" {
+		formats := cli.Formats(cmd.flags)
+		if !slices.Contains(formats, *format) {
+			if formats == nil {
+				fmt.Fprintf(stderr, "gopltool: %s has no -format\n", name)
+			} else {
+				fmt.Fprintf(stderr, "gopltool: %s's -format must be %s, not %q\n", name, strings.Join(formats, ", "), *format)
+			}
+			return 2
+		}
+		// in front, so a -format given after the subcommand still wins, it comes later
+		argv = append([]string{"-format", *format}, argv...)
+	}
+	// the usage and errors say gopltool dup rather than dup, which is what was typed
+	cmd.flags.Init("gopltool "+name, flag.ContinueOnError)
+	cmd.main(argv)
+	return 0
+}
+
+func usage(out io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(out, "usage: gopltool [-format F] command [arguments]")
+	fmt.Fprintln(out, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-9s %s\n", name, commands[name].about)
+	}
+	fmt.Fprintln(out, "\neach command takes the flags of its own program, gopltool CMD -help lists them")
+	fmt.Fprintln(out, "\nflags:")
+	flags.SetOutput(out)
+	flags.PrintDefaults()
+}
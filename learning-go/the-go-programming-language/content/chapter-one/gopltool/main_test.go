@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		wantOut    string // in stdout
+		wantErr    string // in stderr
+	}{
+		{"no command", nil, 2, "", "usage: gopltool"},
+		{"help", []string{"help"}, 0, "fetchall", ""},
+		{"version", []string{"version"}, 0, "gopltool 0.", ""},
+		{"-version", []string{"-version"}, 0, "gopltool 0.", ""},
+		{"unknown command", []string{"grep"}, 2, "", `no command "grep"`},
+		{"no -format", []string{"-format", "json", "echo", "hi"}, 2, "", "echo has no -format"},
+		{"wrong -format", []string{"-format", "csv", "dup"}, 2, "", "dup's -format must be text, json"},
+		{"bad gopltool flag", []string{"-nope"}, 2, "", "flag provided but not defined"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr strings.Builder
+		status := run(tt.args, &stdout, &stderr)
+		if status != tt.wantStatus || !strings.Contains(stdout.String(), tt.wantOut) || !strings.Contains(stderr.String(), tt.wantErr) {
+			t.Errorf("%s: run(%q) = %d, stdout %q, stderr %q; want %d, %q in stdout, %q in stderr",
+				tt.name, tt.args, status, stdout.String(), stderr.String(), tt.wantStatus, tt.wantOut, tt.wantErr)
+		}
+	}
+}
+
+// TestRunEcho checks a subcommand really is run, with the arguments after its name.
+func TestRunEcho(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	status := run([]string{"echo", "-s", ",", "a", "b"}, io.Discard, io.Discard)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if status != 0 || string(out) != "a,b\n" {
+		t.Errorf("gopltool echo -s , a b = %d, %q, want 0, %q", status, out, "a,b\n")
+	}
+}
@@ -0,0 +1,92 @@
+// Package cli is the flag handling the chapter one programs share. dup, fetch, fetchall, serve
+// and echo each parse their own flags, but through here, so they answer -help and -version the
+// same way and a -format that isn't one they know is turned down with the same message, whether
+// they run on their own or as gopltool subcommands.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Version is the version of the chapter one programs. they are released together, so they share one
+const Version = "0.2.0"
+
+// NewFlagSet is the flag set of the program called name, with -version already on it. each
+// program has its own instead of flag.CommandLine, gopltool has all of them in one binary and
+// their flags would clash there.
+func NewFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Bool("version", false, "print the version and the Go it was built with, and exit")
+	return fs
+}
+
+// Parse parses args, the command line without the program name, into fs. -help exits 0 and
+// -version prints the version and exits 0. a bad flag has been complained about by the flag
+// package by then, and exits with usageExit: the programs don't agree on what 2 means, fetch
+// uses it for a transport error.
+func Parse(fs *flag.FlagSet, args []string, usageExit int) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(usageExit)
+	}
+	if v := fs.Lookup("version"); v != nil && v.Value.String() == "true" {
+		fmt.Fprintf(fs.Output(), "%s %s %s\n", fs.Name(), Version, runtime.Version())
+		os.Exit(0)
+	}
+}
+
+// format is a -format value, one of a fixed list.
+type format struct {
+	value   *string
+	allowed []string
+}
+
+func (f *format) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f *format) Set(s string) error {
+	if !slices.Contains(f.allowed, s) {
+		return fmt.Errorf("must be %s", oneOf(f.allowed))
+	}
+	*f.value = s
+	return nil
+}
+
+// Format puts a -format flag on fs that only takes one of formats, and is the first of them
+// by default. usage says what each one prints.
+func Format(fs *flag.FlagSet, usage string, formats ...string) *string {
+	f := &format{value: new(string), allowed: formats}
+	*f.value = formats[0]
+	fs.Var(f, "format", usage)
+	return f.value
+}
+
+// Formats is what the -format of fs takes, nil when it has none.
+func Formats(fs *flag.FlagSet) []string {
+	if fl := fs.Lookup("format"); fl != nil {
+		if f, ok := fl.Value.(*format); ok {
+			return f.allowed
+		}
+	}
+	return nil
+}
+
+// oneOf is "text", "text or json" or "text, json or csv".
+func oneOf(s []string) string {
+	if len(s) < 2 {
+		return strings.Join(s, "")
+	}
+	return strings.Join(s[:len(s)-1], ", ") + " or " + s[len(s)-1]
+}